@@ -0,0 +1,136 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+// Command grpc-receiver runs the reference receiver of the gRPC sink, which
+// logs the batches it receives and accepts them. It is meant to test the
+// gRPC sink and as a starting point for receivers.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	pb "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/grpc"
+	"github.com/mainflux/mainflux"
+	"github.com/mainflux/mainflux/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	defLogLevel   = "info"
+	defPort       = "8186"
+	defServerCert = ""
+	defServerKey  = ""
+	defClientCA   = ""
+
+	envLogLevel   = "MF_GRPC_RECEIVER_LOG_LEVEL"
+	envPort       = "MF_GRPC_RECEIVER_PORT"
+	envServerCert = "MF_GRPC_RECEIVER_SERVER_CERT"
+	envServerKey  = "MF_GRPC_RECEIVER_SERVER_KEY"
+	envClientCA   = "MF_GRPC_RECEIVER_CLIENT_CA_CERTS"
+)
+
+type config struct {
+	logLevel   string
+	port       string
+	serverCert string
+	serverKey  string
+	clientCA   string
+}
+
+func main() {
+	cfg := loadConfigs()
+
+	logger, err := logger.New(os.Stdout, cfg.logLevel)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	var opts []grpc.ServerOption
+	if cfg.serverCert != "" || cfg.serverKey != "" {
+		creds, err := serverCredentials(cfg)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to load TLS credentials: %s", err))
+			os.Exit(1)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.port))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to listen on port %s: %s", cfg.port, err))
+		os.Exit(1)
+	}
+
+	srv := grpc.NewServer(opts...)
+	pb.RegisterReceiverServer(srv, pb.NewReceiver(logBatch(logger)))
+
+	errs := make(chan error, 2)
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errs <- fmt.Errorf("%s", <-c)
+	}()
+	go func() {
+		logger.Info(fmt.Sprintf("gRPC receiver started, exposed port %s", cfg.port))
+		errs <- srv.Serve(lis)
+	}()
+
+	err = <-errs
+	srv.GracefulStop()
+	logger.Info(fmt.Sprintf("gRPC receiver terminated: %s", err))
+}
+
+func loadConfigs() config {
+	return config{
+		logLevel:   mainflux.Env(envLogLevel, defLogLevel),
+		port:       mainflux.Env(envPort, defPort),
+		serverCert: mainflux.Env(envServerCert, defServerCert),
+		serverKey:  mainflux.Env(envServerKey, defServerKey),
+		clientCA:   mainflux.Env(envClientCA, defClientCA),
+	}
+}
+
+// serverCredentials returns the TLS credentials of the server, verifying
+// the clients if the client CA certificates are set.
+func serverCredentials(cfg config) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.serverCert, cfg.serverKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if cfg.clientCA != "" {
+		data, err := ioutil.ReadFile(cfg.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no CA certificate found in %s", cfg.clientCA)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// logBatch returns handler logging the batches, and accepting them.
+func logBatch(logger logger.Logger) pb.Handler {
+	return func(ctx context.Context, batch *pb.Batch) error {
+		a := batch.GetAddress()
+		logger.Info(fmt.Sprintf("Received %d records of channel %s, subtopic %s and publisher %s, with key %s", len(batch.Records), a.GetChannel(), a.GetSubtopic(), a.GetPublisher(), batch.Key))
+		for _, r := range batch.Records {
+			logger.Debug(fmt.Sprintf("Record %s", r.String()))
+		}
+		return nil
+	}
+}
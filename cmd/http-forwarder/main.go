@@ -4,21 +4,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/api"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/nats"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
 	"github.com/mainflux/mainflux"
+	"github.com/mainflux/mainflux/errors"
 	"github.com/mainflux/mainflux/logger"
-	"github.com/mainflux/mainflux/messaging/nats"
 	"github.com/mainflux/mainflux/transformers/senml"
-	"github.com/mainflux/mainflux/writers"
-	"github.com/mainflux/mainflux/writers/api"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 )
 
@@ -26,30 +31,220 @@ const (
 	svcName = "http-forwarder"
 
 	defNatsURL         = "nats://localhost:4222"
+	defNatsCreds       = ""
+	defNatsNKeySeed    = ""
+	defNatsToken       = ""
+	defNatsUser        = ""
+	defNatsPassword    = ""
+	defNatsCACert      = ""
+	defNatsClientCert  = ""
+	defNatsClientKey   = ""
+	defNatsReconnWait  = "2s"
+	defNatsMaxReconn   = "-1"
 	defLogLevel        = "error"
 	defPort            = "8990"
 	defRemoteUrl       = "http://localhost:9000"
 	defRemoteToken     = ""
 	defSubjectsCfgPath = "/config/subjects.toml"
 	defContentType     = "application/senml+json"
+	defBreakerRatio    = "0.5"
+	defBreakerRequests = "10"
+	defBreakerCoolDown = "30s"
+	defBreakerProbes   = "1"
+	defOTLPEndpoint    = ""
+	defOTLPSampleRatio = "1"
+	defAdminToken      = ""
+	defWatchInterval   = "5s"
+	defShutdownTimeout = "30s"
+	defDedupWindow     = "0s"
+	defMaxBodySize     = "0"
+	defMaxRecords      = "0"
+	defRemoteTimeout   = "10s"
+	defDeliveryMode    = nats.FanOut
+	defQueueGroup      = svcName
+	defJSStream        = ""
+	defJSDurable       = svcName
+	defJSBatch         = "10"
+	defJSMaxWait       = "5s"
+	defJSAckWait       = "30s"
+	defJSMaxDeliver    = "5"
+	defJSNakDelay      = "10s"
+	defJSDeadLetter    = ""
+	defMQTTURL         = ""
+	defMQTTClientID    = svcName
+	defMQTTUsername    = ""
+	defMQTTPassword    = ""
+	defMQTTCACert      = ""
+	defMQTTClientCert  = ""
+	defMQTTClientKey   = ""
+	defMQTTTopic       = http_forwarder.DefMQTTTopic
+	defMQTTQoS         = "0"
+	defMQTTRetain      = "false"
+	defMQTTTimeout     = "10s"
+	defMainfluxURL     = ""
+	defMainfluxMapping = "/config/mainflux.toml"
+	defMainfluxTimeout = "10s"
+	defKafkaBrokers    = ""
+	defKafkaClientID   = svcName
+	defKafkaVersion    = "2.1.0"
+	defKafkaTopic      = http_forwarder.DefKafkaTopic
+	defKafkaKey        = http_forwarder.KafkaKeyChannel
+	defKafkaAcks       = "all"
+	defKafkaCompress   = "none"
+	defKafkaIdempotent = "false"
+	defKafkaTimeout    = "10s"
+	defGRPCURL         = ""
+	defGRPCTLS         = "false"
+	defGRPCCACert      = ""
+	defGRPCClientCert  = ""
+	defGRPCClientKey   = ""
+	defGRPCMaxRecords  = "0"
+	defGRPCWindow      = "64"
+	defGRPCTimeout     = "10s"
+	defPushToken       = ""
+	defPushBuffer      = "64"
+	defPushOrigins     = ""
+	defArchiveDir      = ""
+	defArchiveFormat   = http_forwarder.ArchiveJSONL
+	defArchiveMaxSize  = "67108864"
+	defArchiveMaxAge   = "1h"
+	defArchiveRetain   = "0s"
+	defArchiveS3URL    = ""
+	defArchiveS3Region = "us-east-1"
+	defArchiveS3Bucket = ""
+	defArchiveS3Access = ""
+	defArchiveS3Secret = ""
+	defArchiveS3Prefix = ""
+	defRetryQueueSize  = "1000"
+	defRetrySpillFile  = ""
+	defRetryMinBackoff = "1s"
+	defRetryMaxBackoff = "1m"
+	defRetryReady      = "500"
 
 	envNatsURL         = "MF_NATS_URL"
+	envNatsCreds       = "MF_HTTP_FORWARDER_NATS_CREDS"
+	envNatsNKeySeed    = "MF_HTTP_FORWARDER_NATS_NKEY_SEED"
+	envNatsToken       = "MF_HTTP_FORWARDER_NATS_TOKEN"
+	envNatsUser        = "MF_HTTP_FORWARDER_NATS_USER"
+	envNatsPassword    = "MF_HTTP_FORWARDER_NATS_PASSWORD"
+	envNatsCACert      = "MF_HTTP_FORWARDER_NATS_CA_CERT"
+	envNatsClientCert  = "MF_HTTP_FORWARDER_NATS_CLIENT_CERT"
+	envNatsClientKey   = "MF_HTTP_FORWARDER_NATS_CLIENT_KEY"
+	envNatsReconnWait  = "MF_HTTP_FORWARDER_NATS_RECONNECT_WAIT"
+	envNatsMaxReconn   = "MF_HTTP_FORWARDER_NATS_MAX_RECONNECTS"
 	envLogLevel        = "MF_HTTP_FORWARDER_LOG_LEVEL"
 	envPort            = "MF_HTTP_FORWARDER_PORT"
 	envRemoteUrl       = "MF_HTTP_FORWARDER_REMOTE_URL"
 	envRemoteToken     = "MF_HTTP_FORWARDER_REMOTE_TOKEN"
 	envSubjectsCfgPath = "MF_HTTP_FORWARDER_SUBJECTS_CONFIG"
 	envContentType     = "MF_HTTP_FORWARDER_CONTENT_TYPE"
+	envBreakerRatio    = "MF_HTTP_FORWARDER_BREAKER_FAILURE_RATIO"
+	envBreakerRequests = "MF_HTTP_FORWARDER_BREAKER_MIN_REQUESTS"
+	envBreakerCoolDown = "MF_HTTP_FORWARDER_BREAKER_COOL_DOWN"
+	envBreakerProbes   = "MF_HTTP_FORWARDER_BREAKER_PROBES"
+	envOTLPEndpoint    = "MF_HTTP_FORWARDER_OTLP_ENDPOINT"
+	envOTLPSampleRatio = "MF_HTTP_FORWARDER_OTLP_SAMPLE_RATIO"
+	envAdminToken      = "MF_HTTP_FORWARDER_ADMIN_TOKEN"
+	envWatchInterval   = "MF_HTTP_FORWARDER_CONFIG_WATCH_INTERVAL"
+	envShutdownTimeout = "MF_HTTP_FORWARDER_SHUTDOWN_TIMEOUT"
+	envDedupWindow     = "MF_HTTP_FORWARDER_DEDUP_WINDOW"
+	envMaxBodySize     = "MF_HTTP_FORWARDER_REMOTE_MAX_BODY_SIZE"
+	envMaxRecords      = "MF_HTTP_FORWARDER_REMOTE_MAX_RECORDS"
+	envRemoteTimeout   = "MF_HTTP_FORWARDER_REMOTE_TIMEOUT"
+	envDeliveryMode    = "MF_HTTP_FORWARDER_DELIVERY_MODE"
+	envQueueGroup      = "MF_HTTP_FORWARDER_QUEUE_GROUP"
+	envJSStream        = "MF_HTTP_FORWARDER_JETSTREAM_STREAM"
+	envJSDurable       = "MF_HTTP_FORWARDER_JETSTREAM_DURABLE"
+	envJSBatch         = "MF_HTTP_FORWARDER_JETSTREAM_BATCH"
+	envJSMaxWait       = "MF_HTTP_FORWARDER_JETSTREAM_MAX_WAIT"
+	envJSAckWait       = "MF_HTTP_FORWARDER_JETSTREAM_ACK_WAIT"
+	envJSMaxDeliver    = "MF_HTTP_FORWARDER_JETSTREAM_MAX_DELIVER"
+	envJSNakDelay      = "MF_HTTP_FORWARDER_JETSTREAM_NAK_DELAY"
+	envJSDeadLetter    = "MF_HTTP_FORWARDER_JETSTREAM_DEAD_LETTER"
+	envMQTTURL         = "MF_HTTP_FORWARDER_MQTT_URL"
+	envMQTTClientID    = "MF_HTTP_FORWARDER_MQTT_CLIENT_ID"
+	envMQTTUsername    = "MF_HTTP_FORWARDER_MQTT_USERNAME"
+	envMQTTPassword    = "MF_HTTP_FORWARDER_MQTT_PASSWORD"
+	envMQTTCACert      = "MF_HTTP_FORWARDER_MQTT_CA_CERT"
+	envMQTTClientCert  = "MF_HTTP_FORWARDER_MQTT_CLIENT_CERT"
+	envMQTTClientKey   = "MF_HTTP_FORWARDER_MQTT_CLIENT_KEY"
+	envMQTTTopic       = "MF_HTTP_FORWARDER_MQTT_TOPIC"
+	envMQTTQoS         = "MF_HTTP_FORWARDER_MQTT_QOS"
+	envMQTTRetain      = "MF_HTTP_FORWARDER_MQTT_RETAIN"
+	envMQTTTimeout     = "MF_HTTP_FORWARDER_MQTT_TIMEOUT"
+	envMainfluxURL     = "MF_HTTP_FORWARDER_MAINFLUX_URL"
+	envMainfluxMapping = "MF_HTTP_FORWARDER_MAINFLUX_MAPPING"
+	envMainfluxTimeout = "MF_HTTP_FORWARDER_MAINFLUX_TIMEOUT"
+	envKafkaBrokers    = "MF_HTTP_FORWARDER_KAFKA_BROKERS"
+	envKafkaClientID   = "MF_HTTP_FORWARDER_KAFKA_CLIENT_ID"
+	envKafkaVersion    = "MF_HTTP_FORWARDER_KAFKA_VERSION"
+	envKafkaTopic      = "MF_HTTP_FORWARDER_KAFKA_TOPIC"
+	envKafkaKey        = "MF_HTTP_FORWARDER_KAFKA_KEY"
+	envKafkaAcks       = "MF_HTTP_FORWARDER_KAFKA_ACKS"
+	envKafkaCompress   = "MF_HTTP_FORWARDER_KAFKA_COMPRESSION"
+	envKafkaIdempotent = "MF_HTTP_FORWARDER_KAFKA_IDEMPOTENT"
+	envKafkaTimeout    = "MF_HTTP_FORWARDER_KAFKA_TIMEOUT"
+	envGRPCURL         = "MF_HTTP_FORWARDER_GRPC_URL"
+	envGRPCTLS         = "MF_HTTP_FORWARDER_GRPC_TLS"
+	envGRPCCACert      = "MF_HTTP_FORWARDER_GRPC_CA_CERT"
+	envGRPCClientCert  = "MF_HTTP_FORWARDER_GRPC_CLIENT_CERT"
+	envGRPCClientKey   = "MF_HTTP_FORWARDER_GRPC_CLIENT_KEY"
+	envGRPCMaxRecords  = "MF_HTTP_FORWARDER_GRPC_MAX_RECORDS"
+	envGRPCWindow      = "MF_HTTP_FORWARDER_GRPC_WINDOW"
+	envGRPCTimeout     = "MF_HTTP_FORWARDER_GRPC_TIMEOUT"
+	envPushToken       = "MF_HTTP_FORWARDER_PUSH_TOKEN"
+	envPushBuffer      = "MF_HTTP_FORWARDER_PUSH_BUFFER"
+	envPushOrigins     = "MF_HTTP_FORWARDER_PUSH_ORIGINS"
+	envArchiveDir      = "MF_HTTP_FORWARDER_ARCHIVE_DIR"
+	envArchiveFormat   = "MF_HTTP_FORWARDER_ARCHIVE_FORMAT"
+	envArchiveMaxSize  = "MF_HTTP_FORWARDER_ARCHIVE_MAX_SIZE"
+	envArchiveMaxAge   = "MF_HTTP_FORWARDER_ARCHIVE_MAX_AGE"
+	envArchiveRetain   = "MF_HTTP_FORWARDER_ARCHIVE_RETENTION"
+	envArchiveS3URL    = "MF_HTTP_FORWARDER_ARCHIVE_S3_URL"
+	envArchiveS3Region = "MF_HTTP_FORWARDER_ARCHIVE_S3_REGION"
+	envArchiveS3Bucket = "MF_HTTP_FORWARDER_ARCHIVE_S3_BUCKET"
+	envArchiveS3Access = "MF_HTTP_FORWARDER_ARCHIVE_S3_ACCESS_KEY"
+	envArchiveS3Secret = "MF_HTTP_FORWARDER_ARCHIVE_S3_SECRET_KEY"
+	envArchiveS3Prefix = "MF_HTTP_FORWARDER_ARCHIVE_S3_PREFIX"
+	envRetryQueueSize  = "MF_HTTP_FORWARDER_RETRY_QUEUE_SIZE"
+	envRetrySpillFile  = "MF_HTTP_FORWARDER_RETRY_SPILL_FILE"
+	envRetryMinBackoff = "MF_HTTP_FORWARDER_RETRY_MIN_BACKOFF"
+	envRetryMaxBackoff = "MF_HTTP_FORWARDER_RETRY_MAX_BACKOFF"
+	envRetryReady      = "MF_HTTP_FORWARDER_RETRY_READY_THRESHOLD"
+
+	tracesInterval = 5 * time.Second
 )
 
 type config struct {
-	natsURL         string
+	nats            nats.ConnConfig
+	natsQueue       string
+	jetStream       nats.JetStreamConfig
 	logLevel        string
 	port            string
 	remoteUrl       string
 	remoteToken     string
+	remoteMaxBody   int
+	remoteMaxRecs   int
+	remoteTimeout   time.Duration
 	subjectsCfgPath string
 	contentType     string
+	breaker         http_forwarder.BreakerConfig
+	otlpEndpoint    string
+	otlpSampleRatio float64
+	adminToken      string
+	watchInterval   time.Duration
+	shutdownTimeout time.Duration
+	dedupWindow     time.Duration
+	mqtt            http_forwarder.MQTTConfig
+	mainflux        http_forwarder.MainfluxConfig
+	kafka           http_forwarder.KafkaConfig
+	grpc            http_forwarder.GRPCConfig
+	pushToken       string
+	pushOrigins     []string
+	push            http_forwarder.PushConfig
+	archive         http_forwarder.ArchiveConfig
+	retry           http_forwarder.RetryConfig
+	retryReady      int
 }
 
 func main() {
@@ -60,71 +255,672 @@ func main() {
 		log.Fatalf(err.Error())
 	}
 
-	pubSub, err := nats.NewPubSub(cfg.natsURL, "", logger)
+	sub, err := newSubscriber(cfg, logger)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to connect to NATS: %s", err))
 		os.Exit(1)
 	}
-	defer pubSub.Close()
 
-	repo := http_forwarder.New(cfg.remoteUrl, cfg.remoteToken)
+	tracer, closer := initTracer(cfg.otlpEndpoint, cfg.otlpSampleRatio, logger)
+
+	metrics := makeMetrics()
+	remote, err := http_forwarder.NewRemote(http_forwarder.RemoteConfig{URL: cfg.remoteUrl, Token: cfg.remoteToken, MaxBodySize: cfg.remoteMaxBody, MaxRecords: cfg.remoteMaxRecs, Timeout: http_forwarder.Duration(cfg.remoteTimeout)})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to configure remote target: %s", err))
+		os.Exit(1)
+	}
+
+	breaker := http_forwarder.NewCircuitBreaker(cfg.breaker, makeBreakerObserver(logger))
+	dedup := http_forwarder.NewDedupCache(cfg.dedupWindow)
+	sinks := map[string]http_forwarder.Repository{
+		http_forwarder.SinkHTTP: http_forwarder.New(remote, breaker, dedup, metrics, tracer),
+	}
+
+	checks := map[string]http_forwarder.Check{
+		"remote": http_forwarder.BreakerCheck(breaker, remote),
+	}
+
+	var mqttSink *http_forwarder.MQTTSink
+	if cfg.mqtt.URL != "" {
+		mqttSink, err = http_forwarder.NewMQTTSink(cfg.mqtt, metrics, tracer, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to connect to MQTT broker: %s", err))
+			os.Exit(1)
+		}
+		sinks[http_forwarder.SinkMQTT] = mqttSink
+		checks["mqtt"] = mqttSink.CheckConnection
+	}
+
+	if cfg.mainflux.URL != "" {
+		bridge, err := http_forwarder.NewMainfluxBridge(cfg.mainflux, breaker, dedup, metrics, tracer)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to configure Mainflux bridge: %s", err))
+			os.Exit(1)
+		}
+		sinks[http_forwarder.SinkMainflux] = bridge
+		checks["mainflux"] = bridge.Check
+	}
+
+	var kafkaSink *http_forwarder.KafkaSink
+	if len(cfg.kafka.Brokers) > 0 {
+		producer, err := http_forwarder.NewKafkaProducer(cfg.kafka)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to connect to Kafka brokers: %s", err))
+			os.Exit(1)
+		}
+		kafkaSink, err = http_forwarder.NewKafkaSink(cfg.kafka, producer, dedup, metrics, tracer)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to configure Kafka sink: %s", err))
+			os.Exit(1)
+		}
+		sinks[http_forwarder.SinkKafka] = kafkaSink
+	}
+
+	var grpcSink *http_forwarder.GRPCSink
+	if cfg.grpc.URL != "" {
+		grpcSink, err = http_forwarder.NewGRPCSink(cfg.grpc, metrics, tracer, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to configure gRPC sink: %s", err))
+			os.Exit(1)
+		}
+		sinks[http_forwarder.SinkGRPC] = grpcSink
+		checks["grpc"] = grpcSink.CheckConnection
+	}
 
-	counter, latency := makeMetrics()
+	var pushHub *http_forwarder.PushHub
+	if cfg.pushToken != "" {
+		pushHub, err = http_forwarder.NewPushHub(cfg.push, metrics, tracer, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to configure push sink: %s", err))
+			os.Exit(1)
+		}
+		sinks[http_forwarder.SinkPush] = pushHub
+	}
+
+	var names []string
+	for name := range sinks {
+		names = append(names, name)
+	}
+	repo := http_forwarder.NewSinks(sinks, metrics)
+	var archive *http_forwarder.Archive
+	if cfg.archive.Dir != "" {
+		archive, err = http_forwarder.NewArchive(cfg.archive, metrics, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to configure archive: %s", err))
+			os.Exit(1)
+		}
+		repo = http_forwarder.NewArchiveTee(repo, archive, logger)
+	}
+	// JetStream redelivers the failed messages itself. The queue wraps the
+	// archive, so that only the records accepted by the sinks are archived.
+	var retryQueue *http_forwarder.RetryQueue
+	if cfg.retry.Size > 0 && cfg.jetStream.Stream == "" {
+		retryQueue, err = http_forwarder.NewRetryQueue(repo, cfg.retry, metrics, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to configure retry queue: %s", err))
+			os.Exit(1)
+		}
+		repo = retryQueue
+		if cfg.retryReady > 0 {
+			checks["queue"] = http_forwarder.QueueCheck(retryQueue, cfg.retryReady)
+		}
+	}
 	repo = api.LoggingMiddleware(repo, logger)
-	repo = api.MetricsMiddleware(repo, counter, latency)
 	st := senml.New(cfg.contentType)
-	if err := writers.Start(pubSub, repo, st, svcName, cfg.subjectsCfgPath, logger); err != nil {
+	routes, err := http_forwarder.Start(sub, repo, names, remote, st, cfg.subjectsCfgPath, metrics, tracer, logger)
+	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to start HTTP forwarder: %s", err))
 		os.Exit(1)
 	}
 
+	done := make(chan struct{})
+	if cfg.watchInterval > 0 {
+		go http_forwarder.WatchConfig(routes, cfg.subjectsCfgPath, cfg.watchInterval, logger, done)
+	}
+	go reloadOnSIGHUP(routes, logger, done)
+
 	errs := make(chan error, 2)
 	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT)
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
-	go startHTTPService(cfg.port, logger, errs)
+	checks["nats"] = sub.CheckConnection
+	checks["subscriptions"] = sub.CheckSubscriptions
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.port),
+		Handler: api.MakeHandler(svcName, checks, routes, cfg.adminToken, pushHub, cfg.pushToken, cfg.pushOrigins),
+	}
+	if pushHub != nil {
+		// Push streams never end by themselves.
+		srv.RegisterOnShutdown(pushHub.Close)
+	}
+	go startHTTPService(srv, logger, errs)
 
 	err = <-errs
-	logger.Error(fmt.Sprintf("HTTP forwarder service terminated: %s", err))
+	logger.Info(fmt.Sprintf("HTTP forwarder service shutting down: %s", err))
+
+	close(done)
+	shutdown(sub, routes, retryQueue, srv, closer, cfg.shutdownTimeout, logger)
+	if mqttSink != nil {
+		mqttSink.Close()
+	}
+	if kafkaSink != nil {
+		if err := kafkaSink.Close(); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to close Kafka producer: %s", err))
+		}
+	}
+	if grpcSink != nil {
+		grpcSink.Close()
+	}
+	if archive != nil {
+		archive.Close()
+	}
+	logger.Info("HTTP forwarder service terminated")
+}
+
+// shutdown stops the service in order: the routes stop changing, NATS
+// subscriptions are drained so that the messages already received are
+// forwarded, the aggregates of the open windows are forwarded, the batches
+// left in the retry queue are written to its spill file, pending spans are
+// exported, the HTTP server stops and the NATS connection is closed. Steps
+// which don't complete before the timeout are abandoned.
+func shutdown(sub nats.Subscriber, routes http_forwarder.Routes, queue *http_forwarder.RetryQueue, srv *http.Server, closer func(), timeout time.Duration, logger logger.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	routes.Close()
+	if err := sub.Drain(ctx); err != nil {
+		logger.Warn(fmt.Sprintf("Shutdown deadline exceeded while draining NATS: %s", err))
+	}
+
+	if err := routes.Flush(ctx); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to forward aggregates: %s", err))
+	}
+
+	if queue != nil {
+		if err := queue.Close(ctx); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to save retry queue: %s", err))
+		}
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		closer()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		logger.Warn("Shutdown deadline exceeded while exporting traces")
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to shut down HTTP server: %s", err))
+	}
+
+	sub.Close()
+}
+
+// newSubscriber returns JetStream subscriber if a stream is configured and
+// core NATS subscriber otherwise.
+func newSubscriber(cfg config, logger logger.Logger) (nats.Subscriber, error) {
+	if cfg.jetStream.Stream == "" {
+		return nats.NewPubSub(cfg.nats, cfg.natsQueue, logger)
+	}
+
+	js := cfg.jetStream
+	js.Unprocessable = func(err error) bool {
+		return errors.Contains(err, http_forwarder.ErrUnprocessable)
+	}
+	return nats.NewJetStream(cfg.nats, js, logger)
 }
 
 func loadConfigs() config {
+	ratio, err := strconv.ParseFloat(mainflux.Env(envBreakerRatio, defBreakerRatio), 64)
+	if err != nil || ratio <= 0 || ratio > 1 {
+		log.Fatalf("Invalid value for circuit breaker failure ratio: %s", mainflux.Env(envBreakerRatio, defBreakerRatio))
+	}
+
+	requests, err := strconv.ParseUint(mainflux.Env(envBreakerRequests, defBreakerRequests), 10, 32)
+	if err != nil {
+		log.Fatalf("Invalid value for circuit breaker minimum requests: %s", err)
+	}
+
+	coolDown, err := time.ParseDuration(mainflux.Env(envBreakerCoolDown, defBreakerCoolDown))
+	if err != nil {
+		log.Fatalf("Invalid value for circuit breaker cool-down: %s", err)
+	}
+
+	probes, err := strconv.ParseUint(mainflux.Env(envBreakerProbes, defBreakerProbes), 10, 32)
+	if err != nil {
+		log.Fatalf("Invalid value for circuit breaker probes: %s", err)
+	}
+
+	sampleRatio, err := strconv.ParseFloat(mainflux.Env(envOTLPSampleRatio, defOTLPSampleRatio), 64)
+	if err != nil || sampleRatio < 0 || sampleRatio > 1 {
+		log.Fatalf("Invalid value for traces sample ratio: %s", mainflux.Env(envOTLPSampleRatio, defOTLPSampleRatio))
+	}
+
+	watchInterval, err := time.ParseDuration(mainflux.Env(envWatchInterval, defWatchInterval))
+	if err != nil {
+		log.Fatalf("Invalid value for configuration watch interval: %s", err)
+	}
+
+	shutdownTimeout, err := time.ParseDuration(mainflux.Env(envShutdownTimeout, defShutdownTimeout))
+	if err != nil {
+		log.Fatalf("Invalid value for shutdown timeout: %s", err)
+	}
+
+	dedupWindow, err := time.ParseDuration(mainflux.Env(envDedupWindow, defDedupWindow))
+	if err != nil {
+		log.Fatalf("Invalid value for dedup window: %s", err)
+	}
+
+	natsReconnWait, err := time.ParseDuration(mainflux.Env(envNatsReconnWait, defNatsReconnWait))
+	if err != nil {
+		log.Fatalf("Invalid value for NATS reconnect wait: %s", err)
+	}
+
+	natsMaxReconn, err := strconv.Atoi(mainflux.Env(envNatsMaxReconn, defNatsMaxReconn))
+	if err != nil {
+		log.Fatalf("Invalid value for NATS max reconnects: %s", err)
+	}
+
+	jsBatch, err := strconv.Atoi(mainflux.Env(envJSBatch, defJSBatch))
+	if err != nil || jsBatch < 1 {
+		log.Fatalf("Invalid value for JetStream batch: %s", mainflux.Env(envJSBatch, defJSBatch))
+	}
+
+	jsMaxWait, err := time.ParseDuration(mainflux.Env(envJSMaxWait, defJSMaxWait))
+	if err != nil {
+		log.Fatalf("Invalid value for JetStream max wait: %s", err)
+	}
+
+	jsAckWait, err := time.ParseDuration(mainflux.Env(envJSAckWait, defJSAckWait))
+	if err != nil {
+		log.Fatalf("Invalid value for JetStream ack wait: %s", err)
+	}
+
+	jsMaxDeliver, err := strconv.Atoi(mainflux.Env(envJSMaxDeliver, defJSMaxDeliver))
+	if err != nil {
+		log.Fatalf("Invalid value for JetStream max deliver: %s", err)
+	}
+
+	jsNakDelay, err := time.ParseDuration(mainflux.Env(envJSNakDelay, defJSNakDelay))
+	if err != nil {
+		log.Fatalf("Invalid value for JetStream NAK delay: %s", err)
+	}
+
+	maxBodySize, err := strconv.Atoi(mainflux.Env(envMaxBodySize, defMaxBodySize))
+	if err != nil || maxBodySize < 0 {
+		log.Fatalf("Invalid value for remote max body size: %s", mainflux.Env(envMaxBodySize, defMaxBodySize))
+	}
+
+	maxRecords, err := strconv.Atoi(mainflux.Env(envMaxRecords, defMaxRecords))
+	if err != nil || maxRecords < 0 {
+		log.Fatalf("Invalid value for remote max records: %s", mainflux.Env(envMaxRecords, defMaxRecords))
+	}
+
+	remoteTimeout, err := time.ParseDuration(mainflux.Env(envRemoteTimeout, defRemoteTimeout))
+	if err != nil || remoteTimeout < 0 {
+		log.Fatalf("Invalid value for remote timeout: %s", mainflux.Env(envRemoteTimeout, defRemoteTimeout))
+	}
+
+	mqttQoS, err := strconv.ParseUint(mainflux.Env(envMQTTQoS, defMQTTQoS), 10, 8)
+	if err != nil || mqttQoS > 2 {
+		log.Fatalf("Invalid value for MQTT QoS: %s", mainflux.Env(envMQTTQoS, defMQTTQoS))
+	}
+
+	mqttRetain, err := strconv.ParseBool(mainflux.Env(envMQTTRetain, defMQTTRetain))
+	if err != nil {
+		log.Fatalf("Invalid value for MQTT retain: %s", err)
+	}
+
+	mqttTimeout, err := time.ParseDuration(mainflux.Env(envMQTTTimeout, defMQTTTimeout))
+	if err != nil {
+		log.Fatalf("Invalid value for MQTT timeout: %s", err)
+	}
+
+	kafkaIdempotent, err := strconv.ParseBool(mainflux.Env(envKafkaIdempotent, defKafkaIdempotent))
+	if err != nil {
+		log.Fatalf("Invalid value for Kafka idempotent: %s", err)
+	}
+
+	mainfluxTimeout, err := time.ParseDuration(mainflux.Env(envMainfluxTimeout, defMainfluxTimeout))
+	if err != nil {
+		log.Fatalf("Invalid value for Mainflux timeout: %s", err)
+	}
+
+	kafkaTimeout, err := time.ParseDuration(mainflux.Env(envKafkaTimeout, defKafkaTimeout))
+	if err != nil {
+		log.Fatalf("Invalid value for Kafka timeout: %s", err)
+	}
+
+	grpcTLS, err := strconv.ParseBool(mainflux.Env(envGRPCTLS, defGRPCTLS))
+	if err != nil {
+		log.Fatalf("Invalid value for gRPC TLS: %s", err)
+	}
+
+	grpcMaxRecords, err := strconv.Atoi(mainflux.Env(envGRPCMaxRecords, defGRPCMaxRecords))
+	if err != nil || grpcMaxRecords < 0 {
+		log.Fatalf("Invalid value for gRPC max records: %s", mainflux.Env(envGRPCMaxRecords, defGRPCMaxRecords))
+	}
+
+	grpcWindow, err := strconv.Atoi(mainflux.Env(envGRPCWindow, defGRPCWindow))
+	if err != nil || grpcWindow < 1 {
+		log.Fatalf("Invalid value for gRPC window: %s", mainflux.Env(envGRPCWindow, defGRPCWindow))
+	}
+
+	grpcTimeout, err := time.ParseDuration(mainflux.Env(envGRPCTimeout, defGRPCTimeout))
+	if err != nil {
+		log.Fatalf("Invalid value for gRPC timeout: %s", err)
+	}
+
+	pushBuffer, err := strconv.Atoi(mainflux.Env(envPushBuffer, defPushBuffer))
+	if err != nil || pushBuffer < 1 {
+		log.Fatalf("Invalid value for push buffer: %s", mainflux.Env(envPushBuffer, defPushBuffer))
+	}
+
+	archiveMaxSize, err := strconv.ParseInt(mainflux.Env(envArchiveMaxSize, defArchiveMaxSize), 10, 64)
+	if err != nil || archiveMaxSize < 1 {
+		log.Fatalf("Invalid value for archive max size: %s", mainflux.Env(envArchiveMaxSize, defArchiveMaxSize))
+	}
+
+	archiveMaxAge, err := time.ParseDuration(mainflux.Env(envArchiveMaxAge, defArchiveMaxAge))
+	if err != nil {
+		log.Fatalf("Invalid value for archive max age: %s", err)
+	}
+
+	archiveRetention, err := time.ParseDuration(mainflux.Env(envArchiveRetain, defArchiveRetain))
+	if err != nil {
+		log.Fatalf("Invalid value for archive retention: %s", err)
+	}
+
+	var kafkaBrokers []string
+	for _, broker := range strings.Split(mainflux.Env(envKafkaBrokers, defKafkaBrokers), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			kafkaBrokers = append(kafkaBrokers, broker)
+		}
+	}
+
+	var pushOrigins []string
+	for _, origin := range strings.Split(mainflux.Env(envPushOrigins, defPushOrigins), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			pushOrigins = append(pushOrigins, origin)
+		}
+	}
+
+	retrySize, err := strconv.Atoi(mainflux.Env(envRetryQueueSize, defRetryQueueSize))
+	if err != nil || retrySize < 0 {
+		log.Fatalf("Invalid value for retry queue size: %s", mainflux.Env(envRetryQueueSize, defRetryQueueSize))
+	}
+
+	retryReady, err := strconv.Atoi(mainflux.Env(envRetryReady, defRetryReady))
+	if err != nil || retryReady < 0 {
+		log.Fatalf("Invalid value for retry queue readiness threshold: %s", mainflux.Env(envRetryReady, defRetryReady))
+	}
+
+	retryMinBackoff, err := time.ParseDuration(mainflux.Env(envRetryMinBackoff, defRetryMinBackoff))
+	if err != nil {
+		log.Fatalf("Invalid value for retry min backoff: %s", err)
+	}
+
+	retryMaxBackoff, err := time.ParseDuration(mainflux.Env(envRetryMaxBackoff, defRetryMaxBackoff))
+	if err != nil {
+		log.Fatalf("Invalid value for retry max backoff: %s", err)
+	}
+
+	queue, err := nats.QueueGroup(mainflux.Env(envDeliveryMode, defDeliveryMode), mainflux.Env(envQueueGroup, defQueueGroup))
+	if err != nil {
+		log.Fatalf("Invalid value for delivery mode: %s", err)
+	}
+
 	cfg := config{
-		natsURL:         mainflux.Env(envNatsURL, defNatsURL),
+		natsQueue:       queue,
 		logLevel:        mainflux.Env(envLogLevel, defLogLevel),
 		port:            mainflux.Env(envPort, defPort),
 		remoteUrl:       mainflux.Env(envRemoteUrl, defRemoteUrl),
 		remoteToken:     mainflux.Env(envRemoteToken, defRemoteToken),
+		remoteMaxBody:   maxBodySize,
+		remoteMaxRecs:   maxRecords,
+		remoteTimeout:   remoteTimeout,
 		subjectsCfgPath: mainflux.Env(envSubjectsCfgPath, defSubjectsCfgPath),
 		contentType:     mainflux.Env(envContentType, defContentType),
+		otlpEndpoint:    mainflux.Env(envOTLPEndpoint, defOTLPEndpoint),
+		otlpSampleRatio: sampleRatio,
+		adminToken:      mainflux.Env(envAdminToken, defAdminToken),
+		watchInterval:   watchInterval,
+		shutdownTimeout: shutdownTimeout,
+		dedupWindow:     dedupWindow,
+		breaker: http_forwarder.BreakerConfig{
+			FailureRatio: ratio,
+			MinRequests:  uint(requests),
+			CoolDown:     coolDown,
+			Probes:       uint(probes),
+		},
+		nats: nats.ConnConfig{
+			URL:            mainflux.Env(envNatsURL, defNatsURL),
+			Name:           svcName,
+			CredsFile:      mainflux.Env(envNatsCreds, defNatsCreds),
+			NKeySeedFile:   mainflux.Env(envNatsNKeySeed, defNatsNKeySeed),
+			Token:          mainflux.Env(envNatsToken, defNatsToken),
+			User:           mainflux.Env(envNatsUser, defNatsUser),
+			Password:       mainflux.Env(envNatsPassword, defNatsPassword),
+			CACertFile:     mainflux.Env(envNatsCACert, defNatsCACert),
+			ClientCertFile: mainflux.Env(envNatsClientCert, defNatsClientCert),
+			ClientKeyFile:  mainflux.Env(envNatsClientKey, defNatsClientKey),
+			ReconnectWait:  natsReconnWait,
+			MaxReconnects:  natsMaxReconn,
+		},
+		jetStream: nats.JetStreamConfig{
+			Stream:     mainflux.Env(envJSStream, defJSStream),
+			Durable:    mainflux.Env(envJSDurable, defJSDurable),
+			Batch:      jsBatch,
+			MaxWait:    jsMaxWait,
+			AckWait:    jsAckWait,
+			MaxDeliver: jsMaxDeliver,
+			NakDelay:   jsNakDelay,
+			DeadLetter: mainflux.Env(envJSDeadLetter, defJSDeadLetter),
+		},
+		mqtt: http_forwarder.MQTTConfig{
+			URL:            mainflux.Env(envMQTTURL, defMQTTURL),
+			ClientID:       mainflux.Env(envMQTTClientID, defMQTTClientID),
+			Username:       mainflux.Env(envMQTTUsername, defMQTTUsername),
+			Password:       mainflux.Env(envMQTTPassword, defMQTTPassword),
+			CACertFile:     mainflux.Env(envMQTTCACert, defMQTTCACert),
+			ClientCertFile: mainflux.Env(envMQTTClientCert, defMQTTClientCert),
+			ClientKeyFile:  mainflux.Env(envMQTTClientKey, defMQTTClientKey),
+			Topic:          mainflux.Env(envMQTTTopic, defMQTTTopic),
+			QoS:            byte(mqttQoS),
+			Retain:         mqttRetain,
+			Timeout:        mqttTimeout,
+		},
+		mainflux: http_forwarder.MainfluxConfig{
+			URL:         mainflux.Env(envMainfluxURL, defMainfluxURL),
+			MappingFile: mainflux.Env(envMainfluxMapping, defMainfluxMapping),
+			Timeout:     mainfluxTimeout,
+		},
+		kafka: http_forwarder.KafkaConfig{
+			Brokers:     kafkaBrokers,
+			ClientID:    mainflux.Env(envKafkaClientID, defKafkaClientID),
+			Version:     mainflux.Env(envKafkaVersion, defKafkaVersion),
+			Topic:       mainflux.Env(envKafkaTopic, defKafkaTopic),
+			Key:         mainflux.Env(envKafkaKey, defKafkaKey),
+			Acks:        mainflux.Env(envKafkaAcks, defKafkaAcks),
+			Compression: mainflux.Env(envKafkaCompress, defKafkaCompress),
+			Idempotent:  kafkaIdempotent,
+			Timeout:     kafkaTimeout,
+		},
+		grpc: http_forwarder.GRPCConfig{
+			URL:            mainflux.Env(envGRPCURL, defGRPCURL),
+			TLS:            grpcTLS,
+			CACertFile:     mainflux.Env(envGRPCCACert, defGRPCCACert),
+			ClientCertFile: mainflux.Env(envGRPCClientCert, defGRPCClientCert),
+			ClientKeyFile:  mainflux.Env(envGRPCClientKey, defGRPCClientKey),
+			MaxRecords:     grpcMaxRecords,
+			Window:         grpcWindow,
+			Timeout:        grpcTimeout,
+		},
+		pushToken:   mainflux.Env(envPushToken, defPushToken),
+		pushOrigins: pushOrigins,
+		push: http_forwarder.PushConfig{
+			Buffer: pushBuffer,
+		},
+		archive: http_forwarder.ArchiveConfig{
+			Dir:       mainflux.Env(envArchiveDir, defArchiveDir),
+			Format:    mainflux.Env(envArchiveFormat, defArchiveFormat),
+			MaxSize:   archiveMaxSize,
+			MaxAge:    archiveMaxAge,
+			Retention: archiveRetention,
+			S3: http_forwarder.S3Config{
+				URL:       mainflux.Env(envArchiveS3URL, defArchiveS3URL),
+				Region:    mainflux.Env(envArchiveS3Region, defArchiveS3Region),
+				Bucket:    mainflux.Env(envArchiveS3Bucket, defArchiveS3Bucket),
+				AccessKey: mainflux.Env(envArchiveS3Access, defArchiveS3Access),
+				SecretKey: mainflux.Env(envArchiveS3Secret, defArchiveS3Secret),
+				Prefix:    mainflux.Env(envArchiveS3Prefix, defArchiveS3Prefix),
+			},
+		},
+		retry: http_forwarder.RetryConfig{
+			Size:       retrySize,
+			SpillFile:  mainflux.Env(envRetrySpillFile, defRetrySpillFile),
+			MinBackoff: retryMinBackoff,
+			MaxBackoff: retryMaxBackoff,
+		},
+		retryReady: retryReady,
 	}
 
 	return cfg
 }
 
-func makeMetrics() (*kitprometheus.Counter, *kitprometheus.Summary) {
-	counter := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+func reloadOnSIGHUP(routes http_forwarder.Routes, logger logger.Logger, done chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-c:
+			if err := routes.Reload(); err != nil {
+				logger.Warn(fmt.Sprintf("Rejected configuration, keeping the previous one: %s", err))
+				continue
+			}
+			logger.Info("Configuration reloaded on SIGHUP")
+		}
+	}
+}
+
+func initTracer(endpoint string, ratio float64, logger logger.Logger) (tracing.Tracer, func()) {
+	if endpoint == "" {
+		return tracing.NewNop(), func() {}
+	}
+
+	exporter := tracing.NewOTLPExporter(endpoint, svcName, tracesInterval, logger)
+	closer := func() {
+		if err := exporter.Close(); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to flush traces: %s", err))
+		}
+	}
+
+	return tracing.New(exporter, ratio), closer
+}
+
+func makeMetrics() http_forwarder.Metrics {
+	return http_forwarder.Metrics{
+		Requests: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "remote",
+			Name:      "request_count",
+			Help:      "Number of outbound requests by target, status code class and outcome.",
+		}, []string{"target", "code", "outcome"}),
+		Records: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "remote",
+			Name:      "records_count",
+			Help:      "Number of SenML records accepted by the target.",
+		}, []string{"target"}),
+		Bytes: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "remote",
+			Name:      "bytes_count",
+			Help:      "Number of request body bytes accepted by the target.",
+		}, []string{"target"}),
+		BatchSize: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "remote",
+			Name:      "batch_size",
+			Help:      "Number of SenML records per outbound batch.",
+			Buckets:   stdprometheus.ExponentialBuckets(1, 2, 12),
+		}, []string{"target"}),
+		TransformFailures: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "consumer",
+			Name:      "transform_failures_count",
+			Help:      "Number of received messages which could not be transformed to SenML.",
+		}, []string{}),
+		Dropped: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "consumer",
+			Name:      "dropped_records_count",
+			Help:      "Number of records which have not been forwarded, by reason.",
+		}, []string{"reason"}),
+		Latency: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "consumer",
+			Name:      "end_to_end_latency_seconds",
+			Help:      "Seconds from message creation to remote acknowledgement.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{}),
+		DedupHits: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "remote",
+			Name:      "dedup_hits_count",
+			Help:      "Number of batches not sent again because the target already accepted them.",
+		}, []string{"target"}),
+		Retries: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "retry",
+			Name:      "attempts_count",
+			Help:      "Number of attempts to send again the queued batches, by outcome.",
+		}, []string{"outcome"}),
+		QueueDepth: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "http_forwarder",
+			Subsystem: "retry",
+			Name:      "queue_depth",
+			Help:      "Number of batches of the retry queue, including the spilled ones.",
+		}, []string{}),
+	}
+}
+
+func makeBreakerObserver(logger logger.Logger) http_forwarder.StateChangeFunc {
+	state := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
 		Namespace: "http_forwarder",
-		Subsystem: "message_writer",
-		Name:      "request_count",
-		Help:      "Number of database inserts.",
-	}, []string{"method"})
+		Subsystem: "circuit_breaker",
+		Name:      "state",
+		Help:      "Circuit breaker state per target (0 closed, 1 open, 2 half-open).",
+	}, []string{"target"})
 
-	latency := kitprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+	transitions := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
 		Namespace: "http_forwarder",
-		Subsystem: "message_writer",
-		Name:      "request_latency_microseconds",
-		Help:      "Total duration of inserts in microseconds.",
-	}, []string{"method"})
+		Subsystem: "circuit_breaker",
+		Name:      "transitions_count",
+		Help:      "Number of circuit breaker state transitions.",
+	}, []string{"target", "from", "to"})
 
-	return counter, latency
+	return func(target string, from, to http_forwarder.State) {
+		logger.Warn(fmt.Sprintf("Circuit breaker of %s changed from %s to %s", target, from, to))
+		state.With("target", target).Set(float64(to))
+		transitions.With("target", target, "from", from.String(), "to", to.String()).Add(1)
+	}
 }
 
-func startHTTPService(port string, logger logger.Logger, errs chan error) {
-	p := fmt.Sprintf(":%s", port)
-	logger.Info(fmt.Sprintf("HTTP forwarder service started, exposed port %s", p))
-	errs <- http.ListenAndServe(p, api.MakeHandler(svcName))
+func startHTTPService(srv *http.Server, logger logger.Logger, errs chan error) {
+	logger.Info(fmt.Sprintf("HTTP forwarder service started, exposed port %s", srv.Addr))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		errs <- err
+	}
 }
@@ -3,9 +3,21 @@ module github.com/jonathandreyer/mainflux-httpforwarder
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/Shopify/sarama v1.27.2
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/go-kit/kit v0.10.0
+	github.com/go-zoo/bone v1.3.0
+	github.com/golang/protobuf v1.4.2
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/mainflux/mainflux v0.11.0
+	github.com/nats-io/nats-server/v2 v2.2.6
+	github.com/nats-io/nats.go v1.11.0
+	github.com/nats-io/nkeys v0.3.0
 	github.com/prometheus/client_golang v1.7.1
 	github.com/stretchr/testify v1.6.1
+	go.starlark.net v0.0.0-20210223155950-e043a3d3c984
+	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,370 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+// Aggregation functions.
+const (
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateMean  = "mean"
+	AggregateCount = "count"
+	AggregateLast  = "last"
+	AggregateSum   = "sum"
+)
+
+// Handling of the records arriving after their window is closed.
+const (
+	LateDrop    = "drop"
+	LateForward = "forward"
+)
+
+// maxAggregateTick is the longest interval between checks of the windows
+// to close.
+const maxAggregateTick = time.Second
+
+// ErrInvalidAggregate indicates that the aggregation settings are malformed.
+var ErrInvalidAggregate = errors.New("invalid aggregation")
+
+// Emitter forwards the records emitted by a pipeline stage apart from the
+// handling of the received messages.
+type Emitter func(ctx context.Context, msgs []senml.Message) error
+
+// AggregateConfig contains the settings of the aggregation of a route.
+type AggregateConfig struct {
+	// Window is the duration of the tumbling windows, aligned on the
+	// record times.
+	Window Duration `toml:"window"`
+
+	// Grace is the time records are still accepted after the end of their
+	// window, before it is closed.
+	Grace Duration `toml:"grace,omitempty"`
+
+	// Functions are the aggregation functions: min, max, mean, count,
+	// last or sum. Mean by default.
+	Functions []string `toml:"functions,omitempty"`
+
+	// Name is the glob pattern of the names of the aggregated records,
+	// every record if empty.
+	Name string `toml:"name,omitempty"`
+
+	// KeepNames keeps the record names instead of suffixing them with the
+	// function (e.g. "temperature_mean"). It requires a single function.
+	KeepNames bool `toml:"keep_names,omitempty"`
+
+	// Late is the handling of the records arriving after their window is
+	// closed: drop (default) or forward unchanged.
+	Late string `toml:"late,omitempty"`
+}
+
+// aggregateKey identifies the series of records aggregated together.
+type aggregateKey struct {
+	channel   string
+	subtopic  string
+	publisher string
+	name      string
+}
+
+type aggregateStats struct {
+	min, max, sum float64
+	count         int
+	last          float64
+	lastTime      float64
+	unit          string
+	protocol      string
+}
+
+func (s *aggregateStats) add(v, t float64, msg senml.Message) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	if s.count == 0 || t >= s.lastTime {
+		s.last, s.lastTime = v, t
+		s.unit, s.protocol = msg.Unit, msg.Protocol
+	}
+	s.sum += v
+	s.count++
+}
+
+func (s *aggregateStats) value(fn string) float64 {
+	switch fn {
+	case AggregateMin:
+		return s.min
+	case AggregateMax:
+		return s.max
+	case AggregateMean:
+		return s.sum / float64(s.count)
+	case AggregateCount:
+		return float64(s.count)
+	case AggregateLast:
+		return s.last
+	}
+	return s.sum
+}
+
+// Aggregator replaces the numeric records by their aggregates over tumbling
+// windows, by channel, subtopic, publisher and name. Windows are closed
+// once their end and the grace period have passed, and their aggregates
+// are forwarded by the emitter, with the time of the window start.
+type Aggregator struct {
+	cfg    AggregateConfig
+	window float64
+	grace  float64
+	emit   Emitter
+	logger logger.Logger
+
+	mu      sync.Mutex
+	windows map[int64]map[aggregateKey]*aggregateStats
+	tags    map[string]string
+
+	// emitting serializes the emissions, so that a window is not emitted
+	// twice while it is being forwarded.
+	emitting sync.Mutex
+
+	done   chan struct{}
+	closed sync.Once
+}
+
+// NewAggregator returns aggregator forwarding the aggregates with the
+// emitter, or ErrInvalidAggregate if the settings are malformed.
+func NewAggregator(cfg AggregateConfig, emit Emitter, logger logger.Logger) (*Aggregator, error) {
+	if cfg.Window <= 0 {
+		return nil, errors.Wrap(ErrInvalidAggregate, errors.New("window must be positive"))
+	}
+	if cfg.Grace < 0 {
+		return nil, errors.Wrap(ErrInvalidAggregate, errors.New("grace must not be negative"))
+	}
+	if len(cfg.Functions) == 0 {
+		cfg.Functions = []string{AggregateMean}
+	}
+	for _, fn := range cfg.Functions {
+		switch fn {
+		case AggregateMin, AggregateMax, AggregateMean, AggregateCount, AggregateLast, AggregateSum:
+		default:
+			return nil, errors.Wrap(ErrInvalidAggregate, errors.New(fn))
+		}
+	}
+	if cfg.KeepNames && len(cfg.Functions) > 1 {
+		return nil, errors.Wrap(ErrInvalidAggregate, errors.New("names can only be kept with a single function"))
+	}
+	if cfg.Name != "" {
+		if _, err := path.Match(cfg.Name, ""); err != nil {
+			return nil, errors.Wrap(ErrInvalidAggregate, errors.New(cfg.Name))
+		}
+	}
+	switch cfg.Late {
+	case "":
+		cfg.Late = LateDrop
+	case LateDrop, LateForward:
+	default:
+		return nil, errors.Wrap(ErrInvalidAggregate, errors.New(cfg.Late))
+	}
+
+	a := &Aggregator{
+		cfg:     cfg,
+		window:  time.Duration(cfg.Window).Seconds(),
+		grace:   time.Duration(cfg.Grace).Seconds(),
+		emit:    emit,
+		logger:  logger,
+		windows: make(map[int64]map[aggregateKey]*aggregateStats),
+		done:    make(chan struct{}),
+	}
+
+	tick := time.Duration(cfg.Window)
+	if tick > maxAggregateTick {
+		tick = maxAggregateTick
+	}
+	go a.run(tick)
+
+	return a, nil
+}
+
+// Add moves the numeric records of the batch matching the name pattern to
+// their windows. Records arriving after their window is closed are dropped
+// or left in the batch. Records later than a window and the grace period
+// from now are dropped, since they would keep their window open. It
+// returns the numbers of aggregated and dropped records.
+func (a *Aggregator) Add(b *Batch) (aggregated, dropped int) {
+	now := float64(time.Now().UnixNano()) / 1e9
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(b.Tags) > 0 {
+		a.tags = b.Tags
+	}
+
+	kept := b.Records[:0]
+	for _, msg := range b.Records {
+		if msg.Value == nil || !matchName(a.cfg.Name, msg.Name) {
+			kept = append(kept, msg)
+			continue
+		}
+
+		t := msg.Time
+		if t == 0 {
+			t = now
+		}
+		if t > now+a.window+a.grace {
+			dropped++
+			continue
+		}
+		idx := int64(math.Floor(t / a.window))
+		if now >= float64(idx+1)*a.window+a.grace {
+			if a.cfg.Late == LateForward {
+				kept = append(kept, msg)
+				continue
+			}
+			dropped++
+			continue
+		}
+
+		w, ok := a.windows[idx]
+		if !ok {
+			w = make(map[aggregateKey]*aggregateStats)
+			a.windows[idx] = w
+		}
+		k := aggregateKey{channel: msg.Channel, subtopic: msg.Subtopic, publisher: msg.Publisher, name: msg.Name}
+		s, ok := w[k]
+		if !ok {
+			s = &aggregateStats{}
+			w[k] = s
+		}
+		s.add(*msg.Value, t, msg)
+		aggregated++
+	}
+	b.Records = kept
+
+	return aggregated, dropped
+}
+
+// Flush forwards the aggregates of the open windows.
+func (a *Aggregator) Flush(ctx context.Context) error {
+	return a.emitWindows(ctx, math.Inf(1))
+}
+
+// Close stops closing the windows. Open windows are not forwarded.
+func (a *Aggregator) Close() {
+	a.closed.Do(func() {
+		close(a.done)
+	})
+}
+
+func (a *Aggregator) run(tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			now := float64(time.Now().UnixNano()) / 1e9
+			if err := a.emitWindows(context.Background(), now); err != nil {
+				a.logger.Warn(fmt.Sprintf("Failed to forward aggregates: %s", err))
+			}
+		}
+	}
+}
+
+// emitWindows forwards the aggregates of the windows closed at the time.
+// The windows are removed once forwarded or rejected, otherwise they are
+// forwarded again with the next closed windows.
+func (a *Aggregator) emitWindows(ctx context.Context, now float64) error {
+	a.emitting.Lock()
+	defer a.emitting.Unlock()
+
+	a.mu.Lock()
+	var indexes []int64
+	for idx := range a.windows {
+		if now >= float64(idx+1)*a.window+a.grace {
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	var msgs []senml.Message
+	for _, idx := range indexes {
+		msgs = append(msgs, a.aggregates(idx, a.windows[idx])...)
+	}
+	tags := a.tags
+	a.mu.Unlock()
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	err := a.emit(WithTags(ctx, tags), msgs)
+	if err != nil && !errors.Contains(err, ErrRemoteRejected) {
+		return err
+	}
+
+	a.mu.Lock()
+	for _, idx := range indexes {
+		delete(a.windows, idx)
+	}
+	a.mu.Unlock()
+	return err
+}
+
+// aggregates returns the records of the aggregates of the window.
+func (a *Aggregator) aggregates(idx int64, w map[aggregateKey]*aggregateStats) []senml.Message {
+	keys := make([]aggregateKey, 0, len(w))
+	for k := range w {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ki, kj := keys[i], keys[j]
+		if ki.channel != kj.channel {
+			return ki.channel < kj.channel
+		}
+		if ki.subtopic != kj.subtopic {
+			return ki.subtopic < kj.subtopic
+		}
+		if ki.publisher != kj.publisher {
+			return ki.publisher < kj.publisher
+		}
+		return ki.name < kj.name
+	})
+
+	var msgs []senml.Message
+	for _, k := range keys {
+		s := w[k]
+		for _, fn := range a.cfg.Functions {
+			v := s.value(fn)
+			msg := senml.Message{
+				Channel:   k.channel,
+				Subtopic:  k.subtopic,
+				Publisher: k.publisher,
+				Protocol:  s.protocol,
+				Name:      k.name,
+				Time:      float64(idx) * a.window,
+				Value:     &v,
+			}
+			if !a.cfg.KeepNames {
+				msg.Name = fmt.Sprintf("%s_%s", k.name, fn)
+			}
+			if fn != AggregateCount {
+				msg.Unit = s.unit
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
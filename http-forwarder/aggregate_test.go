@@ -0,0 +1,294 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// emitterMock sends the emitted records on a channel.
+type emitterMock chan []senml.Message
+
+func (em emitterMock) emit(ctx context.Context, msgs []senml.Message) error {
+	em <- msgs
+	return nil
+}
+
+func newAggregator(t *testing.T, cfg writer.AggregateConfig) (*writer.Aggregator, emitterMock) {
+	em := make(emitterMock, 10)
+	a, err := writer.NewAggregator(cfg, em.emit, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating aggregator: %s", err))
+	return a, em
+}
+
+// windowStart returns the start of the current window of the duration.
+func windowStart(d time.Duration) float64 {
+	now := float64(time.Now().UnixNano()) / 1e9
+	return math.Floor(now/d.Seconds()) * d.Seconds()
+}
+
+func TestNewAggregator(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  writer.AggregateConfig
+		err  error
+	}{
+		{
+			desc: "create aggregator with defaults",
+			cfg:  writer.AggregateConfig{Window: writer.Duration(time.Minute)},
+			err:  nil,
+		},
+		{
+			desc: "create aggregator with every setting",
+			cfg: writer.AggregateConfig{
+				Window:    writer.Duration(time.Minute),
+				Grace:     writer.Duration(time.Second),
+				Functions: []string{writer.AggregateMin, writer.AggregateMax, writer.AggregateMean, writer.AggregateCount, writer.AggregateLast, writer.AggregateSum},
+				Name:      "temp*",
+				Late:      writer.LateForward,
+			},
+			err: nil,
+		},
+		{
+			desc: "create aggregator without window",
+			cfg:  writer.AggregateConfig{},
+			err:  writer.ErrInvalidAggregate,
+		},
+		{
+			desc: "create aggregator with negative grace",
+			cfg:  writer.AggregateConfig{Window: writer.Duration(time.Minute), Grace: writer.Duration(-time.Second)},
+			err:  writer.ErrInvalidAggregate,
+		},
+		{
+			desc: "create aggregator with unknown function",
+			cfg:  writer.AggregateConfig{Window: writer.Duration(time.Minute), Functions: []string{"median"}},
+			err:  writer.ErrInvalidAggregate,
+		},
+		{
+			desc: "create aggregator keeping names of several functions",
+			cfg:  writer.AggregateConfig{Window: writer.Duration(time.Minute), Functions: []string{writer.AggregateMin, writer.AggregateMax}, KeepNames: true},
+			err:  writer.ErrInvalidAggregate,
+		},
+		{
+			desc: "create aggregator with malformed name",
+			cfg:  writer.AggregateConfig{Window: writer.Duration(time.Minute), Name: "["},
+			err:  writer.ErrInvalidAggregate,
+		},
+		{
+			desc: "create aggregator with unknown late handling",
+			cfg:  writer.AggregateConfig{Window: writer.Duration(time.Minute), Late: "keep"},
+			err:  writer.ErrInvalidAggregate,
+		},
+	}
+
+	for _, tc := range cases {
+		a, err := writer.NewAggregator(tc.cfg, emitterMock(nil).emit, testLog)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		if a != nil {
+			a.Close()
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	start := windowStart(time.Hour)
+	text := "on"
+	msgs := []senml.Message{
+		{Channel: "1", Publisher: "2580", Name: "temperature", Unit: "Cel", Time: start + 3, Value: float(24)},
+		{Channel: "1", Publisher: "2580", Name: "temperature", Unit: "Cel", Time: start + 1, Value: float(20)},
+		{Channel: "1", Publisher: "2580", Name: "temperature", Unit: "Cel", Time: start + 2, Value: float(19)},
+		{Channel: "1", Publisher: "2581", Name: "temperature", Unit: "Cel", Time: start + 1, Value: float(30)},
+		{Channel: "1", Publisher: "2580", Name: "status", Time: start + 1, StringValue: &text},
+	}
+
+	cases := []struct {
+		desc     string
+		cfg      writer.AggregateConfig
+		kept     int
+		expected map[string]float64
+	}{
+		{
+			desc: "aggregate with every function",
+			cfg: writer.AggregateConfig{
+				Window:    writer.Duration(time.Hour),
+				Functions: []string{writer.AggregateMin, writer.AggregateMax, writer.AggregateMean, writer.AggregateCount, writer.AggregateLast, writer.AggregateSum},
+			},
+			kept: 1,
+			expected: map[string]float64{
+				"2580/temperature_min":   19,
+				"2580/temperature_max":   24,
+				"2580/temperature_mean":  21,
+				"2580/temperature_count": 3,
+				"2580/temperature_last":  24,
+				"2580/temperature_sum":   63,
+				"2581/temperature_min":   30,
+				"2581/temperature_max":   30,
+				"2581/temperature_mean":  30,
+				"2581/temperature_count": 1,
+				"2581/temperature_last":  30,
+				"2581/temperature_sum":   30,
+			},
+		},
+		{
+			desc: "aggregate keeping names",
+			cfg:  writer.AggregateConfig{Window: writer.Duration(time.Hour), Functions: []string{writer.AggregateMax}, KeepNames: true},
+			kept: 1,
+			expected: map[string]float64{
+				"2580/temperature": 24,
+				"2581/temperature": 30,
+			},
+		},
+		{
+			desc:     "aggregate records not matching name",
+			cfg:      writer.AggregateConfig{Window: writer.Duration(time.Hour), Name: "hum*"},
+			kept:     5,
+			expected: map[string]float64{},
+		},
+	}
+
+	for _, tc := range cases {
+		a, em := newAggregator(t, tc.cfg)
+		b := writer.Batch{Records: append([]senml.Message{}, msgs...)}
+		aggregated, dropped := a.Add(&b)
+		assert.Equal(t, len(msgs)-tc.kept, aggregated, fmt.Sprintf("%s: unexpected aggregated records", tc.desc))
+		assert.Equal(t, 0, dropped, fmt.Sprintf("%s: unexpected dropped records", tc.desc))
+		assert.Len(t, b.Records, tc.kept, fmt.Sprintf("%s: unexpected kept records", tc.desc))
+
+		err := a.Flush(context.Background())
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		a.Close()
+
+		values := map[string]float64{}
+		if len(tc.expected) > 0 {
+			for _, msg := range <-em {
+				values[msg.Publisher+"/"+msg.Name] = *msg.Value
+				assert.Equal(t, start, msg.Time, fmt.Sprintf("%s: expected time of window start", tc.desc))
+				if msg.Name != "temperature_count" {
+					assert.Equal(t, "Cel", msg.Unit, fmt.Sprintf("%s: expected unit of records", tc.desc))
+				}
+			}
+		}
+		assert.Equal(t, tc.expected, values, fmt.Sprintf("%s: unexpected aggregates", tc.desc))
+	}
+}
+
+func TestAggregateLate(t *testing.T) {
+	start := windowStart(time.Minute)
+	late := senml.Message{Name: "temperature", Time: start - 120, Value: float(20)}
+
+	cases := []struct {
+		desc    string
+		late    string
+		dropped int
+		kept    int
+	}{
+		{
+			desc:    "drop late records",
+			late:    writer.LateDrop,
+			dropped: 1,
+			kept:    0,
+		},
+		{
+			desc:    "forward late records",
+			late:    writer.LateForward,
+			dropped: 0,
+			kept:    1,
+		},
+	}
+
+	for _, tc := range cases {
+		a, _ := newAggregator(t, writer.AggregateConfig{Window: writer.Duration(time.Minute), Grace: writer.Duration(time.Minute), Late: tc.late})
+		b := writer.Batch{Records: []senml.Message{late}}
+		aggregated, dropped := a.Add(&b)
+		a.Close()
+		assert.Equal(t, 0, aggregated, fmt.Sprintf("%s: unexpected aggregated records", tc.desc))
+		assert.Equal(t, tc.dropped, dropped, fmt.Sprintf("%s: unexpected dropped records", tc.desc))
+		assert.Len(t, b.Records, tc.kept, fmt.Sprintf("%s: unexpected kept records", tc.desc))
+	}
+}
+
+func TestAggregateFuture(t *testing.T) {
+	a, _ := newAggregator(t, writer.AggregateConfig{Window: writer.Duration(time.Minute), Grace: writer.Duration(time.Minute)})
+	defer a.Close()
+
+	start := windowStart(time.Minute)
+	b := writer.Batch{Records: []senml.Message{
+		{Name: "temperature", Time: start + 60, Value: float(20)},
+		{Name: "temperature", Time: start + 3600, Value: float(20)},
+	}}
+	aggregated, dropped := a.Add(&b)
+	assert.Equal(t, 1, aggregated, "expected record of next window to be aggregated")
+	assert.Equal(t, 1, dropped, "expected record beyond next window and grace to be dropped")
+	assert.Len(t, b.Records, 0, "unexpected kept records")
+}
+
+func TestAggregateEmitFailure(t *testing.T) {
+	cases := []struct {
+		desc    string
+		err     error
+		emitted int
+	}{
+		{
+			desc:    "emit aggregates again after failure",
+			err:     errors.New("remote target unavailable"),
+			emitted: 2,
+		},
+		{
+			desc:    "emit aggregates once after rejection",
+			err:     writer.ErrRemoteRejected,
+			emitted: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		var emitted int
+		emit := func(ctx context.Context, msgs []senml.Message) error {
+			emitted++
+			require.Len(t, msgs, 1, fmt.Sprintf("%s: expected aggregate of window", tc.desc))
+			if emitted == 1 {
+				return tc.err
+			}
+			return nil
+		}
+		a, err := writer.NewAggregator(writer.AggregateConfig{Window: writer.Duration(time.Hour), Functions: []string{writer.AggregateCount}}, emit, testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating aggregator: %s", tc.desc, err))
+
+		b := writer.Batch{Records: []senml.Message{{Name: "temperature", Value: float(20)}}}
+		a.Add(&b)
+		err = a.Flush(context.Background())
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %s got %v", tc.desc, tc.err, err))
+		err = a.Flush(context.Background())
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		a.Close()
+		assert.Equal(t, tc.emitted, emitted, fmt.Sprintf("%s: unexpected emissions", tc.desc))
+	}
+}
+
+func TestAggregateWindowClose(t *testing.T) {
+	a, em := newAggregator(t, writer.AggregateConfig{Window: writer.Duration(100 * time.Millisecond), Functions: []string{writer.AggregateCount}})
+	defer a.Close()
+
+	b := writer.Batch{Records: []senml.Message{{Name: "temperature", Value: float(20)}}}
+	aggregated, _ := a.Add(&b)
+	require.Equal(t, 1, aggregated, "expected aggregated record")
+
+	select {
+	case msgs := <-em:
+		require.Len(t, msgs, 1, "expected aggregate of closed window")
+		assert.Equal(t, "temperature_count", msgs[0].Name, "expected aggregate name")
+		assert.Equal(t, 1.0, *msgs[0].Value, "expected aggregate value")
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected aggregates of closed window to be emitted")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-zoo/bone"
+	http_forwarder "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+)
+
+const bearerPrefix = "Bearer "
+
+var (
+	errUnauthorized    = errors.New("missing or invalid admin credentials")
+	errMalformedEntity = errors.New("malformed entity")
+)
+
+type routeReq struct {
+	Subject string `json:"subject"`
+}
+
+type routesRes struct {
+	Routes []http_forwarder.Route `json:"routes"`
+}
+
+type errorRes struct {
+	Error string `json:"error"`
+}
+
+// makeAdminHandler registers the route management endpoints, protected
+// by the admin bearer token.
+func makeAdminHandler(r *bone.Mux, routes http_forwarder.Routes, token string) {
+	r.GetFunc("/routes", authorize(token, listRoutes(routes)))
+	r.PostFunc("/routes", authorize(token, addRoute(routes)))
+	r.DeleteFunc("/routes/:subject", authorize(token, removeRoute(routes)))
+	r.PostFunc("/routes/:subject/pause", authorize(token, pauseRoute(routes)))
+	r.PostFunc("/routes/:subject/resume", authorize(token, resumeRoute(routes)))
+}
+
+func authorize(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, bearerPrefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, bearerPrefix)), []byte(token)) != 1 {
+			encodeError(w, errUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func listRoutes(routes http_forwarder.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encodeResponse(w, http.StatusOK, routesRes{Routes: routes.List()})
+	}
+}
+
+func addRoute(routes http_forwarder.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req routeReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			encodeError(w, errors.Wrap(errMalformedEntity, err))
+			return
+		}
+
+		route, err := routes.Add(req.Subject)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusCreated, route)
+	}
+}
+
+func removeRoute(routes http_forwarder.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := routes.Remove(bone.GetValue(r, "subject")); err != nil {
+			encodeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func pauseRoute(routes http_forwarder.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, err := routes.Pause(bone.GetValue(r, "subject"))
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusOK, route)
+	}
+}
+
+func resumeRoute(routes http_forwarder.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, err := routes.Resume(bone.GetValue(r, "subject"))
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		encodeResponse(w, http.StatusOK, route)
+	}
+}
+
+func encodeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Contains(err, errUnauthorized):
+		code = http.StatusUnauthorized
+	case errors.Contains(err, errOriginNotAllowed):
+		code = http.StatusForbidden
+	case errors.Contains(err, errMalformedEntity),
+		errors.Contains(err, http_forwarder.ErrInvalidSubject),
+		errors.Contains(err, http_forwarder.ErrSinkNotConfigured):
+		code = http.StatusBadRequest
+	case errors.Contains(err, http_forwarder.ErrRouteNotFound):
+		code = http.StatusNotFound
+	case errors.Contains(err, http_forwarder.ErrRouteExists):
+		code = http.StatusConflict
+	case errors.Contains(err, http_forwarder.ErrRoutesClosed):
+		code = http.StatusServiceUnavailable
+	}
+
+	encodeResponse(w, code, errorRes{Error: err.Error()})
+}
@@ -0,0 +1,166 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	http_forwarder "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/api"
+	"github.com/stretchr/testify/assert"
+)
+
+const adminToken = "admin-token"
+
+type routesMock struct {
+	routes []http_forwarder.Route
+	closed bool
+}
+
+func (rm *routesMock) Reload() error {
+	return nil
+}
+
+func (rm *routesMock) List() []http_forwarder.Route {
+	return rm.routes
+}
+
+func (rm *routesMock) Add(subject string) (http_forwarder.Route, error) {
+	if rm.closed {
+		return http_forwarder.Route{}, http_forwarder.ErrRoutesClosed
+	}
+	if subject == "" {
+		return http_forwarder.Route{}, http_forwarder.ErrInvalidSubject
+	}
+	for _, r := range rm.routes {
+		if r.Subject == subject {
+			return http_forwarder.Route{}, http_forwarder.ErrRouteExists
+		}
+	}
+	r := http_forwarder.Route{Subject: subject}
+	rm.routes = append(rm.routes, r)
+	return r, nil
+}
+
+func (rm *routesMock) Remove(subject string) error {
+	if rm.closed {
+		return http_forwarder.ErrRoutesClosed
+	}
+	for i, r := range rm.routes {
+		if r.Subject == subject {
+			rm.routes = append(rm.routes[:i], rm.routes[i+1:]...)
+			return nil
+		}
+	}
+	return http_forwarder.ErrRouteNotFound
+}
+
+func (rm *routesMock) Pause(subject string) (http_forwarder.Route, error) {
+	return rm.setPaused(subject, true)
+}
+
+func (rm *routesMock) Resume(subject string) (http_forwarder.Route, error) {
+	return rm.setPaused(subject, false)
+}
+
+func (rm *routesMock) Scripts() []string {
+	return nil
+}
+
+func (rm *routesMock) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (rm *routesMock) Close() {
+	rm.closed = true
+}
+
+func (rm *routesMock) setPaused(subject string, paused bool) (http_forwarder.Route, error) {
+	if rm.closed {
+		return http_forwarder.Route{}, http_forwarder.ErrRoutesClosed
+	}
+	for i, r := range rm.routes {
+		if r.Subject == subject {
+			rm.routes[i].Paused = paused
+			return rm.routes[i], nil
+		}
+	}
+	return http_forwarder.Route{}, http_forwarder.ErrRouteNotFound
+}
+
+func TestAdmin(t *testing.T) {
+	routes := &routesMock{routes: []http_forwarder.Route{{Subject: "channels.>"}}}
+	ts := httptest.NewServer(api.MakeHandler(svcName, nil, routes, adminToken, nil, "", nil))
+	defer ts.Close()
+
+	all := url.PathEscape("channels.>")
+
+	cases := []struct {
+		desc   string
+		method string
+		path   string
+		token  string
+		body   string
+		close  bool
+		code   int
+		res    string
+	}{
+		{desc: "list routes without token", method: http.MethodGet, path: "/routes", code: http.StatusUnauthorized},
+		{desc: "list routes with invalid token", method: http.MethodGet, path: "/routes", token: "invalid", code: http.StatusUnauthorized},
+		{desc: "list routes", method: http.MethodGet, path: "/routes", token: adminToken, code: http.StatusOK, res: `{"routes":[{"subject":"channels.>","paused":false}]}`},
+		{desc: "add route", method: http.MethodPost, path: "/routes", token: adminToken, body: `{"subject":"channels.1"}`, code: http.StatusCreated, res: `{"subject":"channels.1","paused":false}`},
+		{desc: "add existing route", method: http.MethodPost, path: "/routes", token: adminToken, body: `{"subject":"channels.1"}`, code: http.StatusConflict},
+		{desc: "add route with malformed body", method: http.MethodPost, path: "/routes", token: adminToken, body: `{"subject":`, code: http.StatusBadRequest},
+		{desc: "add route with invalid subject", method: http.MethodPost, path: "/routes", token: adminToken, body: `{}`, code: http.StatusBadRequest},
+		{desc: "pause route", method: http.MethodPost, path: fmt.Sprintf("/routes/%s/pause", all), token: adminToken, code: http.StatusOK, res: `{"subject":"channels.>","paused":true}`},
+		{desc: "resume route", method: http.MethodPost, path: fmt.Sprintf("/routes/%s/resume", all), token: adminToken, code: http.StatusOK, res: `{"subject":"channels.>","paused":false}`},
+		{desc: "pause unknown route", method: http.MethodPost, path: "/routes/channels.2/pause", token: adminToken, code: http.StatusNotFound},
+		{desc: "remove route", method: http.MethodDelete, path: "/routes/channels.1", token: adminToken, code: http.StatusNoContent},
+		{desc: "remove unknown route", method: http.MethodDelete, path: "/routes/channels.1", token: adminToken, code: http.StatusNotFound},
+		{desc: "add route to closed routes", method: http.MethodPost, path: "/routes", token: adminToken, body: `{"subject":"channels.1"}`, close: true, code: http.StatusServiceUnavailable},
+		{desc: "pause closed route", method: http.MethodPost, path: fmt.Sprintf("/routes/%s/pause", all), token: adminToken, code: http.StatusServiceUnavailable},
+		{desc: "list closed routes", method: http.MethodGet, path: "/routes", token: adminToken, code: http.StatusOK, res: `{"routes":[{"subject":"channels.>","paused":false}]}`},
+	}
+
+	for _, tc := range cases {
+		if tc.close {
+			routes.Close()
+		}
+		req, err := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader(tc.body))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error creating request %s", tc.desc, err))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error reading body %s", tc.desc, err))
+		assert.Equal(t, tc.code, res.StatusCode, fmt.Sprintf("%s: unexpected status code", tc.desc))
+		if tc.res != "" {
+			assert.JSONEq(t, tc.res, string(body), fmt.Sprintf("%s: unexpected response body", tc.desc))
+		}
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	ts := httptest.NewServer(api.MakeHandler(svcName, nil, &routesMock{}, "", nil, "", nil))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/routes", nil)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error creating request %s", err))
+	req.Header.Set("Authorization", "Bearer ")
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "admin API must be disabled without admin token")
+}
@@ -0,0 +1,43 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	http_forwarder "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	log "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+var _ http_forwarder.Repository = (*loggingMiddleware)(nil)
+
+type loggingMiddleware struct {
+	logger log.Logger
+	repo   http_forwarder.Repository
+}
+
+// LoggingMiddleware adds logging facilities to the forwarder.
+func LoggingMiddleware(repo http_forwarder.Repository, logger log.Logger) http_forwarder.Repository {
+	return &loggingMiddleware{logger, repo}
+}
+
+func (lm *loggingMiddleware) Save(msgs ...senml.Message) error {
+	return lm.SaveContext(context.Background(), msgs...)
+}
+
+func (lm *loggingMiddleware) SaveContext(ctx context.Context, msgs ...senml.Message) (err error) {
+	defer func(begin time.Time) {
+		message := fmt.Sprintf("Method save took %s to complete", time.Since(begin))
+		if err != nil {
+			lm.logger.Warn(fmt.Sprintf("%s with error: %s.", message, err))
+			return
+		}
+		lm.logger.Info(fmt.Sprintf("%s without errors.", message))
+	}(time.Now())
+
+	return lm.repo.SaveContext(ctx, msgs...)
+}
@@ -0,0 +1,198 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-zoo/bone"
+	"github.com/gorilla/websocket"
+	http_forwarder "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+)
+
+const (
+	subjectParam     = "subject"
+	accessTokenParam = "access_token"
+
+	pushWriteWait  = 10 * time.Second
+	pushPingPeriod = 30 * time.Second
+)
+
+var errOriginNotAllowed = errors.New("origin not allowed")
+
+// makePushHandler registers the WebSocket and Server-Sent Events endpoints
+// of the push sink, protected by the push bearer token and restricted to
+// the allowed origins.
+func makePushHandler(r *bone.Mux, hub *http_forwarder.PushHub, token string, origins []string) {
+	allowed := allowOrigin(origins)
+	upgrader := websocket.Upgrader{CheckOrigin: allowed}
+	r.GetFunc("/push/ws", checkOrigin(allowed, authorizePush(token, pushWS(hub, upgrader))))
+	r.GetFunc("/push/sse", checkOrigin(allowed, authorizePush(token, pushSSE(hub))))
+}
+
+// allowOrigin returns the function reporting whether the origin of the
+// request is allowed. Requests without Origin header, such as the requests
+// of clients which are not browsers, and same origin requests are allowed,
+// as well as the requests of the listed origins or of any origin if the
+// list contains "*".
+func allowOrigin(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range origins {
+			if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+				return true
+			}
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+// checkOrigin rejects the requests of origins which are not allowed, and
+// lets browsers read the responses of the allowed cross origin requests.
+func checkOrigin(allowed func(r *http.Request) bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r) {
+			encodeError(w, errOriginNotAllowed)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		next(w, r)
+	}
+}
+
+// authorizePush authorizes the request with the bearer token, or with the
+// access_token query parameter since browsers can't set the headers of
+// WebSocket and EventSource requests. The parameter is removed from the
+// request, so that it isn't logged by the handlers.
+func authorizePush(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if t := query.Get(accessTokenParam); t != "" {
+			if r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", bearerPrefix+t)
+			}
+			query.Del(accessTokenParam)
+			r.URL.RawQuery = query.Encode()
+		}
+		authorize(token, next)(w, r)
+	}
+}
+
+// pushWS pushes the batches of the subject to the WebSocket client, a text
+// message per batch. Slow clients are disconnected with the 1013 close code.
+func pushWS(hub *http_forwarder.PushHub, upgrader websocket.Upgrader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := hub.Subscribe(r.URL.Query().Get(subjectParam))
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		defer hub.Unsubscribe(client)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader already replied with the error.
+			return
+		}
+		defer conn.Close()
+
+		// Messages of the client are discarded, reading only detects the
+		// closed connections.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ping := time.NewTicker(pushPingPeriod)
+		defer ping.Stop()
+		for {
+			select {
+			case data := <-client.Batches():
+				conn.SetWriteDeadline(time.Now().Add(pushWriteWait))
+				if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+					return
+				}
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pushWriteWait)); err != nil {
+					return
+				}
+			case <-client.Done():
+				code := websocket.CloseGoingAway
+				if errors.Contains(client.Err(), http_forwarder.ErrSlowClient) {
+					code = websocket.CloseTryAgainLater
+				}
+				msg := websocket.FormatCloseMessage(code, client.Err().Error())
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(pushWriteWait))
+				return
+			case <-closed:
+				return
+			}
+		}
+	}
+}
+
+// pushSSE pushes the batches of the subject to the Server-Sent Events
+// client, a data event per batch. The reason of the disconnection of slow
+// clients is sent as an error event.
+func pushSSE(hub *http_forwarder.PushHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			encodeError(w, errors.New("streaming unsupported"))
+			return
+		}
+
+		client, err := hub.Subscribe(r.URL.Query().Get(subjectParam))
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		defer hub.Unsubscribe(client)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ping := time.NewTicker(pushPingPeriod)
+		defer ping.Stop()
+		for {
+			select {
+			case data := <-client.Batches():
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+					return
+				}
+			case <-ping.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			case <-client.Done():
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", client.Err())
+				flusher.Flush()
+				return
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/gorilla/websocket"
+	http_forwarder "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/api"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	pushToken  = "push-token"
+	pushOrigin = "https://dashboard.example.com"
+)
+
+var nopMetrics = http_forwarder.Metrics{
+	Requests:          discard.NewCounter(),
+	Records:           discard.NewCounter(),
+	Bytes:             discard.NewCounter(),
+	BatchSize:         discard.NewHistogram(),
+	TransformFailures: discard.NewCounter(),
+	Dropped:           discard.NewCounter(),
+	Latency:           discard.NewHistogram(),
+	DedupHits:         discard.NewCounter(),
+	Retries:           discard.NewCounter(),
+	QueueDepth:        discard.NewGauge(),
+}
+
+type pushRes struct {
+	Subject string `json:"subject"`
+}
+
+func newPushServer(t *testing.T, buffer int) (*httptest.Server, *http_forwarder.PushHub) {
+	logger, err := logger.New(ioutil.Discard, logger.Error.String())
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating logger: %s", err))
+	hub, err := http_forwarder.NewPushHub(http_forwarder.PushConfig{Buffer: buffer}, nopMetrics, tracing.NewNop(), logger)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating push hub: %s", err))
+	return httptest.NewServer(api.MakeHandler(svcName, nil, nil, "", hub, pushToken, []string{pushOrigin})), hub
+}
+
+// pushed waits for the clients to subscribe, and pushes a record of the
+// channel.
+func pushed(t *testing.T, hub *http_forwarder.PushHub, channel string) {
+	time.Sleep(100 * time.Millisecond)
+	value := 20.0
+	err := hub.Save(senml.Message{Channel: channel, Name: "temperature", Value: &value})
+	require.Nil(t, err, fmt.Sprintf("unexpected error pushing record: %s", err))
+}
+
+func TestPushAuth(t *testing.T) {
+	ts, _ := newPushServer(t, 0)
+	defer ts.Close()
+
+	cases := []struct {
+		desc  string
+		path  string
+		token string
+		code  int
+	}{
+		{desc: "subscribe without token", path: "/push/sse?subject=channels.>", code: http.StatusUnauthorized},
+		{desc: "subscribe with invalid token", path: "/push/sse?subject=channels.>", token: "invalid", code: http.StatusUnauthorized},
+		{desc: "subscribe with invalid token parameter", path: "/push/sse?subject=channels.>&access_token=invalid", code: http.StatusUnauthorized},
+		{desc: "subscribe to WebSocket without token", path: "/push/ws?subject=channels.>", code: http.StatusUnauthorized},
+		{desc: "subscribe with invalid subject", path: "/push/sse?subject=channels.>.1", token: pushToken, code: http.StatusBadRequest},
+		{desc: "subscribe without subject", path: "/push/ws", token: pushToken, code: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+tc.path, nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating request %s", tc.desc, err))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res.Body.Close()
+		assert.Equal(t, tc.code, res.StatusCode, fmt.Sprintf("%s: unexpected status code", tc.desc))
+	}
+}
+
+func TestPushOrigin(t *testing.T) {
+	ts, _ := newPushServer(t, 0)
+	defer ts.Close()
+
+	cases := []struct {
+		desc   string
+		origin string
+		code   int
+		allow  string
+	}{
+		{desc: "subscribe without origin", code: http.StatusOK},
+		{desc: "subscribe from same origin", origin: ts.URL, code: http.StatusOK, allow: ts.URL},
+		{desc: "subscribe from allowed origin", origin: pushOrigin, code: http.StatusOK, allow: pushOrigin},
+		{desc: "subscribe from other origin", origin: "https://evil.example.com", code: http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/push/sse?subject=channels.>&access_token="+pushToken, nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating request %s", tc.desc, err))
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res.Body.Close()
+		assert.Equal(t, tc.code, res.StatusCode, fmt.Sprintf("%s: unexpected status code", tc.desc))
+		assert.Equal(t, tc.allow, res.Header.Get("Access-Control-Allow-Origin"), fmt.Sprintf("%s: unexpected allowed origin", tc.desc))
+	}
+
+	header := http.Header{}
+	header.Set("Origin", "https://evil.example.com")
+	_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/push/ws?subject=channels.>&access_token="+pushToken, header)
+	require.NotNil(t, err, "expected WebSocket from other origin to be rejected")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "unexpected status code")
+}
+
+func TestPushDisabled(t *testing.T) {
+	ts := httptest.NewServer(api.MakeHandler(svcName, nil, nil, "", nil, pushToken, nil))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/push/sse?subject=channels.>", nil)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating request %s", err))
+	req.Header.Set("Authorization", "Bearer "+pushToken)
+	res, err := http.DefaultClient.Do(req)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "push endpoints must be disabled without push sink")
+}
+
+func TestPushSSE(t *testing.T) {
+	ts, hub := newPushServer(t, 0)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/push/sse?subject=channels.1&access_token=" + pushToken)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode, "unexpected status code")
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"), "unexpected content type")
+
+	pushed(t, hub, "2")
+	pushed(t, hub, "1")
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading event: %s", err))
+	require.True(t, strings.HasPrefix(line, "data: "), fmt.Sprintf("expected data event got %q", line))
+	var batch pushRes
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &batch)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding batch: %s", err))
+	assert.Equal(t, "channels.1", batch.Subject, "unexpected subject")
+}
+
+func TestPushWS(t *testing.T) {
+	ts, hub := newPushServer(t, 0)
+	defer ts.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+pushToken)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/push/ws?subject=channels.*", header)
+	require.Nil(t, err, fmt.Sprintf("unexpected error connecting: %s", err))
+	defer conn.Close()
+
+	pushed(t, hub, "1")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var batch pushRes
+	err = conn.ReadJSON(&batch)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading batch: %s", err))
+	assert.Equal(t, "channels.1", batch.Subject, "unexpected subject")
+}
+
+func TestPushWSSlowClient(t *testing.T) {
+	ts, hub := newPushServer(t, 1)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/push/ws?subject=channels.>&access_token="+pushToken, nil)
+	require.Nil(t, err, fmt.Sprintf("unexpected error connecting: %s", err))
+	defer conn.Close()
+
+	// The batches are pushed faster than the handler can take them out of
+	// the buffer of a single batch.
+	time.Sleep(100 * time.Millisecond)
+	value := 20.0
+	for i := 0; i < 100; i++ {
+		hub.Save(senml.Message{Channel: "1", Name: "temperature", Value: &value})
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater), fmt.Sprintf("expected slow client close got %v", err))
+}
@@ -0,0 +1,91 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-zoo/bone"
+	http_forwarder "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	contentType = "application/json"
+
+	statusUp   = "up"
+	statusDown = "down"
+)
+
+type checkRes struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthRes struct {
+	Status  string              `json:"status"`
+	Service string              `json:"service"`
+	Checks  map[string]checkRes `json:"checks,omitempty"`
+}
+
+// MakeHandler returns a HTTP API handler with version, metrics, health
+// and readiness endpoints. Readiness is reported as the result of the
+// given checks, keyed by name. Route management endpoints are served
+// only if the admin token is set, and the push endpoints only if the push
+// sink and its token are set, to the same origin and the push origins.
+func MakeHandler(svcName string, checks map[string]http_forwarder.Check, routes http_forwarder.Routes, adminToken string, push *http_forwarder.PushHub, pushToken string, pushOrigins []string) http.Handler {
+	r := bone.New()
+	r.GetFunc("/version", mainflux.Version(svcName))
+	r.Handle("/metrics", promhttp.Handler())
+	r.GetFunc("/health", health(svcName))
+	r.GetFunc("/ready", ready(svcName, checks))
+	if adminToken != "" {
+		makeAdminHandler(r, routes, adminToken)
+	}
+	if push != nil && pushToken != "" {
+		makePushHandler(r, push, pushToken, pushOrigins)
+	}
+
+	return r
+}
+
+func health(svcName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encodeResponse(w, http.StatusOK, healthRes{
+			Status:  statusUp,
+			Service: svcName,
+		})
+	}
+}
+
+func ready(svcName string, checks map[string]http_forwarder.Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := healthRes{
+			Status:  statusUp,
+			Service: svcName,
+			Checks:  make(map[string]checkRes),
+		}
+		code := http.StatusOK
+
+		for name, check := range checks {
+			if err := check(); err != nil {
+				res.Checks[name] = checkRes{Status: statusDown, Error: err.Error()}
+				res.Status = statusDown
+				code = http.StatusServiceUnavailable
+				continue
+			}
+			res.Checks[name] = checkRes{Status: statusUp}
+		}
+
+		encodeResponse(w, code, res)
+	}
+}
+
+func encodeResponse(w http.ResponseWriter, code int, res interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	http_forwarder "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/api"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	svcName   = "http-forwarder"
+	remoteURL = "http://localhost:9000"
+)
+
+var errNATS = errors.New("not connected to NATS")
+
+type checkRes struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+type healthRes struct {
+	Status  string              `json:"status"`
+	Service string              `json:"service"`
+	Checks  map[string]checkRes `json:"checks"`
+}
+
+func TestHealth(t *testing.T) {
+	ts := httptest.NewServer(api.MakeHandler(svcName, nil, nil, "", nil, "", nil))
+	defer ts.Close()
+
+	res, err := http.Get(fmt.Sprintf("%s/health", ts.URL))
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	defer res.Body.Close()
+
+	var body healthRes
+	err = json.NewDecoder(res.Body).Decode(&body)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error decoding body %s", err))
+	assert.Equal(t, http.StatusOK, res.StatusCode, "unexpected status code")
+	assert.Equal(t, "up", body.Status, "unexpected health status")
+	assert.Equal(t, svcName, body.Service, "unexpected service name")
+}
+
+func TestReady(t *testing.T) {
+	remote, err := http_forwarder.NewRemote(http_forwarder.RemoteConfig{URL: remoteURL})
+	assert.Nil(t, err, fmt.Sprintf("unexpected error creating remote: %s", err))
+	breaker := http_forwarder.NewCircuitBreaker(http_forwarder.BreakerConfig{FailureRatio: 0.5, MinRequests: 1, CoolDown: time.Hour, Probes: 1}, nil)
+
+	cases := []struct {
+		desc   string
+		checks map[string]http_forwarder.Check
+		trip   bool
+		code   int
+		status string
+		down   map[string]string
+	}{
+		{
+			desc: "all checks passing",
+			checks: map[string]http_forwarder.Check{
+				"nats":   func() error { return nil },
+				"remote": http_forwarder.BreakerCheck(breaker, remote),
+			},
+			code:   http.StatusOK,
+			status: "up",
+			down:   map[string]string{},
+		},
+		{
+			desc: "NATS disconnected",
+			checks: map[string]http_forwarder.Check{
+				"nats":   func() error { return errNATS },
+				"remote": http_forwarder.BreakerCheck(breaker, remote),
+			},
+			code:   http.StatusServiceUnavailable,
+			status: "down",
+			down:   map[string]string{"nats": errNATS.Error()},
+		},
+		{
+			desc: "circuit of remote target open",
+			checks: map[string]http_forwarder.Check{
+				"nats":   func() error { return nil },
+				"remote": http_forwarder.BreakerCheck(breaker, remote),
+			},
+			trip:   true,
+			code:   http.StatusServiceUnavailable,
+			status: "down",
+			down:   map[string]string{"remote": http_forwarder.ErrCircuitOpen.Error()},
+		},
+	}
+
+	for _, tc := range cases {
+		if tc.trip {
+			breaker.Allow(remoteURL)
+			breaker.Report(remoteURL, false)
+		}
+
+		ts := httptest.NewServer(api.MakeHandler(svcName, tc.checks, nil, "", nil, "", nil))
+		res, err := http.Get(fmt.Sprintf("%s/ready", ts.URL))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		var body healthRes
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		ts.Close()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding body %s", tc.desc, err))
+		assert.Equal(t, tc.code, res.StatusCode, fmt.Sprintf("%s: unexpected status code", tc.desc))
+		assert.Equal(t, tc.status, body.Status, fmt.Sprintf("%s: unexpected readiness status", tc.desc))
+		assert.Equal(t, len(tc.checks), len(body.Checks), fmt.Sprintf("%s: expected every check in body", tc.desc))
+		for name, check := range body.Checks {
+			if msg, ok := tc.down[name]; ok {
+				assert.Equal(t, "down", check.Status, fmt.Sprintf("%s: expected %s check down", tc.desc, name))
+				assert.Equal(t, msg, check.Error, fmt.Sprintf("%s: unexpected %s check error", tc.desc, name))
+				continue
+			}
+			assert.Equal(t, "up", check.Status, fmt.Sprintf("%s: expected %s check up", tc.desc, name))
+		}
+	}
+}
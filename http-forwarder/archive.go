@@ -0,0 +1,535 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+// Formats of the archive files.
+const (
+	// ArchiveJSONL writes a line per record, with the flat JSON object sent
+	// with the DeliveryRecord granularity. It is the default.
+	ArchiveJSONL = "jsonl"
+
+	// ArchiveSenML writes a line per address, with the SenML pack of its
+	// records.
+	ArchiveSenML = "senml"
+)
+
+const (
+	defArchiveMaxSize = 64 << 20
+	defArchiveMaxAge  = time.Hour
+
+	archiveTarget   = "archive"
+	archivePartial  = ".part"
+	archiveDate     = "2006-01-02"
+	archiveFileTime = "20060102T150405.000Z"
+	archiveTick     = time.Second
+	archiveScan     = time.Minute
+)
+
+var (
+	// ErrInvalidArchive indicates that the archive settings are malformed.
+	ErrInvalidArchive = errors.New("invalid archive")
+
+	errArchiveRecords = errors.New("failed to archive records")
+	errArchiveClosed  = errors.New("archive closed")
+
+	unsafePartition = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// ArchiveConfig contains the settings of the archive.
+type ArchiveConfig struct {
+	// Dir is the directory the files are written to, partitioned by date
+	// and channel.
+	Dir string
+
+	// Format is the format of the files, ArchiveJSONL if empty.
+	Format string
+
+	// MaxSize is the compressed size above which a file is rotated, 64 MiB
+	// if 0.
+	MaxSize int64
+
+	// MaxAge is the time after which a file is rotated, one hour if 0.
+	MaxAge time.Duration
+
+	// Retention is the time the rotated files are kept, forever if 0.
+	Retention time.Duration
+
+	// S3 is the object store the rotated files are uploaded to, and
+	// removed once uploaded. The files are kept locally if its URL is
+	// empty.
+	S3 S3Config
+}
+
+var _ Repository = (*Archive)(nil)
+
+// Archive writes the forwarded records to gzip compressed JSON lines
+// files, partitioned by date and channel: <dir>/<date>/<channel>/. Files
+// being written have the .part suffix, which is removed when they are
+// rotated.
+type Archive struct {
+	cfg     ArchiveConfig
+	s3      *s3Client
+	metrics Metrics
+	logger  logger.Logger
+
+	mu     sync.Mutex
+	files  map[string]*archiveFile
+	seq    uint64
+	closed bool
+
+	rotated chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// archiveFile is a file being written.
+type archiveFile struct {
+	path    string
+	file    *os.File
+	gz      *gzip.Writer
+	size    int64
+	flushed int64
+	opened  time.Time
+}
+
+func (f *archiveFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// NewArchive returns archive writing to the directory. Files left being
+// written by a previous run are rotated.
+func NewArchive(cfg ArchiveConfig, metrics Metrics, logger logger.Logger) (*Archive, error) {
+	if cfg.Format == "" {
+		cfg.Format = ArchiveJSONL
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = defArchiveMaxSize
+	}
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = defArchiveMaxAge
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	a := &Archive{
+		cfg:     cfg,
+		metrics: metrics,
+		logger:  logger,
+		files:   make(map[string]*archiveFile),
+		rotated: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if cfg.S3.URL != "" {
+		s3, err := newS3Client(cfg.S3)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidArchive, err)
+		}
+		a.s3 = s3
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, errors.Wrap(ErrInvalidArchive, err)
+	}
+	if err := a.recover(); err != nil {
+		return nil, errors.Wrap(ErrInvalidArchive, err)
+	}
+
+	a.wg.Add(1)
+	go a.run()
+	return a, nil
+}
+
+func (cfg ArchiveConfig) validate() error {
+	if cfg.Dir == "" {
+		return errors.Wrap(ErrInvalidArchive, errors.New("missing directory"))
+	}
+	switch cfg.Format {
+	case ArchiveJSONL, ArchiveSenML:
+	default:
+		return errors.Wrap(ErrInvalidArchive, fmt.Errorf("unknown format %s", cfg.Format))
+	}
+	if cfg.MaxSize < 0 || cfg.MaxAge < 0 || cfg.Retention < 0 {
+		return errors.Wrap(ErrInvalidArchive, errors.New("size and durations must not be negative"))
+	}
+	return nil
+}
+
+func (a *Archive) Save(messages ...senml.Message) error {
+	return a.SaveContext(context.Background(), messages...)
+}
+
+func (a *Archive) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	tags := TagsFromContext(ctx)
+	now := time.Now().UTC()
+	packs, _ := groupPacks(messages, 0, tags)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return errArchiveClosed
+	}
+
+	written := make(map[*archiveFile]bool)
+	bytes := 0
+	for _, p := range packs {
+		var lines []interface{}
+		switch a.cfg.Format {
+		case ArchiveSenML:
+			lines = append(lines, p.records)
+		default:
+			for _, msg := range p.msgs {
+				lines = append(lines, recordFields(msg, tags))
+			}
+		}
+
+		f, err := a.file(now, p.address.Channel)
+		if err != nil {
+			return a.failed(written, err)
+		}
+		written[f] = true
+		for _, line := range lines {
+			data, err := json.Marshal(line)
+			if err != nil {
+				return a.failed(written, err)
+			}
+			data = append(data, '\n')
+			if _, err := f.gz.Write(data); err != nil {
+				return a.failed(written, err)
+			}
+			bytes += len(data)
+		}
+	}
+
+	// Records are flushed to the file before being reported as archived.
+	for f := range written {
+		if err := f.gz.Flush(); err != nil {
+			return a.failed(written, err)
+		}
+	}
+	for f := range written {
+		f.flushed = f.size
+		if f.size >= a.cfg.MaxSize {
+			a.rotate(f)
+		}
+	}
+
+	a.metrics.Requests.With("target", archiveTarget, "code", statusClass(0), "outcome", outcomeSuccess).Add(1)
+	a.metrics.Records.With("target", archiveTarget).Add(float64(len(messages)))
+	a.metrics.Bytes.With("target", archiveTarget).Add(float64(bytes))
+	return nil
+}
+
+// failed discards the files written by the failed batch, whose records
+// are sent again when retried.
+func (a *Archive) failed(written map[*archiveFile]bool, err error) error {
+	for f := range written {
+		a.discard(f)
+	}
+	a.metrics.Requests.With("target", archiveTarget, "code", statusClass(0), "outcome", outcomeError).Add(1)
+	return errors.Wrap(errArchiveRecords, err)
+}
+
+// file returns the file of the partition of the date and channel, which is
+// opened if needed.
+func (a *Archive) file(now time.Time, channel string) (*archiveFile, error) {
+	partition := filepath.Join(now.Format(archiveDate), partitionName(channel))
+	if f, ok := a.files[partition]; ok {
+		return f, nil
+	}
+
+	dir := filepath.Join(a.cfg.Dir, partition)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Files of previous runs are never overwritten.
+	var path string
+	for {
+		a.seq++
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d%s.gz", now.Format(archiveFileTime), a.seq, a.extension()))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+	}
+	file, err := os.OpenFile(path+archivePartial, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &archiveFile{path: path, file: file, opened: now}
+	f.gz = gzip.NewWriter(f)
+	a.files[partition] = f
+	return f, nil
+}
+
+func (a *Archive) extension() string {
+	if a.cfg.Format == ArchiveSenML {
+		return ".senml.jsonl"
+	}
+	return ".jsonl"
+}
+
+// rotate completes the file, which won't be written anymore.
+func (a *Archive) rotate(f *archiveFile) {
+	for partition, file := range a.files {
+		if file == f {
+			delete(a.files, partition)
+		}
+	}
+
+	err := f.gz.Close()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.path+archivePartial, f.path)
+	}
+	if err != nil {
+		a.logger.Error(fmt.Sprintf("Failed to rotate archive file %s: %s", f.path, err))
+		return
+	}
+
+	select {
+	case a.rotated <- struct{}{}:
+	default:
+	}
+}
+
+// discard truncates the file to its last flushed batch, the rest of the
+// compressed stream being left unusable, and completes it as the files
+// recovered on start. Later records are written to a new file.
+func (a *Archive) discard(f *archiveFile) {
+	for partition, file := range a.files {
+		if file == f {
+			delete(a.files, partition)
+		}
+	}
+
+	err := f.file.Truncate(f.flushed)
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if f.flushed == 0 {
+			err = os.Remove(f.path + archivePartial)
+		} else {
+			err = os.Rename(f.path+archivePartial, f.path)
+		}
+	}
+	if err != nil {
+		a.logger.Error(fmt.Sprintf("Failed to discard archive file %s: %s", f.path, err))
+		return
+	}
+	a.logger.Warn(fmt.Sprintf("Discarded archive file %s after failed batch", f.path))
+
+	select {
+	case a.rotated <- struct{}{}:
+	default:
+	}
+}
+
+// run rotates the files older than the maximum age, and uploads and
+// removes the rotated files after each rotation and periodically.
+func (a *Archive) run() {
+	defer a.wg.Done()
+
+	tick := time.NewTicker(archiveTick)
+	defer tick.Stop()
+	scan := time.NewTicker(archiveScan)
+	defer scan.Stop()
+
+	a.scan()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-tick.C:
+			a.mu.Lock()
+			now := time.Now().UTC()
+			for _, f := range a.files {
+				// Files are rotated at midnight, when their partition ends.
+				if now.Sub(f.opened) >= a.cfg.MaxAge || now.Format(archiveDate) != f.opened.Format(archiveDate) {
+					a.rotate(f)
+				}
+			}
+			a.mu.Unlock()
+		case <-a.rotated:
+			a.scan()
+		case <-scan.C:
+			a.scan()
+		}
+	}
+}
+
+// scan uploads the rotated files to the object store, if set, and removes
+// the ones older than the retention and the empty partitions.
+func (a *Archive) scan() {
+	var files []string
+	err := filepath.Walk(a.cfg.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !strings.HasSuffix(path, archivePartial) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		a.logger.Warn(fmt.Sprintf("Failed to list archive files: %s", err))
+		return
+	}
+	sort.Strings(files)
+
+	if a.s3 != nil {
+		files = a.upload(files)
+	}
+	if a.cfg.Retention > 0 {
+		for _, path := range files {
+			info, err := os.Stat(path)
+			if err != nil || time.Since(info.ModTime()) < a.cfg.Retention {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				a.logger.Warn(fmt.Sprintf("Failed to remove archive file %s: %s", path, err))
+				continue
+			}
+			a.logger.Info(fmt.Sprintf("Removed archive file %s after retention", path))
+		}
+	}
+	a.removeEmpty()
+}
+
+// upload uploads the files, and removes the uploaded ones. Files which are
+// not uploaded are returned, the upload being stopped at the first failure.
+func (a *Archive) upload(files []string) []string {
+	for i, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			rel, _ := filepath.Rel(a.cfg.Dir, path)
+			ctx, cancel := context.WithTimeout(context.Background(), a.s3.cfg.Timeout)
+			err = a.s3.put(ctx, filepath.ToSlash(rel), data)
+			cancel()
+		}
+		if err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to upload archive file %s: %s", path, err))
+			return files[i:]
+		}
+		if err := os.Remove(path); err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to remove uploaded archive file %s: %s", path, err))
+		}
+	}
+	return nil
+}
+
+// removeEmpty removes the empty partition directories, deepest first.
+func (a *Archive) removeEmpty() {
+	// Partitions are not removed while a file is being opened in them.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var dirs []string
+	filepath.Walk(a.cfg.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != a.cfg.Dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// Directories which are not empty are not removed.
+		os.Remove(dirs[i])
+	}
+}
+
+// recover rotates the files left being written, which are readable up to
+// their last flushed batch.
+func (a *Archive) recover() error {
+	return filepath.Walk(a.cfg.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, archivePartial) {
+			return nil
+		}
+		a.logger.Warn(fmt.Sprintf("Recovered archive file %s", path))
+		return os.Rename(path, strings.TrimSuffix(path, archivePartial))
+	})
+}
+
+// Close rotates the files, and uploads them if the object store is set.
+// Records can't be archived anymore.
+func (a *Archive) Close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	for _, f := range a.files {
+		a.rotate(f)
+	}
+	a.mu.Unlock()
+
+	close(a.done)
+	a.wg.Wait()
+	a.scan()
+}
+
+// partitionName returns the name of the partition directory of the
+// channel, whose unsafe characters are replaced.
+func partitionName(channel string) string {
+	if channel == "" {
+		return "_"
+	}
+	return unsafePartition.ReplaceAllString(channel, "_")
+}
+
+var _ Repository = (*archiveTee)(nil)
+
+type archiveTee struct {
+	repo    Repository
+	archive Repository
+	logger  logger.Logger
+}
+
+// NewArchiveTee returns repository forwarding the records to the
+// repository, and writing the forwarded records to the archive. Records
+// which can't be archived are logged, without failing their forwarding.
+func NewArchiveTee(repo, archive Repository, logger logger.Logger) Repository {
+	return &archiveTee{repo: repo, archive: archive, logger: logger}
+}
+
+func (t *archiveTee) Save(messages ...senml.Message) error {
+	return t.SaveContext(context.Background(), messages...)
+}
+
+func (t *archiveTee) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	if err := t.repo.SaveContext(ctx, messages...); err != nil {
+		return err
+	}
+	if err := t.archive.SaveContext(ctx, messages...); err != nil {
+		t.logger.Error(fmt.Sprintf("Failed to archive %d forwarded records: %s", len(messages), err))
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// objectStoreMock is a local stand-in of an S3 compatible object store,
+// storing the uploaded objects by path.
+type objectStoreMock struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	fail    bool
+}
+
+func (store *objectStoreMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	hash := sha256.Sum256(body)
+	if r.Method != http.MethodPut ||
+		!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") ||
+		!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/s3/aws4_request") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	store.objects[r.URL.Path] = body
+	w.WriteHeader(http.StatusOK)
+}
+
+// archived returns the lines of the rotated files of the directory, by
+// path relative to the directory.
+func archived(t *testing.T, dir string) map[string][]string {
+	files := make(map[string][]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".part") {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = gunzip(t, f)
+		return nil
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading archive: %s", err))
+	return files
+}
+
+func gunzip(t *testing.T, r interface{ Read([]byte) (int, error) }) []string {
+	gz, err := gzip.NewReader(r)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decompressing file: %s", err))
+	var lines []string
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Nil(t, scanner.Err(), fmt.Sprintf("unexpected error reading file: %s", scanner.Err()))
+	return lines
+}
+
+func newArchiveDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "archive")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	return dir
+}
+
+func TestNewArchive(t *testing.T) {
+	dir := newArchiveDir(t)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		desc string
+		cfg  writer.ArchiveConfig
+		err  error
+	}{
+		{
+			desc: "create archive",
+			cfg:  writer.ArchiveConfig{Dir: dir},
+		},
+		{
+			desc: "create archive without directory",
+			cfg:  writer.ArchiveConfig{},
+			err:  writer.ErrInvalidArchive,
+		},
+		{
+			desc: "create archive with unknown format",
+			cfg:  writer.ArchiveConfig{Dir: dir, Format: "csv"},
+			err:  writer.ErrInvalidArchive,
+		},
+		{
+			desc: "create archive with negative retention",
+			cfg:  writer.ArchiveConfig{Dir: dir, Retention: -time.Hour},
+			err:  writer.ErrInvalidArchive,
+		},
+		{
+			desc: "create archive with invalid object store URL",
+			cfg:  writer.ArchiveConfig{Dir: dir, S3: writer.S3Config{URL: "minio:9000", Bucket: "audit", AccessKey: "access", SecretKey: "secret"}},
+			err:  writer.ErrInvalidArchive,
+		},
+		{
+			desc: "create archive without bucket",
+			cfg:  writer.ArchiveConfig{Dir: dir, S3: writer.S3Config{URL: "http://minio:9000", AccessKey: "access", SecretKey: "secret"}},
+			err:  writer.ErrInvalidArchive,
+		},
+	}
+
+	for _, tc := range cases {
+		a, err := writer.NewArchive(tc.cfg, nopMetrics, testLog)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		if a != nil {
+			a.Close()
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	msgs := []senml.Message{
+		{Channel: "1", Subtopic: "room", Name: "temperature", Unit: "Cel", Time: 1600000000, Value: float(20)},
+		{Channel: "1", Subtopic: "room", Name: "temperature", Unit: "Cel", Time: 1600000001, Value: float(21)},
+		{Channel: "../2", Name: "humidity", Time: 1600000000, Value: float(40)},
+	}
+	date := time.Now().UTC().Format("2006-01-02")
+
+	cases := []struct {
+		desc   string
+		format string
+		ext    string
+		lines  map[string][]string
+	}{
+		{
+			desc:   "archive records as JSON lines",
+			format: writer.ArchiveJSONL,
+			ext:    ".jsonl.gz",
+			lines: map[string][]string{
+				date + "/1": {
+					`{"channel":"1","name":"temperature","subtopic":"room","unit":"Cel","time":1600000000,"value":20,"site":"lab"}`,
+					`{"channel":"1","name":"temperature","subtopic":"room","unit":"Cel","time":1600000001,"value":21,"site":"lab"}`,
+				},
+				date + "/___2": {
+					`{"channel":"../2","name":"humidity","time":1600000000,"value":40,"site":"lab"}`,
+				},
+			},
+		},
+		{
+			desc:   "archive records as SenML packs",
+			format: writer.ArchiveSenML,
+			ext:    ".senml.jsonl.gz",
+			lines: map[string][]string{
+				date + "/1": {
+					`[{"bn":"temperature","bt":1600000000,"bu":"Cel","bver":5,"site":"lab","v":20},{"site":"lab","t":1,"v":21}]`,
+				},
+				date + "/___2": {
+					`[{"n":"humidity","site":"lab","t":1600000000,"v":40}]`,
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		dir := newArchiveDir(t)
+		defer os.RemoveAll(dir)
+		a, err := writer.NewArchive(writer.ArchiveConfig{Dir: dir, Format: tc.format}, nopMetrics, testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating archive: %s", tc.desc, err))
+
+		err = a.SaveContext(writer.WithTags(context.Background(), map[string]string{"site": "lab"}), msgs...)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error archiving records: %s", tc.desc, err))
+		assert.Len(t, archived(t, dir), 0, fmt.Sprintf("%s: unexpected rotated file", tc.desc))
+		a.Close()
+
+		files := archived(t, dir)
+		require.Len(t, files, len(tc.lines), fmt.Sprintf("%s: unexpected files %v", tc.desc, files))
+		for path, lines := range files {
+			assert.True(t, strings.HasSuffix(path, tc.ext), fmt.Sprintf("%s: expected %s extension of %s", tc.desc, tc.ext, path))
+			partition := filepath.ToSlash(filepath.Dir(path))
+			require.Contains(t, tc.lines, partition, fmt.Sprintf("%s: unexpected partition %s", tc.desc, partition))
+			require.Len(t, lines, len(tc.lines[partition]), fmt.Sprintf("%s: unexpected lines %v", tc.desc, lines))
+			for i, line := range lines {
+				assert.JSONEq(t, tc.lines[partition][i], line, fmt.Sprintf("%s: unexpected line of %s", tc.desc, partition))
+			}
+		}
+
+		err = a.Save(msgs...)
+		assert.NotNil(t, err, fmt.Sprintf("%s: expected error archiving to closed archive", tc.desc))
+	}
+}
+
+func TestArchiveRotation(t *testing.T) {
+	msg := senml.Message{Channel: "1", Name: "temperature", Value: float(20)}
+
+	dir := newArchiveDir(t)
+	defer os.RemoveAll(dir)
+	a, err := writer.NewArchive(writer.ArchiveConfig{Dir: dir, MaxSize: 1}, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating archive: %s", err))
+	for i := 0; i < 3; i++ {
+		err := a.Save(msg)
+		require.Nil(t, err, fmt.Sprintf("unexpected error archiving records: %s", err))
+	}
+	assert.Len(t, archived(t, dir), 3, "expected file rotated above maximum size")
+	a.Close()
+
+	dir = newArchiveDir(t)
+	defer os.RemoveAll(dir)
+	a, err = writer.NewArchive(writer.ArchiveConfig{Dir: dir, MaxAge: time.Millisecond}, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating archive: %s", err))
+	defer a.Close()
+	err = a.Save(msg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error archiving records: %s", err))
+	assert.Eventually(t, func() bool { return len(archived(t, dir)) == 1 }, 3*time.Second, 100*time.Millisecond, "expected file rotated after maximum age")
+}
+
+func TestArchiveFailure(t *testing.T) {
+	msg := func(value float64) senml.Message {
+		return senml.Message{Channel: "1", Name: "temperature", Value: &value}
+	}
+	// NaN values can't be encoded in JSON.
+	invalid := msg(math.NaN())
+
+	dir := newArchiveDir(t)
+	defer os.RemoveAll(dir)
+	a, err := writer.NewArchive(writer.ArchiveConfig{Dir: dir}, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating archive: %s", err))
+
+	err = a.Save(invalid)
+	assert.NotNil(t, err, "expected error archiving invalid record")
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "1", "*"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error listing files: %s", err))
+	assert.Len(t, paths, 0, "expected file of failed batch removed")
+
+	err = a.Save(msg(20))
+	require.Nil(t, err, fmt.Sprintf("unexpected error archiving records: %s", err))
+	err = a.Save(msg(21), invalid)
+	assert.NotNil(t, err, "expected error archiving invalid record")
+	err = a.Save(msg(22))
+	require.Nil(t, err, fmt.Sprintf("unexpected error archiving records: %s", err))
+	a.Close()
+
+	paths, err = filepath.Glob(filepath.Join(dir, "*", "1", "*"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error listing files: %s", err))
+	require.Len(t, paths, 2, fmt.Sprintf("expected batch after failure written to new file: %v", paths))
+	sort.Strings(paths)
+
+	// The truncated file is readable up to its last flushed batch.
+	f, err := os.Open(paths[0])
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening file: %s", err))
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decompressing file: %s", err))
+	data, err := ioutil.ReadAll(gz)
+	assert.Equal(t, io.ErrUnexpectedEOF, err, fmt.Sprintf("expected truncated file, got %s", err))
+	assert.JSONEq(t, `{"channel":"1","name":"temperature","value":20}`, string(data), "expected records of failed batch discarded")
+
+	f, err = os.Open(paths[1])
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening file: %s", err))
+	defer f.Close()
+	lines := gunzip(t, f)
+	require.Len(t, lines, 1, fmt.Sprintf("unexpected lines %v", lines))
+	assert.JSONEq(t, `{"channel":"1","name":"temperature","value":22}`, lines[0], "expected record of batch after failure")
+}
+
+func TestArchiveRetention(t *testing.T) {
+	dir := newArchiveDir(t)
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "2020-01-01", "1", "20200101T000000Z-1.jsonl.gz")
+	recent := filepath.Join(dir, "2020-01-02", "1", "20200102T000000Z-1.jsonl.gz")
+	partial := filepath.Join(dir, "2020-01-02", "1", "20200102T000000Z-2.jsonl.gz")
+	for _, path := range []string{old, recent, partial + ".part"} {
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755), "unexpected error creating partition")
+		require.Nil(t, ioutil.WriteFile(path, nil, 0644), "unexpected error creating file")
+	}
+	require.Nil(t, os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)), "unexpected error aging file")
+
+	a, err := writer.NewArchive(writer.ArchiveConfig{Dir: dir, Retention: time.Hour}, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating archive: %s", err))
+	a.Close()
+
+	cases := []struct {
+		desc   string
+		path   string
+		exists bool
+	}{
+		{desc: "remove file older than retention", path: old, exists: false},
+		{desc: "remove empty partition", path: filepath.Dir(filepath.Dir(old)), exists: false},
+		{desc: "keep file within retention", path: recent, exists: true},
+		{desc: "recover file being written", path: partial, exists: true},
+	}
+
+	for _, tc := range cases {
+		_, err := os.Stat(tc.path)
+		assert.Equal(t, tc.exists, err == nil, fmt.Sprintf("%s: unexpected state of %s: %v", tc.desc, tc.path, err))
+	}
+}
+
+func TestArchiveS3(t *testing.T) {
+	store := &objectStoreMock{objects: make(map[string][]byte), fail: true}
+	ts := httptest.NewServer(store)
+	defer ts.Close()
+
+	dir := newArchiveDir(t)
+	defer os.RemoveAll(dir)
+	cfg := writer.ArchiveConfig{
+		Dir:    dir,
+		Format: writer.ArchiveJSONL,
+		S3: writer.S3Config{
+			URL:       ts.URL,
+			Region:    "eu-west-1",
+			Bucket:    "audit",
+			AccessKey: "access",
+			SecretKey: "secret",
+			Prefix:    "forwarder-1/",
+		},
+	}
+	msg := senml.Message{Channel: "1", Name: "temperature", Value: float(20)}
+
+	a, err := writer.NewArchive(cfg, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating archive: %s", err))
+	err = a.Save(msg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error archiving records: %s", err))
+	a.Close()
+	files := archived(t, dir)
+	assert.Len(t, files, 1, "expected file kept when upload fails")
+	assert.Len(t, store.objects, 0, "unexpected uploaded object")
+
+	store.fail = false
+	a, err = writer.NewArchive(cfg, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating archive: %s", err))
+	err = a.Save(msg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error archiving records: %s", err))
+	a.Close()
+	assert.Len(t, archived(t, dir), 0, "expected uploaded files removed")
+
+	var keys []string
+	for path := range files {
+		keys = append(keys, "/audit/forwarder-1/"+path)
+	}
+	var objects []string
+	for key, data := range store.objects {
+		objects = append(objects, key)
+		lines := gunzip(t, strings.NewReader(string(data)))
+		require.Len(t, lines, 1, fmt.Sprintf("unexpected lines of %s", key))
+		var record map[string]interface{}
+		err := json.Unmarshal([]byte(lines[0]), &record)
+		require.Nil(t, err, fmt.Sprintf("unexpected error decoding record: %s", err))
+		assert.Equal(t, "temperature", record["name"], "unexpected record")
+	}
+	sort.Strings(objects)
+	assert.Len(t, objects, 2, fmt.Sprintf("unexpected objects %v", objects))
+	assert.Contains(t, objects, keys[0], "expected file kept on failure uploaded")
+}
+
+func TestArchiveTee(t *testing.T) {
+	msg := senml.Message{Channel: "1", Name: "temperature", Value: float(20)}
+
+	cases := []struct {
+		desc     string
+		err      error
+		archived int
+	}{
+		{
+			desc:     "archive forwarded records",
+			archived: 1,
+		},
+		{
+			desc:     "don't archive records which are not forwarded",
+			err:      errors.New("remote unavailable"),
+			archived: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		archive := &recorderMock{}
+		tee := writer.NewArchiveTee(repoMock{err: tc.err}, archive, testLog)
+		err := tee.Save(msg)
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		assert.Len(t, archive.msgs, tc.archived, fmt.Sprintf("%s: unexpected archived records", tc.desc))
+	}
+
+	tee := writer.NewArchiveTee(repoMock{}, repoMock{err: errors.New("disk full")}, testLog)
+	err := tee.Save(msg)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error forwarding records which can't be archived: %v", err))
+}
@@ -0,0 +1,210 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+)
+
+// ErrCircuitOpen indicates that the circuit breaker of the target is open
+// and that requests are rejected without being sent.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// State represents the state of a circuit breaker.
+type State int
+
+const (
+	// StateClosed lets every request through.
+	StateClosed State = iota
+	// StateOpen rejects every request until the cool-down elapses.
+	StateOpen
+	// StateHalfOpen lets a limited number of probe requests through.
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig contains the circuit breaker settings.
+type BreakerConfig struct {
+	// FailureRatio is the ratio of failed requests which opens the circuit,
+	// greater than 0 and at most 1.
+	FailureRatio float64
+	// MinRequests is the number of requests over which the failure ratio
+	// is evaluated while the circuit is closed.
+	MinRequests uint
+	// CoolDown is the time the circuit stays open before probing the target.
+	CoolDown time.Duration
+	// Probes is the number of successful probe requests needed to close
+	// a half-open circuit.
+	Probes uint
+}
+
+// StateChangeFunc is called on every state transition of a target circuit.
+type StateChangeFunc func(target string, from, to State)
+
+// CircuitBreaker guards outbound requests, keyed by target.
+type CircuitBreaker interface {
+	// Allow returns ErrCircuitOpen if a request to the target must not be sent.
+	Allow(target string) error
+
+	// Report records the outcome of a request allowed for the target.
+	Report(target string, success bool)
+
+	// State returns the current circuit state of the target.
+	State(target string) State
+}
+
+var _ CircuitBreaker = (*circuitBreaker)(nil)
+
+type circuitBreaker struct {
+	cfg      BreakerConfig
+	onChange StateChangeFunc
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state     State
+	requests  uint
+	failures  uint
+	probes    uint
+	successes uint
+	openedAt  time.Time
+}
+
+// NewCircuitBreaker returns circuit breaker which keeps a separate circuit
+// for each target. The onChange function may be nil.
+func NewCircuitBreaker(cfg BreakerConfig, onChange StateChangeFunc) CircuitBreaker {
+	if cfg.MinRequests == 0 {
+		cfg.MinRequests = 1
+	}
+	if cfg.Probes == 0 {
+		cfg.Probes = 1
+	}
+
+	return &circuitBreaker{
+		cfg:      cfg,
+		onChange: onChange,
+		circuits: make(map[string]*circuit),
+	}
+}
+
+func (cb *circuitBreaker) Allow(target string) error {
+	cb.mu.Lock()
+	c := cb.circuit(target)
+	from := c.state
+
+	if c.state == StateOpen {
+		if time.Since(c.openedAt) < cb.cfg.CoolDown {
+			cb.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		c.toHalfOpen()
+	}
+
+	if c.state == StateHalfOpen {
+		if c.probes >= cb.cfg.Probes {
+			cb.mu.Unlock()
+			cb.notify(target, from, c.state)
+			return ErrCircuitOpen
+		}
+		c.probes++
+	}
+	to := c.state
+	cb.mu.Unlock()
+
+	cb.notify(target, from, to)
+	return nil
+}
+
+func (cb *circuitBreaker) Report(target string, success bool) {
+	cb.mu.Lock()
+	c := cb.circuit(target)
+	from := c.state
+
+	switch c.state {
+	case StateClosed:
+		c.requests++
+		if !success {
+			c.failures++
+		}
+		// The failure ratio is evaluated over tumbling windows of MinRequests.
+		if c.requests >= cb.cfg.MinRequests {
+			if float64(c.failures)/float64(c.requests) >= cb.cfg.FailureRatio {
+				c.toOpen()
+				break
+			}
+			c.requests, c.failures = 0, 0
+		}
+	case StateHalfOpen:
+		if !success {
+			c.toOpen()
+			break
+		}
+		c.successes++
+		if c.successes >= cb.cfg.Probes {
+			c.toClosed()
+		}
+	}
+	to := c.state
+	cb.mu.Unlock()
+
+	cb.notify(target, from, to)
+}
+
+func (cb *circuitBreaker) State(target string) State {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c, ok := cb.circuits[target]
+	if !ok {
+		return StateClosed
+	}
+	if c.state == StateOpen && time.Since(c.openedAt) >= cb.cfg.CoolDown {
+		return StateHalfOpen
+	}
+	return c.state
+}
+
+// circuit returns the circuit of the target. It must be called with the lock held.
+func (cb *circuitBreaker) circuit(target string) *circuit {
+	c, ok := cb.circuits[target]
+	if !ok {
+		c = &circuit{state: StateClosed}
+		cb.circuits[target] = c
+	}
+	return c
+}
+
+func (cb *circuitBreaker) notify(target string, from, to State) {
+	if from != to && cb.onChange != nil {
+		cb.onChange(target, from, to)
+	}
+}
+
+func (c *circuit) toOpen() {
+	*c = circuit{state: StateOpen, openedAt: time.Now()}
+}
+
+func (c *circuit) toHalfOpen() {
+	*c = circuit{state: StateHalfOpen}
+}
+
+func (c *circuit) toClosed() {
+	*c = circuit{state: StateClosed}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/stretchr/testify/assert"
+)
+
+const breakerTarget = "http://localhost:9000"
+
+func TestCircuitBreaker(t *testing.T) {
+	coolDown := 20 * time.Millisecond
+	var transitions []string
+	cb := writer.NewCircuitBreaker(writer.BreakerConfig{
+		FailureRatio: 0.5,
+		MinRequests:  4,
+		CoolDown:     coolDown,
+		Probes:       2,
+	}, func(target string, from, to writer.State) {
+		transitions = append(transitions, fmt.Sprintf("%s>%s", from, to))
+	})
+
+	cases := []struct {
+		desc    string
+		wait    time.Duration
+		success bool
+		allowed bool
+		state   writer.State
+	}{
+		{desc: "successful request keeps circuit closed", success: true, allowed: true, state: writer.StateClosed},
+		{desc: "failed request below window keeps circuit closed", success: false, allowed: true, state: writer.StateClosed},
+		{desc: "successful request keeps circuit closed", success: true, allowed: true, state: writer.StateClosed},
+		{desc: "failure ratio reached opens circuit", success: false, allowed: true, state: writer.StateOpen},
+		{desc: "open circuit rejects request", allowed: false, state: writer.StateOpen},
+		{desc: "first probe after cool-down is allowed", wait: coolDown, success: true, allowed: true, state: writer.StateHalfOpen},
+		{desc: "failed probe opens circuit again", success: false, allowed: true, state: writer.StateOpen},
+		{desc: "first probe after second cool-down is allowed", wait: coolDown, success: true, allowed: true, state: writer.StateHalfOpen},
+		{desc: "second successful probe closes circuit", success: true, allowed: true, state: writer.StateClosed},
+	}
+
+	for _, tc := range cases {
+		time.Sleep(tc.wait)
+		err := cb.Allow(breakerTarget)
+		if !tc.allowed {
+			assert.Equal(t, writer.ErrCircuitOpen, err, fmt.Sprintf("%s: expected %s got %s\n", tc.desc, writer.ErrCircuitOpen, err))
+			assert.Equal(t, tc.state, cb.State(breakerTarget), fmt.Sprintf("%s: unexpected state\n", tc.desc))
+			continue
+		}
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s\n", tc.desc, err))
+		cb.Report(breakerTarget, tc.success)
+		assert.Equal(t, tc.state, cb.State(breakerTarget), fmt.Sprintf("%s: unexpected state\n", tc.desc))
+	}
+
+	expected := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	assert.Equal(t, expected, transitions, "unexpected state transitions")
+	assert.Equal(t, writer.StateClosed, cb.State("http://other:9000"), "targets must have separate circuits")
+}
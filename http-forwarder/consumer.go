@@ -0,0 +1,202 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/messaging"
+	"github.com/mainflux/mainflux/messaging/nats"
+	"github.com/mainflux/mainflux/transformers"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+var (
+	// ErrUnprocessable indicates that the message can't be forwarded, whatever
+	// the number of attempts, because it is malformed or rejected by the
+	// remote target.
+	ErrUnprocessable = errors.New("unprocessable message")
+
+	errOpenConfFile      = errors.New("unable to open configuration file")
+	errParseConfFile     = errors.New("unable to parse configuration file")
+	errMessageConversion = errors.New("error conversing transformed messages")
+)
+
+type consumer struct {
+	repo        Repository
+	transformer transformers.Transformer
+	metrics     Metrics
+	tracer      tracing.Tracer
+	logger      logger.Logger
+}
+
+// Start method starts consuming messages received from NATS.
+// This method transforms messages to SenML format before
+// using Repository to forward them. The sinks are the names of the sinks
+// configured in the repository, routes selecting other sinks are rejected.
+// The returned Routes manage
+// the subscriptions loaded from the subjects configuration file,
+// whose remote table overrides the settings of the remote target
+// and whose routes table sets the processing of the records.
+func Start(sub messaging.Subscriber, repo Repository, sinks []string, remote *Remote, transformer transformers.Transformer, subjectsCfgPath string, metrics Metrics, tracer tracing.Tracer, logger logger.Logger) (Routes, error) {
+	c := consumer{
+		repo:        repo,
+		transformer: transformer,
+		metrics:     metrics,
+		tracer:      tracer,
+		logger:      logger,
+	}
+
+	configured := make(map[string]bool, len(sinks))
+	for _, sink := range sinks {
+		configured[sink] = true
+	}
+
+	rs := &routes{
+		sub:       sub,
+		handler:   c.handler,
+		emit:      c.emit,
+		sinks:     configured,
+		path:      subjectsCfgPath,
+		remote:    remote,
+		defRemote: remote.Config(),
+		logger:    logger,
+	}
+
+	var pipelines map[string]*pipeline
+	cfg, err := loadSubjectsConfig(subjectsCfgPath)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err == nil {
+		pipelines, err = cfg.pipelines(rs.env())
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Failed to load subjects: %s", err))
+		cfg = subjectsConfig{Subjects: filterConfig{List: []string{nats.SubjectAllChannels}}}
+		pipelines = nil
+		// A missing file is created by the first change of the routes,
+		// an invalid one is left for the user to fix.
+		if _, statErr := os.Stat(subjectsCfgPath); !os.IsNotExist(statErr) {
+			rs.fallback = true
+		}
+	}
+
+	rs.routes = cfg.routes()
+	rs.configs = cfg.Routes
+	rs.setPipelines(pipelines)
+	if cfg.Remote != nil {
+		// The remote table has already been validated.
+		remote.Set(*cfg.Remote)
+		rs.fileRemote = cfg.Remote
+	}
+
+	if err := rs.subscribe(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (c *consumer) handler(p *pipeline, msg messaging.Message) (err error) {
+	ctx, span := c.tracer.Start(context.Background(), "consume", tracing.KindConsumer,
+		tracing.String("channel", msg.Channel),
+		tracing.String("subtopic", msg.Subtopic),
+		tracing.String("publisher", msg.Publisher),
+		tracing.String("protocol", msg.Protocol),
+	)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	msgs, err := c.transform(ctx, msg)
+	if err != nil {
+		c.metrics.TransformFailures.Add(1)
+		c.metrics.Dropped.With("reason", reasonTransform).Add(1)
+		return errors.Wrap(ErrUnprocessable, err)
+	}
+	span.SetAttributes(tracing.Int("records", len(msgs)))
+
+	n := len(msgs)
+	b, stats, err := p.run(msgs)
+	if err != nil {
+		c.metrics.Dropped.With("reason", reasonScript).Add(float64(n))
+		if errors.Contains(err, ErrScriptTimeout) {
+			return err
+		}
+		return errors.Wrap(ErrUnprocessable, err)
+	}
+	msgs = b.Records
+	if filtered := n - len(msgs) - stats.aggregated - stats.late - stats.suppressed; filtered > 0 {
+		c.metrics.Dropped.With("reason", reasonFilter).Add(float64(filtered))
+		span.SetAttributes(tracing.Int("filtered", filtered))
+	}
+	if stats.aggregated > 0 {
+		span.SetAttributes(tracing.Int("aggregated", stats.aggregated))
+	}
+	if stats.late > 0 {
+		c.metrics.Dropped.With("reason", reasonLate).Add(float64(stats.late))
+		span.SetAttributes(tracing.Int("late", stats.late))
+	}
+	if stats.suppressed > 0 {
+		c.metrics.Dropped.With("reason", reasonDeadband).Add(float64(stats.suppressed))
+		span.SetAttributes(tracing.Int("suppressed", stats.suppressed))
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	ctx = withCreated(p.context(ctx, b), msg.Created)
+
+	if err := c.repo.SaveContext(ctx, msgs...); err != nil {
+		c.metrics.Dropped.With("reason", reasonSend).Add(float64(len(msgs)))
+		if errors.Contains(err, ErrRemoteRejected) {
+			return errors.Wrap(ErrUnprocessable, err)
+		}
+		return err
+	}
+	p.commit(stats)
+	return nil
+}
+
+// emit forwards the records emitted by the aggregators of the routes. They
+// are dropped only if rejected, otherwise the aggregators emit them again.
+func (c *consumer) emit(ctx context.Context, msgs []senml.Message) (err error) {
+	ctx, span := c.tracer.Start(ctx, "aggregate", tracing.KindInternal, tracing.Int("records", len(msgs)))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	if err := c.repo.SaveContext(ctx, msgs...); err != nil {
+		if errors.Contains(err, ErrRemoteRejected) {
+			c.metrics.Dropped.With("reason", reasonSend).Add(float64(len(msgs)))
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *consumer) transform(ctx context.Context, msg messaging.Message) ([]senml.Message, error) {
+	_, span := c.tracer.Start(ctx, "transform", tracing.KindInternal)
+	defer span.End()
+
+	t, err := c.transformer.Transform(msg)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	msgs, ok := t.([]senml.Message)
+	if !ok {
+		span.SetError(errMessageConversion)
+		return nil, errMessageConversion
+	}
+	span.SetAttributes(tracing.Int("records", len(msgs)))
+
+	return msgs, nil
+}
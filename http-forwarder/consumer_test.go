@@ -0,0 +1,447 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/messaging"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errRepo = errors.New("repository failure")
+
+	// httpSink configures only the default sink.
+	httpSink = []string{writer.SinkHTTP}
+)
+
+type subscriberMock struct {
+	handlers map[string]messaging.MessageHandler
+}
+
+func (sm *subscriberMock) Subscribe(topic string, handler messaging.MessageHandler) error {
+	sm.handlers[topic] = handler
+	return nil
+}
+
+func (sm *subscriberMock) Unsubscribe(topic string) error {
+	delete(sm.handlers, topic)
+	return nil
+}
+
+type counterMock struct {
+	value *float64
+}
+
+func (cm counterMock) With(labelValues ...string) metrics.Counter {
+	return cm
+}
+
+func (cm counterMock) Add(delta float64) {
+	*cm.value += delta
+}
+
+type histogramMock struct {
+	count *int
+}
+
+func (hm histogramMock) With(labelValues ...string) metrics.Histogram {
+	return hm
+}
+
+func (hm histogramMock) Observe(value float64) {
+	*hm.count++
+}
+
+type repoMock struct {
+	err error
+}
+
+func (rm repoMock) Save(messages ...senml.Message) error {
+	return rm.err
+}
+
+func (rm repoMock) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	return rm.err
+}
+
+// recorderMock records the forwarded messages, and the delivery of each call.
+type recorderMock struct {
+	mu         sync.Mutex
+	msgs       []senml.Message
+	deliveries []string
+}
+
+func (rm *recorderMock) Save(messages ...senml.Message) error {
+	return rm.SaveContext(context.Background(), messages...)
+}
+
+func (rm *recorderMock) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.msgs = append(rm.msgs, messages...)
+	rm.deliveries = append(rm.deliveries, writer.DeliveryFromContext(ctx))
+	return nil
+}
+
+func (rm *recorderMock) count() int {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return len(rm.msgs)
+}
+
+func TestConsumerMetrics(t *testing.T) {
+	cases := []struct {
+		desc      string
+		payload   string
+		repoErr   error
+		err       error
+		failures  float64
+		dropped   float64
+		latencies int
+	}{
+		{
+			desc:      "forward valid message",
+			payload:   `[{"n":"temperature","v":21.5},{"n":"humidity","v":60}]`,
+			latencies: 1,
+		},
+		{
+			desc:     "forward invalid message",
+			payload:  `{"n":`,
+			err:      writer.ErrUnprocessable,
+			failures: 1,
+			dropped:  1,
+		},
+		{
+			desc:    "forward message rejected by repository",
+			payload: `[{"n":"temperature","v":21.5},{"n":"humidity","v":60}]`,
+			repoErr: errRepo,
+			err:     errRepo,
+			dropped: 2,
+		},
+		{
+			desc:    "forward message rejected by remote target",
+			payload: `[{"n":"temperature","v":21.5},{"n":"humidity","v":60}]`,
+			repoErr: errors.Wrap(writer.ErrRemoteRejected, errors.New("400 Bad Request")),
+			err:     writer.ErrUnprocessable,
+			dropped: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		var failures, dropped float64
+		var latencies int
+		m := writer.Metrics{
+			Requests:          discard.NewCounter(),
+			Records:           discard.NewCounter(),
+			Bytes:             discard.NewCounter(),
+			BatchSize:         discard.NewHistogram(),
+			TransformFailures: counterMock{value: &failures},
+			Dropped:           counterMock{value: &dropped},
+			Latency:           histogramMock{count: &latencies},
+			DedupHits:         discard.NewCounter(),
+		}
+
+		sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+		repo := writer.NewSinks(map[string]writer.Repository{writer.SinkHTTP: repoMock{err: tc.repoErr}}, m)
+		_, err := writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), "", m, tracing.NewNop(), testLog)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error starting consumer: %s", tc.desc, err))
+
+		handler, ok := sub.handlers["channels.>"]
+		assert.True(t, ok, fmt.Sprintf("%s: expected subscription to all channels", tc.desc))
+
+		err = handler(messaging.Message{
+			Channel:   "45",
+			Publisher: "2580",
+			Protocol:  "http",
+			Payload:   []byte(tc.payload),
+			Created:   time.Now().UnixNano(),
+		})
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		assert.Equal(t, tc.failures, failures, fmt.Sprintf("%s: unexpected transform failures", tc.desc))
+		assert.Equal(t, tc.dropped, dropped, fmt.Sprintf("%s: unexpected dropped records", tc.desc))
+		assert.Equal(t, tc.latencies, latencies, fmt.Sprintf("%s: unexpected latency observations", tc.desc))
+	}
+}
+
+const filtersCfg = `[subjects]
+filter = ["channels.1", "channels.2"]
+
+[[routes."channels.1".include]]
+name = "*temperature"
+min = 30.0
+
+[[routes."channels.1".exclude]]
+protocol = "coap"
+`
+
+func TestConsumerFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(filtersCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	cases := []struct {
+		desc     string
+		subject  string
+		protocol string
+		payload  string
+		names    []string
+		dropped  float64
+	}{
+		{
+			desc:     "forward records matching the rules",
+			subject:  "channels.1",
+			protocol: "mqtt",
+			payload:  `[{"n":"room:temperature","v":35},{"n":"room:temperature","v":21},{"n":"room:humidity","v":60}]`,
+			names:    []string{"room:temperature"},
+			dropped:  2,
+		},
+		{
+			desc:     "forward no record of excluded protocol",
+			subject:  "channels.1",
+			protocol: "coap",
+			payload:  `[{"n":"room:temperature","v":35}]`,
+			dropped:  1,
+		},
+		{
+			desc:     "forward every record of route without rules",
+			subject:  "channels.2",
+			protocol: "coap",
+			payload:  `[{"n":"room:temperature","v":21},{"n":"room:humidity","v":60}]`,
+			names:    []string{"room:temperature", "room:humidity"},
+		},
+	}
+
+	for _, tc := range cases {
+		var dropped float64
+		m := nopMetrics
+		m.Dropped = counterMock{value: &dropped}
+		repo := &recorderMock{}
+		sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+		_, err := writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), path, m, tracing.NewNop(), testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error starting consumer: %s", tc.desc, err))
+
+		err = sub.handlers[tc.subject](messaging.Message{Channel: "1", Publisher: "2580", Protocol: tc.protocol, Payload: []byte(tc.payload)})
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+
+		var names []string
+		for _, msg := range repo.msgs {
+			names = append(names, msg.Name)
+		}
+		assert.Equal(t, tc.names, names, fmt.Sprintf("%s: unexpected forwarded records", tc.desc))
+		assert.Equal(t, tc.dropped, dropped, fmt.Sprintf("%s: unexpected dropped records", tc.desc))
+	}
+}
+
+const processorsCfg = `[subjects]
+filter = ["channels.1"]
+
+[[routes."channels.1".exclude]]
+name = "battery"
+
+[[routes."channels.1".processors]]
+type = "rename"
+pattern = "^dev1:"
+replacement = "room:"
+
+[[routes."channels.1".processors]]
+type = "convert"
+from = "Cel"
+to = "degF"
+
+[[routes."channels.1".processors]]
+type = "enrich"
+
+[routes."channels.1".processors.tags]
+site = "lab"
+`
+
+// tagsRecorderMock records the tags of the forwarded messages.
+type tagsRecorderMock struct {
+	recorderMock
+	tags map[string]string
+}
+
+func (rm *tagsRecorderMock) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	rm.tags = writer.TagsFromContext(ctx)
+	return rm.recorderMock.SaveContext(ctx, messages...)
+}
+
+func TestConsumerProcessors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(processorsCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	repo := &tagsRecorderMock{}
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	_, err = writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	payload := `[{"n":"dev1:temperature","u":"Cel","v":100},{"n":"battery","v":80}]`
+	err = sub.handlers["channels.1"](messaging.Message{Channel: "1", Publisher: "2580", Protocol: "mqtt", Payload: []byte(payload)})
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+
+	require.Len(t, repo.msgs, 1, "expected filtered records")
+	assert.Equal(t, "room:temperature", repo.msgs[0].Name, "expected renamed record")
+	assert.Equal(t, "degF", repo.msgs[0].Unit, "expected converted unit")
+	assert.InDelta(t, 212, *repo.msgs[0].Value, 1e-9, "expected converted value")
+	assert.Equal(t, map[string]string{"site": "lab"}, repo.tags, "expected tags of forwarded records")
+}
+
+const aggregateCfg = `[subjects]
+filter = ["channels.1"]
+
+[[routes."channels.1".processors]]
+type = "enrich"
+
+[routes."channels.1".processors.tags]
+site = "lab"
+
+[routes."channels.1".aggregate]
+window = "1h"
+functions = ["max"]
+name = "temperature"
+`
+
+func TestConsumerAggregate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(aggregateCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	repo := &tagsRecorderMock{}
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	for _, payload := range []string{
+		`[{"n":"temperature","u":"Cel","v":20},{"n":"battery","v":80}]`,
+		`[{"n":"temperature","u":"Cel","v":22}]`,
+	} {
+		err = sub.handlers["channels.1"](messaging.Message{Channel: "1", Publisher: "2580", Protocol: "mqtt", Payload: []byte(payload)})
+		assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	}
+	require.Len(t, repo.msgs, 1, "expected records which are not aggregated")
+	assert.Equal(t, "battery", repo.msgs[0].Name, "expected record which is not aggregated")
+
+	err = routes.Flush(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	require.Len(t, repo.msgs, 2, "expected aggregate of open window")
+	assert.Equal(t, "temperature_max", repo.msgs[1].Name, "expected aggregate name")
+	assert.Equal(t, 22.0, *repo.msgs[1].Value, "expected aggregate value")
+	assert.Equal(t, "2580", repo.msgs[1].Publisher, "expected aggregate publisher")
+	assert.Equal(t, map[string]string{"site": "lab"}, repo.tags, "expected tags of aggregates")
+}
+
+const deadbandCfg = `[subjects]
+filter = ["channels.1"]
+
+[routes."channels.1".deadband]
+absolute = 0.5
+state = "deadband.json"
+`
+
+func TestConsumerDeadband(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(deadbandCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	repo := &recorderMock{}
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	for _, payload := range []string{
+		`[{"n":"temperature","v":20},{"n":"status","vs":"on"}]`,
+		`[{"n":"temperature","v":20.2},{"n":"status","vs":"on"}]`,
+		`[{"n":"temperature","v":21},{"n":"status","vs":"off"}]`,
+	} {
+		err = sub.handlers["channels.1"](messaging.Message{Channel: "1", Publisher: "2580", Payload: []byte(payload)})
+		assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	}
+	require.Len(t, repo.msgs, 4, "expected changed records")
+	assert.Equal(t, 21.0, *repo.msgs[2].Value, "expected value out of deadband")
+
+	err = routes.Flush(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	_, err = os.Stat(filepath.Join(dir, "deadband.json"))
+	assert.Nil(t, err, fmt.Sprintf("expected deadband state saved: %v", err))
+}
+
+func TestConsumerDeadbandFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(deadbandCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	repo := &flakyMock{err: writer.ErrCircuitOpen}
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	_, err = writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	msg := messaging.Message{Channel: "1", Publisher: "2580", Payload: []byte(`[{"n":"temperature","v":20}]`)}
+	err = sub.handlers["channels.1"](msg)
+	assert.True(t, errors.Contains(err, writer.ErrCircuitOpen), fmt.Sprintf("expected %v got %v", writer.ErrCircuitOpen, err))
+
+	repo.fail(nil)
+	err = sub.handlers["channels.1"](msg)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	assert.Equal(t, []string{"temperature"}, repo.names(), "expected redelivered record not suppressed")
+}
+
+func TestConsumerLatencyRetry(t *testing.T) {
+	var latencies int
+	m := nopMetrics
+	m.Latency = histogramMock{count: &latencies}
+
+	flaky := &flakyMock{err: writer.ErrCircuitOpen}
+	q, err := writer.NewRetryQueue(writer.NewSinks(map[string]writer.Repository{writer.SinkHTTP: flaky}, m), writer.RetryConfig{Size: 10, MinBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}, m, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating retry queue: %s", err))
+
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	_, err = writer.Start(sub, q, httpSink, newRemote(t, host), senml.New(senml.JSON), "", m, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	err = sub.handlers["channels.>"](messaging.Message{Channel: "45", Publisher: "2580", Payload: []byte(`[{"n":"temperature","v":21.5}]`), Created: time.Now().UnixNano()})
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	assert.Equal(t, 0, latencies, "latency of queued records must not be observed")
+
+	flaky.fail(nil)
+	assert.Eventually(t, func() bool { return len(flaky.names()) == 1 }, time.Second, 10*time.Millisecond, "queued records expected to be sent again")
+	q.Close(context.Background())
+	assert.Equal(t, 1, latencies, "latency of queued records expected to be observed once sent")
+}
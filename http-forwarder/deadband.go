@@ -0,0 +1,343 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+const defDeadbandMaxEntries = 100000
+
+// ErrInvalidDeadband indicates that the deadband settings are malformed.
+var ErrInvalidDeadband = errors.New("invalid deadband")
+
+// DeadbandConfig contains the settings of the report by exception of a
+// route.
+type DeadbandConfig struct {
+	// Absolute is the change of a numeric value, from the last forwarded
+	// one, within which records are not forwarded.
+	Absolute *float64 `toml:"absolute,omitempty"`
+
+	// Percent is the change of a numeric value, as a percentage of the last
+	// forwarded one, within which records are not forwarded.
+	Percent *float64 `toml:"percent,omitempty"`
+
+	// Heartbeat is the time after which a record is forwarded even if its
+	// value didn't change, never if not set.
+	Heartbeat Duration `toml:"heartbeat,omitempty"`
+
+	// Name is the glob pattern of the names of the records reported by
+	// exception, every record if empty.
+	Name string `toml:"name,omitempty"`
+
+	// MaxEntries is the number of series whose last forwarded value is
+	// kept, 100000 by default. The least recently received ones are
+	// forgotten beyond.
+	MaxEntries int `toml:"max_entries,omitempty"`
+
+	// State is the path of the file the last forwarded values are saved to
+	// and loaded from, relative to the directory of the configuration file.
+	// They are kept in memory only if not set.
+	State string `toml:"state,omitempty"`
+}
+
+// deadbandKey identifies the series of records reported by exception.
+type deadbandKey struct {
+	channel   string
+	publisher string
+	name      string
+}
+
+// deadbandEntry contains the last forwarded value of a series.
+type deadbandEntry struct {
+	Channel     string   `json:"channel"`
+	Publisher   string   `json:"publisher,omitempty"`
+	Name        string   `json:"name"`
+	Value       *float64 `json:"value,omitempty"`
+	StringValue *string  `json:"string_value,omitempty"`
+	DataValue   *string  `json:"data_value,omitempty"`
+	BoolValue   *bool    `json:"bool_value,omitempty"`
+	Forwarded   int64    `json:"forwarded"`
+}
+
+func (e *deadbandEntry) key() deadbandKey {
+	return deadbandKey{channel: e.Channel, publisher: e.Publisher, name: e.Name}
+}
+
+// Deadband forwards the records of a series, by channel, publisher and
+// name, only when their value changes. Numeric values change when they
+// leave the deadband around the last forwarded value, other values when
+// they differ from it. Records are also forwarded once the heartbeat
+// elapsed since the last forwarded one.
+type Deadband struct {
+	cfg       DeadbandConfig
+	absolute  float64
+	percent   float64
+	heartbeat time.Duration
+	logger    logger.Logger
+
+	mu      sync.Mutex
+	entries map[deadbandKey]*list.Element
+	// lru orders the entries from the most recently received.
+	lru *list.List
+}
+
+// NewDeadband returns deadband with the settings, or ErrInvalidDeadband if
+// they are malformed. The last forwarded values are loaded from the state
+// file if it exists.
+func NewDeadband(cfg DeadbandConfig, logger logger.Logger) (*Deadband, error) {
+	if cfg.Absolute != nil && *cfg.Absolute < 0 {
+		return nil, errors.Wrap(ErrInvalidDeadband, errors.New("absolute must not be negative"))
+	}
+	if cfg.Percent != nil && *cfg.Percent < 0 {
+		return nil, errors.Wrap(ErrInvalidDeadband, errors.New("percent must not be negative"))
+	}
+	if cfg.Heartbeat < 0 {
+		return nil, errors.Wrap(ErrInvalidDeadband, errors.New("heartbeat must not be negative"))
+	}
+	if cfg.Name != "" {
+		if _, err := path.Match(cfg.Name, ""); err != nil {
+			return nil, errors.Wrap(ErrInvalidDeadband, errors.New(cfg.Name))
+		}
+	}
+	if cfg.MaxEntries < 0 {
+		return nil, errors.Wrap(ErrInvalidDeadband, errors.New("max_entries must not be negative"))
+	}
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = defDeadbandMaxEntries
+	}
+
+	d := &Deadband{
+		cfg:       cfg,
+		heartbeat: time.Duration(cfg.Heartbeat),
+		logger:    logger,
+		entries:   make(map[deadbandKey]*list.Element),
+		lru:       list.New(),
+	}
+	if cfg.Absolute != nil {
+		d.absolute = *cfg.Absolute
+	}
+	if cfg.Percent != nil {
+		d.percent = *cfg.Percent
+	}
+
+	if err := d.load(); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to load deadband state %s: %s", cfg.State, err))
+	}
+	return d, nil
+}
+
+// Apply removes the records of the batch whose value didn't change. It
+// returns the number of removed records and the forwarded records reported
+// by exception, whose values are recorded by Commit once they are sent, so
+// that a batch which failed is not suppressed when it is sent again.
+func (d *Deadband) Apply(b *Batch) (int, []senml.Message) {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// pending contains the values of the records kept in the batch, so that
+	// the records of a series repeating a value of the batch are removed.
+	pending := make(map[deadbandKey]*deadbandEntry)
+	var forwarded []senml.Message
+	kept := b.Records[:0]
+	for _, msg := range b.Records {
+		if valueType(msg) == "" || !matchName(d.cfg.Name, msg.Name) {
+			kept = append(kept, msg)
+			continue
+		}
+		if !d.forward(pending, msg, now) {
+			continue
+		}
+		kept = append(kept, msg)
+		forwarded = append(forwarded, msg)
+	}
+	suppressed := len(b.Records) - len(kept)
+	b.Records = kept
+	return suppressed, forwarded
+}
+
+// Commit records the values of the records returned by Apply as the last
+// forwarded ones.
+func (d *Deadband) Commit(msgs []senml.Message) {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, msg := range msgs {
+		k := deadbandKey{channel: msg.Channel, publisher: msg.Publisher, name: msg.Name}
+		if el, ok := d.entries[k]; ok {
+			d.lru.MoveToFront(el)
+			d.set(el.Value.(*deadbandEntry), msg, now)
+			continue
+		}
+
+		e := &deadbandEntry{Channel: msg.Channel, Publisher: msg.Publisher, Name: msg.Name}
+		d.set(e, msg, now)
+		d.entries[k] = d.lru.PushFront(e)
+		if d.lru.Len() > d.cfg.MaxEntries {
+			last := d.lru.Back()
+			d.lru.Remove(last)
+			delete(d.entries, last.Value.(*deadbandEntry).key())
+		}
+	}
+}
+
+// forward reports whether the record is forwarded, comparing its value with
+// the pending one of its series or else with the last forwarded one, and
+// sets the pending value if it is. It must be called with the lock held.
+func (d *Deadband) forward(pending map[deadbandKey]*deadbandEntry, msg senml.Message, now time.Time) bool {
+	k := deadbandKey{channel: msg.Channel, publisher: msg.Publisher, name: msg.Name}
+	e, ok := pending[k]
+	if !ok {
+		if el, found := d.entries[k]; found {
+			d.lru.MoveToFront(el)
+			e, ok = el.Value.(*deadbandEntry), true
+		}
+	}
+	if ok && !d.changed(e, msg) && (d.heartbeat == 0 || now.Sub(time.Unix(0, e.Forwarded)) < d.heartbeat) {
+		return false
+	}
+
+	next := &deadbandEntry{Channel: msg.Channel, Publisher: msg.Publisher, Name: msg.Name}
+	d.set(next, msg, now)
+	pending[k] = next
+	return true
+}
+
+// changed reports whether the value of the record changed from the last
+// forwarded one.
+func (d *Deadband) changed(e *deadbandEntry, msg senml.Message) bool {
+	switch {
+	case msg.Value != nil:
+		if e.Value == nil {
+			return true
+		}
+		diff := math.Abs(*msg.Value - *e.Value)
+		if d.absolute == 0 && d.percent == 0 {
+			return diff != 0
+		}
+		return diff > d.absolute && diff > d.percent/100*math.Abs(*e.Value)
+	case msg.StringValue != nil:
+		return e.StringValue == nil || *msg.StringValue != *e.StringValue
+	case msg.DataValue != nil:
+		return e.DataValue == nil || *msg.DataValue != *e.DataValue
+	case msg.BoolValue != nil:
+		return e.BoolValue == nil || *msg.BoolValue != *e.BoolValue
+	case msg.Sum != nil:
+		// Records holding only a sum are compared as numeric values.
+		return d.changed(e, senml.Message{Value: msg.Sum})
+	}
+	return true
+}
+
+func (d *Deadband) set(e *deadbandEntry, msg senml.Message, now time.Time) {
+	e.Value, e.StringValue, e.DataValue, e.BoolValue = nil, nil, nil, nil
+	switch {
+	case msg.Value != nil:
+		v := *msg.Value
+		e.Value = &v
+	case msg.StringValue != nil:
+		s := *msg.StringValue
+		e.StringValue = &s
+	case msg.DataValue != nil:
+		s := *msg.DataValue
+		e.DataValue = &s
+	case msg.BoolValue != nil:
+		b := *msg.BoolValue
+		e.BoolValue = &b
+	case msg.Sum != nil:
+		v := *msg.Sum
+		e.Value = &v
+	}
+	e.Forwarded = now.UnixNano()
+}
+
+// Save writes the last forwarded values to the state file, if set.
+func (d *Deadband) Save() error {
+	if d.cfg.State == "" {
+		return nil
+	}
+
+	d.mu.Lock()
+	entries := make([]deadbandEntry, 0, d.lru.Len())
+	for el := d.lru.Front(); el != nil; el = el.Next() {
+		entries = append(entries, *el.Value.(*deadbandEntry))
+	}
+	d.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFile(d.cfg.State, data)
+}
+
+// load reads the last forwarded values from the state file, if it exists.
+func (d *Deadband) load() error {
+	if d.cfg.State == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(d.cfg.State)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []deadbandEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for i := range entries {
+		if d.lru.Len() == d.cfg.MaxEntries {
+			break
+		}
+		e := &entries[i]
+		if _, ok := d.entries[e.key()]; ok {
+			continue
+		}
+		d.entries[e.key()] = d.lru.PushBack(e)
+	}
+	return nil
+}
+
+// writeFile atomically replaces the file by writing a temporary file in the
+// same directory and renaming it.
+func writeFile(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,210 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDeadband(t *testing.T, cfg writer.DeadbandConfig) *writer.Deadband {
+	d, err := writer.NewDeadband(cfg, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating deadband: %s", err))
+	return d
+}
+
+// forwarded returns whether each record is forwarded when applied one by one.
+func forwarded(d *writer.Deadband, msgs ...senml.Message) []bool {
+	var res []bool
+	for _, msg := range msgs {
+		b := writer.Batch{Records: []senml.Message{msg}}
+		suppressed, reported := d.Apply(&b)
+		d.Commit(reported)
+		res = append(res, suppressed == 0)
+	}
+	return res
+}
+
+func TestNewDeadband(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  writer.DeadbandConfig
+		err  error
+	}{
+		{
+			desc: "create deadband with defaults",
+			cfg:  writer.DeadbandConfig{},
+			err:  nil,
+		},
+		{
+			desc: "create deadband with every setting",
+			cfg:  writer.DeadbandConfig{Absolute: float(0.5), Percent: float(5), Heartbeat: writer.Duration(time.Minute), Name: "temp*", MaxEntries: 10},
+			err:  nil,
+		},
+		{
+			desc: "create deadband with negative absolute",
+			cfg:  writer.DeadbandConfig{Absolute: float(-1)},
+			err:  writer.ErrInvalidDeadband,
+		},
+		{
+			desc: "create deadband with negative percent",
+			cfg:  writer.DeadbandConfig{Percent: float(-1)},
+			err:  writer.ErrInvalidDeadband,
+		},
+		{
+			desc: "create deadband with negative heartbeat",
+			cfg:  writer.DeadbandConfig{Heartbeat: writer.Duration(-time.Second)},
+			err:  writer.ErrInvalidDeadband,
+		},
+		{
+			desc: "create deadband with malformed name",
+			cfg:  writer.DeadbandConfig{Name: "["},
+			err:  writer.ErrInvalidDeadband,
+		},
+		{
+			desc: "create deadband with negative max entries",
+			cfg:  writer.DeadbandConfig{MaxEntries: -1},
+			err:  writer.ErrInvalidDeadband,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := writer.NewDeadband(tc.cfg, testLog)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+	}
+}
+
+func TestDeadband(t *testing.T) {
+	num := func(v float64) senml.Message {
+		return senml.Message{Channel: "1", Publisher: "2580", Name: "temperature", Value: float(v)}
+	}
+	str := func(v string) senml.Message {
+		return senml.Message{Channel: "1", Publisher: "2580", Name: "status", StringValue: &v}
+	}
+	boolean := func(v bool) senml.Message {
+		return senml.Message{Channel: "1", Publisher: "2580", Name: "open", BoolValue: &v}
+	}
+
+	cases := []struct {
+		desc     string
+		cfg      writer.DeadbandConfig
+		msgs     []senml.Message
+		expected []bool
+	}{
+		{
+			desc:     "forward changed numeric values",
+			cfg:      writer.DeadbandConfig{},
+			msgs:     []senml.Message{num(20), num(20), num(20.1), num(20.1)},
+			expected: []bool{true, false, true, false},
+		},
+		{
+			desc:     "forward numeric values out of absolute deadband",
+			cfg:      writer.DeadbandConfig{Absolute: float(0.5)},
+			msgs:     []senml.Message{num(20), num(20.4), num(19.6), num(20.6), num(21)},
+			expected: []bool{true, false, false, true, false},
+		},
+		{
+			desc:     "forward numeric values out of percent deadband",
+			cfg:      writer.DeadbandConfig{Percent: float(10)},
+			msgs:     []senml.Message{num(100), num(109), num(91), num(111), num(120)},
+			expected: []bool{true, false, false, true, false},
+		},
+		{
+			desc:     "forward numeric values out of both deadbands",
+			cfg:      writer.DeadbandConfig{Absolute: float(5), Percent: float(10)},
+			msgs:     []senml.Message{num(10), num(14), num(16), num(200), num(215), num(225)},
+			expected: []bool{true, false, true, true, false, true},
+		},
+		{
+			desc:     "forward changed string values",
+			cfg:      writer.DeadbandConfig{Absolute: float(100)},
+			msgs:     []senml.Message{str("on"), str("on"), str("off")},
+			expected: []bool{true, false, true},
+		},
+		{
+			desc:     "forward changed bool values",
+			cfg:      writer.DeadbandConfig{},
+			msgs:     []senml.Message{boolean(true), boolean(true), boolean(false)},
+			expected: []bool{true, false, true},
+		},
+		{
+			desc:     "forward records not matching name",
+			cfg:      writer.DeadbandConfig{Name: "hum*"},
+			msgs:     []senml.Message{num(20), num(20)},
+			expected: []bool{true, true},
+		},
+		{
+			desc:     "forward records of other series",
+			cfg:      writer.DeadbandConfig{},
+			msgs:     []senml.Message{num(20), {Channel: "1", Publisher: "2581", Name: "temperature", Value: float(20)}},
+			expected: []bool{true, true},
+		},
+		{
+			desc:     "forward values of series evicted from state",
+			cfg:      writer.DeadbandConfig{MaxEntries: 1},
+			msgs:     []senml.Message{num(20), str("on"), num(20)},
+			expected: []bool{true, true, true},
+		},
+	}
+
+	for _, tc := range cases {
+		d := newDeadband(t, tc.cfg)
+		assert.Equal(t, tc.expected, forwarded(d, tc.msgs...), fmt.Sprintf("%s: unexpected forwarded records", tc.desc))
+	}
+}
+
+func TestDeadbandHeartbeat(t *testing.T) {
+	d := newDeadband(t, writer.DeadbandConfig{Heartbeat: writer.Duration(50 * time.Millisecond)})
+	msg := senml.Message{Channel: "1", Name: "temperature", Value: float(20)}
+
+	assert.Equal(t, []bool{true, false}, forwarded(d, msg, msg), "expected unchanged value suppressed")
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, []bool{true, false}, forwarded(d, msg, msg), "expected unchanged value forwarded on heartbeat")
+}
+
+func TestDeadbandCommit(t *testing.T) {
+	d := newDeadband(t, writer.DeadbandConfig{})
+	msg := senml.Message{Channel: "1", Name: "temperature", Value: float(20)}
+
+	b := writer.Batch{Records: []senml.Message{msg, msg}}
+	suppressed, reported := d.Apply(&b)
+	assert.Equal(t, 1, suppressed, "expected value repeated within the batch suppressed")
+	assert.Len(t, reported, 1, "expected forwarded value reported")
+
+	// The batch failed: its values are not committed.
+	assert.Equal(t, []bool{true}, forwarded(d, msg), "expected value not committed forwarded again")
+	assert.Equal(t, []bool{false}, forwarded(d, msg), "expected committed value suppressed")
+}
+
+func TestDeadbandState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadband")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	cfg := writer.DeadbandConfig{State: filepath.Join(dir, "state.json")}
+	msg := senml.Message{Channel: "1", Name: "temperature", Value: float(20)}
+
+	d := newDeadband(t, cfg)
+	assert.Equal(t, []bool{true}, forwarded(d, msg), "expected first value forwarded")
+	err = d.Save()
+	assert.Nil(t, err, fmt.Sprintf("unexpected error saving state: %s", err))
+
+	d = newDeadband(t, cfg)
+	assert.Equal(t, []bool{false}, forwarded(d, msg), "expected unchanged value suppressed after restart")
+
+	err = ioutil.WriteFile(cfg.State, []byte("{"), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing state: %s", err))
+	d = newDeadband(t, cfg)
+	assert.Equal(t, []bool{true}, forwarded(d, msg), "expected malformed state ignored")
+}
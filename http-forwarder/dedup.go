@@ -0,0 +1,84 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header carrying the idempotency key of a batch,
+// letting the receiver discard batches it already accepted.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DedupCache remembers the idempotency keys of the batches accepted by the
+// remote target within a time window.
+type DedupCache interface {
+	// Seen reports whether the key has been added within the window.
+	Seen(key string) bool
+
+	// Add remembers the key for the window.
+	Add(key string)
+}
+
+var _ DedupCache = (*dedupCache)(nil)
+
+type dedupCache struct {
+	window time.Duration
+	mu     sync.Mutex
+	keys   map[string]time.Time
+	sweep  time.Time
+}
+
+// NewDedupCache returns cache remembering the keys for the window. Keys
+// are not remembered if the window isn't positive.
+func NewDedupCache(window time.Duration) DedupCache {
+	return &dedupCache{
+		window: window,
+		keys:   make(map[string]time.Time),
+	}
+}
+
+func (c *dedupCache) Seen(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiry, ok := c.keys[key]
+	return ok && time.Now().Before(expiry)
+}
+
+func (c *dedupCache) Add(key string) {
+	if c.window <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keys[key] = now.Add(c.window)
+	// Expired keys are removed once per window.
+	if now.After(c.sweep) {
+		for k, expiry := range c.keys {
+			if now.After(expiry) {
+				delete(c.keys, k)
+			}
+		}
+		c.sweep = now.Add(c.window)
+	}
+}
+
+// idempotencyKey returns the key identifying the batch: the SHA-256 of the
+// address and of the encoded records, whose field order is deterministic.
+func idempotencyKey(address Address, data []byte) string {
+	h := sha256.New()
+	for _, s := range []string{address.FullTopic, address.Published, address.Protocol} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
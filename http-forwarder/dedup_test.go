@@ -0,0 +1,48 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupCache(t *testing.T) {
+	cases := []struct {
+		desc   string
+		window time.Duration
+		wait   time.Duration
+		seen   bool
+	}{
+		{
+			desc:   "key added within the window",
+			window: time.Minute,
+			seen:   true,
+		},
+		{
+			desc:   "key expired after the window",
+			window: 10 * time.Millisecond,
+			wait:   20 * time.Millisecond,
+			seen:   false,
+		},
+		{
+			desc:   "key not remembered without window",
+			window: 0,
+			seen:   false,
+		},
+	}
+
+	for _, tc := range cases {
+		cache := writer.NewDedupCache(tc.window)
+		assert.False(t, cache.Seen("key"), fmt.Sprintf("%s: key not expected to be seen before it is added", tc.desc))
+		cache.Add("key")
+		time.Sleep(tc.wait)
+		assert.Equal(t, tc.seen, cache.Seen("key"), fmt.Sprintf("%s: unexpected seen key", tc.desc))
+		assert.False(t, cache.Seen("other"), fmt.Sprintf("%s: other key not expected to be seen", tc.desc))
+	}
+}
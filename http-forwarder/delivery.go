@@ -0,0 +1,208 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+// Granularities of the requests sent to the remote target.
+const (
+	// DeliveryAddress sends a request per address, with the SenML records
+	// of the address. It is the default.
+	DeliveryAddress = "address"
+
+	// DeliveryRecord sends a request per record, with a flat JSON object.
+	DeliveryRecord = "record"
+
+	// DeliveryBatch sends a single request with an envelope listing the
+	// records of every address, along with their address. The envelope is
+	// split in several requests above the maximum body size, as well as
+	// the records of an address which don't fit on their own.
+	DeliveryBatch = "batch"
+)
+
+// ErrInvalidDelivery indicates that the delivery granularity is unknown.
+var ErrInvalidDelivery = errors.New("invalid delivery")
+
+func validDelivery(delivery string) bool {
+	switch delivery {
+	case "", DeliveryAddress, DeliveryRecord, DeliveryBatch:
+		return true
+	}
+	return false
+}
+
+type deliveryKey struct{}
+
+// WithDelivery returns context carrying the granularity of the requests
+// sending the records forwarded within it.
+func WithDelivery(ctx context.Context, delivery string) context.Context {
+	if delivery == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, deliveryKey{}, delivery)
+}
+
+// DeliveryFromContext returns the delivery granularity carried by the
+// context, DeliveryAddress by default.
+func DeliveryFromContext(ctx context.Context) string {
+	if delivery, ok := ctx.Value(deliveryKey{}).(string); ok {
+		return delivery
+	}
+	return DeliveryAddress
+}
+
+// recordFields returns the flat JSON object of the record sent with the
+// DeliveryRecord granularity: its fields keyed by their JSON names and the
+// tags which don't collide with them.
+func recordFields(msg senml.Message, tags map[string]string) fields {
+	f := fields{"channel": msg.Channel, "name": msg.Name}
+	setString := func(key, v string) {
+		if v != "" {
+			f[key] = v
+		}
+	}
+	setString("subtopic", msg.Subtopic)
+	setString("publisher", msg.Publisher)
+	setString("protocol", msg.Protocol)
+	setString("unit", msg.Unit)
+	if msg.Time != 0 {
+		f["time"] = msg.Time
+	}
+	if msg.UpdateTime != 0 {
+		f["update_time"] = msg.UpdateTime
+	}
+	switch {
+	case msg.Value != nil:
+		f["value"] = *msg.Value
+	case msg.StringValue != nil:
+		f["string_value"] = *msg.StringValue
+	case msg.DataValue != nil:
+		f["data_value"] = *msg.DataValue
+	case msg.BoolValue != nil:
+		f["bool_value"] = *msg.BoolValue
+	}
+	if msg.Sum != nil {
+		f["sum"] = *msg.Sum
+	}
+	for label, value := range tags {
+		if _, ok := f[label]; !ok {
+			f[label] = value
+		}
+	}
+	return f
+}
+
+// addressBatch contains the SenML records of an address sent with the
+// DeliveryBatch granularity.
+type addressBatch struct {
+	Topic     string    `json:"topic"`
+	Channel   string    `json:"channel"`
+	Subtopic  string    `json:"subtopic,omitempty"`
+	Publisher string    `json:"publisher,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Records   []*fields `json:"records"`
+
+	// pack is the pack of the records, split when they don't fit in an
+	// envelope.
+	pack pack
+}
+
+// addressBatches returns the packs of the addresses, ordered by topic,
+// publisher and protocol. The packs of an address keep their order.
+func addressBatches(packs []pack) []addressBatch {
+	batches := make([]addressBatch, 0, len(packs))
+	for _, p := range packs {
+		a := p.address
+		batches = append(batches, addressBatch{
+			Topic:     a.FullTopic,
+			Channel:   a.Channel,
+			Subtopic:  a.Subtopic,
+			Publisher: a.Published,
+			Protocol:  a.Protocol,
+			Records:   p.records,
+			pack:      p,
+		})
+	}
+	sort.SliceStable(batches, func(i, j int) bool {
+		bi, bj := batches[i], batches[j]
+		if bi.Topic != bj.Topic {
+			return bi.Topic < bj.Topic
+		}
+		if bi.Publisher != bj.Publisher {
+			return bi.Publisher < bj.Publisher
+		}
+		return bi.Protocol < bj.Protocol
+	})
+	return batches
+}
+
+// splittable reports whether the records of the address batch can be split.
+func (b addressBatch) splittable() bool {
+	return len(b.pack.msgs) > 1
+}
+
+// halves returns the address batches of the halves of the records, in
+// order.
+func (b addressBatch) halves(tags map[string]string) []addressBatch {
+	half := len(b.pack.msgs) / 2
+	return addressBatches([]pack{
+		newPack(b.pack.address, b.pack.msgs[:half], tags),
+		newPack(b.pack.address, b.pack.msgs[half:], tags),
+	})
+}
+
+// envelopes returns the address batches grouped in envelopes, each holding
+// as many consecutive addresses as fit in maxSize bytes, or all of them if
+// maxSize is 0. The records of an address which doesn't fit on its own are
+// split in halves, down to a single record sent in its own envelope.
+func envelopes(batches []addressBatch, maxSize int, tags map[string]string) ([][]addressBatch, error) {
+	if maxSize == 0 {
+		return [][]addressBatch{batches}, nil
+	}
+
+	var envs [][]addressBatch
+	var env []addressBatch
+	// size is the size of the envelope without its closing bracket.
+	size := 0
+	for len(batches) > 0 {
+		b := batches[0]
+		batches = batches[1:]
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, errors.Wrap(ErrRemoteRejected, errors.Wrap(errEncode, err))
+		}
+		// An address alone is enclosed in brackets.
+		if len(data)+2 > maxSize && b.splittable() {
+			batches = append(b.halves(tags), batches...)
+			continue
+		}
+		// The address is added with a separator and the closing bracket.
+		if len(env) > 0 && size+len(data)+2 > maxSize {
+			envs = append(envs, env)
+			env, size = nil, 0
+		}
+		env = append(env, b)
+		size += len(data) + 1
+	}
+	if len(env) > 0 {
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// records returns the number of records of the address batches.
+func records(batches []addressBatch) int {
+	n := 0
+	for _, b := range batches {
+		n += len(b.Records)
+	}
+	return n
+}
@@ -0,0 +1,201 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"path"
+	"regexp"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+// Value types of the records matched by the rules.
+const (
+	TypeNumber = "number"
+	TypeString = "string"
+	TypeBool   = "bool"
+	TypeData   = "data"
+	TypeSum    = "sum"
+)
+
+// ErrInvalidRule indicates that a filtering rule is malformed.
+var ErrInvalidRule = errors.New("invalid filtering rule")
+
+// Rule matches the records meeting all of its conditions. Conditions left
+// empty match every record.
+type Rule struct {
+	// Name is the glob pattern (e.g. "temp*") matching the record name.
+	Name string `toml:"name,omitempty"`
+
+	// NameRegex is the regular expression matching the record name.
+	NameRegex string `toml:"name_regex,omitempty"`
+
+	// Unit is the record unit (e.g. "Cel").
+	Unit string `toml:"unit,omitempty"`
+
+	// Type is the record value type: number, string, bool, data or sum.
+	Type string `toml:"type,omitempty"`
+
+	// Min and Max are the inclusive bounds of the numeric value, or of the
+	// sum if the record has no numeric value. Records without numeric value
+	// or sum don't match the bounds.
+	Min *float64 `toml:"min,omitempty"`
+	Max *float64 `toml:"max,omitempty"`
+
+	// Publisher is the ID of the thing which published the message.
+	Publisher string `toml:"publisher,omitempty"`
+
+	// Protocol is the protocol the message was published with (e.g. "mqtt").
+	Protocol string `toml:"protocol,omitempty"`
+}
+
+type rule struct {
+	Rule
+	nameRegex *regexp.Regexp
+}
+
+func (r Rule) compile() (rule, error) {
+	c := rule{Rule: r}
+	if r.Name != "" {
+		if _, err := path.Match(r.Name, ""); err != nil {
+			return rule{}, errors.Wrap(ErrInvalidRule, errors.New(r.Name))
+		}
+	}
+	if r.NameRegex != "" {
+		re, err := regexp.Compile(r.NameRegex)
+		if err != nil {
+			return rule{}, errors.Wrap(ErrInvalidRule, err)
+		}
+		c.nameRegex = re
+	}
+	switch r.Type {
+	case "", TypeNumber, TypeString, TypeBool, TypeData, TypeSum:
+	default:
+		return rule{}, errors.Wrap(ErrInvalidRule, errors.New(r.Type))
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return rule{}, errors.Wrap(ErrInvalidRule, errors.New("min greater than max"))
+	}
+	return c, nil
+}
+
+func (r rule) match(msg senml.Message) bool {
+	if r.Name != "" {
+		if ok, _ := path.Match(r.Name, msg.Name); !ok {
+			return false
+		}
+	}
+	if r.nameRegex != nil && !r.nameRegex.MatchString(msg.Name) {
+		return false
+	}
+	if r.Unit != "" && r.Unit != msg.Unit {
+		return false
+	}
+	if r.Type != "" && r.Type != valueType(msg) {
+		return false
+	}
+	if r.Min != nil || r.Max != nil {
+		v, ok := numericValue(msg)
+		if !ok || (r.Min != nil && v < *r.Min) || (r.Max != nil && v > *r.Max) {
+			return false
+		}
+	}
+	if r.Publisher != "" && r.Publisher != msg.Publisher {
+		return false
+	}
+	if r.Protocol != "" && r.Protocol != msg.Protocol {
+		return false
+	}
+	return true
+}
+
+// Filter selects the records forwarded on a route. A record is forwarded if
+// it matches any of the include rules, or if there is no include rule, and
+// if it matches none of the exclude rules. A nil Filter forwards every record.
+type Filter struct {
+	include []rule
+	exclude []rule
+}
+
+// NewFilter returns filter applying the rules, or ErrInvalidRule if a rule
+// is malformed.
+func NewFilter(include, exclude []Rule) (*Filter, error) {
+	f := &Filter{}
+	for _, r := range include {
+		c, err := r.compile()
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, c)
+	}
+	for _, r := range exclude {
+		c, err := r.compile()
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, c)
+	}
+	return f, nil
+}
+
+// Match reports whether the record is forwarded.
+func (f *Filter) Match(msg senml.Message) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 && !matchAny(f.include, msg) {
+		return false
+	}
+	return !matchAny(f.exclude, msg)
+}
+
+// Apply returns the forwarded records. The slice is filtered in place.
+func (f *Filter) Apply(msgs []senml.Message) []senml.Message {
+	if f == nil {
+		return msgs
+	}
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		if f.Match(msg) {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+func matchAny(rules []rule, msg senml.Message) bool {
+	for _, r := range rules {
+		if r.match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func valueType(msg senml.Message) string {
+	switch {
+	case msg.Value != nil:
+		return TypeNumber
+	case msg.StringValue != nil:
+		return TypeString
+	case msg.BoolValue != nil:
+		return TypeBool
+	case msg.DataValue != nil:
+		return TypeData
+	case msg.Sum != nil:
+		return TypeSum
+	}
+	return ""
+}
+
+func numericValue(msg senml.Message) (float64, bool) {
+	switch {
+	case msg.Value != nil:
+		return *msg.Value, true
+	case msg.Sum != nil:
+		return *msg.Sum, true
+	}
+	return 0, false
+}
@@ -0,0 +1,122 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"fmt"
+	"testing"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestFilter(t *testing.T) {
+	strV := "open"
+	temperature := senml.Message{Name: "room:temperature", Unit: "Cel", Value: float(25), Publisher: "2580", Protocol: "mqtt"}
+	humidity := senml.Message{Name: "room:humidity", Unit: "%RH", Value: float(60), Publisher: "2580", Protocol: "http"}
+	door := senml.Message{Name: "door", StringValue: &strV, Publisher: "2581", Protocol: "mqtt"}
+	energy := senml.Message{Name: "energy", Unit: "kWh", Sum: float(120), Publisher: "2581", Protocol: "coap"}
+	msgs := []senml.Message{temperature, humidity, door, energy}
+
+	cases := []struct {
+		desc     string
+		include  []writer.Rule
+		exclude  []writer.Rule
+		expected []senml.Message
+	}{
+		{
+			desc:     "filter without rules",
+			expected: []senml.Message{temperature, humidity, door, energy},
+		},
+		{
+			desc:     "include by name glob",
+			include:  []writer.Rule{{Name: "room:*"}},
+			expected: []senml.Message{temperature, humidity},
+		},
+		{
+			desc:     "include by name regex",
+			include:  []writer.Rule{{NameRegex: "^(door|energy)$"}},
+			expected: []senml.Message{door, energy},
+		},
+		{
+			desc:     "include by unit",
+			include:  []writer.Rule{{Unit: "Cel"}},
+			expected: []senml.Message{temperature},
+		},
+		{
+			desc:     "include by value type",
+			include:  []writer.Rule{{Type: writer.TypeString}, {Type: writer.TypeSum}},
+			expected: []senml.Message{door, energy},
+		},
+		{
+			desc:     "include by value range",
+			include:  []writer.Rule{{Min: float(50), Max: float(100)}},
+			expected: []senml.Message{humidity},
+		},
+		{
+			desc:     "include temperature above threshold",
+			include:  []writer.Rule{{Name: "*temperature", Min: float(30)}},
+			expected: []senml.Message{},
+		},
+		{
+			desc:     "include by publisher and protocol",
+			include:  []writer.Rule{{Publisher: "2581", Protocol: "mqtt"}},
+			expected: []senml.Message{door},
+		},
+		{
+			desc:     "exclude by protocol",
+			exclude:  []writer.Rule{{Protocol: "mqtt"}},
+			expected: []senml.Message{humidity, energy},
+		},
+		{
+			desc:     "include and exclude",
+			include:  []writer.Rule{{Publisher: "2580"}},
+			exclude:  []writer.Rule{{Max: float(30)}},
+			expected: []senml.Message{humidity},
+		},
+	}
+
+	for _, tc := range cases {
+		f, err := writer.NewFilter(tc.include, tc.exclude)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		in := make([]senml.Message, len(msgs))
+		copy(in, msgs)
+		assert.ElementsMatch(t, tc.expected, f.Apply(in), fmt.Sprintf("%s: unexpected records", tc.desc))
+	}
+}
+
+func TestFilterInvalidRule(t *testing.T) {
+	cases := []struct {
+		desc string
+		rule writer.Rule
+	}{
+		{
+			desc: "malformed name glob",
+			rule: writer.Rule{Name: "temp["},
+		},
+		{
+			desc: "malformed name regex",
+			rule: writer.Rule{NameRegex: "temp("},
+		},
+		{
+			desc: "unknown value type",
+			rule: writer.Rule{Type: "integer"},
+		},
+		{
+			desc: "min greater than max",
+			rule: writer.Rule{Min: float(10), Max: float(0)},
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := writer.NewFilter(nil, []writer.Rule{tc.rule})
+		assert.True(t, errors.Contains(err, writer.ErrInvalidRule), fmt.Sprintf("%s: expected %v got %v", tc.desc, writer.ErrInvalidRule, err))
+	}
+}
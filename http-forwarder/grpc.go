@@ -0,0 +1,459 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/grpc"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defGRPCWindow  = 64
+	defGRPCTimeout = 10 * time.Second
+)
+
+var (
+	// ErrInvalidGRPC indicates that the gRPC sink settings are malformed.
+	ErrInvalidGRPC = errors.New("invalid gRPC sink")
+
+	errForwardBatch     = errors.New("failed to forward batch to gRPC receiver")
+	errGRPCNotConnected = errors.New("not connected to gRPC receiver")
+	errAckTimeout       = errors.New("gRPC acknowledgement timed out")
+	errStreamClosed     = errors.New("gRPC stream closed")
+)
+
+// GRPCConfig contains the settings of the gRPC sink.
+type GRPCConfig struct {
+	// URL is the address of the receiver, as host:port.
+	URL string
+
+	// TLS enables TLS, verifying the receiver with the CA certificates of
+	// the system unless CACertFile is set. It is enabled when any of the
+	// certificate files is set.
+	TLS bool
+
+	// CACertFile is the path of the CA certificates verifying the receiver.
+	CACertFile string
+
+	// ClientCertFile and ClientKeyFile are the paths of the client
+	// certificate and key, when the receiver verifies clients.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// MaxRecords is the number of records of a batch above which the
+	// records of an address are split in several batches. 0 means no
+	// limit.
+	MaxRecords int
+
+	// Window is the number of batches which can be sent before the
+	// receiver acknowledged them, 64 if 0.
+	Window int
+
+	// Timeout is the time allowed to open the stream and for the receiver
+	// to acknowledge a batch, 10 seconds if 0.
+	Timeout time.Duration
+}
+
+var _ Repository = (*GRPCSink)(nil)
+
+// GRPCSink forwards the records to a gRPC receiver, as batches of an
+// address streamed over a single bidirectional stream. Batches are sent
+// without waiting for the acknowledgement of the previous ones, within the
+// window.
+type GRPCSink struct {
+	cfg     GRPCConfig
+	target  string
+	conn    *grpc.ClientConn
+	client  pb.ReceiverClient
+	window  chan struct{}
+	metrics Metrics
+	tracer  tracing.Tracer
+	logger  logger.Logger
+
+	// mu guards the stream, which is opened again once closed.
+	mu     sync.Mutex
+	stream *grpcStream
+}
+
+// NewGRPCSink returns gRPC sink forwarding the records to the receiver. The
+// connection is established in the background and restored automatically
+// when it is lost.
+func NewGRPCSink(cfg GRPCConfig, metrics Metrics, tracer tracing.Tracer, logger logger.Logger) (*GRPCSink, error) {
+	if cfg.Window == 0 {
+		cfg.Window = defGRPCWindow
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defGRPCTimeout
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	opt := grpc.WithInsecure()
+	if cfg.TLS || cfg.CACertFile != "" || cfg.ClientCertFile != "" {
+		tlsCfg, err := loadTLSConfig(cfg.CACertFile, cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidGRPC, err)
+		}
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg))
+	}
+	conn, err := grpc.Dial(cfg.URL, opt)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidGRPC, err)
+	}
+
+	return &GRPCSink{
+		cfg:     cfg,
+		target:  fmt.Sprintf("grpc://%s", cfg.URL),
+		conn:    conn,
+		client:  pb.NewReceiverClient(conn),
+		window:  make(chan struct{}, cfg.Window),
+		metrics: metrics,
+		tracer:  tracer,
+		logger:  logger,
+	}, nil
+}
+
+func (cfg GRPCConfig) validate() error {
+	if cfg.URL == "" {
+		return errors.Wrap(ErrInvalidGRPC, errors.New("missing receiver URL"))
+	}
+	if cfg.MaxRecords < 0 || cfg.Window < 0 || cfg.Timeout < 0 {
+		return errors.Wrap(ErrInvalidGRPC, errors.New("max records, window and timeout must not be negative"))
+	}
+	if (cfg.ClientCertFile == "") != (cfg.ClientKeyFile == "") {
+		return errors.Wrap(ErrInvalidGRPC, errors.New("client certificate and key must be set together"))
+	}
+	return nil
+}
+
+func (s *GRPCSink) Save(messages ...senml.Message) error {
+	return s.SaveContext(context.Background(), messages...)
+}
+
+// SaveContext forwards a batch per address, whatever the delivery
+// granularity, and returns once the receiver acknowledged all of them.
+// Batches which failed are reported before the rejected ones, so that the
+// records are forwarded again.
+func (s *GRPCSink) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	tags := TagsFromContext(ctx)
+
+	_, span := s.tracer.Start(ctx, "group", tracing.KindInternal, tracing.Int("records", len(messages)))
+	packs, addresses := groupPacks(messages, s.cfg.MaxRecords, tags)
+	span.SetAttributes(tracing.Int("addresses", addresses), tracing.Int("packs", len(packs)))
+	span.End()
+
+	gs, err := s.open()
+	if err != nil {
+		s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeError).Add(float64(len(packs)))
+		return errors.Wrap(errForwardBatch, err)
+	}
+
+	var calls []*grpcCall
+	var sendErr error
+	for _, p := range packs {
+		c, err := s.send(ctx, gs, p, tags)
+		if err != nil {
+			sendErr = err
+			break
+		}
+		calls = append(calls, c)
+	}
+
+	var failed, rejected error
+	for _, c := range calls {
+		err := s.wait(ctx, gs, c)
+		switch {
+		case err == nil:
+		case errors.Contains(err, ErrRemoteRejected):
+			if rejected == nil {
+				rejected = err
+			}
+		default:
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	for _, err := range []error{sendErr, failed, rejected} {
+		if err != nil {
+			return errors.Wrap(errForwardBatch, err)
+		}
+	}
+	return nil
+}
+
+// grpcCall is a batch sent and not yet acknowledged.
+type grpcCall struct {
+	id      uint64
+	ack     chan *pb.Ack
+	records int
+	bytes   int
+	span    *tracing.Span
+}
+
+// send sends the batch of the pack on the stream, once the window allows
+// it. The window is released when the batch is acknowledged or abandoned,
+// whether its sender waits for it or not.
+func (s *GRPCSink) send(ctx context.Context, gs *grpcStream, p pack, tags map[string]string) (*grpcCall, error) {
+	batch := &pb.Batch{
+		Address: &pb.Address{
+			Channel:   p.address.Channel,
+			Subtopic:  p.address.Subtopic,
+			Publisher: p.address.Published,
+			Protocol:  p.address.Protocol,
+		},
+		Tags: tags,
+	}
+	for _, msg := range p.msgs {
+		batch.Records = append(batch.Records, grpcRecord(msg))
+	}
+	// The key is computed before the ID is set, so that it doesn't change
+	// when the batch is sent again.
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(batch)
+	if err != nil {
+		return nil, errors.Wrap(ErrRemoteRejected, errors.Wrap(errEncode, err))
+	}
+	batch.Key = idempotencyKey(p.address, data)
+
+	timer := time.NewTimer(s.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case s.window <- struct{}{}:
+	case <-timer.C:
+		return nil, errAckTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	_, span := s.tracer.Start(ctx, "FORWARD", tracing.KindClient, addressAttributes(p.address, len(p.msgs))...)
+	span.SetAttributes(tracing.String("rpc.system", "grpc"), tracing.String("rpc.service", "httpforwarder.Receiver"), tracing.String("idempotency_key", batch.Key))
+	s.metrics.BatchSize.With("target", s.target).Observe(float64(len(p.msgs)))
+
+	c := &grpcCall{ack: make(chan *pb.Ack, 1), records: len(p.msgs), bytes: len(data), span: span}
+	c.id = gs.register(c.ack)
+	batch.Id = c.id
+	if err := gs.send(batch); err != nil {
+		gs.unregister(c.id)
+		s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeError).Add(1)
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+	return c, nil
+}
+
+// wait waits for the acknowledgement of the batch.
+func (s *GRPCSink) wait(ctx context.Context, gs *grpcStream, c *grpcCall) (err error) {
+	defer func() {
+		c.span.SetError(err)
+		c.span.End()
+	}()
+
+	timer := time.NewTimer(s.cfg.Timeout)
+	defer timer.Stop()
+
+	select {
+	case ack := <-c.ack:
+		switch ack.Status {
+		case pb.Ack_OK:
+			s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeSuccess).Add(1)
+			s.metrics.Records.With("target", s.target).Add(float64(c.records))
+			s.metrics.Bytes.With("target", s.target).Add(float64(c.bytes))
+			return nil
+		case pb.Ack_REJECTED:
+			s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeFailure).Add(1)
+			return errors.Wrap(ErrRemoteRejected, errors.New(ack.Error))
+		default:
+			s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeFailure).Add(1)
+			return errors.New(ack.Error)
+		}
+	case <-gs.done:
+		err = gs.err
+	case <-timer.C:
+		err = errAckTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	gs.unregister(c.id)
+	s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeError).Add(1)
+	return err
+}
+
+// grpcRecord returns the record of the SenML message.
+func grpcRecord(msg senml.Message) *pb.Record {
+	r := &pb.Record{
+		Name:       msg.Name,
+		Unit:       msg.Unit,
+		Time:       msg.Time,
+		UpdateTime: msg.UpdateTime,
+		Sum:        msg.Sum,
+	}
+	switch {
+	case msg.Value != nil:
+		r.Value = &pb.Record_FloatValue{FloatValue: *msg.Value}
+	case msg.StringValue != nil:
+		r.Value = &pb.Record_StringValue{StringValue: *msg.StringValue}
+	case msg.DataValue != nil:
+		r.Value = &pb.Record_DataValue{DataValue: *msg.DataValue}
+	case msg.BoolValue != nil:
+		r.Value = &pb.Record_BoolValue{BoolValue: *msg.BoolValue}
+	}
+	return r
+}
+
+// open returns the stream to the receiver, opening it if it is closed. The
+// connection is waited for within the timeout.
+func (s *GRPCSink) open() (*grpcStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream != nil {
+		return s.stream, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(s.cfg.Timeout, cancel)
+	stream, err := s.client.Forward(ctx, grpc.WaitForReady(true))
+	if !timer.Stop() {
+		cancel()
+		return nil, errGRPCNotConnected
+	}
+	if err != nil {
+		cancel()
+		return nil, errors.Wrap(errGRPCNotConnected, err)
+	}
+
+	gs := &grpcStream{
+		stream:  stream,
+		cancel:  cancel,
+		window:  s.window,
+		pending: make(map[uint64]chan *pb.Ack),
+		done:    make(chan struct{}),
+	}
+	s.stream = gs
+	go s.receive(gs)
+	return gs, nil
+}
+
+// receive dispatches the acknowledgements received on the stream, until it
+// is closed.
+func (s *GRPCSink) receive(gs *grpcStream) {
+	for {
+		ack, err := gs.stream.Recv()
+		if err != nil {
+			s.mu.Lock()
+			if s.stream == gs {
+				s.stream = nil
+			}
+			s.mu.Unlock()
+			gs.close(err)
+			s.logger.Warn(fmt.Sprintf("gRPC stream to receiver %s closed: %s", s.cfg.URL, err))
+			return
+		}
+		gs.acknowledge(ack)
+	}
+}
+
+// CheckConnection returns an error unless the connection to the receiver is
+// established or being established.
+func (s *GRPCSink) CheckConnection() error {
+	switch s.conn.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return errGRPCNotConnected
+	}
+	return nil
+}
+
+// Close closes the stream and the connection to the receiver.
+func (s *GRPCSink) Close() error {
+	s.mu.Lock()
+	if s.stream != nil {
+		s.stream.cancel()
+		s.stream = nil
+	}
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// grpcStream is a stream to the receiver, with the batches waiting for
+// their acknowledgement.
+type grpcStream struct {
+	stream pb.Receiver_ForwardClient
+	cancel context.CancelFunc
+
+	// sendMu serializes the batches sent on the stream.
+	sendMu sync.Mutex
+
+	// window is released for each pending batch once it is removed.
+	window chan struct{}
+
+	// mu guards the pending acknowledgements, keyed by batch ID.
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *pb.Ack
+
+	// done is closed with the stream, with the error which closed it.
+	done chan struct{}
+	err  error
+}
+
+func (gs *grpcStream) register(ack chan *pb.Ack) uint64 {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.nextID++
+	gs.pending[gs.nextID] = ack
+	return gs.nextID
+}
+
+func (gs *grpcStream) unregister(id uint64) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if _, ok := gs.pending[id]; ok {
+		delete(gs.pending, id)
+		<-gs.window
+	}
+}
+
+func (gs *grpcStream) send(batch *pb.Batch) error {
+	gs.sendMu.Lock()
+	defer gs.sendMu.Unlock()
+	return gs.stream.Send(batch)
+}
+
+// acknowledge delivers the acknowledgement to the batch waiting for it.
+// Acknowledgements of unknown batches, e.g. which timed out, are ignored.
+func (gs *grpcStream) acknowledge(ack *pb.Ack) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if c, ok := gs.pending[ack.Id]; ok {
+		delete(gs.pending, ack.Id)
+		<-gs.window
+		c <- ack
+	}
+}
+
+// close releases the pending batches, whose senders are notified by done.
+func (gs *grpcStream) close(err error) {
+	gs.cancel()
+	gs.mu.Lock()
+	for id := range gs.pending {
+		delete(gs.pending, id)
+		<-gs.window
+	}
+	gs.mu.Unlock()
+	gs.err = errors.Wrap(errStreamClosed, err)
+	close(gs.done)
+}
@@ -0,0 +1,759 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.25.0
+// 	protoc        (unknown)
+// source: http-forwarder/grpc/forwarder.proto
+
+package grpc
+
+import (
+	context "context"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// This is a compile-time assertion that a sufficiently up-to-date version
+// of the legacy proto package is being used.
+const _ = proto.ProtoPackageIsVersion4
+
+type Ack_Status int32
+
+const (
+	// OK indicates that the batch is accepted.
+	Ack_OK Ack_Status = 0
+	// FAILED indicates that the batch is not accepted, and can be sent
+	// again.
+	Ack_FAILED Ack_Status = 1
+	// REJECTED indicates that the batch is refused, and must not be sent
+	// again.
+	Ack_REJECTED Ack_Status = 2
+)
+
+// Enum value maps for Ack_Status.
+var (
+	Ack_Status_name = map[int32]string{
+		0: "OK",
+		1: "FAILED",
+		2: "REJECTED",
+	}
+	Ack_Status_value = map[string]int32{
+		"OK":       0,
+		"FAILED":   1,
+		"REJECTED": 2,
+	}
+)
+
+func (x Ack_Status) Enum() *Ack_Status {
+	p := new(Ack_Status)
+	*p = x
+	return p
+}
+
+func (x Ack_Status) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Ack_Status) Descriptor() protoreflect.EnumDescriptor {
+	return file_http_forwarder_grpc_forwarder_proto_enumTypes[0].Descriptor()
+}
+
+func (Ack_Status) Type() protoreflect.EnumType {
+	return &file_http_forwarder_grpc_forwarder_proto_enumTypes[0]
+}
+
+func (x Ack_Status) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Ack_Status.Descriptor instead.
+func (Ack_Status) EnumDescriptor() ([]byte, []int) {
+	return file_http_forwarder_grpc_forwarder_proto_rawDescGZIP(), []int{3, 0}
+}
+
+// Batch contains the records of an address.
+type Batch struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// ID identifies the batch on the stream, to acknowledge it.
+	Id uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// Key is the idempotency key of the batch, which is the same when the
+	// batch is sent again.
+	Key     string    `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Address *Address  `protobuf:"bytes,3,opt,name=address,proto3" json:"address,omitempty"`
+	Records []*Record `protobuf:"bytes,4,rep,name=records,proto3" json:"records,omitempty"`
+	// Tags are the labels set on the records by the route.
+	Tags map[string]string `protobuf:"bytes,5,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (x *Batch) Reset() {
+	*x = Batch{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_http_forwarder_grpc_forwarder_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Batch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Batch) ProtoMessage() {}
+
+func (x *Batch) ProtoReflect() protoreflect.Message {
+	mi := &file_http_forwarder_grpc_forwarder_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Batch.ProtoReflect.Descriptor instead.
+func (*Batch) Descriptor() ([]byte, []int) {
+	return file_http_forwarder_grpc_forwarder_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Batch) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Batch) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *Batch) GetAddress() *Address {
+	if x != nil {
+		return x.Address
+	}
+	return nil
+}
+
+func (x *Batch) GetRecords() []*Record {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *Batch) GetTags() map[string]string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+// Address contains the metadata shared by the records of a batch.
+type Address struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Channel   string `protobuf:"bytes,1,opt,name=channel,proto3" json:"channel,omitempty"`
+	Subtopic  string `protobuf:"bytes,2,opt,name=subtopic,proto3" json:"subtopic,omitempty"`
+	Publisher string `protobuf:"bytes,3,opt,name=publisher,proto3" json:"publisher,omitempty"`
+	Protocol  string `protobuf:"bytes,4,opt,name=protocol,proto3" json:"protocol,omitempty"`
+}
+
+func (x *Address) Reset() {
+	*x = Address{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_http_forwarder_grpc_forwarder_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Address) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Address) ProtoMessage() {}
+
+func (x *Address) ProtoReflect() protoreflect.Message {
+	mi := &file_http_forwarder_grpc_forwarder_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Address.ProtoReflect.Descriptor instead.
+func (*Address) Descriptor() ([]byte, []int) {
+	return file_http_forwarder_grpc_forwarder_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Address) GetChannel() string {
+	if x != nil {
+		return x.Channel
+	}
+	return ""
+}
+
+func (x *Address) GetSubtopic() string {
+	if x != nil {
+		return x.Subtopic
+	}
+	return ""
+}
+
+func (x *Address) GetPublisher() string {
+	if x != nil {
+		return x.Publisher
+	}
+	return ""
+}
+
+func (x *Address) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+// Record is a SenML record, with its name, unit and time resolved.
+type Record struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name       string  `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Unit       string  `protobuf:"bytes,2,opt,name=unit,proto3" json:"unit,omitempty"`
+	Time       float64 `protobuf:"fixed64,3,opt,name=time,proto3" json:"time,omitempty"`
+	UpdateTime float64 `protobuf:"fixed64,4,opt,name=update_time,json=updateTime,proto3" json:"update_time,omitempty"`
+	// Types that are assignable to Value:
+	//	*Record_FloatValue
+	//	*Record_StringValue
+	//	*Record_DataValue
+	//	*Record_BoolValue
+	Value isRecord_Value `protobuf_oneof:"value"`
+	Sum   *float64       `protobuf:"fixed64,9,opt,name=sum,proto3,oneof" json:"sum,omitempty"`
+}
+
+func (x *Record) Reset() {
+	*x = Record{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_http_forwarder_grpc_forwarder_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Record) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Record) ProtoMessage() {}
+
+func (x *Record) ProtoReflect() protoreflect.Message {
+	mi := &file_http_forwarder_grpc_forwarder_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Record.ProtoReflect.Descriptor instead.
+func (*Record) Descriptor() ([]byte, []int) {
+	return file_http_forwarder_grpc_forwarder_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Record) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Record) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+func (x *Record) GetTime() float64 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+func (x *Record) GetUpdateTime() float64 {
+	if x != nil {
+		return x.UpdateTime
+	}
+	return 0
+}
+
+func (m *Record) GetValue() isRecord_Value {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (x *Record) GetFloatValue() float64 {
+	if x, ok := x.GetValue().(*Record_FloatValue); ok {
+		return x.FloatValue
+	}
+	return 0
+}
+
+func (x *Record) GetStringValue() string {
+	if x, ok := x.GetValue().(*Record_StringValue); ok {
+		return x.StringValue
+	}
+	return ""
+}
+
+func (x *Record) GetDataValue() string {
+	if x, ok := x.GetValue().(*Record_DataValue); ok {
+		return x.DataValue
+	}
+	return ""
+}
+
+func (x *Record) GetBoolValue() bool {
+	if x, ok := x.GetValue().(*Record_BoolValue); ok {
+		return x.BoolValue
+	}
+	return false
+}
+
+func (x *Record) GetSum() float64 {
+	if x != nil && x.Sum != nil {
+		return *x.Sum
+	}
+	return 0
+}
+
+type isRecord_Value interface {
+	isRecord_Value()
+}
+
+type Record_FloatValue struct {
+	FloatValue float64 `protobuf:"fixed64,5,opt,name=float_value,json=floatValue,proto3,oneof"`
+}
+
+type Record_StringValue struct {
+	StringValue string `protobuf:"bytes,6,opt,name=string_value,json=stringValue,proto3,oneof"`
+}
+
+type Record_DataValue struct {
+	DataValue string `protobuf:"bytes,7,opt,name=data_value,json=dataValue,proto3,oneof"`
+}
+
+type Record_BoolValue struct {
+	BoolValue bool `protobuf:"varint,8,opt,name=bool_value,json=boolValue,proto3,oneof"`
+}
+
+func (*Record_FloatValue) isRecord_Value() {}
+
+func (*Record_StringValue) isRecord_Value() {}
+
+func (*Record_DataValue) isRecord_Value() {}
+
+func (*Record_BoolValue) isRecord_Value() {}
+
+// Ack acknowledges a batch.
+type Ack struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id     uint64     `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Status Ack_Status `protobuf:"varint,2,opt,name=status,proto3,enum=httpforwarder.Ack_Status" json:"status,omitempty"`
+	// Error describes why the batch is not accepted.
+	Error string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *Ack) Reset() {
+	*x = Ack{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_http_forwarder_grpc_forwarder_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Ack) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ack) ProtoMessage() {}
+
+func (x *Ack) ProtoReflect() protoreflect.Message {
+	mi := &file_http_forwarder_grpc_forwarder_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ack.ProtoReflect.Descriptor instead.
+func (*Ack) Descriptor() ([]byte, []int) {
+	return file_http_forwarder_grpc_forwarder_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Ack) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Ack) GetStatus() Ack_Status {
+	if x != nil {
+		return x.Status
+	}
+	return Ack_OK
+}
+
+func (x *Ack) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_http_forwarder_grpc_forwarder_proto protoreflect.FileDescriptor
+
+var file_http_forwarder_grpc_forwarder_proto_rawDesc = []byte{
+	0x0a, 0x23, 0x68, 0x74, 0x74, 0x70, 0x2d, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65, 0x72,
+	0x2f, 0x67, 0x72, 0x70, 0x63, 0x2f, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65, 0x72, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0d, 0x68, 0x74, 0x74, 0x70, 0x66, 0x6f, 0x72, 0x77, 0x61,
+	0x72, 0x64, 0x65, 0x72, 0x22, 0xf9, 0x01, 0x0a, 0x05, 0x42, 0x61, 0x74, 0x63, 0x68, 0x12, 0x0e,
+	0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x69, 0x64, 0x12, 0x10,
+	0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79,
+	0x12, 0x30, 0x0a, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x16, 0x2e, 0x68, 0x74, 0x74, 0x70, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65,
+	0x72, 0x2e, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x52, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65,
+	0x73, 0x73, 0x12, 0x2f, 0x0a, 0x07, 0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x73, 0x18, 0x04, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x68, 0x74, 0x74, 0x70, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72,
+	0x64, 0x65, 0x72, 0x2e, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x52, 0x07, 0x72, 0x65, 0x63, 0x6f,
+	0x72, 0x64, 0x73, 0x12, 0x32, 0x0a, 0x04, 0x74, 0x61, 0x67, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28,
+	0x0b, 0x32, 0x1e, 0x2e, 0x68, 0x74, 0x74, 0x70, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65,
+	0x72, 0x2e, 0x42, 0x61, 0x74, 0x63, 0x68, 0x2e, 0x54, 0x61, 0x67, 0x73, 0x45, 0x6e, 0x74, 0x72,
+	0x79, 0x52, 0x04, 0x74, 0x61, 0x67, 0x73, 0x1a, 0x37, 0x0a, 0x09, 0x54, 0x61, 0x67, 0x73, 0x45,
+	0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01,
+	0x22, 0x79, 0x0a, 0x07, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x63,
+	0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63, 0x68,
+	0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x75, 0x62, 0x74, 0x6f, 0x70, 0x69,
+	0x63, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x73, 0x75, 0x62, 0x74, 0x6f, 0x70, 0x69,
+	0x63, 0x12, 0x1c, 0x0a, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x73, 0x68, 0x65, 0x72, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x73, 0x68, 0x65, 0x72, 0x12,
+	0x1a, 0x0a, 0x08, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x08, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x22, 0x97, 0x02, 0x0a, 0x06,
+	0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x75, 0x6e,
+	0x69, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x75, 0x6e, 0x69, 0x74, 0x12, 0x12,
+	0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x01, 0x52, 0x04, 0x74, 0x69,
+	0x6d, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x5f, 0x74, 0x69, 0x6d,
+	0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0a, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x54,
+	0x69, 0x6d, 0x65, 0x12, 0x21, 0x0a, 0x0b, 0x66, 0x6c, 0x6f, 0x61, 0x74, 0x5f, 0x76, 0x61, 0x6c,
+	0x75, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x48, 0x00, 0x52, 0x0a, 0x66, 0x6c, 0x6f, 0x61,
+	0x74, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x23, 0x0a, 0x0c, 0x73, 0x74, 0x72, 0x69, 0x6e, 0x67,
+	0x5f, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x48, 0x00, 0x52, 0x0b,
+	0x73, 0x74, 0x72, 0x69, 0x6e, 0x67, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x1f, 0x0a, 0x0a, 0x64,
+	0x61, 0x74, 0x61, 0x5f, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x48,
+	0x00, 0x52, 0x09, 0x64, 0x61, 0x74, 0x61, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x1f, 0x0a, 0x0a,
+	0x62, 0x6f, 0x6f, 0x6c, 0x5f, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x08,
+	0x48, 0x00, 0x52, 0x09, 0x62, 0x6f, 0x6f, 0x6c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x15, 0x0a,
+	0x03, 0x73, 0x75, 0x6d, 0x18, 0x09, 0x20, 0x01, 0x28, 0x01, 0x48, 0x01, 0x52, 0x03, 0x73, 0x75,
+	0x6d, 0x88, 0x01, 0x01, 0x42, 0x07, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x42, 0x06, 0x0a,
+	0x04, 0x5f, 0x73, 0x75, 0x6d, 0x22, 0x8a, 0x01, 0x0a, 0x03, 0x41, 0x63, 0x6b, 0x12, 0x0e, 0x0a,
+	0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x69, 0x64, 0x12, 0x31, 0x0a,
+	0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x19, 0x2e,
+	0x68, 0x74, 0x74, 0x70, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65, 0x72, 0x2e, 0x41, 0x63,
+	0x6b, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73,
+	0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x2a, 0x0a, 0x06, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73,
+	0x12, 0x06, 0x0a, 0x02, 0x4f, 0x4b, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x46, 0x41, 0x49, 0x4c,
+	0x45, 0x44, 0x10, 0x01, 0x12, 0x0c, 0x0a, 0x08, 0x52, 0x45, 0x4a, 0x45, 0x43, 0x54, 0x45, 0x44,
+	0x10, 0x02, 0x32, 0x45, 0x0a, 0x08, 0x52, 0x65, 0x63, 0x65, 0x69, 0x76, 0x65, 0x72, 0x12, 0x39,
+	0x0a, 0x07, 0x46, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x12, 0x14, 0x2e, 0x68, 0x74, 0x74, 0x70,
+	0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65, 0x72, 0x2e, 0x42, 0x61, 0x74, 0x63, 0x68, 0x1a,
+	0x12, 0x2e, 0x68, 0x74, 0x74, 0x70, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65, 0x72, 0x2e,
+	0x41, 0x63, 0x6b, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0x4b, 0x5a, 0x49, 0x67, 0x69, 0x74,
+	0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6a, 0x6f, 0x6e, 0x61, 0x74, 0x68, 0x61, 0x6e,
+	0x64, 0x72, 0x65, 0x79, 0x65, 0x72, 0x2f, 0x6d, 0x61, 0x69, 0x6e, 0x66, 0x6c, 0x75, 0x78, 0x2d,
+	0x68, 0x74, 0x74, 0x70, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65, 0x72, 0x2f, 0x68, 0x74,
+	0x74, 0x70, 0x2d, 0x66, 0x6f, 0x72, 0x77, 0x61, 0x72, 0x64, 0x65, 0x72, 0x2f, 0x67, 0x72, 0x70,
+	0x63, 0x3b, 0x67, 0x72, 0x70, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_http_forwarder_grpc_forwarder_proto_rawDescOnce sync.Once
+	file_http_forwarder_grpc_forwarder_proto_rawDescData = file_http_forwarder_grpc_forwarder_proto_rawDesc
+)
+
+func file_http_forwarder_grpc_forwarder_proto_rawDescGZIP() []byte {
+	file_http_forwarder_grpc_forwarder_proto_rawDescOnce.Do(func() {
+		file_http_forwarder_grpc_forwarder_proto_rawDescData = protoimpl.X.CompressGZIP(file_http_forwarder_grpc_forwarder_proto_rawDescData)
+	})
+	return file_http_forwarder_grpc_forwarder_proto_rawDescData
+}
+
+var file_http_forwarder_grpc_forwarder_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_http_forwarder_grpc_forwarder_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_http_forwarder_grpc_forwarder_proto_goTypes = []interface{}{
+	(Ack_Status)(0), // 0: httpforwarder.Ack.Status
+	(*Batch)(nil),   // 1: httpforwarder.Batch
+	(*Address)(nil), // 2: httpforwarder.Address
+	(*Record)(nil),  // 3: httpforwarder.Record
+	(*Ack)(nil),     // 4: httpforwarder.Ack
+	nil,             // 5: httpforwarder.Batch.TagsEntry
+}
+var file_http_forwarder_grpc_forwarder_proto_depIdxs = []int32{
+	2, // 0: httpforwarder.Batch.address:type_name -> httpforwarder.Address
+	3, // 1: httpforwarder.Batch.records:type_name -> httpforwarder.Record
+	5, // 2: httpforwarder.Batch.tags:type_name -> httpforwarder.Batch.TagsEntry
+	0, // 3: httpforwarder.Ack.status:type_name -> httpforwarder.Ack.Status
+	1, // 4: httpforwarder.Receiver.Forward:input_type -> httpforwarder.Batch
+	4, // 5: httpforwarder.Receiver.Forward:output_type -> httpforwarder.Ack
+	5, // [5:6] is the sub-list for method output_type
+	4, // [4:5] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_http_forwarder_grpc_forwarder_proto_init() }
+func file_http_forwarder_grpc_forwarder_proto_init() {
+	if File_http_forwarder_grpc_forwarder_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_http_forwarder_grpc_forwarder_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Batch); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_http_forwarder_grpc_forwarder_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Address); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_http_forwarder_grpc_forwarder_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Record); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_http_forwarder_grpc_forwarder_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Ack); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_http_forwarder_grpc_forwarder_proto_msgTypes[2].OneofWrappers = []interface{}{
+		(*Record_FloatValue)(nil),
+		(*Record_StringValue)(nil),
+		(*Record_DataValue)(nil),
+		(*Record_BoolValue)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_http_forwarder_grpc_forwarder_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_http_forwarder_grpc_forwarder_proto_goTypes,
+		DependencyIndexes: file_http_forwarder_grpc_forwarder_proto_depIdxs,
+		EnumInfos:         file_http_forwarder_grpc_forwarder_proto_enumTypes,
+		MessageInfos:      file_http_forwarder_grpc_forwarder_proto_msgTypes,
+	}.Build()
+	File_http_forwarder_grpc_forwarder_proto = out.File
+	file_http_forwarder_grpc_forwarder_proto_rawDesc = nil
+	file_http_forwarder_grpc_forwarder_proto_goTypes = nil
+	file_http_forwarder_grpc_forwarder_proto_depIdxs = nil
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// ReceiverClient is the client API for Receiver service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ReceiverClient interface {
+	// Forward streams the batches of records to the receiver, which
+	// acknowledges each batch on the stream, in any order.
+	Forward(ctx context.Context, opts ...grpc.CallOption) (Receiver_ForwardClient, error)
+}
+
+type receiverClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReceiverClient(cc grpc.ClientConnInterface) ReceiverClient {
+	return &receiverClient{cc}
+}
+
+func (c *receiverClient) Forward(ctx context.Context, opts ...grpc.CallOption) (Receiver_ForwardClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Receiver_serviceDesc.Streams[0], "/httpforwarder.Receiver/Forward", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &receiverForwardClient{stream}
+	return x, nil
+}
+
+type Receiver_ForwardClient interface {
+	Send(*Batch) error
+	Recv() (*Ack, error)
+	grpc.ClientStream
+}
+
+type receiverForwardClient struct {
+	grpc.ClientStream
+}
+
+func (x *receiverForwardClient) Send(m *Batch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *receiverForwardClient) Recv() (*Ack, error) {
+	m := new(Ack)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReceiverServer is the server API for Receiver service.
+type ReceiverServer interface {
+	// Forward streams the batches of records to the receiver, which
+	// acknowledges each batch on the stream, in any order.
+	Forward(Receiver_ForwardServer) error
+}
+
+// UnimplementedReceiverServer can be embedded to have forward compatible implementations.
+type UnimplementedReceiverServer struct {
+}
+
+func (*UnimplementedReceiverServer) Forward(Receiver_ForwardServer) error {
+	return status.Errorf(codes.Unimplemented, "method Forward not implemented")
+}
+
+func RegisterReceiverServer(s *grpc.Server, srv ReceiverServer) {
+	s.RegisterService(&_Receiver_serviceDesc, srv)
+}
+
+func _Receiver_Forward_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ReceiverServer).Forward(&receiverForwardServer{stream})
+}
+
+type Receiver_ForwardServer interface {
+	Send(*Ack) error
+	Recv() (*Batch, error)
+	grpc.ServerStream
+}
+
+type receiverForwardServer struct {
+	grpc.ServerStream
+}
+
+func (x *receiverForwardServer) Send(m *Ack) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *receiverForwardServer) Recv() (*Batch, error) {
+	m := new(Batch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Receiver_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "httpforwarder.Receiver",
+	HandlerType: (*ReceiverServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Forward",
+			Handler:       _Receiver_Forward_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "http-forwarder/grpc/forwarder.proto",
+}
@@ -0,0 +1,57 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+// Package grpc contains the protocol of the gRPC sink of the HTTP forwarder,
+// generated from forwarder.proto, and a reference receiver implementing it.
+package grpc
+
+import (
+	"context"
+	"io"
+
+	"github.com/mainflux/mainflux/errors"
+)
+
+// ErrRejected indicates that the receiver refuses the batch, which must not
+// be sent again.
+var ErrRejected = errors.New("batch rejected")
+
+// Handler handles the batches received on a stream. The batch is accepted
+// unless an error is returned, and rejected if the error wraps ErrRejected.
+type Handler func(ctx context.Context, batch *Batch) error
+
+var _ ReceiverServer = (*receiver)(nil)
+
+type receiver struct {
+	handler Handler
+}
+
+// NewReceiver returns receiver server acknowledging the batches of each
+// stream in order, once handled by the handler.
+func NewReceiver(handler Handler) ReceiverServer {
+	return &receiver{handler: handler}
+}
+
+func (r *receiver) Forward(stream Receiver_ForwardServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ack := &Ack{Id: batch.Id, Status: Ack_OK}
+		if err := r.handler(stream.Context(), batch); err != nil {
+			ack.Status = Ack_FAILED
+			if errors.Contains(err, ErrRejected) {
+				ack.Status = Ack_REJECTED
+			}
+			ack.Error = err.Error()
+		}
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
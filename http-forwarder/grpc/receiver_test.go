@@ -0,0 +1,76 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package grpc_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	pb "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/grpc"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestReceiver(t *testing.T) {
+	handler := func(ctx context.Context, batch *pb.Batch) error {
+		switch batch.Address.Channel {
+		case "rejected":
+			return errors.Wrap(pb.ErrRejected, errors.New("unknown channel"))
+		case "failed":
+			return errors.New("storage unavailable")
+		}
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, fmt.Sprintf("unexpected error listening: %s", err))
+	srv := grpc.NewServer()
+	pb.RegisterReceiverServer(srv, pb.NewReceiver(handler))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.Nil(t, err, fmt.Sprintf("unexpected error dialing: %s", err))
+	defer conn.Close()
+	stream, err := pb.NewReceiverClient(conn).Forward(context.Background())
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening stream: %s", err))
+
+	cases := []struct {
+		desc    string
+		channel string
+		status  pb.Ack_Status
+	}{
+		{
+			desc:    "acknowledge accepted batch",
+			channel: "accepted",
+			status:  pb.Ack_OK,
+		},
+		{
+			desc:    "acknowledge rejected batch",
+			channel: "rejected",
+			status:  pb.Ack_REJECTED,
+		},
+		{
+			desc:    "acknowledge failed batch",
+			channel: "failed",
+			status:  pb.Ack_FAILED,
+		},
+	}
+
+	for i, tc := range cases {
+		id := uint64(i + 1)
+		err := stream.Send(&pb.Batch{Id: id, Address: &pb.Address{Channel: tc.channel}})
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error sending batch: %s", tc.desc, err))
+		ack, err := stream.Recv()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error receiving ack: %s", tc.desc, err))
+		assert.Equal(t, id, ack.Id, fmt.Sprintf("%s: unexpected batch ID", tc.desc))
+		assert.Equal(t, tc.status, ack.Status, fmt.Sprintf("%s: expected %s got %s", tc.desc, tc.status, ack.Status))
+		assert.Equal(t, tc.status != pb.Ack_OK, ack.Error != "", fmt.Sprintf("%s: unexpected error description %q", tc.desc, ack.Error))
+	}
+	require.Nil(t, stream.CloseSend(), "unexpected error closing stream")
+}
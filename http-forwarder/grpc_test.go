@@ -0,0 +1,328 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	pb "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/grpc"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// receiverMock records the batches received by the reference receiver, or
+// fails them with err.
+type receiverMock struct {
+	mu      sync.Mutex
+	batches []*pb.Batch
+	err     error
+}
+
+func (rm *receiverMock) handle(ctx context.Context, batch *pb.Batch) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.err != nil {
+		return rm.err
+	}
+	rm.batches = append(rm.batches, batch)
+	return nil
+}
+
+func (rm *receiverMock) reset(err error) []*pb.Batch {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	batches := rm.batches
+	rm.batches = nil
+	rm.err = err
+	return batches
+}
+
+// runReceiver runs the reference receiver on the address, with the server
+// options.
+func runReceiver(t *testing.T, addr string, rm *receiverMock, opts ...grpc.ServerOption) (*grpc.Server, string) {
+	lis, err := net.Listen("tcp", addr)
+	require.Nil(t, err, fmt.Sprintf("unexpected error listening: %s", err))
+	srv := grpc.NewServer(opts...)
+	pb.RegisterReceiverServer(srv, pb.NewReceiver(rm.handle))
+	go srv.Serve(lis)
+	return srv, lis.Addr().String()
+}
+
+func TestNewGRPCSink(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  writer.GRPCConfig
+		err  error
+	}{
+		{
+			desc: "create sink",
+			cfg:  writer.GRPCConfig{URL: "localhost:8186"},
+			err:  nil,
+		},
+		{
+			desc: "create sink without URL",
+			cfg:  writer.GRPCConfig{},
+			err:  writer.ErrInvalidGRPC,
+		},
+		{
+			desc: "create sink with negative window",
+			cfg:  writer.GRPCConfig{URL: "localhost:8186", Window: -1},
+			err:  writer.ErrInvalidGRPC,
+		},
+		{
+			desc: "create sink with client certificate without key",
+			cfg:  writer.GRPCConfig{URL: "localhost:8186", ClientCertFile: "client.pem"},
+			err:  writer.ErrInvalidGRPC,
+		},
+		{
+			desc: "create sink with missing CA certificates",
+			cfg:  writer.GRPCConfig{URL: "localhost:8186", CACertFile: "missing.pem"},
+			err:  writer.ErrInvalidGRPC,
+		},
+	}
+
+	for _, tc := range cases {
+		sink, err := writer.NewGRPCSink(tc.cfg, nopMetrics, tracing.NewNop(), testLog)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		if err == nil {
+			sink.Close()
+		}
+	}
+}
+
+func TestGRPCSink(t *testing.T) {
+	rm := &receiverMock{}
+	srv, addr := runReceiver(t, "127.0.0.1:0", rm)
+	defer srv.Stop()
+
+	sink, err := writer.NewGRPCSink(writer.GRPCConfig{URL: addr, MaxRecords: 2, Window: 1, Timeout: 5 * time.Second}, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating sink: %s", err))
+	defer sink.Close()
+
+	state := "open"
+	msgs := []senml.Message{
+		{Channel: "45", Subtopic: "room.1", Publisher: "2580", Protocol: "http", Name: "temperature", Unit: "Cel", Value: float(20)},
+		{Channel: "45", Subtopic: "room.1", Publisher: "2580", Protocol: "http", Name: "humidity", Unit: "%RH", Value: float(40)},
+		{Channel: "45", Subtopic: "room.1", Publisher: "2580", Protocol: "http", Name: "state", StringValue: &state},
+		{Channel: "46", Publisher: "2581", Protocol: "http", Name: "temperature", Value: float(21)},
+	}
+
+	cases := []struct {
+		desc     string
+		err      error
+		rejected bool
+		records  map[string]int
+	}{
+		{
+			desc:    "forward batches split by max records",
+			records: map[string]int{"45": 3, "46": 1},
+		},
+		{
+			desc:     "forward batches rejected by receiver",
+			err:      errors.Wrap(pb.ErrRejected, errors.New("unknown channel")),
+			rejected: true,
+		},
+		{
+			desc: "forward batches failed by receiver",
+			err:  errors.New("storage unavailable"),
+		},
+	}
+
+	for _, tc := range cases {
+		rm.reset(tc.err)
+		ctx := writer.WithTags(context.Background(), map[string]string{"site": "lab"})
+		err := sink.SaveContext(ctx, msgs...)
+		if tc.err != nil {
+			assert.NotNil(t, err, fmt.Sprintf("%s: expected error", tc.desc))
+			assert.Equal(t, tc.rejected, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+			continue
+		}
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+
+		records := map[string]int{}
+		for _, b := range rm.reset(nil) {
+			assert.LessOrEqual(t, len(b.Records), 2, fmt.Sprintf("%s: batch exceeds max records", tc.desc))
+			assert.NotEmpty(t, b.Key, fmt.Sprintf("%s: expected idempotency key", tc.desc))
+			assert.Equal(t, "lab", b.Tags["site"], fmt.Sprintf("%s: expected tags", tc.desc))
+			records[b.Address.Channel] += len(b.Records)
+		}
+		assert.Equal(t, tc.records, records, fmt.Sprintf("%s: unexpected records", tc.desc))
+	}
+	assert.Nil(t, sink.CheckConnection(), "expected connection to be established")
+}
+
+func TestGRPCSinkRecords(t *testing.T) {
+	rm := &receiverMock{}
+	srv, addr := runReceiver(t, "127.0.0.1:0", rm)
+	defer srv.Stop()
+
+	sink, err := writer.NewGRPCSink(writer.GRPCConfig{URL: addr, Timeout: 5 * time.Second}, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating sink: %s", err))
+	defer sink.Close()
+
+	on := true
+	err = sink.Save(
+		senml.Message{Channel: "45", Publisher: "2580", Name: "temperature", Unit: "Cel", Time: 1600000000, Value: float(20), Sum: float(120)},
+		senml.Message{Channel: "45", Publisher: "2580", Name: "door", Time: 1600000001, BoolValue: &on},
+	)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+
+	batches := rm.reset(nil)
+	require.Len(t, batches, 1, "expected a batch")
+	b := batches[0]
+	assert.Equal(t, "2580", b.Address.Publisher, "unexpected publisher")
+	require.Len(t, b.Records, 2, "expected records")
+	for _, r := range b.Records {
+		switch r.Name {
+		case "temperature":
+			assert.Equal(t, "Cel", r.Unit, "unexpected unit")
+			assert.Equal(t, float64(1600000000), r.Time, "unexpected time")
+			assert.Equal(t, 20.0, r.GetFloatValue(), "unexpected value")
+			require.NotNil(t, r.Sum, "expected sum")
+			assert.Equal(t, 120.0, *r.Sum, "unexpected sum")
+		case "door":
+			assert.True(t, r.GetBoolValue(), "unexpected value")
+			assert.Nil(t, r.Sum, "unexpected sum")
+		default:
+			t.Errorf("unexpected record %s", r.Name)
+		}
+	}
+}
+
+func TestGRPCSinkReconnect(t *testing.T) {
+	rm := &receiverMock{}
+	srv, addr := runReceiver(t, "127.0.0.1:0", rm)
+
+	sink, err := writer.NewGRPCSink(writer.GRPCConfig{URL: addr, Timeout: 500 * time.Millisecond}, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating sink: %s", err))
+	defer sink.Close()
+
+	msg := senml.Message{Channel: "45", Name: "temperature", Value: float(20)}
+	require.Nil(t, sink.Save(msg), "unexpected error forwarding batch")
+
+	srv.Stop()
+	assert.Eventually(t, func() bool {
+		return sink.Save(msg) != nil
+	}, 5*time.Second, 10*time.Millisecond, "expected forwarding to fail without receiver")
+
+	srv, _ = runReceiver(t, addr, rm)
+	defer srv.Stop()
+	assert.Eventually(t, func() bool {
+		return sink.Save(msg) == nil
+	}, 10*time.Second, 10*time.Millisecond, "expected forwarding to succeed once reconnected")
+}
+
+func TestGRPCSinkTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error loading certificate: %s", err))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	creds := credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert})
+
+	rm := &receiverMock{}
+	srv, addr := runReceiver(t, "127.0.0.1:0", rm, grpc.Creds(creds))
+	defer srv.Stop()
+
+	cases := []struct {
+		desc string
+		cfg  writer.GRPCConfig
+		err  bool
+	}{
+		{
+			desc: "forward with CA and client certificate",
+			cfg: writer.GRPCConfig{
+				URL:            addr,
+				CACertFile:     filepath.Join(dir, "ca.pem"),
+				ClientCertFile: filepath.Join(dir, "client.pem"),
+				ClientKeyFile:  filepath.Join(dir, "client-key.pem"),
+			},
+		},
+		{
+			desc: "forward without client certificate",
+			cfg:  writer.GRPCConfig{URL: addr, CACertFile: filepath.Join(dir, "ca.pem")},
+			err:  true,
+		},
+		{
+			desc: "forward without TLS",
+			cfg:  writer.GRPCConfig{URL: addr},
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc.cfg.Timeout = 500 * time.Millisecond
+		sink, err := writer.NewGRPCSink(tc.cfg, nopMetrics, tracing.NewNop(), testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating sink: %s", tc.desc, err))
+		err = sink.Save(senml.Message{Channel: "45", Name: "temperature", Value: float(20)})
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		sink.Close()
+	}
+}
+
+// writeCert writes the certificate and key of the name to the directory,
+// signed by the parent or self-signed if the parent is nil.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err, fmt.Sprintf("unexpected error generating key: %s", err))
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating certificate: %s", err))
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err, fmt.Sprintf("unexpected error parsing certificate: %s", err))
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err, fmt.Sprintf("unexpected error marshalling key: %s", err))
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600), "unexpected error writing certificate")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600), "unexpected error writing key")
+
+	return cert, key
+}
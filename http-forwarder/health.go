@@ -0,0 +1,40 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"fmt"
+
+	"github.com/mainflux/mainflux/errors"
+)
+
+// ErrQueueAboveThreshold indicates that the retry queue holds more batches
+// than the readiness threshold.
+var ErrQueueAboveThreshold = errors.New("retry queue is above threshold")
+
+// Check reports the status of a forwarder dependency. A nil error means
+// that the dependency is healthy.
+type Check func() error
+
+// BreakerCheck returns check which fails while the circuit of the current
+// remote target is open.
+func BreakerCheck(breaker CircuitBreaker, remote *Remote) Check {
+	return func() error {
+		if breaker.State(target(remote.Config().URL)) == StateOpen {
+			return ErrCircuitOpen
+		}
+		return nil
+	}
+}
+
+// QueueCheck returns check which fails while the retry queue holds more
+// than threshold batches, including the batches of the spill file.
+func QueueCheck(queue *RetryQueue, threshold int) Check {
+	return func() error {
+		if depth := queue.Depth(); depth > threshold {
+			return errors.Wrap(ErrQueueAboveThreshold, fmt.Errorf("%d batches queued", depth))
+		}
+		return nil
+	}
+}
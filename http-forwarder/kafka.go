@@ -0,0 +1,414 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+// Keys of the Kafka messages.
+const (
+	// KafkaKeyChannel keys the messages by channel. It is the default.
+	KafkaKeyChannel = "channel"
+
+	// KafkaKeyPublisher keys the messages by publisher.
+	KafkaKeyPublisher = "publisher"
+
+	// KafkaKeyNone produces the messages without key.
+	KafkaKeyNone = "none"
+)
+
+const (
+	// DefKafkaTopic is the topic template used when none is set, which
+	// mirrors the NATS subjects of the messages.
+	DefKafkaTopic = "channels.{channel}.{subtopic}"
+
+	defKafkaVersion = "2.1.0"
+	defKafkaTimeout = 10 * time.Second
+	maxKafkaTopic   = 249
+)
+
+var (
+	// ErrInvalidKafka indicates that the Kafka sink settings are malformed.
+	ErrInvalidKafka = errors.New("invalid Kafka sink")
+
+	errProduceMessage = errors.New("failed to produce message to Kafka")
+
+	kafkaTopic = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+	compressionCodecs = map[string]sarama.CompressionCodec{
+		"none":   sarama.CompressionNone,
+		"gzip":   sarama.CompressionGZIP,
+		"snappy": sarama.CompressionSnappy,
+		"lz4":    sarama.CompressionLZ4,
+		"zstd":   sarama.CompressionZSTD,
+	}
+)
+
+// KafkaConfig contains the settings of the Kafka sink.
+type KafkaConfig struct {
+	// Brokers are the addresses of the bootstrap brokers.
+	Brokers []string
+
+	// ClientID identifies the producer in the broker logs and quotas.
+	ClientID string
+
+	// Version is the Kafka version of the brokers, 2.1.0 if empty.
+	Version string
+
+	// Topic is the template of the topics the records are produced to,
+	// DefKafkaTopic if empty. The {channel}, {subtopic}, {publisher} and
+	// {protocol} placeholders are replaced by the values of the address.
+	// Empty dot separated parts are removed.
+	Topic string
+
+	// Key selects the key of the messages: channel (default), publisher or
+	// none.
+	Key string
+
+	// Acks is the acknowledgement required from the brokers: none, leader
+	// or all (default).
+	Acks string
+
+	// Compression is the compression codec of the messages: none
+	// (default), gzip, snappy, lz4 or zstd.
+	Compression string
+
+	// Idempotent enables the idempotent producer, which writes each
+	// message once whatever the retries. It requires the all acks.
+	Idempotent bool
+
+	// Timeout is the time allowed to the brokers to acknowledge the
+	// messages, 10 seconds if 0.
+	Timeout time.Duration
+}
+
+func (cfg *KafkaConfig) defaults() {
+	if cfg.Version == "" {
+		cfg.Version = defKafkaVersion
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = DefKafkaTopic
+	}
+	if cfg.Key == "" {
+		cfg.Key = KafkaKeyChannel
+	}
+	if cfg.Acks == "" {
+		cfg.Acks = "all"
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = "none"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defKafkaTimeout
+	}
+}
+
+func (cfg KafkaConfig) validate() error {
+	switch cfg.Key {
+	case KafkaKeyChannel, KafkaKeyPublisher, KafkaKeyNone:
+	default:
+		return errors.Wrap(ErrInvalidKafka, fmt.Errorf("unknown key %s", cfg.Key))
+	}
+	for _, p := range topicPlaceholder.FindAllString(cfg.Topic, -1) {
+		switch p {
+		case "{channel}", "{subtopic}", "{publisher}", "{protocol}":
+		default:
+			return errors.Wrap(ErrInvalidKafka, fmt.Errorf("unknown placeholder %s", p))
+		}
+	}
+	if !kafkaTopic.MatchString(topicPlaceholder.ReplaceAllString(cfg.Topic, "x")) {
+		return errors.Wrap(ErrInvalidKafka, errors.New(cfg.Topic))
+	}
+	return nil
+}
+
+// saramaConfig returns the producer settings.
+func (cfg KafkaConfig) saramaConfig() (*sarama.Config, error) {
+	sc := sarama.NewConfig()
+	if cfg.ClientID != "" {
+		sc.ClientID = cfg.ClientID
+	}
+	version, err := sarama.ParseKafkaVersion(cfg.Version)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidKafka, err)
+	}
+	sc.Version = version
+
+	switch cfg.Acks {
+	case "none":
+		sc.Producer.RequiredAcks = sarama.NoResponse
+	case "leader":
+		sc.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all":
+		sc.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return nil, errors.Wrap(ErrInvalidKafka, fmt.Errorf("unknown acks %s", cfg.Acks))
+	}
+
+	codec, ok := compressionCodecs[cfg.Compression]
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidKafka, fmt.Errorf("unknown compression %s", cfg.Compression))
+	}
+	sc.Producer.Compression = codec
+
+	if cfg.Idempotent {
+		if cfg.Acks != "all" {
+			return nil, errors.Wrap(ErrInvalidKafka, errors.New("idempotent producer requires all acks"))
+		}
+		sc.Producer.Idempotent = true
+		sc.Net.MaxOpenRequests = 1
+	}
+	if cfg.Timeout < 0 {
+		return nil, errors.Wrap(ErrInvalidKafka, errors.New("timeout must not be negative"))
+	}
+	sc.Producer.Timeout = cfg.Timeout
+	sc.Producer.Return.Successes = true
+
+	if err := sc.Validate(); err != nil {
+		return nil, errors.Wrap(ErrInvalidKafka, err)
+	}
+	return sc, nil
+}
+
+// NewKafkaProducer returns producer connected to the brokers, with the
+// acks, compression and idempotence settings.
+func NewKafkaProducer(cfg KafkaConfig) (sarama.SyncProducer, error) {
+	cfg.defaults()
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.Wrap(ErrInvalidKafka, errors.New("missing brokers"))
+	}
+	sc, err := cfg.saramaConfig()
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewSyncProducer(cfg.Brokers, sc)
+}
+
+var _ Repository = (*KafkaSink)(nil)
+
+// KafkaSink produces the forwarded records to Kafka topics, encoded as they
+// are sent to the remote HTTP target with the delivery granularity carried
+// by the context.
+type KafkaSink struct {
+	cfg      KafkaConfig
+	target   string
+	headers  bool
+	producer sarama.SyncProducer
+	dedup    DedupCache
+	metrics  Metrics
+	tracer   tracing.Tracer
+}
+
+// NewKafkaSink returns Kafka sink producing the records with the producer.
+// Each message carries an idempotency key header, and messages found in the
+// dedup cache are not produced again.
+func NewKafkaSink(cfg KafkaConfig, producer sarama.SyncProducer, dedup DedupCache, metrics Metrics, tracer tracing.Tracer) (*KafkaSink, error) {
+	cfg.defaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	version, err := sarama.ParseKafkaVersion(cfg.Version)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidKafka, err)
+	}
+	return &KafkaSink{
+		cfg:      cfg,
+		target:   fmt.Sprintf("kafka://%s", strings.Join(cfg.Brokers, ",")),
+		headers:  version.IsAtLeast(sarama.V0_11_0_0),
+		producer: producer,
+		dedup:    dedup,
+		metrics:  metrics,
+		tracer:   tracer,
+	}, nil
+}
+
+func (s *KafkaSink) Save(messages ...senml.Message) error {
+	return s.SaveContext(context.Background(), messages...)
+}
+
+// SaveContext produces the messages of the records in a single call, so
+// that they are batched by partition. The messages produced within the
+// dedup window are skipped, so that only the failed ones are produced again
+// when the records are retried.
+func (s *KafkaSink) SaveContext(ctx context.Context, messages ...senml.Message) (err error) {
+	tags := TagsFromContext(ctx)
+
+	var msgs []*sarama.ProducerMessage
+	var records []int
+	keys := make(map[*sarama.ProducerMessage]string)
+	add := func(address Address, msg interface{}, n int) error {
+		pm, key, err := s.message(address, msg)
+		if err != nil {
+			return err
+		}
+		if s.dedup.Seen(s.target + key) {
+			s.metrics.DedupHits.With("target", s.target).Add(1)
+			return nil
+		}
+		msgs = append(msgs, pm)
+		records = append(records, n)
+		keys[pm] = key
+		return nil
+	}
+
+	switch DeliveryFromContext(ctx) {
+	case DeliveryRecord:
+		for _, msg := range messages {
+			if err := add(addressOf(msg), recordFields(msg, tags), 1); err != nil {
+				return errors.Wrap(errProduceMessage, err)
+			}
+		}
+	case DeliveryBatch:
+		packs, _ := groupPacks(messages, 0, tags)
+		if err := add(Address{}, addressBatches(packs), len(messages)); err != nil {
+			return errors.Wrap(errProduceMessage, err)
+		}
+	default:
+		packs, _ := groupPacks(messages, 0, tags)
+		for _, p := range packs {
+			if err := add(p.address, p.records, len(p.records)); err != nil {
+				return errors.Wrap(errProduceMessage, err)
+			}
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	_, span := s.tracer.Start(ctx, "produce", tracing.KindProducer, tracing.Int("records", len(messages)), tracing.Int("messages", len(msgs)))
+	span.SetAttributes(tracing.String("messaging.system", "kafka"))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	for _, n := range records {
+		s.metrics.BatchSize.With("target", s.target).Observe(float64(n))
+	}
+	if err := s.producer.SendMessages(msgs); err != nil {
+		return errors.Wrap(errProduceMessage, s.failed(msgs, records, keys, err))
+	}
+	s.succeeded(msgs, records, keys, nil)
+	return nil
+}
+
+// message returns the Kafka message of the encoded records of the address,
+// and its idempotency key.
+func (s *KafkaSink) message(address Address, msg interface{}) (*sarama.ProducerMessage, string, error) {
+	topic, err := s.topic(address)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, "", errors.Wrap(ErrRemoteRejected, errors.Wrap(errEncode, err))
+	}
+
+	key := idempotencyKey(address, data)
+	pm := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data)}
+	// Headers are supported from Kafka 0.11.
+	if s.headers {
+		pm.Headers = []sarama.RecordHeader{{Key: []byte(IdempotencyKeyHeader), Value: []byte(key)}}
+	}
+	var partitionKey string
+	switch s.cfg.Key {
+	case KafkaKeyChannel:
+		partitionKey = address.Channel
+	case KafkaKeyPublisher:
+		partitionKey = address.Published
+	}
+	if partitionKey != "" {
+		pm.Key = sarama.StringEncoder(partitionKey)
+	}
+	return pm, key, nil
+}
+
+// topic returns the topic the records of the address are produced to.
+func (s *KafkaSink) topic(address Address) (string, error) {
+	r := strings.NewReplacer(
+		"{channel}", address.Channel,
+		"{subtopic}", address.Subtopic,
+		"{publisher}", address.Published,
+		"{protocol}", address.Protocol,
+	)
+
+	var parts []string
+	for _, part := range strings.Split(r.Replace(s.cfg.Topic), ".") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	topic := strings.Join(parts, ".")
+	if len(topic) > maxKafkaTopic || !kafkaTopic.MatchString(topic) {
+		return "", errors.Wrap(ErrRemoteRejected, errors.Wrap(errInvalidTopic, errors.New(topic)))
+	}
+	return topic, nil
+}
+
+// failed counts the messages which failed and the ones which succeeded, and
+// returns the error of the producer. It is rejected only if every failed
+// message is refused for a reason which producing it again doesn't fix,
+// otherwise the records are retried and the messages which succeeded are
+// skipped within the dedup window.
+func (s *KafkaSink) failed(msgs []*sarama.ProducerMessage, records []int, keys map[*sarama.ProducerMessage]string, err error) error {
+	perrs, ok := err.(sarama.ProducerErrors)
+	if !ok {
+		for range msgs {
+			s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeError).Add(1)
+		}
+		return err
+	}
+
+	failed := make(map[*sarama.ProducerMessage]bool)
+	var rejected, temporary error
+	for _, perr := range perrs {
+		failed[perr.Msg] = true
+		s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeFailure).Add(1)
+		switch perr.Err {
+		case sarama.ErrMessageSizeTooLarge, sarama.ErrInvalidTopic, sarama.ErrInvalidMessage:
+			rejected = perr.Err
+		default:
+			if temporary == nil {
+				temporary = perr.Err
+			}
+		}
+	}
+	s.succeeded(msgs, records, keys, failed)
+
+	if temporary != nil {
+		return temporary
+	}
+	return errors.Wrap(ErrRemoteRejected, rejected)
+}
+
+// succeeded counts the messages which are not failed, and remembers their
+// idempotency keys.
+func (s *KafkaSink) succeeded(msgs []*sarama.ProducerMessage, records []int, keys map[*sarama.ProducerMessage]string, failed map[*sarama.ProducerMessage]bool) {
+	for i, pm := range msgs {
+		if failed[pm] {
+			continue
+		}
+		s.dedup.Add(s.target + keys[pm])
+		s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeSuccess).Add(1)
+		s.metrics.Records.With("target", s.target).Add(float64(records[i]))
+		s.metrics.Bytes.With("target", s.target).Add(float64(pm.Value.Length()))
+	}
+}
+
+// Close closes the producer, after the messages being produced are sent.
+func (s *KafkaSink) Close() error {
+	return s.producer.Close()
+}
@@ -0,0 +1,349 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ sarama.SyncProducer = (*producerMock)(nil)
+
+// producerMock records the produced messages, or fails them with the error
+// of their topic if any, otherwise with err.
+type producerMock struct {
+	msgs []*sarama.ProducerMessage
+	errs map[string]error
+	err  error
+}
+
+func (pm *producerMock) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if err := pm.SendMessages([]*sarama.ProducerMessage{msg}); err != nil {
+		return -1, -1, err
+	}
+	return 0, 0, nil
+}
+
+func (pm *producerMock) SendMessages(msgs []*sarama.ProducerMessage) error {
+	var perrs sarama.ProducerErrors
+	for _, msg := range msgs {
+		err, ok := pm.errs[msg.Topic]
+		if !ok {
+			err = pm.err
+		}
+		if err != nil {
+			perrs = append(perrs, &sarama.ProducerError{Msg: msg, Err: err})
+			continue
+		}
+		pm.msgs = append(pm.msgs, msg)
+	}
+	if len(perrs) > 0 {
+		return perrs
+	}
+	return nil
+}
+
+func (pm *producerMock) Close() error {
+	return nil
+}
+
+// produced is a message produced to a topic with a key.
+type produced struct {
+	topic string
+	key   string
+}
+
+func TestNewKafkaProducer(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  writer.KafkaConfig
+	}{
+		{
+			desc: "create producer without brokers",
+			cfg:  writer.KafkaConfig{},
+		},
+		{
+			desc: "create producer with unknown acks",
+			cfg:  writer.KafkaConfig{Brokers: []string{"localhost:9092"}, Acks: "some"},
+		},
+		{
+			desc: "create producer with unknown compression",
+			cfg:  writer.KafkaConfig{Brokers: []string{"localhost:9092"}, Compression: "brotli"},
+		},
+		{
+			desc: "create idempotent producer without all acks",
+			cfg:  writer.KafkaConfig{Brokers: []string{"localhost:9092"}, Acks: "leader", Idempotent: true},
+		},
+		{
+			desc: "create producer with compression unsupported by version",
+			cfg:  writer.KafkaConfig{Brokers: []string{"localhost:9092"}, Version: "1.0.0", Compression: "zstd"},
+		},
+		{
+			desc: "create producer with malformed version",
+			cfg:  writer.KafkaConfig{Brokers: []string{"localhost:9092"}, Version: "latest"},
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := writer.NewKafkaProducer(tc.cfg)
+		assert.True(t, errors.Contains(err, writer.ErrInvalidKafka), fmt.Sprintf("%s: expected %v got %v", tc.desc, writer.ErrInvalidKafka, err))
+	}
+}
+
+func TestNewKafkaSink(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  writer.KafkaConfig
+		err  error
+	}{
+		{
+			desc: "create sink with defaults",
+			cfg:  writer.KafkaConfig{},
+			err:  nil,
+		},
+		{
+			desc: "create sink with every setting",
+			cfg:  writer.KafkaConfig{Topic: "mainflux-{protocol}.{channel}", Key: writer.KafkaKeyPublisher},
+			err:  nil,
+		},
+		{
+			desc: "create sink with unknown key",
+			cfg:  writer.KafkaConfig{Key: "name"},
+			err:  writer.ErrInvalidKafka,
+		},
+		{
+			desc: "create sink with unknown topic placeholder",
+			cfg:  writer.KafkaConfig{Topic: "channels.{name}"},
+			err:  writer.ErrInvalidKafka,
+		},
+		{
+			desc: "create sink with invalid topic",
+			cfg:  writer.KafkaConfig{Topic: "channels/{channel}"},
+			err:  writer.ErrInvalidKafka,
+		},
+		{
+			desc: "create sink with malformed version",
+			cfg:  writer.KafkaConfig{Version: "latest"},
+			err:  writer.ErrInvalidKafka,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := writer.NewKafkaSink(tc.cfg, &producerMock{}, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	msgs := []senml.Message{
+		{Channel: "45", Subtopic: "room.1", Publisher: "2580", Protocol: "http", Name: "temperature", Value: float(20)},
+		{Channel: "45", Subtopic: "room.1", Publisher: "2580", Protocol: "http", Name: "humidity", Value: float(40)},
+		{Channel: "46", Publisher: "2581", Protocol: "http", Name: "temperature", Value: float(21)},
+	}
+
+	cases := []struct {
+		desc     string
+		cfg      writer.KafkaConfig
+		delivery string
+		produced []produced
+		records  []int
+	}{
+		{
+			desc:     "produce packs keyed by channel",
+			cfg:      writer.KafkaConfig{},
+			produced: []produced{{topic: "channels.45.room.1", key: "45"}, {topic: "channels.46", key: "46"}},
+			records:  []int{2, 1},
+		},
+		{
+			desc:     "produce records keyed by publisher",
+			cfg:      writer.KafkaConfig{Topic: "{protocol}-{channel}", Key: writer.KafkaKeyPublisher},
+			delivery: writer.DeliveryRecord,
+			produced: []produced{{topic: "http-45", key: "2580"}, {topic: "http-45", key: "2580"}, {topic: "http-46", key: "2581"}},
+			records:  []int{1, 1, 1},
+		},
+		{
+			desc:     "produce envelope without key",
+			cfg:      writer.KafkaConfig{Topic: "forwarder.{channel}", Key: writer.KafkaKeyNone},
+			delivery: writer.DeliveryBatch,
+			produced: []produced{{topic: "forwarder"}},
+			records:  []int{2},
+		},
+	}
+
+	for _, tc := range cases {
+		producer := &producerMock{}
+		sink, err := writer.NewKafkaSink(tc.cfg, producer, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating sink: %s", tc.desc, err))
+
+		ctx := writer.WithDelivery(context.Background(), tc.delivery)
+		err = sink.SaveContext(ctx, msgs...)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+
+		var prod []produced
+		var records []int
+		for _, msg := range producer.msgs {
+			p := produced{topic: msg.Topic}
+			if msg.Key != nil {
+				key, err := msg.Key.Encode()
+				require.Nil(t, err, fmt.Sprintf("%s: unexpected error encoding key: %s", tc.desc, err))
+				p.key = string(key)
+			}
+			prod = append(prod, p)
+			require.Len(t, msg.Headers, 1, fmt.Sprintf("%s: expected idempotency key header", tc.desc))
+			assert.Equal(t, writer.IdempotencyKeyHeader, string(msg.Headers[0].Key), fmt.Sprintf("%s: unexpected header", tc.desc))
+			assert.Len(t, msg.Headers[0].Value, 64, fmt.Sprintf("%s: unexpected idempotency key", tc.desc))
+
+			value, err := msg.Value.Encode()
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error encoding value: %s", tc.desc, err))
+			if tc.delivery == writer.DeliveryRecord {
+				var record map[string]interface{}
+				err = json.Unmarshal(value, &record)
+				records = append(records, 1)
+			} else {
+				var pack []map[string]interface{}
+				err = json.Unmarshal(value, &pack)
+				records = append(records, len(pack))
+			}
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding value: %s", tc.desc, err))
+		}
+		assert.ElementsMatch(t, tc.produced, prod, fmt.Sprintf("%s: unexpected messages", tc.desc))
+		assert.ElementsMatch(t, tc.records, records, fmt.Sprintf("%s: unexpected records", tc.desc))
+	}
+}
+
+func TestKafkaSinkErrors(t *testing.T) {
+	msg := senml.Message{Channel: "45", Name: "temperature", Value: float(20)}
+
+	cases := []struct {
+		desc     string
+		err      error
+		rejected bool
+	}{
+		{
+			desc:     "produce message refused as too large",
+			err:      sarama.ErrMessageSizeTooLarge,
+			rejected: true,
+		},
+		{
+			desc:     "produce message without leader",
+			err:      sarama.ErrNotLeaderForPartition,
+			rejected: false,
+		},
+	}
+
+	for _, tc := range cases {
+		sink, err := writer.NewKafkaSink(writer.KafkaConfig{}, &producerMock{err: tc.err}, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating sink: %s", tc.desc, err))
+
+		err = sink.Save(msg)
+		assert.NotNil(t, err, fmt.Sprintf("%s: expected error", tc.desc))
+		assert.Equal(t, tc.rejected, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+	}
+}
+
+func TestKafkaSinkPartialFailure(t *testing.T) {
+	msgs := []senml.Message{
+		{Channel: "45", Name: "temperature", Value: float(20)},
+		{Channel: "46", Name: "temperature", Value: float(21)},
+		{Channel: "47", Name: "temperature", Value: float(22)},
+	}
+
+	cases := []struct {
+		desc     string
+		errs     map[string]error
+		rejected bool
+		produced []string
+	}{
+		{
+			desc:     "produce records with a message failing temporarily",
+			errs:     map[string]error{"channels.46": sarama.ErrNotLeaderForPartition},
+			rejected: false,
+			produced: []string{"channels.45", "channels.47"},
+		},
+		{
+			desc:     "produce records with a message refused and another failing temporarily",
+			errs:     map[string]error{"channels.45": sarama.ErrMessageSizeTooLarge, "channels.46": sarama.ErrNotLeaderForPartition},
+			rejected: false,
+			produced: []string{"channels.47"},
+		},
+		{
+			desc:     "produce records with a message refused",
+			errs:     map[string]error{"channels.45": sarama.ErrMessageSizeTooLarge},
+			rejected: true,
+			produced: []string{"channels.46", "channels.47"},
+		},
+	}
+
+	for _, tc := range cases {
+		producer := &producerMock{errs: tc.errs}
+		sink, err := writer.NewKafkaSink(writer.KafkaConfig{}, producer, writer.NewDedupCache(time.Minute), nopMetrics, tracing.NewNop())
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating sink: %s", tc.desc, err))
+
+		err = sink.Save(msgs...)
+		assert.NotNil(t, err, fmt.Sprintf("%s: expected error", tc.desc))
+		assert.Equal(t, tc.rejected, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		assert.ElementsMatch(t, tc.produced, topics(producer.msgs), fmt.Sprintf("%s: unexpected produced messages", tc.desc))
+
+		// Only the failed messages are produced when the records are
+		// retried.
+		producer.msgs = nil
+		producer.errs = nil
+		err = sink.Save(msgs...)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error retrying %v", tc.desc, err))
+		var failed []string
+		for topic := range tc.errs {
+			failed = append(failed, topic)
+		}
+		assert.ElementsMatch(t, failed, topics(producer.msgs), fmt.Sprintf("%s: unexpected messages produced again", tc.desc))
+	}
+}
+
+func topics(msgs []*sarama.ProducerMessage) []string {
+	var topics []string
+	for _, msg := range msgs {
+		topics = append(topics, msg.Topic)
+	}
+	return topics
+}
+
+func TestKafkaSinkBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("channels.45", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+
+	cfg := writer.KafkaConfig{Brokers: []string{broker.Addr()}, Acks: "leader", Compression: "gzip"}
+	producer, err := writer.NewKafkaProducer(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating producer: %s", err))
+
+	sink, err := writer.NewKafkaSink(cfg, producer, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating sink: %s", err))
+	defer sink.Close()
+
+	err = sink.Save(senml.Message{Channel: "45", Name: "temperature", Value: float(20)})
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+
+	var requests int
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			requests++
+		}
+	}
+	assert.Equal(t, 1, requests, "expected records produced to broker")
+}
@@ -0,0 +1,174 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+const (
+	// senmlContentType is the content type of the SenML packs accepted by
+	// the Mainflux HTTP adapter.
+	senmlContentType = "application/senml+json"
+
+	defMainfluxTimeout = 10 * time.Second
+)
+
+var (
+	// ErrInvalidMainflux indicates that the Mainflux bridge settings or its
+	// mapping file are malformed.
+	ErrInvalidMainflux = errors.New("invalid Mainflux bridge")
+
+	// ErrChannelNotMapped indicates that the channel of the records has no
+	// remote channel in the mapping file of the Mainflux bridge.
+	ErrChannelNotMapped = errors.New("channel not mapped")
+)
+
+// MainfluxConfig contains the settings of the Mainflux bridge.
+type MainfluxConfig struct {
+	// URL is the URL of the HTTP adapter of the remote Mainflux, e.g.
+	// https://mainflux.example.com/http.
+	URL string
+
+	// MappingFile is the path of the file mapping the local channels to
+	// the remote channels and thing keys.
+	MappingFile string
+
+	// Timeout is the time allowed for a request, 10 seconds if 0.
+	Timeout time.Duration
+}
+
+// ChannelMapping contains the remote channel the records of a local channel
+// are published to, and the key of the remote thing publishing them.
+type ChannelMapping struct {
+	ID  string `toml:"id"`
+	Key string `toml:"key"`
+}
+
+// mappingFile contains the channels table of the mapping file, keyed by
+// local channel ID.
+type mappingFile struct {
+	Channels map[string]ChannelMapping `toml:"channels"`
+}
+
+var _ Repository = (*MainfluxBridge)(nil)
+
+// MainfluxBridge publishes the forwarded records to the HTTP adapter of a
+// remote Mainflux, as the things of the mapping file. The records of an
+// address are posted as a SenML pack to the remote channel mapped to their
+// channel, with the same subtopic.
+type MainfluxBridge struct {
+	url      string
+	target   string
+	channels map[string]ChannelMapping
+	repo     *httpforwarderRepo
+}
+
+// NewMainfluxBridge returns Mainflux bridge with the channels of the mapping
+// file. Requests are guarded by the circuit breaker and instrumented like
+// the ones of the HTTP forwarder.
+func NewMainfluxBridge(cfg MainfluxConfig, breaker CircuitBreaker, dedup DedupCache, metrics Metrics, tracer tracing.Tracer) (*MainfluxBridge, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defMainfluxTimeout
+	}
+	if cfg.Timeout < 0 {
+		return nil, errors.Wrap(ErrInvalidMainflux, errors.New("timeout must not be negative"))
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidMainflux, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Wrap(ErrInvalidMainflux, errors.New(cfg.URL))
+	}
+
+	var mf mappingFile
+	if _, err := toml.DecodeFile(cfg.MappingFile, &mf); err != nil {
+		return nil, errors.Wrap(ErrInvalidMainflux, err)
+	}
+	for channel, m := range mf.Channels {
+		if m.ID == "" || m.Key == "" {
+			return nil, errors.Wrap(ErrInvalidMainflux, fmt.Errorf("channel %s requires id and key", channel))
+		}
+	}
+
+	return &MainfluxBridge{
+		url:      strings.TrimRight(cfg.URL, "/"),
+		target:   target(cfg.URL),
+		channels: mf.Channels,
+		repo: &httpforwarderRepo{
+			breaker: breaker,
+			metrics: metrics,
+			tracer:  tracer,
+			dedup:   dedup,
+			client:  &http.Client{Timeout: cfg.Timeout},
+		},
+	}, nil
+}
+
+func (b *MainfluxBridge) Save(messages ...senml.Message) error {
+	return b.SaveContext(context.Background(), messages...)
+}
+
+// SaveContext posts a SenML pack per address, whatever the delivery
+// granularity, since the HTTP adapter only accepts SenML packs of a single
+// channel.
+func (b *MainfluxBridge) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	tags := TagsFromContext(ctx)
+
+	_, span := b.repo.tracer.Start(ctx, "group", tracing.KindInternal, tracing.Int("records", len(messages)))
+	packs, addresses := groupPacks(messages, 0, tags)
+	span.SetAttributes(tracing.Int("addresses", addresses), tracing.Int("packs", len(packs)))
+	span.End()
+
+	send := func(ctx context.Context, p pack, data []byte) error {
+		m := b.channels[p.address.Channel]
+		header := http.Header{}
+		header.Set("Content-Type", senmlContentType)
+		header.Set("Authorization", fmt.Sprintf("Thing %s", m.Key))
+		return b.repo.post(ctx, b.target, b.channelURL(m.ID, p.address.Subtopic), p.address, header, data, len(p.records))
+	}
+	// Records are rejected before any is sent if a channel is not mapped.
+	for _, p := range packs {
+		if _, ok := b.channels[p.address.Channel]; !ok {
+			err := errors.Wrap(ErrRemoteRejected, errors.Wrap(ErrChannelNotMapped, errors.New(p.address.Channel)))
+			return errors.Wrap(errSaveMessage, err)
+		}
+	}
+	for _, p := range packs {
+		if err := b.repo.savePack(ctx, 0, p, tags, send); err != nil {
+			return errors.Wrap(errSaveMessage, err)
+		}
+	}
+	return nil
+}
+
+// channelURL returns the URL of the messages of the remote channel, with the
+// subtopic levels as path segments.
+func (b *MainfluxBridge) channelURL(channel, subtopic string) string {
+	u := fmt.Sprintf("%s/channels/%s/messages", b.url, url.PathEscape(channel))
+	if subtopic != "" {
+		u = fmt.Sprintf("%s/%s", u, strings.ReplaceAll(subtopic, ".", "/"))
+	}
+	return u
+}
+
+// Check returns ErrCircuitOpen while the circuit of the remote Mainflux is
+// open.
+func (b *MainfluxBridge) Check() error {
+	if b.repo.breaker.State(b.target) == StateOpen {
+		return ErrCircuitOpen
+	}
+	return nil
+}
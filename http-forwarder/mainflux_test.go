@@ -0,0 +1,197 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mappingCfg = `[channels.45]
+id = "remote-45"
+key = "key-45"
+
+[channels.46]
+id = "remote-46"
+key = "key-46"
+`
+
+// adapterRequest is a request received by the Mainflux HTTP adapter mock.
+type adapterRequest struct {
+	path          string
+	authorization string
+	contentType   string
+	records       int
+}
+
+func newMapping(t *testing.T, dir, cfg string) string {
+	path := filepath.Join(dir, "mainflux.toml")
+	err := ioutil.WriteFile(path, []byte(cfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing mapping: %s", err))
+	return path
+}
+
+func TestNewMainfluxBridge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mainflux")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+	cases := []struct {
+		desc    string
+		url     string
+		mapping string
+		timeout time.Duration
+		err     error
+	}{
+		{
+			desc:    "create bridge",
+			url:     "http://localhost:8008",
+			mapping: mappingCfg,
+			err:     nil,
+		},
+		{
+			desc:    "create bridge with invalid URL",
+			url:     "localhost",
+			mapping: mappingCfg,
+			err:     writer.ErrInvalidMainflux,
+		},
+		{
+			desc:    "create bridge with malformed mapping",
+			url:     "http://localhost:8008",
+			mapping: `[channels`,
+			err:     writer.ErrInvalidMainflux,
+		},
+		{
+			desc: "create bridge with channel without key",
+			url:  "http://localhost:8008",
+			mapping: `[channels.45]
+id = "remote-45"
+`,
+			err: writer.ErrInvalidMainflux,
+		},
+		{
+			desc:    "create bridge with negative timeout",
+			url:     "http://localhost:8008",
+			mapping: mappingCfg,
+			timeout: -time.Second,
+			err:     writer.ErrInvalidMainflux,
+		},
+	}
+
+	for _, tc := range cases {
+		path := newMapping(t, dir, tc.mapping)
+		_, err := writer.NewMainfluxBridge(writer.MainfluxConfig{URL: tc.url, MappingFile: path, Timeout: tc.timeout}, breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+	}
+
+	_, err = writer.NewMainfluxBridge(writer.MainfluxConfig{URL: "http://localhost:8008", MappingFile: filepath.Join(dir, "missing.toml")}, breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+	assert.True(t, errors.Contains(err, writer.ErrInvalidMainflux), fmt.Sprintf("missing mapping: expected %v got %v", writer.ErrInvalidMainflux, err))
+}
+
+func TestMainfluxBridge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mainflux")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var reqs []adapterRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pack []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&pack); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		reqs = append(reqs, adapterRequest{
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+			contentType:   r.Header.Get("Content-Type"),
+			records:       len(pack),
+		})
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+	bridge, err := writer.NewMainfluxBridge(writer.MainfluxConfig{URL: ts.URL + "/http/", MappingFile: newMapping(t, dir, mappingCfg)}, breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating bridge: %s", err))
+
+	cases := []struct {
+		desc     string
+		delivery string
+		msgs     []senml.Message
+		reqs     []adapterRequest
+		err      error
+	}{
+		{
+			desc: "forward records to mapped channels",
+			msgs: []senml.Message{
+				{Channel: "45", Subtopic: "room.1", Publisher: "2580", Name: "temperature", Value: float(20)},
+				{Channel: "45", Subtopic: "room.1", Publisher: "2580", Name: "humidity", Value: float(40)},
+				{Channel: "46", Publisher: "2581", Name: "temperature", Value: float(21)},
+			},
+			reqs: []adapterRequest{
+				{path: "/http/channels/remote-45/messages/room/1", authorization: "Thing key-45", contentType: "application/senml+json", records: 2},
+				{path: "/http/channels/remote-46/messages", authorization: "Thing key-46", contentType: "application/senml+json", records: 1},
+			},
+		},
+		{
+			desc:     "forward records as packs with record delivery",
+			delivery: writer.DeliveryRecord,
+			msgs: []senml.Message{
+				{Channel: "46", Name: "temperature", Value: float(21)},
+				{Channel: "46", Name: "humidity", Value: float(41)},
+			},
+			reqs: []adapterRequest{
+				{path: "/http/channels/remote-46/messages", authorization: "Thing key-46", contentType: "application/senml+json", records: 2},
+			},
+		},
+		{
+			desc: "forward records of channel which is not mapped",
+			msgs: []senml.Message{
+				{Channel: "46", Name: "temperature", Value: float(22)},
+				{Channel: "47", Name: "temperature", Value: float(22)},
+			},
+			err: writer.ErrChannelNotMapped,
+		},
+	}
+
+	for _, tc := range cases {
+		mu.Lock()
+		reqs = nil
+		mu.Unlock()
+
+		ctx := writer.WithDelivery(context.Background(), tc.delivery)
+		err := bridge.SaveContext(ctx, tc.msgs...)
+		if tc.err != nil {
+			assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+			assert.True(t, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("%s: expected %v got %v", tc.desc, writer.ErrRemoteRejected, err))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		}
+
+		mu.Lock()
+		assert.ElementsMatch(t, tc.reqs, reqs, fmt.Sprintf("%s: unexpected requests", tc.desc))
+		mu.Unlock()
+	}
+	assert.Nil(t, bridge.Check(), "expected remote Mainflux check to pass")
+}
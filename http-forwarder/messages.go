@@ -5,109 +5,423 @@ package http_forwarder
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
 	"github.com/mainflux/mainflux/errors"
 	"github.com/mainflux/mainflux/transformers/senml"
 	"github.com/mainflux/mainflux/writers"
 )
 
-var errSaveMessage = errors.New("failed to send message to host")
+var (
+	errSaveMessage = errors.New("failed to send message to host")
+	// errEncode indicates that the records can't be encoded, e.g. because
+	// they hold a NaN value. It is wrapped in ErrRemoteRejected, since
+	// sending them again doesn't fix it.
+	errEncode = errors.New("failed to encode records")
 
-var _ writers.MessageRepository = (*httpforwarderRepo)(nil)
+	// ErrRemoteRejected indicates that the remote target refused the
+	// messages for a reason which sending them again doesn't fix.
+	ErrRemoteRejected = errors.New("messages rejected by remote target")
+
+	// ErrBodyTooLarge indicates that the remote target refused a request
+	// body as too large.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// Repository extends the message repository with context aware forwarding,
+// used to carry the trace of the received message.
+type Repository interface {
+	writers.MessageRepository
+
+	// SaveContext forwards messages within the trace carried by the context.
+	SaveContext(ctx context.Context, messages ...senml.Message) error
+}
+
+var _ Repository = (*httpforwarderRepo)(nil)
 
 type httpforwarderRepo struct {
-	remoteUrl   string
-	remoteToken string
+	remote  *Remote
+	breaker CircuitBreaker
+	metrics Metrics
+	tracer  tracing.Tracer
+	dedup   DedupCache
+	client  *http.Client
 }
 
 type Address struct {
 	FullTopic string
+	Channel   string
+	Subtopic  string
 	Published string
 	Protocol  string
 }
 type fields map[string]interface{}
 
-// New returns new HTTP forwarder.
-func New(url string, token string) writers.MessageRepository {
+// New returns new HTTP forwarder sending messages to the remote target.
+// Requests sent to the remote host are guarded by the given circuit breaker
+// and instrumented with the metrics and the tracer. Each batch carries an
+// idempotency key, and batches found in the dedup cache are not sent again.
+func New(remote *Remote, breaker CircuitBreaker, dedup DedupCache, metrics Metrics, tracer tracing.Tracer) Repository {
 	return &httpforwarderRepo{
-		remoteUrl: url,
-		remoteToken: token,
+		remote:  remote,
+		breaker: breaker,
+		metrics: metrics,
+		tracer:  tracer,
+		dedup:   dedup,
+		client:  &http.Client{},
 	}
 }
 
 func (repo *httpforwarderRepo) Save(messages ...senml.Message) error {
-	messagesSorted := repo.sortMessages(messages)
+	return repo.SaveContext(context.Background(), messages...)
+}
+
+func (repo *httpforwarderRepo) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	// Settings are read once so that a reload doesn't affect this call.
+	remote := repo.remote.Config()
+
+	tags := TagsFromContext(ctx)
+	if DeliveryFromContext(ctx) == DeliveryRecord {
+		return repo.saveRecords(ctx, remote, messages, tags)
+	}
+
+	_, span := repo.tracer.Start(ctx, "group", tracing.KindInternal, tracing.Int("records", len(messages)))
+	packs, addresses := groupPacks(messages, remote.MaxRecords, tags)
+	span.SetAttributes(tracing.Int("addresses", addresses), tracing.Int("packs", len(packs)))
+	span.End()
+
+	if DeliveryFromContext(ctx) == DeliveryBatch {
+		return repo.saveEnvelopes(ctx, remote, addressBatches(packs), len(messages), tags)
+	}
 
-	messagesFormatted := make(map[Address][]*fields)
+	send := func(ctx context.Context, p pack, data []byte) error {
+		return repo.send(ctx, remote, addressURL(remote, p.address), p.address, data, len(p.records))
+	}
+	for _, p := range packs {
+		if err := repo.savePack(ctx, remote.MaxBodySize, p, tags, send); err != nil {
+			return errors.Wrap(errSaveMessage, err)
+		}
+	}
+
+	return nil
+}
+
+// pack is the SenML pack of records of an address sent in a request.
+type pack struct {
+	address Address
+	msgs    []senml.Message
+	records []*fields
+}
+
+// groupPacks returns the packs of the records grouped by address, split in
+// chunks of at most max records, and the number of addresses.
+func groupPacks(messages []senml.Message, max int, tags map[string]string) ([]pack, int) {
+	messagesSorted := sortMessages(messages)
+
+	var packs []pack
 	for addr, msgs := range messagesSorted {
-		var basefields = repo.extractBaseFields(msgs)
+		for _, chunk := range splitRecords(msgs, max) {
+			packs = append(packs, newPack(addr, chunk, tags))
+		}
+	}
+	return packs, len(messagesSorted)
+}
 
-		for _, msg := range msgs {
-			var m = fields{}
+// newPack returns the SenML pack of the records, with its own base fields.
+func newPack(address Address, msgs []senml.Message, tags map[string]string) pack {
+	p := pack{address: address, msgs: msgs}
+	var basefields = extractBaseFields(msgs)
 
-			// Add base fields when map is empty
-			if _, ok := messagesFormatted[addr]; !ok {
-				m = basefields
-			}
+	for _, msg := range msgs {
+		var m = fields{}
 
-			m = repo.appendFields(&msg, basefields, m)
-			messagesFormatted[addr] = append(messagesFormatted[addr], &m)
+		// Add base fields to the first record
+		if len(p.records) == 0 {
+			m = basefields
 		}
+
+		m = appendFields(&msg, basefields, m)
+		for label, value := range tags {
+			m[label] = value
+		}
+		p.records = append(p.records, &m)
+	}
+	return p
+}
+
+// packSender sends the encoded pack to the target.
+type packSender func(ctx context.Context, p pack, data []byte) error
+
+// savePack encodes the pack and sends it. A pack exceeding maxBodySize
+// bytes, unless it is 0, or refused by the target as too large, is split in
+// halves sent in order.
+func (repo *httpforwarderRepo) savePack(ctx context.Context, maxBodySize int, p pack, tags map[string]string, send packSender) error {
+	data, err := repo.encode(ctx, p.address, p.records, len(p.records))
+	if err != nil {
+		return err
+	}
+
+	splittable := len(p.msgs) > 1
+	if splittable && maxBodySize > 0 && len(data) > maxBodySize {
+		return repo.saveHalves(ctx, maxBodySize, p, tags, send)
+	}
+	err = send(ctx, p, data)
+	if splittable && errors.Contains(err, ErrBodyTooLarge) {
+		return repo.saveHalves(ctx, maxBodySize, p, tags, send)
 	}
+	return err
+}
+
+func (repo *httpforwarderRepo) saveHalves(ctx context.Context, maxBodySize int, p pack, tags map[string]string, send packSender) error {
+	half := len(p.msgs) / 2
+	if err := repo.savePack(ctx, maxBodySize, newPack(p.address, p.msgs[:half], tags), tags, send); err != nil {
+		return err
+	}
+	return repo.savePack(ctx, maxBodySize, newPack(p.address, p.msgs[half:], tags), tags, send)
+}
+
+// splitRecords returns the records split in chunks of at most max records,
+// or in a single chunk if max is 0.
+func splitRecords(msgs []senml.Message, max int) [][]senml.Message {
+	if max <= 0 || len(msgs) <= max {
+		return [][]senml.Message{msgs}
+	}
+	var chunks [][]senml.Message
+	for len(msgs) > max {
+		chunks = append(chunks, msgs[:max])
+		msgs = msgs[max:]
+	}
+	return append(chunks, msgs)
+}
 
-	for address, msg := range messagesFormatted {
-		data, err := json.Marshal(msg)
+// saveRecords sends a request per record, with the flat JSON object of the
+// record.
+func (repo *httpforwarderRepo) saveRecords(ctx context.Context, remote RemoteConfig, messages []senml.Message, tags map[string]string) error {
+	for _, msg := range messages {
+		address := addressOf(msg)
+		data, err := repo.encode(ctx, address, recordFields(msg, tags), 1)
 		if err != nil {
 			return errors.Wrap(errSaveMessage, err)
 		}
+		if err := repo.send(ctx, remote, addressURL(remote, address), address, data, 1); err != nil {
+			return errors.Wrap(errSaveMessage, err)
+		}
+	}
+	return nil
+}
 
-		url := fmt.Sprintf("%s/%s", strings.TrimRight(repo.remoteUrl, "/"), address.FullTopic)
-		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
-		if err != nil {
+// saveEnvelopes sends the address batches in envelopes, split according to
+// the max body size of the remote target.
+func (repo *httpforwarderRepo) saveEnvelopes(ctx context.Context, remote RemoteConfig, batches []addressBatch, records int, tags map[string]string) error {
+	_, span := repo.tracer.Start(ctx, "split", tracing.KindInternal, tracing.Int("addresses", len(batches)), tracing.Int("records", records))
+	envs, err := envelopes(batches, remote.MaxBodySize, tags)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return errors.Wrap(errSaveMessage, err)
+	}
+	span.SetAttributes(tracing.Int("envelopes", len(envs)))
+	span.End()
+
+	for _, env := range envs {
+		if err := repo.saveEnvelope(ctx, remote, env, tags); err != nil {
 			return errors.Wrap(errSaveMessage, err)
 		}
+	}
+	return nil
+}
 
-		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("MF-Publisher", address.Published)
-		if repo.remoteToken != "" {
-			req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", repo.remoteToken) )
+// saveEnvelope sends the envelope to the remote URL. An envelope refused by
+// the target as too large is split in halves sent in order: the addresses
+// of the envelope, or the records of its single address.
+func (repo *httpforwarderRepo) saveEnvelope(ctx context.Context, remote RemoteConfig, env []addressBatch, tags map[string]string) error {
+	n := records(env)
+	data, err := repo.encode(ctx, Address{}, env, n)
+	if err != nil {
+		return err
+	}
+	err = repo.send(ctx, remote, strings.TrimRight(remote.URL, "/"), Address{}, data, n)
+	if !errors.Contains(err, ErrBodyTooLarge) {
+		return err
+	}
+	var halves [][]addressBatch
+	switch {
+	case len(env) > 1:
+		halves = [][]addressBatch{env[:len(env)/2], env[len(env)/2:]}
+	case env[0].splittable():
+		for _, b := range env[0].halves(tags) {
+			halves = append(halves, []addressBatch{b})
 		}
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return errors.Wrap(errSaveMessage, err)
+	default:
+		return err
+	}
+	for _, h := range halves {
+		if err := repo.saveEnvelope(ctx, remote, h, tags); err != nil {
+			return err
 		}
-		defer resp.Body.Close()
+	}
+	return nil
+}
+
+// addressURL returns the URL the records of the address are sent to.
+func addressURL(remote RemoteConfig, address Address) string {
+	return fmt.Sprintf("%s/%s", strings.TrimRight(remote.URL, "/"), address.FullTopic)
+}
 
-		if resp.StatusCode != http.StatusAccepted {
-			return errors.Wrap(errSaveMessage, errors.New(resp.Status))
+func (repo *httpforwarderRepo) encode(ctx context.Context, address Address, msg interface{}, records int) ([]byte, error) {
+	_, span := repo.tracer.Start(ctx, "encode", tracing.KindInternal, addressAttributes(address, records)...)
+	defer span.End()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		err = errors.Wrap(ErrRemoteRejected, errors.Wrap(errEncode, err))
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttributes(tracing.Int("bytes", len(data)))
+
+	return data, nil
+}
+
+func (repo *httpforwarderRepo) send(ctx context.Context, remote RemoteConfig, url string, address Address, data []byte, records int) error {
+	header := http.Header{}
+	for k, v := range remote.Headers {
+		header.Set(k, v)
+	}
+	header.Set("Content-Type", "application/json")
+	header.Set("MF-Publisher", address.Published)
+	if remote.Token != "" {
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", remote.Token))
+	}
+	// The timeout is read from the settings, which may be reloaded.
+	ctx, cancel := context.WithTimeout(ctx, remote.timeout())
+	defer cancel()
+	return repo.post(ctx, target(remote.URL), url, address, header, data, records)
+}
+
+// post sends the request to the URL of the target, with the header, and
+// returns an error unless the target accepted it. The request is cancelled
+// with the context.
+func (repo *httpforwarderRepo) post(ctx context.Context, t, url string, address Address, header http.Header, data []byte, records int) (err error) {
+	repo.metrics.BatchSize.With("target", t).Observe(float64(records))
+
+	key := idempotencyKey(address, data)
+	ctx, span := repo.tracer.Start(ctx, "POST", tracing.KindClient, addressAttributes(address, records)...)
+	span.SetAttributes(tracing.String("http.method", http.MethodPost), tracing.String("http.url", url), tracing.String("idempotency_key", key))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	// Keys are remembered per target, since other targets may not have accepted the batch.
+	if repo.dedup.Seen(t + key) {
+		span.SetAttributes(tracing.String("dedup", "hit"))
+		repo.metrics.DedupHits.With("target", t).Add(1)
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set(IdempotencyKeyHeader, key)
+	if err := repo.breaker.Allow(t); err != nil {
+		repo.metrics.Requests.With("target", t, "code", statusClass(0), "outcome", outcomeRejected).Add(1)
+		return err
+	}
+	resp, err := repo.client.Do(req)
+	if err != nil {
+		repo.breaker.Report(t, false)
+		repo.metrics.Requests.With("target", t, "code", statusClass(0), "outcome", outcomeError).Add(1)
+		return err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(tracing.Int("http.status_code", resp.StatusCode))
+	// Only server side errors mean that the target is unhealthy.
+	repo.breaker.Report(t, resp.StatusCode < http.StatusInternalServerError)
+
+	if resp.StatusCode != http.StatusAccepted {
+		repo.metrics.Requests.With("target", t, "code", statusClass(resp.StatusCode), "outcome", outcomeFailure).Add(1)
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			return errors.Wrap(ErrRemoteRejected, errors.Wrap(ErrBodyTooLarge, errors.New(resp.Status)))
+		}
+		if rejected(resp.StatusCode) {
+			return errors.Wrap(ErrRemoteRejected, errors.New(resp.Status))
 		}
+		return errors.New(resp.Status)
 	}
 
+	repo.dedup.Add(t + key)
+	repo.metrics.Requests.With("target", t, "code", statusClass(resp.StatusCode), "outcome", outcomeSuccess).Add(1)
+	repo.metrics.Records.With("target", t).Add(float64(records))
+	repo.metrics.Bytes.With("target", t).Add(float64(len(data)))
 	return nil
 }
 
-func (repo *httpforwarderRepo) sortMessages(messages []senml.Message) map[Address][]senml.Message {
+func addressAttributes(address Address, records int) []tracing.Attribute {
+	return []tracing.Attribute{
+		tracing.String("channel", address.Channel),
+		tracing.String("subtopic", address.Subtopic),
+		tracing.String("publisher", address.Published),
+		tracing.Int("records", records),
+	}
+}
+
+// rejected reports whether the status code is a client error which doesn't
+// depend on the time the request is sent.
+func rejected(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return code >= http.StatusBadRequest && code < http.StatusInternalServerError
+}
+
+// target returns the scheme and host of the URL, used as circuit breaker key.
+func target(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return rawurl
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+}
+
+func sortMessages(messages []senml.Message) map[Address][]senml.Message {
 	sortedMessages := make(map[Address][]senml.Message)
 
 	for _, msg := range messages {
-		a := Address{
-			FullTopic: strings.ReplaceAll(fmt.Sprintf("channels.%s.%s", msg.Channel, msg.Subtopic), ".", "/"),
-			Published: msg.Publisher,
-			Protocol: msg.Protocol,
-		}
+		a := addressOf(msg)
  		sortedMessages[a] = append(sortedMessages[a], msg)
 	}
 
 	return sortedMessages
 }
 
-func (repo *httpforwarderRepo) extractBaseFields(messages []senml.Message) fields {
+// addressOf returns the address the message is forwarded to.
+func addressOf(msg senml.Message) Address {
+	return Address{
+		FullTopic: strings.ReplaceAll(fmt.Sprintf("channels.%s.%s", msg.Channel, msg.Subtopic), ".", "/"),
+		Channel:   msg.Channel,
+		Subtopic:  msg.Subtopic,
+		Published: msg.Publisher,
+		Protocol:  msg.Protocol,
+	}
+}
+
+func extractBaseFields(messages []senml.Message) fields {
 	var f = fields{}
 
 	if len(messages) < 2 {
@@ -170,7 +484,7 @@ func (repo *httpforwarderRepo) extractBaseFields(messages []senml.Message) field
 	return f
 }
 
-func (repo *httpforwarderRepo) appendFields(msg *senml.Message, baseField fields, field fields) fields {
+func appendFields(msg *senml.Message, baseField fields, field fields) fields {
 	// Remove base name of name when it is available
 	if prefix, ok := baseField["bn"].(string); ok {
 		if value := strings.TrimPrefix(msg.Name, prefix); value != "" {
@@ -4,16 +4,26 @@
 package http_forwarder_test
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/metrics/discard"
 	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
 	"github.com/mainflux/mainflux/errors"
 	log "github.com/mainflux/mainflux/logger"
 	"github.com/mainflux/mainflux/transformers/senml"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const valueFields = 5
@@ -26,6 +36,19 @@ var (
 	subtopic = "messages"
 )
 
+var nopMetrics = writer.Metrics{
+	Requests:          discard.NewCounter(),
+	Records:           discard.NewCounter(),
+	Bytes:             discard.NewCounter(),
+	BatchSize:         discard.NewHistogram(),
+	TransformFailures: discard.NewCounter(),
+	Dropped:           discard.NewCounter(),
+	Latency:           discard.NewHistogram(),
+	DedupHits:         discard.NewCounter(),
+	Retries:           discard.NewCounter(),
+	QueueDepth:        discard.NewGauge(),
+}
+
 var (
 	v       float64 = 5
 	stringV         = "value"
@@ -34,8 +57,15 @@ var (
 	sum     float64 = 42
 )
 
+func newRemote(t *testing.T, url string) *writer.Remote {
+	remote, err := writer.NewRemote(writer.RemoteConfig{URL: url, Token: token})
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating remote: %s", err))
+	return remote
+}
+
 func TestForwarder(t *testing.T) {
-	repo := writer.New(host, token)
+	breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+	repo := writer.New(newRemote(t, host), breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
 
 	cases := []struct {
 		desc         string
@@ -98,3 +128,536 @@ func TestForwarder(t *testing.T) {
 		assert.Truef(t, errors.Contains(err, errExpected), "Error should be: %v, got: %v", errExpected, err)
 	}
 }
+
+type exporterMock struct {
+	spans []*tracing.Span
+}
+
+func (em *exporterMock) Export(s *tracing.Span) {
+	em.spans = append(em.spans, s)
+}
+
+func (em *exporterMock) Close() error {
+	return nil
+}
+
+func TestForwarderTraceContext(t *testing.T) {
+	var traceParent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent = r.Header.Get(tracing.TraceParentHeader)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	exporter := &exporterMock{}
+	tracer := tracing.New(exporter, 1)
+	breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+	repo := writer.New(newRemote(t, ts.URL), breaker, writer.NewDedupCache(0), nopMetrics, tracer)
+
+	ctx, span := tracer.Start(context.Background(), "consume", tracing.KindConsumer)
+	msg := senml.Message{Channel: "45", Subtopic: subtopic, Publisher: "2580", Name: "temperature", Value: &v}
+	err := repo.SaveContext(ctx, msg)
+	assert.Nil(t, err, fmt.Sprintf("Send message expected to succeed: %s.\n", err))
+
+	traceID, _, ok := tracing.ParseTraceParent(traceParent)
+	assert.True(t, ok, fmt.Sprintf("receiver expected valid traceparent, got %q", traceParent))
+	assert.Equal(t, span.TraceID(), hex.EncodeToString(traceID[:]), "receiver expected trace ID of the consumed message")
+	// Group, encode and request spans are children of the consume span.
+	assert.Len(t, exporter.spans, 3, "expected group, encode and request spans")
+}
+
+func TestForwarderRejected(t *testing.T) {
+	cases := []struct {
+		desc     string
+		status   int
+		rejected bool
+	}{
+		{
+			desc:     "remote target rejects malformed messages",
+			status:   http.StatusBadRequest,
+			rejected: true,
+		},
+		{
+			desc:     "remote target rejects unauthorized requests",
+			status:   http.StatusForbidden,
+			rejected: true,
+		},
+		{
+			desc:     "remote target times out",
+			status:   http.StatusRequestTimeout,
+			rejected: false,
+		},
+		{
+			desc:     "remote target limits rate",
+			status:   http.StatusTooManyRequests,
+			rejected: false,
+		},
+		{
+			desc:     "remote target fails",
+			status:   http.StatusServiceUnavailable,
+			rejected: false,
+		},
+	}
+
+	for _, tc := range cases {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+
+		breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+		repo := writer.New(newRemote(t, ts.URL), breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+
+		err := repo.Save(senml.Message{Channel: "45", Subtopic: subtopic, Publisher: "2580", Name: "temperature", Value: &v})
+		assert.NotNil(t, err, fmt.Sprintf("%s: expected error", tc.desc))
+		assert.Equal(t, tc.rejected, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("%s: unexpected rejection %v", tc.desc, err))
+		ts.Close()
+	}
+}
+
+func TestForwarderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	remote, err := writer.NewRemote(writer.RemoteConfig{URL: ts.URL, Timeout: writer.Duration(50 * time.Millisecond)})
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating remote: %s", err))
+	breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+	repo := writer.New(remote, breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+
+	start := time.Now()
+	err = repo.Save(senml.Message{Channel: "45", Subtopic: subtopic, Publisher: "2580", Name: "temperature", Value: &v})
+	assert.NotNil(t, err, "expected error of request timing out")
+	assert.False(t, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("request timing out must not be rejected: %s", err))
+	assert.True(t, time.Since(start) < time.Second, fmt.Sprintf("request expected to time out, took %s", time.Since(start)))
+}
+
+func TestForwarderUnencodable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+	repo := writer.New(newRemote(t, ts.URL), breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+
+	nan := math.NaN()
+	err := repo.Save(senml.Message{Channel: "45", Subtopic: subtopic, Publisher: "2580", Name: "temperature", Value: &nan})
+	assert.True(t, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("records which can't be encoded expected to be rejected, got %v", err))
+}
+
+func TestForwarderIdempotency(t *testing.T) {
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(writer.IdempotencyKeyHeader))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	var hits float64
+	m := nopMetrics
+	m.DedupHits = counterMock{value: &hits}
+
+	cases := []struct {
+		desc     string
+		window   time.Duration
+		requests int
+		hits     float64
+	}{
+		{
+			desc:     "send retried batch without dedup window",
+			window:   0,
+			requests: 2,
+			hits:     0,
+		},
+		{
+			desc:     "suppress retried batch within dedup window",
+			window:   time.Minute,
+			requests: 1,
+			hits:     1,
+		},
+	}
+
+	for _, tc := range cases {
+		keys, hits = nil, 0
+		breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+		repo := writer.New(newRemote(t, ts.URL), breaker, writer.NewDedupCache(tc.window), m, tracing.NewNop())
+
+		msg := senml.Message{Channel: "45", Subtopic: subtopic, Publisher: "2580", Name: "temperature", Value: &v, Time: 1000}
+		for i := 0; i < 2; i++ {
+			err := repo.Save(msg)
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		}
+		assert.Len(t, keys, tc.requests, fmt.Sprintf("%s: unexpected number of requests", tc.desc))
+		assert.Equal(t, tc.hits, hits, fmt.Sprintf("%s: unexpected number of dedup hits", tc.desc))
+		for _, k := range keys {
+			assert.Equal(t, keys[0], k, fmt.Sprintf("%s: retried batch expected to keep its idempotency key", tc.desc))
+			assert.Len(t, k, 64, fmt.Sprintf("%s: idempotency key expected to be a SHA-256 digest", tc.desc))
+		}
+	}
+
+	keys = nil
+	repo := writer.New(newRemote(t, ts.URL), writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil), writer.NewDedupCache(0), m, tracing.NewNop())
+	for _, val := range []float64{1, 2} {
+		val := val
+		err := repo.Save(senml.Message{Channel: "45", Subtopic: subtopic, Publisher: "2580", Name: "temperature", Value: &val, Time: 1000})
+		assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	}
+	require.Len(t, keys, 2, "expected a request per batch")
+	assert.NotEqual(t, keys[0], keys[1], "different batches expected to have different idempotency keys")
+}
+
+func TestForwarderTags(t *testing.T) {
+	var records []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		records = nil
+		json.NewDecoder(r.Body).Decode(&records)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+	repo := writer.New(newRemote(t, ts.URL), breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+
+	cases := []struct {
+		desc string
+		tags map[string]string
+	}{
+		{
+			desc: "forward records without tags",
+		},
+		{
+			desc: "forward records with tags",
+			tags: map[string]string{"site": "lab", "floor": "2"},
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := writer.WithTags(context.Background(), tc.tags)
+		err := repo.SaveContext(ctx,
+			senml.Message{Channel: "45", Publisher: "2580", Name: "room:temperature", Value: &v},
+			senml.Message{Channel: "45", Publisher: "2580", Name: "room:humidity", Value: &v},
+		)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		require.Len(t, records, 2, fmt.Sprintf("%s: expected records", tc.desc))
+		for _, r := range records {
+			for label, value := range tc.tags {
+				assert.Equal(t, value, r[label], fmt.Sprintf("%s: expected tag %s in record", tc.desc, label))
+			}
+			if tc.tags == nil {
+				assert.NotContains(t, r, "site", fmt.Sprintf("%s: unexpected tag in record", tc.desc))
+			}
+		}
+	}
+}
+
+func TestForwarderDelivery(t *testing.T) {
+	type request struct {
+		path string
+		body interface{}
+	}
+	var requests []request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, request{path: r.URL.Path, body: body})
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+	repo := writer.New(newRemote(t, ts.URL), breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+	msgs := []senml.Message{
+		{Channel: "45", Publisher: "2580", Name: "temperature", Unit: "Cel", Value: &v},
+		{Channel: "45", Publisher: "2580", Name: "status", StringValue: &stringV},
+		{Channel: "46", Subtopic: subtopic, Publisher: "2581", Name: "open", BoolValue: &boolV},
+	}
+
+	cases := []struct {
+		desc     string
+		delivery string
+		paths    []string
+	}{
+		{
+			desc:     "deliver records per address",
+			delivery: writer.DeliveryAddress,
+			paths:    []string{"/channels/45/", "/channels/46/messages"},
+		},
+		{
+			desc:     "deliver records one by one",
+			delivery: writer.DeliveryRecord,
+			paths:    []string{"/channels/45/", "/channels/45/", "/channels/46/messages"},
+		},
+		{
+			desc:     "deliver records in a single batch",
+			delivery: writer.DeliveryBatch,
+			paths:    []string{"/"},
+		},
+	}
+
+	for _, tc := range cases {
+		requests = nil
+		ctx := writer.WithTags(writer.WithDelivery(context.Background(), tc.delivery), map[string]string{"site": "lab"})
+		err := repo.SaveContext(ctx, msgs...)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+
+		var paths []string
+		for _, r := range requests {
+			paths = append(paths, r.path)
+		}
+		assert.ElementsMatch(t, tc.paths, paths, fmt.Sprintf("%s: unexpected requests", tc.desc))
+
+		switch tc.delivery {
+		case writer.DeliveryRecord:
+			require.Len(t, requests, 3, fmt.Sprintf("%s: expected requests", tc.desc))
+			expected := map[string]interface{}{"channel": "45", "publisher": "2580", "name": "temperature", "unit": "Cel", "value": v, "site": "lab"}
+			assert.Equal(t, expected, requests[0].body, fmt.Sprintf("%s: unexpected record object", tc.desc))
+		case writer.DeliveryBatch:
+			require.Len(t, requests, 1, fmt.Sprintf("%s: expected request", tc.desc))
+			batches, ok := requests[0].body.([]interface{})
+			require.True(t, ok, fmt.Sprintf("%s: expected list of addresses", tc.desc))
+			require.Len(t, batches, 2, fmt.Sprintf("%s: expected addresses", tc.desc))
+			first := batches[0].(map[string]interface{})
+			assert.Equal(t, "channels/45/", first["topic"], fmt.Sprintf("%s: unexpected topic", tc.desc))
+			assert.Equal(t, "2580", first["publisher"], fmt.Sprintf("%s: unexpected publisher", tc.desc))
+			assert.Len(t, first["records"], 2, fmt.Sprintf("%s: unexpected records", tc.desc))
+		}
+	}
+}
+
+func TestForwarderEnvelopes(t *testing.T) {
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	var msgs []senml.Message
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, senml.Message{Channel: fmt.Sprintf("%d", i), Publisher: "2580", Name: "temperature", Value: &v})
+	}
+
+	cases := []struct {
+		desc      string
+		maxBody   int
+		envelopes int
+	}{
+		{
+			desc:      "send envelope without size limit",
+			maxBody:   0,
+			envelopes: 1,
+		},
+		{
+			desc:      "send envelopes split to size limit",
+			maxBody:   300,
+			envelopes: 5,
+		},
+		{
+			desc:      "send envelopes of single addresses over size limit",
+			maxBody:   10,
+			envelopes: 10,
+		},
+	}
+
+	for _, tc := range cases {
+		bodies = nil
+		remote, err := writer.NewRemote(writer.RemoteConfig{URL: ts.URL, MaxBodySize: tc.maxBody})
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating remote: %s", tc.desc, err))
+		breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+		repo := writer.New(remote, breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+
+		err = repo.SaveContext(writer.WithDelivery(context.Background(), writer.DeliveryBatch), msgs...)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		assert.Len(t, bodies, tc.envelopes, fmt.Sprintf("%s: unexpected number of envelopes", tc.desc))
+
+		channels := 0
+		for _, body := range bodies {
+			var addresses []map[string]interface{}
+			err := json.Unmarshal(body, &addresses)
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding envelope %v", tc.desc, err))
+			if tc.maxBody > 0 && len(addresses) > 1 {
+				assert.LessOrEqual(t, len(body), tc.maxBody, fmt.Sprintf("%s: envelope over size limit", tc.desc))
+			}
+			channels += len(addresses)
+		}
+		assert.Equal(t, len(msgs), channels, fmt.Sprintf("%s: expected every address sent", tc.desc))
+	}
+}
+
+func TestForwarderEnvelopesSplitAddress(t *testing.T) {
+	var (
+		limit  int
+		bodies [][]byte
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) > limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	var msgs []senml.Message
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, senml.Message{Channel: "45", Publisher: "2580", Name: "temperature", Time: float64(i), Value: &v})
+	}
+
+	cases := []struct {
+		desc    string
+		maxBody int
+		limit   int
+	}{
+		{
+			desc:    "split records of address over max body size",
+			maxBody: 300,
+			limit:   300,
+		},
+		{
+			desc:    "split records of address refused as too large",
+			maxBody: 0,
+			limit:   300,
+		},
+	}
+
+	for _, tc := range cases {
+		bodies, limit = nil, tc.limit
+		remote, err := writer.NewRemote(writer.RemoteConfig{URL: ts.URL, MaxBodySize: tc.maxBody})
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating remote: %s", tc.desc, err))
+		breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+		repo := writer.New(remote, breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+
+		err = repo.SaveContext(writer.WithDelivery(context.Background(), writer.DeliveryBatch), msgs...)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		assert.True(t, len(bodies) > 1, fmt.Sprintf("%s: expected records of address split", tc.desc))
+
+		var times []float64
+		for _, body := range bodies {
+			assert.LessOrEqual(t, len(body), tc.limit, fmt.Sprintf("%s: envelope over size limit", tc.desc))
+			var addresses []struct {
+				Channel string                   `json:"channel"`
+				Records []map[string]interface{} `json:"records"`
+			}
+			err := json.Unmarshal(body, &addresses)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding envelope %v", tc.desc, err))
+			for _, a := range addresses {
+				assert.Equal(t, "45", a.Channel, fmt.Sprintf("%s: unexpected channel", tc.desc))
+				// The base time is set on the first record of each pack.
+				bt, _ := a.Records[0]["bt"].(float64)
+				for _, r := range a.Records {
+					tm, _ := r["t"].(float64)
+					times = append(times, bt+tm)
+				}
+			}
+		}
+		require.Len(t, times, len(msgs), fmt.Sprintf("%s: expected every record sent", tc.desc))
+		for i := range times {
+			assert.Equal(t, float64(i), times[i], fmt.Sprintf("%s: expected records in order", tc.desc))
+		}
+	}
+}
+
+func TestForwarderSplit(t *testing.T) {
+	var (
+		limit    int
+		accepted [][]map[string]interface{}
+		sizes    []int
+		refused  int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) > limit {
+			refused++
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		var pack []map[string]interface{}
+		json.Unmarshal(body, &pack)
+		accepted = append(accepted, pack)
+		sizes = append(sizes, len(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	now := float64(time.Now().Unix())
+	var msgs []senml.Message
+	for i := 0; i < streamsSize; i++ {
+		name := "room:temperature"
+		if i%2 == 1 {
+			name = "room:humidity"
+		}
+		msgs = append(msgs, senml.Message{Channel: "45", Publisher: "2580", Name: name, Unit: "Cel", Time: now + float64(i), Value: &v})
+	}
+
+	cases := []struct {
+		desc       string
+		maxBody    int
+		maxRecords int
+		limit      int
+		requests   []int
+		refused    bool
+	}{
+		{
+			desc:       "split pack to max records",
+			maxRecords: 100,
+			limit:      1 << 20,
+			requests:   []int{100, 100, 50},
+		},
+		{
+			desc:    "split pack to max body size",
+			maxBody: 2000,
+			limit:   1 << 20,
+		},
+		{
+			desc:    "halve pack refused as too large",
+			limit:   3000,
+			refused: true,
+		},
+	}
+
+	for _, tc := range cases {
+		limit, accepted, sizes, refused = tc.limit, nil, nil, 0
+		remote, err := writer.NewRemote(writer.RemoteConfig{URL: ts.URL, MaxBodySize: tc.maxBody, MaxRecords: tc.maxRecords})
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating remote: %s", tc.desc, err))
+		breaker := writer.NewCircuitBreaker(writer.BreakerConfig{FailureRatio: 0.5, MinRequests: 10, CoolDown: time.Second, Probes: 1}, nil)
+		repo := writer.New(remote, breaker, writer.NewDedupCache(0), nopMetrics, tracing.NewNop())
+
+		err = repo.Save(msgs...)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		assert.Equal(t, tc.refused, refused > 0, fmt.Sprintf("%s: unexpected refused requests", tc.desc))
+
+		var counts []int
+		var resolved []senml.Message
+		for _, pack := range accepted {
+			counts = append(counts, len(pack))
+			// Resolve the records with the base fields of their own pack.
+			bn, _ := pack[0]["bn"].(string)
+			bt, _ := pack[0]["bt"].(float64)
+			for _, r := range pack {
+				n, _ := r["n"].(string)
+				dt, _ := r["t"].(float64)
+				resolved = append(resolved, senml.Message{Name: bn + n, Time: bt + dt})
+			}
+		}
+		if tc.requests != nil {
+			assert.Equal(t, tc.requests, counts, fmt.Sprintf("%s: unexpected records per request", tc.desc))
+		}
+		if tc.maxBody > 0 {
+			for _, size := range sizes {
+				assert.LessOrEqual(t, size, tc.maxBody, fmt.Sprintf("%s: request over max body size", tc.desc))
+			}
+		}
+		require.Len(t, resolved, len(msgs), fmt.Sprintf("%s: expected every record sent", tc.desc))
+		for i, msg := range msgs {
+			assert.Equal(t, msg.Name, resolved[i].Name, fmt.Sprintf("%s: unexpected name of record %d", tc.desc, i))
+			assert.Equal(t, msg.Time, resolved[i].Time, fmt.Sprintf("%s: unexpected time of record %d", tc.desc, i))
+		}
+	}
+}
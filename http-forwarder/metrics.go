@@ -0,0 +1,63 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+const (
+	outcomeSuccess  = "success"
+	outcomeFailure  = "failure"
+	outcomeError    = "error"
+	outcomeRejected = "rejected"
+
+	reasonTransform = "transform"
+	reasonSend      = "send"
+	reasonFilter    = "filter"
+	reasonScript    = "script"
+	reasonLate      = "late"
+	reasonDeadband  = "deadband"
+	reasonSlow      = "slow_client"
+	reasonShutdown  = "shutdown"
+)
+
+// Metrics contains the forwarder instrumentation.
+type Metrics struct {
+	// Requests counts outbound requests by target, status code class and outcome.
+	Requests metrics.Counter
+	// Records counts records sent by target.
+	Records metrics.Counter
+	// Bytes counts request body bytes sent by target.
+	Bytes metrics.Counter
+	// BatchSize observes the number of records per outbound batch by target.
+	BatchSize metrics.Histogram
+	// TransformFailures counts received messages which could not be transformed.
+	TransformFailures metrics.Counter
+	// Dropped counts records which have not been forwarded, by reason.
+	// Messages which cannot be transformed count as a single record.
+	Dropped metrics.Counter
+	// Latency observes the seconds from message creation to acknowledgement by
+	// the sink, including the time spent in the retry queue.
+	Latency metrics.Histogram
+	// DedupHits counts batches not sent by target, because the target
+	// already accepted them within the dedup window.
+	DedupHits metrics.Counter
+	// Retries counts the attempts to send again the batches of the retry
+	// queue, by outcome.
+	Retries metrics.Counter
+	// QueueDepth is the number of batches of the retry queue, including
+	// the spilled ones.
+	QueueDepth metrics.Gauge
+}
+
+// statusClass returns the class of the HTTP status code (e.g. "2xx").
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "none"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
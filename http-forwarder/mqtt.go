@@ -0,0 +1,328 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+const (
+	// DefMQTTTopic is the topic template used when none is set, which
+	// mirrors the topics of the Mainflux MQTT adapter.
+	DefMQTTTopic = "channels/{channel}/messages/{subtopic}"
+
+	defMQTTTimeout = 10 * time.Second
+	mqttQuiesce    = 250 // milliseconds
+)
+
+var (
+	// ErrInvalidMQTT indicates that the MQTT sink settings are malformed.
+	ErrInvalidMQTT = errors.New("invalid MQTT sink")
+
+	errPublishMessage   = errors.New("failed to publish message to broker")
+	errMQTTNotConnected = errors.New("not connected to MQTT broker")
+	errPublishTimeout   = errors.New("MQTT publish acknowledgement timed out")
+	errInvalidTopic     = errors.New("invalid MQTT topic")
+
+	topicPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+)
+
+// MQTTConfig contains the settings of the MQTT sink.
+type MQTTConfig struct {
+	// URL is the broker URL, with the tcp, ssl, ws or wss scheme.
+	URL string
+
+	// ClientID identifies the connection to the broker.
+	ClientID string
+
+	// Username and Password are the authentication credentials.
+	Username string
+	Password string
+
+	// CACertFile is the path of the CA certificates verifying the broker.
+	CACertFile string
+
+	// ClientCertFile and ClientKeyFile are the paths of the client
+	// certificate and key, when the broker verifies clients.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// Topic is the template of the topics the records are published to,
+	// DefMQTTTopic if empty. The {channel}, {subtopic}, {publisher},
+	// {protocol} and {name} placeholders are replaced by the values of the
+	// address, the subtopic levels being separated by slashes. Empty topic
+	// levels are removed.
+	Topic string
+
+	// QoS is the quality of service of the published messages, 0 to 2.
+	QoS byte
+
+	// Retain sets the retain flag of the published messages.
+	Retain bool
+
+	// Timeout is the time allowed to connect and for the broker to
+	// acknowledge a message, 10 seconds if 0.
+	Timeout time.Duration
+}
+
+var _ Repository = (*MQTTSink)(nil)
+
+// MQTTSink publishes the forwarded records to an MQTT broker, encoded as
+// they are sent to the remote HTTP target with the delivery granularity
+// carried by the context.
+type MQTTSink struct {
+	cfg     MQTTConfig
+	target  string
+	client  mqtt.Client
+	metrics Metrics
+	tracer  tracing.Tracer
+}
+
+// NewMQTTSink returns MQTT sink connected to the broker. The connection is
+// restored automatically when it is lost.
+func NewMQTTSink(cfg MQTTConfig, metrics Metrics, tracer tracing.Tracer, logger logger.Logger) (*MQTTSink, error) {
+	if cfg.Topic == "" {
+		cfg.Topic = DefMQTTTopic
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defMQTTTimeout
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.URL).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(cfg.Timeout).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			logger.Warn(fmt.Sprintf("Disconnected from MQTT broker: %s", err))
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			logger.Info(fmt.Sprintf("Connected to MQTT broker %s", cfg.URL))
+		})
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(cfg.Timeout) {
+		return nil, errMQTTNotConnected
+	}
+	if err := token.Error(); err != nil {
+		return nil, errors.Wrap(errMQTTNotConnected, err)
+	}
+
+	return &MQTTSink{
+		cfg:     cfg,
+		target:  target(cfg.URL),
+		client:  client,
+		metrics: metrics,
+		tracer:  tracer,
+	}, nil
+}
+
+func (cfg MQTTConfig) validate() error {
+	if cfg.URL == "" {
+		return errors.Wrap(ErrInvalidMQTT, errors.New("missing broker URL"))
+	}
+	if cfg.QoS > 2 {
+		return errors.Wrap(ErrInvalidMQTT, fmt.Errorf("QoS %d", cfg.QoS))
+	}
+	if cfg.Timeout < 0 {
+		return errors.Wrap(ErrInvalidMQTT, errors.New("timeout must not be negative"))
+	}
+	if strings.ContainsAny(cfg.Topic, "+#") {
+		return errors.Wrap(ErrInvalidMQTT, errors.New(cfg.Topic))
+	}
+	for _, p := range topicPlaceholder.FindAllString(cfg.Topic, -1) {
+		switch p {
+		case "{channel}", "{subtopic}", "{publisher}", "{protocol}", "{name}":
+		default:
+			return errors.Wrap(ErrInvalidMQTT, fmt.Errorf("unknown placeholder %s", p))
+		}
+	}
+	if (cfg.ClientCertFile == "") != (cfg.ClientKeyFile == "") {
+		return errors.Wrap(ErrInvalidMQTT, errors.New("client certificate and key must be set together"))
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS settings of the connection, nil if the default
+// ones are used.
+func (cfg MQTTConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.CACertFile == "" && cfg.ClientCertFile == "" {
+		return nil, nil
+	}
+
+	tlsCfg, err := loadTLSConfig(cfg.CACertFile, cfg.ClientCertFile, cfg.ClientKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidMQTT, err)
+	}
+	return tlsCfg, nil
+}
+
+// loadTLSConfig returns TLS settings verifying the server with the CA
+// certificates of the file, or of the system if it is empty, and presenting
+// the client certificate if it is set.
+func loadTLSConfig(caCertFile, clientCertFile, clientKeyFile string) (*tls.Config, error) {
+	tlsCfg := &tls.Config{}
+	if caCertFile != "" {
+		data, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no CA certificate found")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if clientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func (s *MQTTSink) Save(messages ...senml.Message) error {
+	return s.SaveContext(context.Background(), messages...)
+}
+
+func (s *MQTTSink) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	tags := TagsFromContext(ctx)
+
+	switch DeliveryFromContext(ctx) {
+	case DeliveryRecord:
+		for _, msg := range messages {
+			address := addressOf(msg)
+			if err := s.publish(ctx, address, msg.Name, recordFields(msg, tags), 1); err != nil {
+				return errors.Wrap(errPublishMessage, err)
+			}
+		}
+		return nil
+	case DeliveryBatch:
+		packs, _ := groupPacks(messages, 0, tags)
+		if err := s.publish(ctx, Address{}, "", addressBatches(packs), len(messages)); err != nil {
+			return errors.Wrap(errPublishMessage, err)
+		}
+		return nil
+	}
+
+	packs, _ := groupPacks(messages, 0, tags)
+	for _, p := range packs {
+		if err := s.publish(ctx, p.address, "", p.records, len(p.records)); err != nil {
+			return errors.Wrap(errPublishMessage, err)
+		}
+	}
+	return nil
+}
+
+// publish publishes the encoded message to the topic of the address and
+// waits for the broker acknowledgement, if the QoS requires one.
+func (s *MQTTSink) publish(ctx context.Context, address Address, name string, msg interface{}, records int) (err error) {
+	topic, err := s.topic(address, name)
+	if err != nil {
+		return err
+	}
+
+	_, span := s.tracer.Start(ctx, "PUBLISH", tracing.KindProducer, addressAttributes(address, records)...)
+	span.SetAttributes(tracing.String("messaging.system", "mqtt"), tracing.String("messaging.destination", topic), tracing.Int("messaging.mqtt.qos", int(s.cfg.QoS)))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(ErrRemoteRejected, errors.Wrap(errEncode, err))
+	}
+	s.metrics.BatchSize.With("target", s.target).Observe(float64(records))
+
+	// Messages of QoS 0 published while reconnecting are silently dropped.
+	if !s.client.IsConnectionOpen() {
+		s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeError).Add(1)
+		return errMQTTNotConnected
+	}
+	token := s.client.Publish(topic, s.cfg.QoS, s.cfg.Retain, data)
+	if !token.WaitTimeout(s.cfg.Timeout) {
+		s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeError).Add(1)
+		return errPublishTimeout
+	}
+	if err := token.Error(); err != nil {
+		s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeError).Add(1)
+		return err
+	}
+
+	s.metrics.Requests.With("target", s.target, "code", statusClass(0), "outcome", outcomeSuccess).Add(1)
+	s.metrics.Records.With("target", s.target).Add(float64(records))
+	s.metrics.Bytes.With("target", s.target).Add(float64(len(data)))
+	return nil
+}
+
+// topic returns the topic the records of the address are published to. The
+// name is the one of the record, published with the DeliveryRecord
+// granularity.
+func (s *MQTTSink) topic(address Address, name string) (string, error) {
+	r := strings.NewReplacer(
+		"{channel}", address.Channel,
+		"{subtopic}", strings.ReplaceAll(address.Subtopic, ".", "/"),
+		"{publisher}", address.Published,
+		"{protocol}", address.Protocol,
+		"{name}", name,
+	)
+
+	var levels []string
+	for _, level := range strings.Split(r.Replace(s.cfg.Topic), "/") {
+		if level != "" {
+			levels = append(levels, level)
+		}
+	}
+	topic := strings.Join(levels, "/")
+	// Values of the address can't be published as wildcards.
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return "", errors.Wrap(ErrRemoteRejected, errors.Wrap(errInvalidTopic, errors.New(topic)))
+	}
+	return topic, nil
+}
+
+// CheckConnection returns an error if the connection to the broker is not
+// established.
+func (s *MQTTSink) CheckConnection() error {
+	if !s.client.IsConnectionOpen() {
+		return errMQTTNotConnected
+	}
+	return nil
+}
+
+// Close disconnects from the broker, after the messages being published
+// are sent.
+func (s *MQTTSink) Close() {
+	s.client.Disconnect(mqttQuiesce)
+}
@@ -0,0 +1,277 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// brokerMock is an in-process MQTT broker recording the published messages.
+type brokerMock struct {
+	l        net.Listener
+	username string
+	password string
+
+	mu   sync.Mutex
+	msgs []*packets.PublishPacket
+}
+
+func newBroker(t *testing.T, username, password string) *brokerMock {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting broker: %s", err))
+
+	b := &brokerMock{l: l, username: username, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *brokerMock) url() string {
+	return fmt.Sprintf("tcp://%s", b.l.Addr())
+}
+
+func (b *brokerMock) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			if p.Username != b.username || string(p.Password) != b.password {
+				ack.ReturnCode = packets.ErrRefusedNotAuthorised
+			}
+			ack.Write(conn)
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.msgs = append(b.msgs, p)
+			b.mu.Unlock()
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				rec.Write(conn)
+			}
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			comp.Write(conn)
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *brokerMock) published() []*packets.PublishPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*packets.PublishPacket(nil), b.msgs...)
+}
+
+func (b *brokerMock) close() {
+	b.l.Close()
+}
+
+func TestNewMQTTSink(t *testing.T) {
+	broker := newBroker(t, "user", "secret")
+	defer broker.close()
+
+	cases := []struct {
+		desc    string
+		cfg     writer.MQTTConfig
+		invalid bool
+		err     bool
+	}{
+		{
+			desc: "connect to broker",
+			cfg:  writer.MQTTConfig{URL: broker.url(), Username: "user", Password: "secret"},
+		},
+		{
+			desc: "connect to broker with bad credentials",
+			cfg:  writer.MQTTConfig{URL: broker.url(), Username: "user", Password: "wrong"},
+			err:  true,
+		},
+		{
+			desc: "connect to unreachable broker",
+			cfg:  writer.MQTTConfig{URL: "tcp://127.0.0.1:1", Timeout: time.Second},
+			err:  true,
+		},
+		{
+			desc:    "connect without broker URL",
+			cfg:     writer.MQTTConfig{},
+			invalid: true,
+			err:     true,
+		},
+		{
+			desc:    "connect with invalid QoS",
+			cfg:     writer.MQTTConfig{URL: broker.url(), QoS: 3},
+			invalid: true,
+			err:     true,
+		},
+		{
+			desc:    "connect with unknown topic placeholder",
+			cfg:     writer.MQTTConfig{URL: broker.url(), Topic: "channels/{thing}"},
+			invalid: true,
+			err:     true,
+		},
+		{
+			desc:    "connect with wildcard topic",
+			cfg:     writer.MQTTConfig{URL: broker.url(), Topic: "channels/+/messages"},
+			invalid: true,
+			err:     true,
+		},
+		{
+			desc:    "connect with client certificate without key",
+			cfg:     writer.MQTTConfig{URL: broker.url(), ClientCertFile: "client.crt"},
+			invalid: true,
+			err:     true,
+		},
+		{
+			desc:    "connect with missing CA certificate",
+			cfg:     writer.MQTTConfig{URL: broker.url(), CACertFile: "missing.crt"},
+			invalid: true,
+			err:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		sink, err := writer.NewMQTTSink(tc.cfg, nopMetrics, tracing.NewNop(), testLog)
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		assert.Equal(t, tc.invalid, errors.Contains(err, writer.ErrInvalidMQTT), fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		if sink != nil {
+			assert.Nil(t, sink.CheckConnection(), fmt.Sprintf("%s: expected connection established", tc.desc))
+			sink.Close()
+		}
+	}
+}
+
+func TestMQTTSink(t *testing.T) {
+	msgs := []senml.Message{
+		{Channel: "45", Subtopic: "room.1", Publisher: "2580", Protocol: "http", Name: "temperature", Unit: "Cel", Time: 1000, Value: float(20)},
+		{Channel: "45", Subtopic: "room.1", Publisher: "2580", Protocol: "http", Name: "humidity", Unit: "%RH", Time: 1000, Value: float(40)},
+		{Channel: "46", Publisher: "2581", Protocol: "http", Name: "temperature", Unit: "Cel", Time: 1000, Value: float(21)},
+	}
+
+	cases := []struct {
+		desc     string
+		cfg      writer.MQTTConfig
+		delivery string
+		topics   []string
+		records  []int
+	}{
+		{
+			desc:    "publish packs to default topics",
+			cfg:     writer.MQTTConfig{QoS: 1},
+			topics:  []string{"channels/45/messages/room/1", "channels/46/messages"},
+			records: []int{2, 1},
+		},
+		{
+			desc:     "publish records to topics of their name",
+			cfg:      writer.MQTTConfig{Topic: "site/{publisher}/{name}", QoS: 1},
+			delivery: writer.DeliveryRecord,
+			topics:   []string{"site/2580/temperature", "site/2580/humidity", "site/2581/temperature"},
+			records:  []int{1, 1, 1},
+		},
+		{
+			desc:     "publish envelope",
+			cfg:      writer.MQTTConfig{Topic: "forwarder/{channel}/batch", QoS: 1},
+			delivery: writer.DeliveryBatch,
+			topics:   []string{"forwarder/batch"},
+			records:  []int{2},
+		},
+		{
+			desc:    "publish retained packs with QoS 2",
+			cfg:     writer.MQTTConfig{Topic: "{protocol}/{channel}", QoS: 2, Retain: true},
+			topics:  []string{"http/45", "http/46"},
+			records: []int{2, 1},
+		},
+		{
+			desc:    "publish packs with QoS 0",
+			cfg:     writer.MQTTConfig{},
+			topics:  []string{"channels/45/messages/room/1", "channels/46/messages"},
+			records: []int{2, 1},
+		},
+	}
+
+	for _, tc := range cases {
+		broker := newBroker(t, "", "")
+		tc.cfg.URL = broker.url()
+		sink, err := writer.NewMQTTSink(tc.cfg, nopMetrics, tracing.NewNop(), testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error connecting: %s", tc.desc, err))
+
+		ctx := writer.WithDelivery(context.Background(), tc.delivery)
+		err = sink.SaveContext(ctx, msgs...)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		assert.Eventually(t, func() bool { return len(broker.published()) == len(tc.topics) }, time.Second, 10*time.Millisecond, fmt.Sprintf("%s: expected %d messages", tc.desc, len(tc.topics)))
+
+		var topics []string
+		var records []int
+		for _, p := range broker.published() {
+			topics = append(topics, p.TopicName)
+			assert.Equal(t, tc.cfg.QoS, p.Qos, fmt.Sprintf("%s: unexpected QoS", tc.desc))
+			assert.Equal(t, tc.cfg.Retain, p.Retain, fmt.Sprintf("%s: unexpected retain flag", tc.desc))
+
+			switch tc.delivery {
+			case writer.DeliveryRecord:
+				var record map[string]interface{}
+				err := json.Unmarshal(p.Payload, &record)
+				assert.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding record: %s", tc.desc, err))
+				records = append(records, 1)
+			default:
+				var pack []map[string]interface{}
+				err := json.Unmarshal(p.Payload, &pack)
+				assert.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding pack: %s", tc.desc, err))
+				records = append(records, len(pack))
+			}
+		}
+		assert.ElementsMatch(t, tc.topics, topics, fmt.Sprintf("%s: unexpected topics", tc.desc))
+		assert.ElementsMatch(t, tc.records, records, fmt.Sprintf("%s: unexpected records", tc.desc))
+
+		sink.Close()
+		broker.close()
+	}
+}
+
+func TestMQTTSinkInvalidTopic(t *testing.T) {
+	broker := newBroker(t, "", "")
+	defer broker.close()
+
+	sink, err := writer.NewMQTTSink(writer.MQTTConfig{URL: broker.url(), Topic: "{name}"}, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error connecting: %s", err))
+	defer sink.Close()
+
+	ctx := writer.WithDelivery(context.Background(), writer.DeliveryRecord)
+	err = sink.SaveContext(ctx, senml.Message{Channel: "45", Name: "sensor/#", Value: float(20)})
+	assert.True(t, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("expected %v got %v", writer.ErrRemoteRejected, err))
+	assert.Empty(t, broker.published(), "expected no message published")
+}
@@ -0,0 +1,182 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package nats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	log "github.com/mainflux/mainflux/logger"
+	broker "github.com/nats-io/nats.go"
+)
+
+var (
+	// ErrInvalidAuth indicates that several authentication methods are set.
+	ErrInvalidAuth = errors.New("only one NATS authentication method can be set")
+
+	// ErrInvalidTLS indicates that the client certificate or key is missing.
+	ErrInvalidTLS = errors.New("NATS client certificate and key must be set together")
+)
+
+// ConnConfig contains the settings of the connection to NATS.
+type ConnConfig struct {
+	// URL is the comma separated list of the NATS server URLs.
+	URL string
+
+	// Name identifies the connection in the NATS server monitoring.
+	Name string
+
+	// CredsFile is the path of the user credentials file (JWT and NKey seed).
+	CredsFile string
+
+	// NKeySeedFile is the path of the user NKey seed file.
+	NKeySeedFile string
+
+	// Token is the authentication token.
+	Token string
+
+	// User and Password are the authentication user credentials.
+	User     string
+	Password string
+
+	// CACertFile is the path of the CA certificates verifying the server.
+	CACertFile string
+
+	// ClientCertFile and ClientKeyFile are the paths of the client
+	// certificate and key, when the server verifies clients.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// ReconnectWait is the time between reconnection attempts to a server.
+	ReconnectWait time.Duration
+
+	// MaxReconnects is the number of reconnection attempts before the
+	// connection is closed, unlimited if negative.
+	MaxReconnects int
+}
+
+// conn is a NATS connection keeping track of the reason of the last
+// disconnection, reported by the connection checks.
+type conn struct {
+	*broker.Conn
+	mu      sync.Mutex
+	lastErr error
+}
+
+// connect establishes the connection to NATS. Connection events are logged.
+func connect(cfg ConnConfig, logger log.Logger) (*conn, error) {
+	c := &conn{}
+	opts, err := cfg.options(c, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	nc, err := broker.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.Conn = nc
+	return c, nil
+}
+
+func (cfg ConnConfig) options(c *conn, logger log.Logger) ([]broker.Option, error) {
+	opts := []broker.Option{
+		broker.Name(cfg.Name),
+		broker.MaxReconnects(cfg.MaxReconnects),
+		broker.DisconnectErrHandler(func(nc *broker.Conn, err error) {
+			c.setErr(err)
+			if err != nil {
+				logger.Warn(fmt.Sprintf("Disconnected from NATS: %s", err))
+				return
+			}
+			logger.Warn("Disconnected from NATS")
+		}),
+		broker.ReconnectHandler(func(nc *broker.Conn) {
+			c.setErr(nil)
+			logger.Info(fmt.Sprintf("Reconnected to NATS %s", nc.ConnectedUrl()))
+		}),
+		broker.ClosedHandler(func(nc *broker.Conn) {
+			if err := nc.LastError(); err != nil {
+				c.setErr(err)
+				logger.Error(fmt.Sprintf("NATS connection closed: %s", err))
+				return
+			}
+			logger.Info("NATS connection closed")
+		}),
+		broker.DiscoveredServersHandler(func(nc *broker.Conn) {
+			logger.Info(fmt.Sprintf("Discovered NATS servers %v", nc.DiscoveredServers()))
+		}),
+		broker.ErrorHandler(func(nc *broker.Conn, sub *broker.Subscription, err error) {
+			if sub != nil {
+				logger.Warn(fmt.Sprintf("NATS error on subscription to %s: %s", sub.Subject, err))
+				return
+			}
+			logger.Warn(fmt.Sprintf("NATS error: %s", err))
+		}),
+	}
+	if cfg.ReconnectWait > 0 {
+		opts = append(opts, broker.ReconnectWait(cfg.ReconnectWait))
+	}
+
+	methods := 0
+	if cfg.CredsFile != "" {
+		methods++
+		opts = append(opts, broker.UserCredentials(cfg.CredsFile))
+	}
+	if cfg.NKeySeedFile != "" {
+		methods++
+		opt, err := broker.NkeyOptionFromSeed(cfg.NKeySeedFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	if cfg.Token != "" {
+		methods++
+		opts = append(opts, broker.Token(cfg.Token))
+	}
+	if cfg.User != "" {
+		methods++
+		opts = append(opts, broker.UserInfo(cfg.User, cfg.Password))
+	}
+	if methods > 1 {
+		return nil, ErrInvalidAuth
+	}
+
+	if cfg.CACertFile != "" {
+		opts = append(opts, broker.RootCAs(cfg.CACertFile))
+	}
+	if (cfg.ClientCertFile == "") != (cfg.ClientKeyFile == "") {
+		return nil, ErrInvalidTLS
+	}
+	if cfg.ClientCertFile != "" {
+		opts = append(opts, broker.ClientCert(cfg.ClientCertFile, cfg.ClientKeyFile))
+	}
+
+	return opts, nil
+}
+
+func (c *conn) setErr(err error) {
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+}
+
+// check returns an error if the connection is not established, wrapping
+// the reason of the disconnection if known.
+func (c *conn) check() error {
+	if c.IsConnected() {
+		return nil
+	}
+
+	status := statusText(c.Status())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastErr != nil {
+		return errors.Wrap(errNotConnected, fmt.Errorf("%s, %s", status, c.lastErr))
+	}
+	return errors.Wrap(errNotConnected, errors.New(status))
+}
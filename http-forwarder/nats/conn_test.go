@@ -0,0 +1,253 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package nats_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/nats"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runServer(t *testing.T, opts *server.Options) *server.Server {
+	opts.Host = "127.0.0.1"
+	opts.NoSigs = true
+	if opts.Port == 0 {
+		opts.Port = server.RANDOM_PORT
+	}
+
+	srv, err := server.NewServer(opts)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating NATS server: %s", err))
+	go srv.Start()
+	require.True(t, srv.ReadyForConnections(5*time.Second), "NATS server expected to start")
+	return srv
+}
+
+func TestConnectAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	user, err := nkeys.CreateUser()
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating NKey: %s", err))
+	pub, err := user.PublicKey()
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading NKey: %s", err))
+	seed, err := user.Seed()
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading NKey seed: %s", err))
+	seedFile := filepath.Join(dir, "user.nk")
+	require.Nil(t, ioutil.WriteFile(seedFile, seed, 0600), "unexpected error writing NKey seed")
+
+	tokenSrv := runServer(t, &server.Options{Authorization: "secret"})
+	defer tokenSrv.Shutdown()
+	userSrv := runServer(t, &server.Options{Username: "forwarder", Password: "secret"})
+	defer userSrv.Shutdown()
+	nkeySrv := runServer(t, &server.Options{Nkeys: []*server.NkeyUser{{Nkey: pub}}})
+	defer nkeySrv.Shutdown()
+
+	cases := []struct {
+		desc string
+		cfg  nats.ConnConfig
+		err  bool
+	}{
+		{
+			desc: "connect with token",
+			cfg:  nats.ConnConfig{URL: tokenSrv.ClientURL(), Token: "secret"},
+		},
+		{
+			desc: "connect with invalid token",
+			cfg:  nats.ConnConfig{URL: tokenSrv.ClientURL(), Token: "invalid"},
+			err:  true,
+		},
+		{
+			desc: "connect with user and password",
+			cfg:  nats.ConnConfig{URL: userSrv.ClientURL(), User: "forwarder", Password: "secret"},
+		},
+		{
+			desc: "connect without credentials",
+			cfg:  nats.ConnConfig{URL: userSrv.ClientURL()},
+			err:  true,
+		},
+		{
+			desc: "connect with NKey",
+			cfg:  nats.ConnConfig{URL: nkeySrv.ClientURL(), NKeySeedFile: seedFile},
+		},
+		{
+			desc: "connect with missing NKey seed file",
+			cfg:  nats.ConnConfig{URL: nkeySrv.ClientURL(), NKeySeedFile: filepath.Join(dir, "missing.nk")},
+			err:  true,
+		},
+		{
+			desc: "connect to cluster with unavailable server",
+			cfg:  nats.ConnConfig{URL: fmt.Sprintf("nats://127.0.0.1:1,%s", tokenSrv.ClientURL()), Token: "secret"},
+		},
+	}
+
+	for _, tc := range cases {
+		ps, err := nats.NewPubSub(tc.cfg, "", testLog)
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		if err == nil {
+			assert.Nil(t, ps.CheckConnection(), fmt.Sprintf("%s: connection expected to be established", tc.desc))
+			ps.Close()
+		}
+	}
+}
+
+func TestConnectInvalidConfig(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  nats.ConnConfig
+		err  error
+	}{
+		{
+			desc: "several authentication methods",
+			cfg:  nats.ConnConfig{URL: natsURL, Token: "secret", User: "forwarder"},
+			err:  nats.ErrInvalidAuth,
+		},
+		{
+			desc: "client certificate without key",
+			cfg:  nats.ConnConfig{URL: natsURL, ClientCertFile: "client.pem"},
+			err:  nats.ErrInvalidTLS,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := nats.NewPubSub(tc.cfg, "", testLog)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+
+	tlsCfg, err := server.GenTLSConfig(&server.TLSConfigOpts{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CaFile:   filepath.Join(dir, "ca.pem"),
+		Verify:   true,
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating TLS config: %s", err))
+	srv := runServer(t, &server.Options{TLS: true, TLSVerify: true, TLSConfig: tlsCfg, TLSTimeout: 2})
+	defer srv.Shutdown()
+	url := fmt.Sprintf("tls://%s", srv.Addr().String())
+
+	cases := []struct {
+		desc string
+		cfg  nats.ConnConfig
+		err  bool
+	}{
+		{
+			desc: "connect with CA and client certificate",
+			cfg: nats.ConnConfig{
+				URL:            url,
+				CACertFile:     filepath.Join(dir, "ca.pem"),
+				ClientCertFile: filepath.Join(dir, "client.pem"),
+				ClientKeyFile:  filepath.Join(dir, "client-key.pem"),
+			},
+		},
+		{
+			desc: "connect without client certificate",
+			cfg:  nats.ConnConfig{URL: url, CACertFile: filepath.Join(dir, "ca.pem")},
+			err:  true,
+		},
+		{
+			desc: "connect without CA",
+			cfg: nats.ConnConfig{
+				URL:            url,
+				ClientCertFile: filepath.Join(dir, "client.pem"),
+				ClientKeyFile:  filepath.Join(dir, "client-key.pem"),
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		ps, err := nats.NewPubSub(tc.cfg, "", testLog)
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		if err == nil {
+			assert.Nil(t, ps.CheckConnection(), fmt.Sprintf("%s: connection expected to be established", tc.desc))
+			ps.Close()
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := runServer(t, &server.Options{})
+	port := srv.Addr().(*net.TCPAddr).Port
+
+	ps, err := nats.NewPubSub(nats.ConnConfig{URL: srv.ClientURL(), ReconnectWait: 10 * time.Millisecond, MaxReconnects: -1}, "", testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error connecting to NATS: %s", err))
+	defer ps.Close()
+	assert.Nil(t, ps.CheckConnection(), "connection expected to be established")
+
+	srv.Shutdown()
+	assert.Eventually(t, func() bool {
+		return ps.CheckConnection() != nil
+	}, 5*time.Second, 10*time.Millisecond, "connection expected to be reported lost")
+
+	srv = runServer(t, &server.Options{Port: port})
+	defer srv.Shutdown()
+	assert.Eventually(t, func() bool {
+		return ps.CheckConnection() == nil
+	}, 5*time.Second, 10*time.Millisecond, "connection expected to be reported reestablished")
+}
+
+// writeCert writes the certificate and key of the name to the directory,
+// signed by the parent or self-signed if the parent is nil.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err, fmt.Sprintf("unexpected error generating key: %s", err))
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating certificate: %s", err))
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err, fmt.Sprintf("unexpected error parsing certificate: %s", err))
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err, fmt.Sprintf("unexpected error marshalling key: %s", err))
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600), "unexpected error writing certificate")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600), "unexpected error writing key")
+
+	return cert, key
+}
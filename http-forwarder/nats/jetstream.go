@@ -0,0 +1,352 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package nats
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	log "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/messaging"
+	broker "github.com/nats-io/nats.go"
+)
+
+const (
+	apiTimeout    = 5 * time.Second
+	stopTimeout   = time.Second
+	nakDelayedFmt = "-NAK {\"delay\":%d}"
+)
+
+var (
+	// ErrJetStream indicates that the JetStream API returned an error.
+	ErrJetStream = errors.New("JetStream API error")
+
+	errInvalidDurable = errors.New("invalid durable consumer name")
+)
+
+// JetStreamConfig contains the settings of the JetStream durable consumers.
+type JetStreamConfig struct {
+	// Stream is the name of the existing stream storing the messages.
+	Stream string
+
+	// Durable is the prefix of the durable consumer names. Replicas using
+	// the same prefix share the messages.
+	Durable string
+
+	// Batch is the maximum number of messages pulled at once.
+	Batch int
+
+	// MaxWait is the time a pull request waits for messages.
+	MaxWait time.Duration
+
+	// AckWait is the time after which an unacknowledged message is
+	// delivered again.
+	AckWait time.Duration
+
+	// MaxDeliver is the number of delivery attempts after which a message
+	// is routed to the dead letter, unlimited if 0.
+	MaxDeliver int
+
+	// NakDelay is the time before a message whose handling failed is
+	// delivered again.
+	NakDelay time.Duration
+
+	// DeadLetter is the subject prefix messages are published to before
+	// being terminated, followed by their original subject. Terminated
+	// messages are discarded if it is empty.
+	DeadLetter string
+
+	// Unprocessable reports whether the handler error means that the
+	// message must not be delivered again. Optional.
+	Unprocessable func(error) bool
+}
+
+var _ Subscriber = (*jetStream)(nil)
+
+type jetStream struct {
+	conn      *conn
+	ctx       broker.JetStreamContext
+	cfg       JetStreamConfig
+	logger    log.Logger
+	mu        sync.Mutex
+	consumers map[string]*pullConsumer
+}
+
+type pullConsumer struct {
+	topic   string
+	sub     *broker.Subscription
+	handler messaging.MessageHandler
+	ctx     context.Context
+	stop    context.CancelFunc
+	done    chan struct{}
+}
+
+// NewJetStream returns NATS subscriber consuming the messages stored in the
+// JetStream stream with durable pull consumers, one per subscribed topic.
+// A message is acknowledged once the handler succeeds, so it is delivered
+// at least once. On failure, it is delivered again after the NAK delay,
+// unless it is unprocessable or the delivery attempts are exhausted; it is
+// then published to the dead letter and terminated.
+func NewJetStream(connCfg ConnConfig, cfg JetStreamConfig, logger log.Logger) (Subscriber, error) {
+	if cfg.Durable == "" || strings.ContainsAny(cfg.Durable, ".*> \t") {
+		return nil, errors.Wrap(errInvalidDurable, errors.New(cfg.Durable))
+	}
+
+	conn, err := connect(connCfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := conn.JetStream(broker.MaxWait(apiTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(ErrJetStream, err)
+	}
+	if _, err := ctx.StreamInfo(cfg.Stream); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(ErrJetStream, err)
+	}
+
+	js := &jetStream{
+		conn:      conn,
+		ctx:       ctx,
+		cfg:       cfg,
+		logger:    logger,
+		consumers: make(map[string]*pullConsumer),
+	}
+	return js, nil
+}
+
+func (js *jetStream) Subscribe(topic string, handler messaging.MessageHandler) error {
+	if topic == "" {
+		return errEmptyTopic
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if _, ok := js.consumers[topic]; ok {
+		return errAlreadySubscribed
+	}
+
+	// The durable consumer is created if it doesn't exist yet, otherwise
+	// the subscription is bound to it.
+	sub, err := js.ctx.PullSubscribe(topic, durableName(js.cfg.Durable, topic),
+		broker.BindStream(js.cfg.Stream),
+		broker.DeliverAll(),
+		broker.AckExplicit(),
+		broker.AckWait(js.cfg.AckWait),
+		broker.MaxDeliver(js.cfg.MaxDeliver),
+	)
+	if err != nil {
+		return errors.Wrap(ErrJetStream, err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	pc := &pullConsumer{
+		topic:   topic,
+		sub:     sub,
+		handler: handler,
+		ctx:     ctx,
+		stop:    stop,
+		done:    make(chan struct{}),
+	}
+	js.consumers[topic] = pc
+	go js.pull(pc)
+	return nil
+}
+
+// Unsubscribe stops pulling the messages of the topic. The durable consumer
+// is kept, so the messages published meanwhile are delivered once
+// subscribing again.
+func (js *jetStream) Unsubscribe(topic string) error {
+	if topic == "" {
+		return errEmptyTopic
+	}
+	js.mu.Lock()
+	pc, ok := js.consumers[topic]
+	delete(js.consumers, topic)
+	js.mu.Unlock()
+	if !ok {
+		return errNotSubscribed
+	}
+
+	pc.stop()
+	<-pc.done
+	return nil
+}
+
+func (js *jetStream) CheckConnection() error {
+	return js.conn.check()
+}
+
+func (js *jetStream) CheckSubscriptions() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if len(js.consumers) == 0 {
+		return errNoSubscriptions
+	}
+	for topic, pc := range js.consumers {
+		if !pc.sub.IsValid() {
+			return errors.Wrap(errInvalidSub, errors.New(topic))
+		}
+	}
+	return nil
+}
+
+// Drain stops pulling messages and waits until the messages being handled
+// are acknowledged. The other pulled messages are released to be delivered
+// again right away, to another replica if any.
+func (js *jetStream) Drain(ctx context.Context) error {
+	js.mu.Lock()
+	consumers := js.consumers
+	js.consumers = make(map[string]*pullConsumer)
+	js.mu.Unlock()
+
+	for _, pc := range consumers {
+		pc.stop()
+	}
+	for topic, pc := range consumers {
+		select {
+		case <-pc.done:
+		case <-ctx.Done():
+			return errors.Wrap(errDrain, fmt.Errorf("%s, consumer of %s not stopped", ctx.Err(), topic))
+		}
+	}
+	return nil
+}
+
+func (js *jetStream) Close() {
+	js.conn.Close()
+}
+
+// pull fetches batches of messages until the consumer is stopped, at most
+// the max wait later. The message being handled when stopping is completed,
+// the other fetched ones are negatively acknowledged so that they are
+// delivered again right away.
+func (js *jetStream) pull(pc *pullConsumer) {
+	defer close(pc.done)
+	defer pc.sub.Unsubscribe()
+
+	for {
+		// The pull request is not cancelled when stopping: the messages
+		// delivered to a cancelled request would only be delivered again
+		// once the ack wait is over.
+		msgs, err := pc.sub.Fetch(js.cfg.Batch, broker.MaxWait(js.cfg.MaxWait))
+		switch {
+		case pc.ctx.Err() != nil:
+			js.release(msgs)
+			return
+		case err == broker.ErrTimeout:
+		case err != nil:
+			js.logger.Warn(fmt.Sprintf("Failed to pull messages of %s: %s", pc.topic, err))
+			select {
+			case <-pc.ctx.Done():
+				return
+			case <-time.After(js.cfg.MaxWait):
+			}
+		}
+
+		for i, m := range msgs {
+			if pc.ctx.Err() != nil {
+				js.release(msgs[i:])
+				return
+			}
+			js.handle(pc, m)
+		}
+	}
+}
+
+func (js *jetStream) handle(pc *pullConsumer, m *broker.Msg) {
+	var msg messaging.Message
+	if err := msg.Unmarshal(m.Data); err != nil {
+		js.logger.Warn(fmt.Sprintf("Failed to unmarshal received message: %s", err))
+		js.terminate(m, m.Subject)
+		return
+	}
+
+	subject := fmt.Sprintf("%s.%s", chansPrefix, msg.Channel)
+	if msg.Subtopic != "" {
+		subject = fmt.Sprintf("%s.%s", subject, msg.Subtopic)
+	}
+
+	err := pc.handler(msg)
+	switch {
+	case err == nil:
+		js.settle(m.Ack())
+	case js.cfg.Unprocessable != nil && js.cfg.Unprocessable(err):
+		js.logger.Warn(fmt.Sprintf("Failed to handle unprocessable message: %s", err))
+		js.terminate(m, subject)
+	case js.cfg.MaxDeliver > 0 && deliveries(m) >= js.cfg.MaxDeliver:
+		js.logger.Warn(fmt.Sprintf("Failed to handle message after %d attempts: %s", js.cfg.MaxDeliver, err))
+		js.terminate(m, subject)
+	default:
+		js.logger.Warn(fmt.Sprintf("Failed to handle message, delivering it again in %s: %s", js.cfg.NakDelay, err))
+		js.nak(m, js.cfg.NakDelay)
+	}
+}
+
+// release negatively acknowledges the fetched messages which are not
+// handled.
+func (js *jetStream) release(msgs []*broker.Msg) {
+	for _, m := range msgs {
+		js.nak(m, 0)
+	}
+	js.conn.FlushTimeout(stopTimeout)
+}
+
+// terminate publishes the message to the dead letter, if any, and stops
+// its delivery.
+func (js *jetStream) terminate(m *broker.Msg, subject string) {
+	if js.cfg.DeadLetter != "" {
+		subject := fmt.Sprintf("%s.%s", js.cfg.DeadLetter, subject)
+		if err := js.conn.Publish(subject, m.Data); err != nil {
+			js.logger.Error(fmt.Sprintf("Failed to publish message to dead letter %s: %s", subject, err))
+		}
+	}
+	js.settle(m.Term())
+}
+
+// nak negatively acknowledges the message so that it is delivered again
+// after the delay. The client has no delayed NAK, so it is sent as a reply;
+// servers which ignore the delay deliver the message again once the ack
+// wait is over.
+func (js *jetStream) nak(m *broker.Msg, delay time.Duration) {
+	if delay <= 0 {
+		js.settle(m.Nak())
+		return
+	}
+	js.settle(m.Respond([]byte(fmt.Sprintf(nakDelayedFmt, delay.Nanoseconds()))))
+}
+
+func (js *jetStream) settle(err error) {
+	if err != nil {
+		js.logger.Warn(fmt.Sprintf("Failed to acknowledge message: %s", err))
+	}
+}
+
+// deliveries returns the number of times the message has been delivered,
+// 0 if the metadata of the message can't be read.
+func deliveries(m *broker.Msg) int {
+	meta, err := m.Metadata()
+	if err != nil {
+		return 0
+	}
+	return int(meta.NumDelivered)
+}
+
+// durableName returns the name of the durable consumer of the topic, which
+// can't contain the subject separators and wildcards. The readable part is
+// followed by a hash of the topic, since distinct topics such as
+// channels.a.b and channels.a_b are replaced by the same name.
+func durableName(prefix, topic string) string {
+	r := strings.NewReplacer(".", "_", "*", "any", ">", "all")
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return fmt.Sprintf("%s_%s_%08x", prefix, r.Replace(topic), h.Sum32())
+}
@@ -0,0 +1,370 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package nats_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/nats"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/messaging"
+	broker "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	stream     = "mainflux"
+	deadLetter = "deadletter"
+)
+
+var errUnprocessable = errors.New("unprocessable")
+
+// streamServer is a JetStream enabled NATS server storing the messages of
+// the channels in the stream. The acknowledgements sent by the subscriber
+// are counted by kind.
+type streamServer struct {
+	url      string
+	conn     *broker.Conn
+	js       broker.JetStreamContext
+	shutdown func()
+	mu       sync.Mutex
+	acks     map[string]int
+	naks     []string
+}
+
+func newStreamServer(t *testing.T) *streamServer {
+	url, shutdown := newJetStreamServer(t)
+	conn, err := broker.Connect(url)
+	require.Nil(t, err, fmt.Sprintf("unexpected error connecting to NATS: %s", err))
+	js, err := conn.JetStream()
+	require.Nil(t, err, fmt.Sprintf("unexpected error getting JetStream context: %s", err))
+	_, err = js.AddStream(&broker.StreamConfig{Name: stream, Subjects: []string{"channels.>"}, Storage: broker.MemoryStorage})
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating stream: %s", err))
+
+	ss := &streamServer{
+		url:      url,
+		conn:     conn,
+		js:       js,
+		shutdown: shutdown,
+		acks:     make(map[string]int),
+	}
+	_, err = conn.Subscribe(fmt.Sprintf("$JS.ACK.%s.>", stream), func(m *broker.Msg) {
+		kind := strings.SplitN(string(m.Data), " ", 2)
+		ss.mu.Lock()
+		ss.acks[kind[0]]++
+		if kind[0] == "-NAK" {
+			ss.naks = append(ss.naks, string(m.Data))
+		}
+		ss.mu.Unlock()
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error subscribing to acknowledgements: %s", err))
+	require.Nil(t, conn.Flush(), "unexpected error flushing")
+	return ss
+}
+
+func (ss *streamServer) close() {
+	ss.conn.Close()
+	ss.shutdown()
+}
+
+func (ss *streamServer) publish(t *testing.T, payload string) {
+	msg := messaging.Message{Channel: channel, Payload: []byte(payload)}
+	data, err := msg.Marshal()
+	require.Nil(t, err, fmt.Sprintf("unexpected error marshalling message: %s", err))
+	_, err = ss.js.Publish("channels."+channel, data)
+	require.Nil(t, err, fmt.Sprintf("unexpected error storing message: %s", err))
+}
+
+// filters returns the subjects filtered by the durable consumers.
+func (ss *streamServer) filters() []string {
+	var filters []string
+	for info := range ss.js.ConsumersInfo(stream) {
+		filters = append(filters, info.Config.FilterSubject)
+	}
+	return filters
+}
+
+func (ss *streamServer) count(kind string) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.acks[kind]
+}
+
+func (ss *streamServer) nakDelays() []string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return append([]string{}, ss.naks...)
+}
+
+func TestJetStream(t *testing.T) {
+	cfg := nats.JetStreamConfig{
+		Stream:     stream,
+		Durable:    "http-forwarder",
+		Batch:      5,
+		MaxWait:    100 * time.Millisecond,
+		AckWait:    500 * time.Millisecond,
+		MaxDeliver: 3,
+		NakDelay:   10 * time.Millisecond,
+		DeadLetter: deadLetter,
+		Unprocessable: func(err error) bool {
+			return errors.Contains(err, errUnprocessable)
+		},
+	}
+
+	cases := []struct {
+		desc       string
+		handlerErr func(attempt int64) error
+		attempts   int64
+		acks       int
+		naks       int
+		terms      int
+		deadLetter bool
+	}{
+		{
+			desc:       "acknowledge handled message",
+			handlerErr: func(int64) error { return nil },
+			attempts:   1,
+			acks:       1,
+		},
+		{
+			desc: "deliver again message whose handling failed",
+			handlerErr: func(attempt int64) error {
+				if attempt == 1 {
+					return errors.New("remote target unavailable")
+				}
+				return nil
+			},
+			attempts: 2,
+			acks:     1,
+			naks:     1,
+		},
+		{
+			desc:       "terminate unprocessable message",
+			handlerErr: func(int64) error { return errUnprocessable },
+			attempts:   1,
+			terms:      1,
+			deadLetter: true,
+		},
+		{
+			desc:       "terminate message after max deliver attempts",
+			handlerErr: func(int64) error { return errors.New("remote target unavailable") },
+			attempts:   3,
+			naks:       2,
+			terms:      1,
+			deadLetter: true,
+		},
+	}
+
+	for _, tc := range cases {
+		ss := newStreamServer(t)
+
+		dl := make(chan *broker.Msg, 1)
+		_, err := ss.conn.ChanSubscribe(deadLetter+".>", dl)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error subscribing to dead letter: %s", tc.desc, err))
+		require.Nil(t, ss.conn.Flush(), fmt.Sprintf("%s: unexpected error flushing", tc.desc))
+
+		js, err := nats.NewJetStream(nats.ConnConfig{URL: ss.url}, cfg, testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating JetStream subscriber: %s", tc.desc, err))
+
+		var attempts int64
+		err = js.Subscribe(nats.SubjectAllChannels, func(msg messaging.Message) error {
+			return tc.handlerErr(atomic.AddInt64(&attempts, 1))
+		})
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error subscribing: %s", tc.desc, err))
+		assert.Nil(t, js.CheckSubscriptions(), fmt.Sprintf("%s: subscription expected to be valid", tc.desc))
+		assert.Equal(t, []string{nats.SubjectAllChannels}, ss.filters(), fmt.Sprintf("%s: expected durable consumer filtering subject", tc.desc))
+
+		ss.publish(t, tc.desc)
+
+		assert.Eventually(t, func() bool {
+			return ss.count("+ACK")+ss.count("+TERM") == 1
+		}, 5*time.Second, 10*time.Millisecond, fmt.Sprintf("%s: message expected to be settled", tc.desc))
+		assert.Equal(t, tc.attempts, atomic.LoadInt64(&attempts), fmt.Sprintf("%s: unexpected delivery attempts", tc.desc))
+		assert.Equal(t, tc.acks, ss.count("+ACK"), fmt.Sprintf("%s: unexpected acks", tc.desc))
+		assert.Equal(t, tc.naks, ss.count("-NAK"), fmt.Sprintf("%s: unexpected naks", tc.desc))
+		assert.Equal(t, tc.terms, ss.count("+TERM"), fmt.Sprintf("%s: unexpected terms", tc.desc))
+		for _, nak := range ss.nakDelays() {
+			assert.Equal(t, fmt.Sprintf(`-NAK {"delay":%d}`, cfg.NakDelay.Nanoseconds()), nak, fmt.Sprintf("%s: unexpected nak delay", tc.desc))
+		}
+
+		if tc.deadLetter {
+			select {
+			case m := <-dl:
+				assert.Equal(t, deadLetter+".channels."+channel, m.Subject, fmt.Sprintf("%s: unexpected dead letter subject", tc.desc))
+				var msg messaging.Message
+				assert.Nil(t, msg.Unmarshal(m.Data), fmt.Sprintf("%s: dead letter expected to carry the message", tc.desc))
+				assert.Equal(t, tc.desc, string(msg.Payload), fmt.Sprintf("%s: unexpected dead letter payload", tc.desc))
+			case <-time.After(time.Second):
+				assert.Fail(t, fmt.Sprintf("%s: message expected in dead letter", tc.desc))
+			}
+		}
+
+		err = js.Drain(context.Background())
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error draining: %s", tc.desc, err))
+		js.Close()
+		ss.close()
+	}
+}
+
+func TestJetStreamUnknownStream(t *testing.T) {
+	ss := newStreamServer(t)
+	defer ss.close()
+
+	_, err := nats.NewJetStream(nats.ConnConfig{URL: ss.url}, nats.JetStreamConfig{Stream: "unknown", Durable: "http-forwarder", Batch: 1, MaxWait: time.Second}, testLog)
+	assert.True(t, errors.Contains(err, nats.ErrJetStream), fmt.Sprintf("expected %s got %v", nats.ErrJetStream, err))
+
+	_, err = nats.NewJetStream(nats.ConnConfig{URL: ss.url}, nats.JetStreamConfig{Stream: stream, Durable: "http.forwarder", Batch: 1, MaxWait: time.Second}, testLog)
+	assert.NotNil(t, err, "durable name containing a subject separator expected to be rejected")
+}
+
+func TestJetStreamDurableNames(t *testing.T) {
+	ss := newStreamServer(t)
+	defer ss.close()
+
+	cfg := nats.JetStreamConfig{Stream: stream, Durable: "http-forwarder", Batch: 1, MaxWait: 100 * time.Millisecond}
+	js, err := nats.NewJetStream(nats.ConnConfig{URL: ss.url}, cfg, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating JetStream subscriber: %s", err))
+	defer js.Close()
+
+	// The topics are replaced by the same readable name.
+	topics := []string{"channels.a.b", "channels.a_b", "channels.*", "channels.any"}
+	for _, topic := range topics {
+		err := js.Subscribe(topic, func(messaging.Message) error { return nil })
+		require.Nil(t, err, fmt.Sprintf("unexpected error subscribing to %s: %s", topic, err))
+	}
+	assert.ElementsMatch(t, topics, ss.filters(), "expected a durable consumer per topic")
+
+	err = js.Drain(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("unexpected error draining: %s", err))
+
+	// The durable consumers are kept and bound again.
+	for _, topic := range topics {
+		err := js.Subscribe(topic, func(messaging.Message) error { return nil })
+		assert.Nil(t, err, fmt.Sprintf("unexpected error subscribing again to %s: %s", topic, err))
+	}
+	assert.Len(t, ss.filters(), len(topics), "expected durable consumers to be reused")
+}
+
+func TestJetStreamDrain(t *testing.T) {
+	ss := newStreamServer(t)
+	defer ss.close()
+
+	cfg := nats.JetStreamConfig{Stream: stream, Durable: "http-forwarder", Batch: 10, MaxWait: 100 * time.Millisecond, AckWait: 30 * time.Second, NakDelay: time.Second}
+	js, err := nats.NewJetStream(nats.ConnConfig{URL: ss.url}, cfg, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating JetStream subscriber: %s", err))
+	defer js.Close()
+
+	for i := 0; i < 5; i++ {
+		ss.publish(t, fmt.Sprintf("%d", i))
+	}
+
+	started := make(chan struct{}, 10)
+	err = js.Subscribe(nats.SubjectAllChannels, func(msg messaging.Message) error {
+		started <- struct{}{}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error subscribing: %s", err))
+	<-started
+
+	err = js.Drain(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("unexpected error draining: %s", err))
+	assert.NotNil(t, js.CheckSubscriptions(), "no subscription expected after drain")
+
+	// The message being handled is acknowledged and the other fetched ones
+	// are released to be delivered again.
+	assert.Eventually(t, func() bool {
+		return ss.count("+ACK")+ss.count("-NAK") == 5
+	}, time.Second, 10*time.Millisecond, "fetched messages expected to be settled")
+	assert.True(t, ss.count("+ACK") >= 1, "message being handled expected to be acknowledged")
+}
+
+func TestJetStreamExpiredPulls(t *testing.T) {
+	ss := newStreamServer(t)
+	defer ss.close()
+
+	dl := make(chan *broker.Msg, 10)
+	_, err := ss.conn.ChanSubscribe(deadLetter+".>", dl)
+	require.Nil(t, err, fmt.Sprintf("unexpected error subscribing to dead letter: %s", err))
+	require.Nil(t, ss.conn.Flush(), "unexpected error flushing")
+
+	cfg := nats.JetStreamConfig{
+		Stream:     stream,
+		Durable:    "http-forwarder",
+		Batch:      5,
+		MaxWait:    50 * time.Millisecond,
+		AckWait:    time.Second,
+		MaxDeliver: 3,
+		NakDelay:   10 * time.Millisecond,
+		DeadLetter: deadLetter,
+		Unprocessable: func(err error) bool {
+			return errors.Contains(err, errUnprocessable)
+		},
+	}
+	js, err := nats.NewJetStream(nats.ConnConfig{URL: ss.url}, cfg, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating JetStream subscriber: %s", err))
+	defer js.Close()
+
+	handled := make(chan string, 10)
+	err = js.Subscribe(nats.SubjectAllChannels, func(msg messaging.Message) error {
+		handled <- string(msg.Payload)
+		if string(msg.Payload) == "unprocessable" {
+			return errUnprocessable
+		}
+		return nil
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error subscribing: %s", err))
+
+	// The pull requests expire several times while the stream is empty,
+	// which is not a failure of the subscription.
+	time.Sleep(10 * cfg.MaxWait)
+	select {
+	case m := <-dl:
+		assert.Fail(t, fmt.Sprintf("unexpected dead letter %q with headers %v", m.Data, m.Header))
+	case payload := <-handled:
+		assert.Fail(t, fmt.Sprintf("unexpected handled message %q", payload))
+	default:
+	}
+
+	for _, payload := range []string{"forwarded", "unprocessable"} {
+		ss.publish(t, payload)
+	}
+
+	for _, expected := range []string{"forwarded", "unprocessable"} {
+		select {
+		case payload := <-handled:
+			assert.Equal(t, expected, payload, "unexpected handled message")
+		case <-time.After(time.Second):
+			assert.Fail(t, fmt.Sprintf("message %q expected to be handled", expected))
+		}
+	}
+	select {
+	case m := <-dl:
+		var msg messaging.Message
+		assert.Nil(t, msg.Unmarshal(m.Data), "dead letter expected to carry the message")
+		assert.Equal(t, "unprocessable", string(msg.Payload), "unexpected dead letter payload")
+	case <-time.After(time.Second):
+		assert.Fail(t, "unprocessable message expected in dead letter")
+	}
+
+	// Both messages are settled: neither is delivered again.
+	time.Sleep(cfg.AckWait + 10*cfg.MaxWait)
+	select {
+	case m := <-dl:
+		assert.Fail(t, fmt.Sprintf("unexpected dead letter %q with headers %v", m.Data, m.Header))
+	case payload := <-handled:
+		assert.Fail(t, fmt.Sprintf("unexpected message %q delivered again", payload))
+	default:
+	}
+
+	err = js.Drain(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("unexpected error draining: %s", err))
+}
@@ -0,0 +1,278 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+// Package nats contains the NATS PubSub used by the forwarder. It behaves
+// like the Mainflux NATS PubSub and additionally reports the state of the
+// connection and of the subscriptions.
+package nats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	log "github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/messaging"
+	broker "github.com/nats-io/nats.go"
+)
+
+const (
+	chansPrefix   = "channels"
+	drainInterval = 50 * time.Millisecond
+)
+
+// SubjectAllChannels represents subject to subscribe for all the channels.
+const SubjectAllChannels = "channels.>"
+
+// Delivery modes of the messages among the replicas of the forwarder.
+const (
+	// FanOut delivers every message to every replica.
+	FanOut = "fanout"
+
+	// LoadBalanced delivers every message to a single replica of the
+	// queue group.
+	LoadBalanced = "balanced"
+)
+
+var (
+	errAlreadySubscribed = errors.New("already subscribed to topic")
+	errNotSubscribed     = errors.New("not subscribed")
+	errEmptyTopic        = errors.New("empty topic")
+	errNotConnected      = errors.New("not connected to NATS")
+	errNoSubscriptions   = errors.New("no active subscriptions")
+	errInvalidSub        = errors.New("invalid subscription")
+	errDrain             = errors.New("failed to drain subscriptions")
+
+	// ErrInvalidMode indicates that the delivery mode is unknown.
+	ErrInvalidMode = errors.New("invalid delivery mode")
+)
+
+var _ messaging.PubSub = (*pubsub)(nil)
+
+// Subscriber wraps messaging Subscriber exposing methods reporting the state
+// of NATS connection and subscriptions, draining and closing them.
+type Subscriber interface {
+	messaging.Subscriber
+
+	// CheckConnection returns an error if NATS connection is not established.
+	CheckConnection() error
+
+	// CheckSubscriptions returns an error if there is no subscription or
+	// if any subscription is no longer valid.
+	CheckSubscriptions() error
+
+	// Drain stops receiving messages on all the subscriptions and waits
+	// until the messages already received are handled or the context is
+	// done. Subscribing again afterwards is allowed.
+	Drain(ctx context.Context) error
+
+	// Close closes NATS connection.
+	Close()
+}
+
+// PubSub wraps messaging PubSub exposing Close() method for NATS connection
+// and methods reporting its state.
+type PubSub interface {
+	messaging.Publisher
+	Subscriber
+}
+
+type pubsub struct {
+	conn          *conn
+	logger        log.Logger
+	mu            sync.Mutex
+	queue         string
+	subscriptions map[string]*broker.Subscription
+}
+
+// NewPubSub returns NATS message publisher/subscriber connected with the
+// connection settings.
+// Parameter queue specifies the queue for the Subscribe method.
+// If queue is specified (is not an empty string), Subscribe method
+// will execute NATS QueueSubscribe. If the queue is empty,
+// Subscribe will be used.
+func NewPubSub(cfg ConnConfig, queue string, logger log.Logger) (PubSub, error) {
+	conn, err := connect(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	ret := &pubsub{
+		conn:          conn,
+		queue:         queue,
+		logger:        logger,
+		subscriptions: make(map[string]*broker.Subscription),
+	}
+	return ret, nil
+}
+
+// QueueGroup returns the queue to pass to NewPubSub for the delivery mode:
+// the group name for LoadBalanced and no queue for FanOut.
+func QueueGroup(mode, group string) (string, error) {
+	switch mode {
+	case FanOut:
+		return "", nil
+	case LoadBalanced:
+		if group == "" {
+			return "", errors.Wrap(ErrInvalidMode, errors.New("empty queue group"))
+		}
+		return group, nil
+	default:
+		return "", errors.Wrap(ErrInvalidMode, errors.New(mode))
+	}
+}
+
+func (ps *pubsub) Publish(topic string, msg messaging.Message) error {
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("%s.%s", chansPrefix, topic)
+	if msg.Subtopic != "" {
+		subject = fmt.Sprintf("%s.%s", subject, msg.Subtopic)
+	}
+	return ps.conn.Publish(subject, data)
+}
+
+func (ps *pubsub) Subscribe(topic string, handler messaging.MessageHandler) error {
+	if topic == "" {
+		return errEmptyTopic
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.subscriptions[topic]; ok {
+		return errAlreadySubscribed
+	}
+	nh := ps.natsHandler(handler)
+
+	if ps.queue != "" {
+		sub, err := ps.conn.QueueSubscribe(topic, ps.queue, nh)
+		if err != nil {
+			return err
+		}
+		ps.subscriptions[topic] = sub
+		return nil
+	}
+	sub, err := ps.conn.Subscribe(topic, nh)
+	if err != nil {
+		return err
+	}
+	ps.subscriptions[topic] = sub
+	return nil
+}
+
+func (ps *pubsub) Unsubscribe(topic string) error {
+	if topic == "" {
+		return errEmptyTopic
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	sub, ok := ps.subscriptions[topic]
+	if !ok {
+		return errNotSubscribed
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		return err
+	}
+
+	delete(ps.subscriptions, topic)
+	return nil
+}
+
+func (ps *pubsub) CheckConnection() error {
+	return ps.conn.check()
+}
+
+func (ps *pubsub) CheckSubscriptions() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if len(ps.subscriptions) == 0 {
+		return errNoSubscriptions
+	}
+	for topic, sub := range ps.subscriptions {
+		if !sub.IsValid() {
+			return errors.Wrap(errInvalidSub, errors.New(topic))
+		}
+	}
+	return nil
+}
+
+func (ps *pubsub) Drain(ctx context.Context) error {
+	ps.mu.Lock()
+	subs := ps.subscriptions
+	ps.subscriptions = make(map[string]*broker.Subscription)
+	ps.mu.Unlock()
+
+	for topic, sub := range subs {
+		if err := sub.Drain(); err != nil {
+			ps.logger.Warn(fmt.Sprintf("Failed to drain subscription to %s: %s", topic, err))
+			delete(subs, topic)
+		}
+	}
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		// A drained subscription becomes invalid once the handler of its
+		// last pending message has returned.
+		for topic, sub := range subs {
+			if !sub.IsValid() {
+				delete(subs, topic)
+			}
+		}
+		if len(subs) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			pending := 0
+			for _, sub := range subs {
+				if n, _, err := sub.Pending(); err == nil {
+					pending += n
+				}
+			}
+			return errors.Wrap(errDrain, fmt.Errorf("%s, %d messages not handled", ctx.Err(), pending))
+		}
+	}
+}
+
+func (ps *pubsub) Close() {
+	ps.conn.Close()
+}
+
+func (ps *pubsub) natsHandler(h messaging.MessageHandler) broker.MsgHandler {
+	return func(m *broker.Msg) {
+		var msg messaging.Message
+		if err := msg.Unmarshal(m.Data); err != nil {
+			ps.logger.Warn(fmt.Sprintf("Failed to unmarshal received message: %s", err))
+			return
+		}
+		if err := h(msg); err != nil {
+			ps.logger.Warn(fmt.Sprintf("Failed to handle Mainflux message: %s", err))
+		}
+	}
+}
+
+func statusText(s broker.Status) string {
+	switch s {
+	case broker.DISCONNECTED:
+		return "disconnected"
+	case broker.CONNECTED:
+		return "connected"
+	case broker.CLOSED:
+		return "closed"
+	case broker.RECONNECTING:
+		return "reconnecting"
+	case broker.CONNECTING:
+		return "connecting"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package nats_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/nats"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/messaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	channel  = "1"
+	messages = 100
+)
+
+func counter(count *int64, delay time.Duration) messaging.MessageHandler {
+	return func(msg messaging.Message) error {
+		time.Sleep(delay)
+		atomic.AddInt64(count, 1)
+		return nil
+	}
+}
+
+func TestQueueGroup(t *testing.T) {
+	cases := []struct {
+		desc  string
+		mode  string
+		group string
+		queue string
+		err   error
+	}{
+		{
+			desc:  "fan-out mode",
+			mode:  nats.FanOut,
+			group: "http-forwarder",
+			queue: "",
+		},
+		{
+			desc:  "load-balanced mode",
+			mode:  nats.LoadBalanced,
+			group: "http-forwarder",
+			queue: "http-forwarder",
+		},
+		{
+			desc:  "load-balanced mode without group",
+			mode:  nats.LoadBalanced,
+			group: "",
+			err:   nats.ErrInvalidMode,
+		},
+		{
+			desc:  "unknown mode",
+			mode:  "broadcast",
+			group: "http-forwarder",
+			err:   nats.ErrInvalidMode,
+		},
+	}
+
+	for _, tc := range cases {
+		queue, err := nats.QueueGroup(tc.mode, tc.group)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		assert.Equal(t, tc.queue, queue, fmt.Sprintf("%s: unexpected queue", tc.desc))
+	}
+}
+
+func TestDeliveryModes(t *testing.T) {
+	cases := []struct {
+		desc     string
+		mode     string
+		replicas int
+		total    int64
+	}{
+		{
+			desc:     "fan-out delivers every message to each replica",
+			mode:     nats.FanOut,
+			replicas: 2,
+			total:    2 * messages,
+		},
+		{
+			desc:     "load-balanced delivers every message once",
+			mode:     nats.LoadBalanced,
+			replicas: 2,
+			total:    messages,
+		},
+	}
+
+	for _, tc := range cases {
+		queue, err := nats.QueueGroup(tc.mode, "http-forwarder")
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		counts := make([]int64, tc.replicas)
+		for i := range counts {
+			ps, err := nats.NewPubSub(nats.ConnConfig{URL: natsURL}, queue, testLog)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error connecting to NATS: %s", tc.desc, err))
+			defer ps.Close()
+
+			err = ps.Subscribe(nats.SubjectAllChannels, counter(&counts[i], 0))
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error subscribing: %s", tc.desc, err))
+			require.Nil(t, ps.CheckSubscriptions(), fmt.Sprintf("%s: subscription expected to be valid", tc.desc))
+		}
+
+		pub, err := nats.NewPubSub(nats.ConnConfig{URL: natsURL}, "", testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error connecting to NATS: %s", tc.desc, err))
+		defer pub.Close()
+
+		for i := 0; i < messages; i++ {
+			err := pub.Publish(channel, messaging.Message{Channel: channel, Payload: []byte(fmt.Sprintf("%d", i))})
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error publishing: %s", tc.desc, err))
+		}
+
+		total := func() int64 {
+			var sum int64
+			for i := range counts {
+				sum += atomic.LoadInt64(&counts[i])
+			}
+			return sum
+		}
+		assert.Eventually(t, func() bool { return total() >= tc.total }, 5*time.Second, 10*time.Millisecond, fmt.Sprintf("%s: messages expected to be delivered", tc.desc))
+		// Leave time to duplicated deliveries to show up.
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, tc.total, total(), fmt.Sprintf("%s: unexpected number of deliveries", tc.desc))
+		for i := range counts {
+			assert.True(t, atomic.LoadInt64(&counts[i]) > 0, fmt.Sprintf("%s: replica %d expected to receive messages", tc.desc, i))
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	cases := []struct {
+		desc    string
+		delay   time.Duration
+		timeout time.Duration
+		handled int64
+		err     bool
+	}{
+		{
+			desc:    "drain handles received messages",
+			delay:   5 * time.Millisecond,
+			timeout: 5 * time.Second,
+			handled: 10,
+		},
+		{
+			desc:    "drain exceeding the deadline",
+			delay:   100 * time.Millisecond,
+			timeout: 50 * time.Millisecond,
+			err:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		ps, err := nats.NewPubSub(nats.ConnConfig{URL: natsURL}, "", testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error connecting to NATS: %s", tc.desc, err))
+		defer ps.Close()
+
+		var count int64
+		err = ps.Subscribe(nats.SubjectAllChannels, counter(&count, tc.delay))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error subscribing: %s", tc.desc, err))
+
+		// Messages published on the same connection are delivered before
+		// the subscription is drained.
+		for i := 0; i < 10; i++ {
+			err := ps.Publish(channel, messaging.Message{Channel: channel, Payload: []byte(fmt.Sprintf("%d", i))})
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error publishing: %s", tc.desc, err))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+		err = ps.Drain(ctx)
+		cancel()
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		if !tc.err {
+			assert.Equal(t, tc.handled, atomic.LoadInt64(&count), fmt.Sprintf("%s: unexpected number of handled messages", tc.desc))
+		}
+		assert.NotNil(t, ps.CheckSubscriptions(), fmt.Sprintf("%s: no subscription expected after drain", tc.desc))
+
+		err = ps.Subscribe(nats.SubjectAllChannels, counter(&count, 0))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error subscribing after drain: %s", tc.desc, err))
+	}
+}
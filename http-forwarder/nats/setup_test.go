@@ -0,0 +1,59 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package nats_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/mainflux/mainflux/logger"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	natsURL    string
+	testLog, _ = log.New(os.Stdout, log.Info.String())
+)
+
+func TestMain(m *testing.M) {
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoSigs: true})
+	if err != nil {
+		testLog.Error(fmt.Sprintf("Could not create NATS server: %s", err))
+		os.Exit(1)
+	}
+
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		testLog.Error("Could not start NATS server")
+		os.Exit(1)
+	}
+	natsURL = srv.ClientURL()
+
+	code := m.Run()
+
+	srv.Shutdown()
+	os.Exit(code)
+}
+
+// newJetStreamServer starts a JetStream enabled NATS server, separate from
+// the server of the other tests, and returns its URL and the function
+// shutting it down.
+func newJetStreamServer(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "jetstream")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoSigs: true, JetStream: true, StoreDir: dir})
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating JetStream server: %s", err))
+	go srv.Start()
+	require.True(t, srv.ReadyForConnections(5*time.Second), "JetStream server expected to start")
+
+	return srv.ClientURL(), func() {
+		srv.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+// RouteConfig contains the processing of the records received on a route,
+// set in the routes table of the subjects configuration file.
+type RouteConfig struct {
+	// Include and Exclude are the rules selecting the forwarded records.
+	Include []Rule `toml:"include,omitempty"`
+	Exclude []Rule `toml:"exclude,omitempty"`
+
+	// Processors transform the forwarded records, in order.
+	Processors []ProcessorConfig `toml:"processors,omitempty"`
+
+	// Script processes the records grouped by address, after the processors.
+	Script *ScriptConfig `toml:"script,omitempty"`
+
+	// Aggregate replaces the numeric records by their aggregates over time
+	// windows, after the script.
+	Aggregate *AggregateConfig `toml:"aggregate,omitempty"`
+
+	// Deadband forwards the records which are not aggregated only when
+	// their value changes.
+	Deadband *DeadbandConfig `toml:"deadband,omitempty"`
+
+	// Delivery is the granularity of the requests sending the records:
+	// address (default), record or batch.
+	Delivery string `toml:"delivery,omitempty"`
+
+	// Sink is the destination of the records: http (default), mqtt,
+	// mainflux, kafka, grpc or push.
+	Sink string `toml:"sink,omitempty"`
+}
+
+// releaseTimeout is the time allowed to forward the aggregates of a released
+// pipeline.
+const releaseTimeout = 30 * time.Second
+
+// pipelineEnv contains the dependencies of the pipelines.
+type pipelineEnv struct {
+	// dir is the directory the script and state paths are relative to.
+	dir string
+	// emit forwards the records emitted by the aggregators.
+	emit Emitter
+	// sinks contains the configured sinks, the only ones the routes may
+	// select.
+	sinks  map[string]bool
+	logger logger.Logger
+}
+
+// checkSink returns ErrSinkNotConfigured if the sink, SinkHTTP if empty,
+// is not configured.
+func (env pipelineEnv) checkSink(sink string) error {
+	if sink == "" {
+		sink = SinkHTTP
+	}
+	if !env.sinks[sink] {
+		return errors.Wrap(ErrSinkNotConfigured, errors.New(sink))
+	}
+	return nil
+}
+
+// pipeline processes the records received on a route before they are
+// forwarded. A nil pipeline forwards the records unchanged.
+type pipeline struct {
+	filter     *Filter
+	processors []Processor
+	script     *Script
+	aggregator *Aggregator
+	deadband   *Deadband
+	delivery   string
+	sink       string
+}
+
+// runStats contains the numbers of records held by the pipeline stages
+// instead of being forwarded.
+type runStats struct {
+	aggregated int
+	late       int
+	suppressed int
+	// reported contains the forwarded records reported by exception, whose
+	// values are committed to the deadband once they are sent.
+	reported []senml.Message
+}
+
+// pipeline returns the pipeline of the settings.
+func (cfg RouteConfig) pipeline(env pipelineEnv) (*pipeline, error) {
+	if !validDelivery(cfg.Delivery) {
+		return nil, errors.Wrap(ErrInvalidDelivery, errors.New(cfg.Delivery))
+	}
+	if !validSink(cfg.Sink) {
+		return nil, errors.Wrap(ErrInvalidSink, errors.New(cfg.Sink))
+	}
+	if err := env.checkSink(cfg.Sink); err != nil {
+		return nil, err
+	}
+	p := &pipeline{delivery: cfg.Delivery, sink: cfg.Sink}
+	if len(cfg.Include) > 0 || len(cfg.Exclude) > 0 {
+		f, err := NewFilter(cfg.Include, cfg.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		p.filter = f
+	}
+	for _, pc := range cfg.Processors {
+		proc, err := NewProcessor(pc)
+		if err != nil {
+			return nil, err
+		}
+		p.processors = append(p.processors, proc)
+	}
+	if cfg.Script != nil {
+		sc := *cfg.Script
+		if !filepath.IsAbs(sc.Path) {
+			sc.Path = filepath.Join(env.dir, sc.Path)
+		}
+		s, err := NewScript(sc, env.logger)
+		if err != nil {
+			return nil, err
+		}
+		p.script = s
+	}
+	if cfg.Aggregate != nil {
+		emit := func(ctx context.Context, msgs []senml.Message) error {
+			return env.emit(WithSink(WithDelivery(ctx, cfg.Delivery), cfg.Sink), msgs)
+		}
+		a, err := NewAggregator(*cfg.Aggregate, emit, env.logger)
+		if err != nil {
+			return nil, err
+		}
+		p.aggregator = a
+	}
+	if cfg.Deadband != nil {
+		dc := *cfg.Deadband
+		if dc.State != "" && !filepath.IsAbs(dc.State) {
+			dc.State = filepath.Join(env.dir, dc.State)
+		}
+		d, err := NewDeadband(dc, env.logger)
+		if err != nil {
+			if p.aggregator != nil {
+				p.aggregator.Close()
+			}
+			return nil, err
+		}
+		p.deadband = d
+	}
+	return p, nil
+}
+
+// run returns the records to forward: the records selected by the filter,
+// transformed by the processors and the script, which are not held by the
+// aggregator and whose value changed.
+func (p *pipeline) run(msgs []senml.Message) (Batch, runStats, error) {
+	var stats runStats
+	if p == nil {
+		return Batch{Records: msgs}, stats, nil
+	}
+	b := Batch{Records: p.filter.Apply(msgs)}
+	for _, proc := range p.processors {
+		proc.Process(&b)
+	}
+	if p.script != nil && len(b.Records) > 0 {
+		if err := p.script.Run(&b); err != nil {
+			return Batch{}, stats, err
+		}
+	}
+	if p.aggregator != nil && len(b.Records) > 0 {
+		stats.aggregated, stats.late = p.aggregator.Add(&b)
+	}
+	if p.deadband != nil && len(b.Records) > 0 {
+		stats.suppressed, stats.reported = p.deadband.Apply(&b)
+	}
+	return b, stats, nil
+}
+
+// commit records the values of the records reported by exception once
+// they are sent.
+func (p *pipeline) commit(stats runStats) {
+	if p != nil && p.deadband != nil && len(stats.reported) > 0 {
+		p.deadband.Commit(stats.reported)
+	}
+}
+
+// context returns the context of the records forwarded by the pipeline.
+func (p *pipeline) context(ctx context.Context, b Batch) context.Context {
+	ctx = WithTags(ctx, b.Tags)
+	if p != nil {
+		ctx = WithDelivery(ctx, p.delivery)
+		ctx = WithSink(ctx, p.sink)
+	}
+	return ctx
+}
+
+// flush forwards the aggregates of the open windows of the pipeline and
+// saves the state of its deadband.
+func (p *pipeline) flush(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	var err error
+	if p.aggregator != nil {
+		err = p.aggregator.Flush(ctx)
+	}
+	if p.deadband != nil {
+		if e := p.deadband.Save(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// release flushes the pipeline and stops its aggregator.
+func (p *pipeline) release(logger logger.Logger) {
+	if p == nil {
+		return
+	}
+	if p.aggregator != nil {
+		p.aggregator.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if err := p.flush(ctx); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to release route pipeline: %s", err))
+	}
+}
+
+// keepState moves the aggregators and deadbands of the current pipelines to
+// the next ones having the same settings, so that their state survives a
+// reload. Aggregators are only kept if the delivery and the sink of the
+// route are unchanged too, since they emit with the settings they were
+// created with. It returns pipelines holding the stages which are not kept.
+func keepState(current, next map[string]*pipeline) []*pipeline {
+	var released []*pipeline
+	for subject, p := range current {
+		if p == nil {
+			continue
+		}
+		np := next[subject]
+		if np == nil {
+			np = &pipeline{}
+		}
+		rp := &pipeline{}
+		if p.aggregator != nil {
+			if np.aggregator != nil && reflect.DeepEqual(np.aggregator.cfg, p.aggregator.cfg) &&
+				np.delivery == p.delivery && np.sink == p.sink {
+				np.aggregator.Close()
+				np.aggregator = p.aggregator
+			} else {
+				rp.aggregator = p.aggregator
+			}
+		}
+		if p.deadband != nil {
+			if np.deadband != nil && reflect.DeepEqual(np.deadband.cfg, p.deadband.cfg) {
+				np.deadband = p.deadband
+			} else {
+				rp.deadband = p.deadband
+			}
+		}
+		if rp.aggregator != nil || rp.deadband != nil {
+			released = append(released, rp)
+		}
+	}
+	return released
+}
+
+// closeAggregators stops the aggregators of pipelines which are not used.
+func closeAggregators(pipelines map[string]*pipeline) {
+	for _, p := range pipelines {
+		if p != nil && p.aggregator != nil {
+			p.aggregator.Close()
+		}
+	}
+}
+
+// scripts returns the paths of the scripts of the pipelines.
+func scripts(pipelines map[string]*pipeline) []string {
+	var paths []string
+	for _, p := range pipelines {
+		if p != nil && p.script != nil {
+			paths = append(paths, p.script.path)
+		}
+	}
+	return paths
+}
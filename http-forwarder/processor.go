@@ -0,0 +1,386 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"path"
+	"regexp"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+// Types of the record processors.
+const (
+	ProcessorRename  = "rename"
+	ProcessorConvert = "convert"
+	ProcessorScale   = "scale"
+	ProcessorDrop    = "drop"
+	ProcessorEnrich  = "enrich"
+)
+
+// Record fields which can be dropped.
+const (
+	FieldUnit       = "unit"
+	FieldTime       = "time"
+	FieldUpdateTime = "update_time"
+	FieldSum        = "sum"
+	FieldPublisher  = "publisher"
+	FieldProtocol   = "protocol"
+)
+
+// ErrInvalidProcessor indicates that a record processor is malformed.
+var ErrInvalidProcessor = errors.New("invalid record processor")
+
+// senmlLabels are the labels of the encoded records, which tags can't override.
+var senmlLabels = map[string]bool{
+	"bn": true, "bt": true, "bu": true, "bv": true, "bs": true, "bver": true,
+	"n": true, "u": true, "v": true, "vs": true, "vb": true, "vd": true,
+	"s": true, "t": true, "ut": true,
+}
+
+// Batch contains the records of a received message being processed, and
+// the tags added to the labels of each of them when they are encoded.
+type Batch struct {
+	Records []senml.Message
+	Tags    map[string]string
+}
+
+// Processor transforms the records received on a route before they are
+// forwarded.
+type Processor interface {
+	// Process transforms the batch in place.
+	Process(b *Batch)
+}
+
+// ProcessorConfig contains the settings of a record processor. The settings
+// used depend on the type.
+type ProcessorConfig struct {
+	// Type is the processor type: rename, convert, scale, drop or enrich.
+	Type string `toml:"type"`
+
+	// Name is the glob pattern of the names of the records processed by
+	// the convert, scale and drop processors, every record if empty.
+	Name string `toml:"name,omitempty"`
+
+	// Mapping replaces the record names by the rename processor. Names
+	// which aren't mapped are replaced by applying Pattern and Replacement.
+	Mapping map[string]string `toml:"mapping,omitempty"`
+
+	// Pattern is the regular expression replaced in the record names by
+	// the Replacement, which can refer to its groups (e.g. "${1}").
+	Pattern     string `toml:"pattern,omitempty"`
+	Replacement string `toml:"replacement,omitempty"`
+
+	// From and To are the units the convert processor converts between.
+	From string `toml:"from,omitempty"`
+	To   string `toml:"to,omitempty"`
+
+	// Factor and Offset are applied by the scale processor to the values,
+	// as value * factor + offset, and Factor alone to the sums. Factor
+	// defaults to 1.
+	Factor *float64 `toml:"factor,omitempty"`
+	Offset float64  `toml:"offset,omitempty"`
+
+	// Unit replaces the unit of the records scaled by the scale processor,
+	// if set.
+	Unit string `toml:"unit,omitempty"`
+
+	// Fields are the record fields cleared by the drop processor: unit,
+	// time, update_time, sum, publisher or protocol.
+	Fields []string `toml:"fields,omitempty"`
+
+	// Tags are the static labels added to the records by the enrich processor.
+	Tags map[string]string `toml:"tags,omitempty"`
+}
+
+// NewProcessor returns the processor of the settings, or ErrInvalidProcessor
+// if they are malformed.
+func NewProcessor(cfg ProcessorConfig) (Processor, error) {
+	if cfg.Name != "" {
+		if _, err := path.Match(cfg.Name, ""); err != nil {
+			return nil, errors.Wrap(ErrInvalidProcessor, errors.New(cfg.Name))
+		}
+	}
+
+	switch cfg.Type {
+	case ProcessorRename:
+		return newRenamer(cfg)
+	case ProcessorConvert:
+		return newConverter(cfg)
+	case ProcessorScale:
+		return newScaler(cfg), nil
+	case ProcessorDrop:
+		return newDropper(cfg)
+	case ProcessorEnrich:
+		return newEnricher(cfg)
+	}
+	return nil, errors.Wrap(ErrInvalidProcessor, errors.New(cfg.Type))
+}
+
+// matchName reports whether the record name matches the glob pattern, or
+// whether the pattern is empty.
+func matchName(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+type renamer struct {
+	mapping     map[string]string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func newRenamer(cfg ProcessorConfig) (Processor, error) {
+	if len(cfg.Mapping) == 0 && cfg.Pattern == "" {
+		return nil, errors.Wrap(ErrInvalidProcessor, errors.New("rename without mapping or pattern"))
+	}
+	r := renamer{mapping: cfg.Mapping, replacement: cfg.Replacement}
+	if cfg.Pattern != "" {
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidProcessor, err)
+		}
+		r.pattern = re
+	}
+	return r, nil
+}
+
+func (r renamer) Process(b *Batch) {
+	for i := range b.Records {
+		msg := &b.Records[i]
+		if name, ok := r.mapping[msg.Name]; ok {
+			msg.Name = name
+			continue
+		}
+		if r.pattern != nil {
+			msg.Name = r.pattern.ReplaceAllString(msg.Name, r.replacement)
+		}
+	}
+}
+
+// unit is a unit converted to the base unit of its quantity as
+// value * scale + offset.
+type unit struct {
+	quantity string
+	scale    float64
+	offset   float64
+}
+
+// units are the units known by the convert processor, named according to
+// the SenML units registry where they are registered.
+var units = map[string]unit{
+	"K":    {"temperature", 1, 0},
+	"Cel":  {"temperature", 1, 273.15},
+	"degF": {"temperature", 5.0 / 9, 459.67 * 5 / 9},
+
+	"Pa":   {"pressure", 1, 0},
+	"hPa":  {"pressure", 100, 0},
+	"kPa":  {"pressure", 1000, 0},
+	"mbar": {"pressure", 100, 0},
+	"bar":  {"pressure", 100000, 0},
+	"psi":  {"pressure", 6894.757293168, 0},
+
+	"m":  {"length", 1, 0},
+	"mm": {"length", 0.001, 0},
+	"cm": {"length", 0.01, 0},
+	"km": {"length", 1000, 0},
+	"in": {"length", 0.0254, 0},
+	"ft": {"length", 0.3048, 0},
+
+	"m/s":  {"speed", 1, 0},
+	"km/h": {"speed", 1 / 3.6, 0},
+	"mph":  {"speed", 0.44704, 0},
+
+	"s":   {"time", 1, 0},
+	"ms":  {"time", 0.001, 0},
+	"min": {"time", 60, 0},
+	"h":   {"time", 3600, 0},
+
+	"W":  {"power", 1, 0},
+	"mW": {"power", 0.001, 0},
+	"kW": {"power", 1000, 0},
+
+	"J":   {"energy", 1, 0},
+	"Wh":  {"energy", 3600, 0},
+	"kWh": {"energy", 3600000, 0},
+
+	"kg": {"mass", 1, 0},
+	"g":  {"mass", 0.001, 0},
+
+	"/": {"ratio", 1, 0},
+	"%": {"ratio", 0.01, 0},
+}
+
+type converter struct {
+	name     string
+	from, to string
+	scale    float64
+	offset   float64
+}
+
+func newConverter(cfg ProcessorConfig) (Processor, error) {
+	from, ok := units[cfg.From]
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidProcessor, errors.New(cfg.From))
+	}
+	to, ok := units[cfg.To]
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidProcessor, errors.New(cfg.To))
+	}
+	if from.quantity != to.quantity {
+		return nil, errors.Wrap(ErrInvalidProcessor, errors.New("units of different quantities"))
+	}
+
+	return converter{
+		name:   cfg.Name,
+		from:   cfg.From,
+		to:     cfg.To,
+		scale:  from.scale / to.scale,
+		offset: (from.offset - to.offset) / to.scale,
+	}, nil
+}
+
+func (c converter) Process(b *Batch) {
+	for i := range b.Records {
+		msg := &b.Records[i]
+		if msg.Unit != c.from || !matchName(c.name, msg.Name) {
+			continue
+		}
+		linear(msg, c.scale, c.offset)
+		msg.Unit = c.to
+	}
+}
+
+type scaler struct {
+	name   string
+	factor float64
+	offset float64
+	unit   string
+}
+
+func newScaler(cfg ProcessorConfig) Processor {
+	s := scaler{name: cfg.Name, factor: 1, offset: cfg.Offset, unit: cfg.Unit}
+	if cfg.Factor != nil {
+		s.factor = *cfg.Factor
+	}
+	return s
+}
+
+func (s scaler) Process(b *Batch) {
+	for i := range b.Records {
+		msg := &b.Records[i]
+		if !matchName(s.name, msg.Name) || (msg.Value == nil && msg.Sum == nil) {
+			continue
+		}
+		linear(msg, s.factor, s.offset)
+		if s.unit != "" {
+			msg.Unit = s.unit
+		}
+	}
+}
+
+// linear replaces the value of the record by value * a + b, and its sum by
+// sum * a: the offset of a sum of values depends on their number, which is
+// unknown. The values are copied, since the records may share them.
+func linear(msg *senml.Message, a, b float64) {
+	if msg.Value != nil {
+		v := *msg.Value*a + b
+		msg.Value = &v
+	}
+	if msg.Sum != nil {
+		s := *msg.Sum * a
+		msg.Sum = &s
+	}
+}
+
+type dropper struct {
+	name   string
+	fields []string
+}
+
+func newDropper(cfg ProcessorConfig) (Processor, error) {
+	if len(cfg.Fields) == 0 {
+		return nil, errors.Wrap(ErrInvalidProcessor, errors.New("drop without fields"))
+	}
+	for _, f := range cfg.Fields {
+		switch f {
+		case FieldUnit, FieldTime, FieldUpdateTime, FieldSum, FieldPublisher, FieldProtocol:
+		default:
+			return nil, errors.Wrap(ErrInvalidProcessor, errors.New(f))
+		}
+	}
+	return dropper{name: cfg.Name, fields: cfg.Fields}, nil
+}
+
+func (d dropper) Process(b *Batch) {
+	for i := range b.Records {
+		msg := &b.Records[i]
+		if !matchName(d.name, msg.Name) {
+			continue
+		}
+		for _, f := range d.fields {
+			switch f {
+			case FieldUnit:
+				msg.Unit = ""
+			case FieldTime:
+				msg.Time = 0
+			case FieldUpdateTime:
+				msg.UpdateTime = 0
+			case FieldSum:
+				msg.Sum = nil
+			case FieldPublisher:
+				msg.Publisher = ""
+			case FieldProtocol:
+				msg.Protocol = ""
+			}
+		}
+	}
+}
+
+type enricher struct {
+	tags map[string]string
+}
+
+func newEnricher(cfg ProcessorConfig) (Processor, error) {
+	if len(cfg.Tags) == 0 {
+		return nil, errors.Wrap(ErrInvalidProcessor, errors.New("enrich without tags"))
+	}
+	for label := range cfg.Tags {
+		if label == "" || senmlLabels[label] {
+			return nil, errors.Wrap(ErrInvalidProcessor, errors.New(label))
+		}
+	}
+	return enricher{tags: cfg.Tags}, nil
+}
+
+func (e enricher) Process(b *Batch) {
+	if b.Tags == nil {
+		b.Tags = make(map[string]string, len(e.tags))
+	}
+	for label, value := range e.tags {
+		b.Tags[label] = value
+	}
+}
+
+type tagsKey struct{}
+
+// WithTags returns context carrying the tags added to the labels of the
+// records forwarded within it.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	if len(tags) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+// TagsFromContext returns the tags carried by the context, if any.
+func TagsFromContext(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	return tags
+}
@@ -0,0 +1,275 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"fmt"
+	"testing"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func process(t *testing.T, cfg writer.ProcessorConfig, msgs ...senml.Message) writer.Batch {
+	p, err := writer.NewProcessor(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating processor: %s", err))
+	b := writer.Batch{Records: msgs}
+	p.Process(&b)
+	return b
+}
+
+func TestRename(t *testing.T) {
+	cases := []struct {
+		desc     string
+		cfg      writer.ProcessorConfig
+		names    []string
+		expected []string
+	}{
+		{
+			desc:     "rename with mapping",
+			cfg:      writer.ProcessorConfig{Type: writer.ProcessorRename, Mapping: map[string]string{"temp": "temperature"}},
+			names:    []string{"temp", "hum"},
+			expected: []string{"temperature", "hum"},
+		},
+		{
+			desc:     "rename with pattern",
+			cfg:      writer.ProcessorConfig{Type: writer.ProcessorRename, Pattern: "^dev1:(.*)$", Replacement: "room:${1}"},
+			names:    []string{"dev1:temp", "dev2:temp"},
+			expected: []string{"room:temp", "dev2:temp"},
+		},
+		{
+			desc:     "rename with mapping before pattern",
+			cfg:      writer.ProcessorConfig{Type: writer.ProcessorRename, Mapping: map[string]string{"dev1:temp": "temperature"}, Pattern: "^dev1:", Replacement: "room:"},
+			names:    []string{"dev1:temp", "dev1:hum"},
+			expected: []string{"temperature", "room:hum"},
+		},
+	}
+
+	for _, tc := range cases {
+		var msgs []senml.Message
+		for _, n := range tc.names {
+			msgs = append(msgs, senml.Message{Name: n, Value: float(1)})
+		}
+		b := process(t, tc.cfg, msgs...)
+		var names []string
+		for _, msg := range b.Records {
+			names = append(names, msg.Name)
+		}
+		assert.Equal(t, tc.expected, names, fmt.Sprintf("%s: unexpected names", tc.desc))
+	}
+}
+
+func TestConvert(t *testing.T) {
+	cases := []struct {
+		desc  string
+		cfg   writer.ProcessorConfig
+		msg   senml.Message
+		value float64
+		unit  string
+	}{
+		{
+			desc:  "convert Celsius to Fahrenheit",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "Cel", To: "degF"},
+			msg:   senml.Message{Name: "temperature", Unit: "Cel", Value: float(100)},
+			value: 212,
+			unit:  "degF",
+		},
+		{
+			desc:  "convert Kelvin to Celsius",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "K", To: "Cel"},
+			msg:   senml.Message{Name: "temperature", Unit: "K", Value: float(273.15)},
+			value: 0,
+			unit:  "Cel",
+		},
+		{
+			desc:  "convert Pascal to hectopascal",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "Pa", To: "hPa"},
+			msg:   senml.Message{Name: "pressure", Unit: "Pa", Value: float(101325)},
+			value: 1013.25,
+			unit:  "hPa",
+		},
+		{
+			desc:  "convert sum of kilowatt-hours to joules",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "kWh", To: "J"},
+			msg:   senml.Message{Name: "energy", Unit: "kWh", Sum: float(2)},
+			value: 7200000,
+			unit:  "J",
+		},
+		{
+			desc:  "convert sum of degrees Celsius to Fahrenheit without offset",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "Cel", To: "degF"},
+			msg:   senml.Message{Name: "temperature", Unit: "Cel", Sum: float(100)},
+			value: 180,
+			unit:  "degF",
+		},
+		{
+			desc:  "convert record of other unit",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "Cel", To: "degF"},
+			msg:   senml.Message{Name: "temperature", Unit: "K", Value: float(300)},
+			value: 300,
+			unit:  "K",
+		},
+		{
+			desc:  "convert record of other name",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorConvert, Name: "outdoor:*", From: "Cel", To: "degF"},
+			msg:   senml.Message{Name: "indoor:temperature", Unit: "Cel", Value: float(20)},
+			value: 20,
+			unit:  "Cel",
+		},
+	}
+
+	for _, tc := range cases {
+		b := process(t, tc.cfg, tc.msg)
+		msg := b.Records[0]
+		v := msg.Value
+		if v == nil {
+			v = msg.Sum
+		}
+		assert.InDelta(t, tc.value, *v, 1e-9, fmt.Sprintf("%s: unexpected value", tc.desc))
+		assert.Equal(t, tc.unit, msg.Unit, fmt.Sprintf("%s: unexpected unit", tc.desc))
+	}
+}
+
+func TestScale(t *testing.T) {
+	shared := float(512)
+	cases := []struct {
+		desc  string
+		cfg   writer.ProcessorConfig
+		msg   senml.Message
+		value float64
+		unit  string
+	}{
+		{
+			desc:  "scale with factor and offset",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorScale, Factor: float(0.1), Offset: -40, Unit: "Cel"},
+			msg:   senml.Message{Name: "raw:temperature", Value: shared},
+			value: 11.2,
+			unit:  "Cel",
+		},
+		{
+			desc:  "scale with offset only",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorScale, Offset: 2},
+			msg:   senml.Message{Name: "level", Unit: "m", Value: float(3)},
+			value: 5,
+			unit:  "m",
+		},
+		{
+			desc:  "scale record of other name",
+			cfg:   writer.ProcessorConfig{Type: writer.ProcessorScale, Name: "raw:*", Factor: float(10)},
+			msg:   senml.Message{Name: "level", Value: float(3)},
+			value: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		b := process(t, tc.cfg, tc.msg)
+		assert.InDelta(t, tc.value, *b.Records[0].Value, 1e-9, fmt.Sprintf("%s: unexpected value", tc.desc))
+		assert.Equal(t, tc.unit, b.Records[0].Unit, fmt.Sprintf("%s: unexpected unit", tc.desc))
+	}
+	assert.Equal(t, float64(512), *shared, "scaled value expected to be copied")
+}
+
+func TestDrop(t *testing.T) {
+	msg := senml.Message{Name: "energy", Unit: "kWh", Time: 1000, UpdateTime: 60, Value: float(1), Sum: float(10), Publisher: "2580", Protocol: "mqtt"}
+
+	cases := []struct {
+		desc     string
+		cfg      writer.ProcessorConfig
+		expected senml.Message
+	}{
+		{
+			desc:     "drop time fields",
+			cfg:      writer.ProcessorConfig{Type: writer.ProcessorDrop, Fields: []string{writer.FieldTime, writer.FieldUpdateTime}},
+			expected: senml.Message{Name: "energy", Unit: "kWh", Value: float(1), Sum: float(10), Publisher: "2580", Protocol: "mqtt"},
+		},
+		{
+			desc:     "drop sum, unit, publisher and protocol",
+			cfg:      writer.ProcessorConfig{Type: writer.ProcessorDrop, Fields: []string{writer.FieldSum, writer.FieldUnit, writer.FieldPublisher, writer.FieldProtocol}},
+			expected: senml.Message{Name: "energy", Time: 1000, UpdateTime: 60, Value: float(1)},
+		},
+		{
+			desc:     "drop fields of record of other name",
+			cfg:      writer.ProcessorConfig{Type: writer.ProcessorDrop, Name: "power", Fields: []string{writer.FieldSum}},
+			expected: msg,
+		},
+	}
+
+	for _, tc := range cases {
+		b := process(t, tc.cfg, msg)
+		assert.Equal(t, tc.expected, b.Records[0], fmt.Sprintf("%s: unexpected record", tc.desc))
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	msg := senml.Message{Name: "temperature", Value: float(20)}
+	p, err := writer.NewProcessor(writer.ProcessorConfig{Type: writer.ProcessorEnrich, Tags: map[string]string{"site": "lab", "floor": "2"}})
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating processor: %s", err))
+
+	b := writer.Batch{Records: []senml.Message{msg}, Tags: map[string]string{"site": "office", "building": "A"}}
+	p.Process(&b)
+	assert.Equal(t, []senml.Message{msg}, b.Records, "records expected to be unchanged")
+	assert.Equal(t, map[string]string{"site": "lab", "floor": "2", "building": "A"}, b.Tags, "unexpected tags")
+}
+
+func TestNewProcessor(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  writer.ProcessorConfig
+		err  error
+	}{
+		{
+			desc: "unknown type",
+			cfg:  writer.ProcessorConfig{Type: "round"},
+			err:  writer.ErrInvalidProcessor,
+		},
+		{
+			desc: "malformed name glob",
+			cfg:  writer.ProcessorConfig{Type: writer.ProcessorScale, Name: "raw["},
+			err:  writer.ErrInvalidProcessor,
+		},
+		{
+			desc: "rename without mapping or pattern",
+			cfg:  writer.ProcessorConfig{Type: writer.ProcessorRename},
+			err:  writer.ErrInvalidProcessor,
+		},
+		{
+			desc: "rename with malformed pattern",
+			cfg:  writer.ProcessorConfig{Type: writer.ProcessorRename, Pattern: "dev("},
+			err:  writer.ErrInvalidProcessor,
+		},
+		{
+			desc: "convert unknown unit",
+			cfg:  writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "Cel", To: "degR"},
+			err:  writer.ErrInvalidProcessor,
+		},
+		{
+			desc: "convert units of different quantities",
+			cfg:  writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "Cel", To: "Pa"},
+			err:  writer.ErrInvalidProcessor,
+		},
+		{
+			desc: "drop unknown field",
+			cfg:  writer.ProcessorConfig{Type: writer.ProcessorDrop, Fields: []string{"name"}},
+			err:  writer.ErrInvalidProcessor,
+		},
+		{
+			desc: "enrich with SenML label",
+			cfg:  writer.ProcessorConfig{Type: writer.ProcessorEnrich, Tags: map[string]string{"bn": "lab"}},
+			err:  writer.ErrInvalidProcessor,
+		},
+		{
+			desc: "valid processor",
+			cfg:  writer.ProcessorConfig{Type: writer.ProcessorConvert, From: "Cel", To: "K"},
+			err:  nil,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := writer.NewProcessor(tc.cfg)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+	}
+}
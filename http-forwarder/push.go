@@ -0,0 +1,255 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+const (
+	defPushBuffer = 64
+	pushTarget    = "push"
+)
+
+var (
+	// ErrInvalidPush indicates that the push sink settings are malformed.
+	ErrInvalidPush = errors.New("invalid push sink")
+
+	// ErrSlowClient indicates that the client has been disconnected because
+	// its buffer was full.
+	ErrSlowClient = errors.New("push client too slow")
+
+	// ErrPushClosed indicates that the client has been disconnected because
+	// the push sink is closed.
+	ErrPushClosed = errors.New("push sink closed")
+)
+
+// PushConfig contains the settings of the push sink.
+type PushConfig struct {
+	// Buffer is the number of batches buffered per client, 64 if 0.
+	// Clients whose buffer is full are disconnected.
+	Buffer int
+}
+
+// pushBatch is the SenML pack of an address pushed to the clients.
+type pushBatch struct {
+	Subject string `json:"subject"`
+	addressBatch
+}
+
+var _ Repository = (*PushHub)(nil)
+
+// PushHub pushes the forwarded records to the subscribed clients, e.g. the
+// WebSocket and Server-Sent Events connections of dashboards. The records
+// are pushed as a SenML pack per address, whatever the delivery of the
+// route, and are lost for the clients which are not connected.
+type PushHub struct {
+	cfg     PushConfig
+	metrics Metrics
+	tracer  tracing.Tracer
+	logger  logger.Logger
+
+	mu      sync.Mutex
+	clients map[*PushClient]struct{}
+	closed  bool
+}
+
+// PushClient receives the batches of the subjects matching its filter.
+type PushClient struct {
+	filter  string
+	batches chan []byte
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// NewPushHub returns push sink without clients.
+func NewPushHub(cfg PushConfig, metrics Metrics, tracer tracing.Tracer, logger logger.Logger) (*PushHub, error) {
+	if cfg.Buffer == 0 {
+		cfg.Buffer = defPushBuffer
+	}
+	if cfg.Buffer < 0 {
+		return nil, errors.Wrap(ErrInvalidPush, errors.New("buffer must not be negative"))
+	}
+
+	return &PushHub{
+		cfg:     cfg,
+		metrics: metrics,
+		tracer:  tracer,
+		logger:  logger,
+		clients: make(map[*PushClient]struct{}),
+	}, nil
+}
+
+// Subscribe returns client receiving the batches whose subject matches the
+// filter, a NATS subject which may contain the * and > wildcards, e.g.
+// channels.<channel_id>.>.
+func (h *PushHub) Subscribe(filter string) (*PushClient, error) {
+	if !validSubject(filter) {
+		return nil, errors.Wrap(ErrInvalidSubject, errors.New(filter))
+	}
+
+	c := &PushClient{
+		filter:  filter,
+		batches: make(chan []byte, h.cfg.Buffer),
+		done:    make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrPushClosed
+	}
+	h.clients[c] = struct{}{}
+	return c, nil
+}
+
+// Unsubscribe removes the client, which receives no more batches.
+func (h *PushHub) Unsubscribe(c *PushClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+func (h *PushHub) Save(messages ...senml.Message) error {
+	return h.SaveContext(context.Background(), messages...)
+}
+
+func (h *PushHub) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	packs, _ := groupPacks(messages, 0, TagsFromContext(ctx))
+	for _, p := range packs {
+		if err := h.push(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push sends the pack to the clients whose filter matches its subject.
+// Clients whose buffer is full are disconnected rather than slowing the
+// route down.
+func (h *PushHub) push(ctx context.Context, p pack) (err error) {
+	batch := pushBatch{
+		Subject: pushSubject(p.address),
+		addressBatch: addressBatch{
+			Topic:     p.address.FullTopic,
+			Channel:   p.address.Channel,
+			Subtopic:  p.address.Subtopic,
+			Publisher: p.address.Published,
+			Protocol:  p.address.Protocol,
+			Records:   p.records,
+		},
+	}
+
+	_, span := h.tracer.Start(ctx, "PUSH", tracing.KindProducer, addressAttributes(p.address, len(p.records))...)
+	span.SetAttributes(tracing.String("messaging.destination", batch.Subject))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return errors.Wrap(ErrRemoteRejected, err)
+	}
+	h.metrics.BatchSize.With("target", pushTarget).Observe(float64(len(p.records)))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pushed := 0
+	for c := range h.clients {
+		if !matchSubject(c.filter, batch.Subject) {
+			continue
+		}
+		select {
+		case c.batches <- data:
+			pushed++
+		default:
+			delete(h.clients, c)
+			c.disconnect(ErrSlowClient)
+			h.metrics.Dropped.With("reason", reasonSlow).Add(float64(len(p.records)))
+			h.logger.Warn(fmt.Sprintf("Disconnected push client of %s: %s", c.filter, ErrSlowClient))
+		}
+	}
+	span.SetAttributes(tracing.Int("push.clients", pushed))
+
+	h.metrics.Requests.With("target", pushTarget, "code", statusClass(0), "outcome", outcomeSuccess).Add(1)
+	h.metrics.Records.With("target", pushTarget).Add(float64(len(p.records) * pushed))
+	h.metrics.Bytes.With("target", pushTarget).Add(float64(len(data) * pushed))
+	return nil
+}
+
+// Close disconnects all the clients. Clients can't subscribe anymore.
+func (h *PushHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		delete(h.clients, c)
+		c.disconnect(ErrPushClosed)
+	}
+}
+
+// Batches returns the channel of the batches pushed to the client, encoded
+// as JSON.
+func (c *PushClient) Batches() <-chan []byte {
+	return c.batches
+}
+
+// Done returns channel which is closed when the client is disconnected by
+// the push sink.
+func (c *PushClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason of the disconnection, nil while connected.
+func (c *PushClient) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *PushClient) disconnect(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// pushSubject returns the NATS subject the records of the address are
+// published to by Mainflux.
+func pushSubject(address Address) string {
+	if address.Subtopic == "" {
+		return fmt.Sprintf("channels.%s", address.Channel)
+	}
+	return fmt.Sprintf("channels.%s.%s", address.Channel, address.Subtopic)
+}
+
+// matchSubject reports whether the subject matches the filter, with the
+// NATS wildcards: * matches a token and > the remaining tokens.
+func matchSubject(filter, subject string) bool {
+	ft := strings.Split(filter, ".")
+	st := strings.Split(subject, ".")
+	for i, t := range ft {
+		if t == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) || (t != "*" && t != st[i]) {
+			return false
+		}
+	}
+	return len(ft) == len(st)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushed is the part of a pushed batch checked by the tests.
+type pushed struct {
+	Subject string                   `json:"subject"`
+	Channel string                   `json:"channel"`
+	Records []map[string]interface{} `json:"records"`
+}
+
+func TestNewPushHub(t *testing.T) {
+	_, err := writer.NewPushHub(writer.PushConfig{Buffer: -1}, nopMetrics, tracing.NewNop(), testLog)
+	assert.True(t, errors.Contains(err, writer.ErrInvalidPush), fmt.Sprintf("expected %s got %v", writer.ErrInvalidPush, err))
+
+	hub, err := writer.NewPushHub(writer.PushConfig{}, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating push hub: %s", err))
+
+	cases := []struct {
+		desc   string
+		filter string
+		err    error
+	}{
+		{
+			desc:   "subscribe to channel",
+			filter: "channels.1",
+		},
+		{
+			desc:   "subscribe with wildcards",
+			filter: "channels.*.>",
+		},
+		{
+			desc:   "subscribe without filter",
+			filter: "",
+			err:    writer.ErrInvalidSubject,
+		},
+		{
+			desc:   "subscribe with misplaced wildcard",
+			filter: "channels.>.temperature",
+			err:    writer.ErrInvalidSubject,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := hub.Subscribe(tc.filter)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+	}
+}
+
+func TestPushHub(t *testing.T) {
+	hub, err := writer.NewPushHub(writer.PushConfig{}, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating push hub: %s", err))
+
+	msgs := []senml.Message{
+		{Channel: "1", Name: "temperature", Value: float(20)},
+		{Channel: "1", Subtopic: "room.kitchen", Name: "temperature", Value: float(21)},
+		{Channel: "2", Name: "humidity", Value: float(40)},
+	}
+
+	cases := []struct {
+		desc     string
+		filter   string
+		subjects []string
+	}{
+		{
+			desc:     "push channel without subtopic",
+			filter:   "channels.1",
+			subjects: []string{"channels.1"},
+		},
+		{
+			desc:     "push channel subtopics",
+			filter:   "channels.1.>",
+			subjects: []string{"channels.1.room.kitchen"},
+		},
+		{
+			desc:     "push subtopic token",
+			filter:   "channels.*.room.*",
+			subjects: []string{"channels.1.room.kitchen"},
+		},
+		{
+			desc:     "push every channel",
+			filter:   "channels.*",
+			subjects: []string{"channels.1", "channels.2"},
+		},
+		{
+			desc:     "push nothing to other channel",
+			filter:   "channels.3.>",
+			subjects: nil,
+		},
+	}
+
+	clients := make([]*writer.PushClient, len(cases))
+	for i, tc := range cases {
+		clients[i], err = hub.Subscribe(tc.filter)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error subscribing: %s", tc.desc, err))
+	}
+
+	err = hub.SaveContext(writer.WithTags(context.Background(), map[string]string{"site": "lab"}), msgs...)
+	require.Nil(t, err, fmt.Sprintf("unexpected error pushing records: %s", err))
+
+	for i, tc := range cases {
+		var subjects []string
+		for len(clients[i].Batches()) > 0 {
+			var batch pushed
+			err := json.Unmarshal(<-clients[i].Batches(), &batch)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding batch: %s", tc.desc, err))
+			require.Len(t, batch.Records, 1, fmt.Sprintf("%s: unexpected records %v", tc.desc, batch.Records))
+			assert.Equal(t, "lab", batch.Records[0]["site"], fmt.Sprintf("%s: expected tags in %v", tc.desc, batch.Records[0]))
+			subjects = append(subjects, batch.Subject)
+		}
+		assert.ElementsMatch(t, tc.subjects, subjects, fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.subjects, subjects))
+	}
+}
+
+func TestPushHubSlowClient(t *testing.T) {
+	hub, err := writer.NewPushHub(writer.PushConfig{Buffer: 2}, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating push hub: %s", err))
+
+	slow, err := hub.Subscribe("channels.>")
+	require.Nil(t, err, fmt.Sprintf("unexpected error subscribing: %s", err))
+	fast, err := hub.Subscribe("channels.>")
+	require.Nil(t, err, fmt.Sprintf("unexpected error subscribing: %s", err))
+
+	msg := senml.Message{Channel: "1", Name: "temperature", Value: float(20)}
+	for i := 0; i < 3; i++ {
+		err := hub.Save(msg)
+		require.Nil(t, err, fmt.Sprintf("unexpected error pushing records: %s", err))
+		<-fast.Batches()
+	}
+
+	assert.True(t, errors.Contains(slow.Err(), writer.ErrSlowClient), fmt.Sprintf("expected %s got %v", writer.ErrSlowClient, slow.Err()))
+	assert.Len(t, slow.Batches(), 2, "expected buffered batches of disconnected client")
+	assert.Nil(t, fast.Err(), fmt.Sprintf("unexpected disconnection of client: %v", fast.Err()))
+
+	hub.Unsubscribe(fast)
+	err = hub.Save(msg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error pushing records: %s", err))
+	assert.Len(t, fast.Batches(), 0, "unexpected batch pushed to unsubscribed client")
+
+	client, err := hub.Subscribe("channels.>")
+	require.Nil(t, err, fmt.Sprintf("unexpected error subscribing: %s", err))
+	hub.Close()
+	<-client.Done()
+	assert.True(t, errors.Contains(client.Err(), writer.ErrPushClosed), fmt.Sprintf("expected %s got %v", writer.ErrPushClosed, client.Err()))
+	_, err = hub.Subscribe("channels.>")
+	assert.True(t, errors.Contains(err, writer.ErrPushClosed), fmt.Sprintf("expected %s got %v", writer.ErrPushClosed, err))
+}
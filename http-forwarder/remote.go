@@ -0,0 +1,94 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+)
+
+const defRemoteTimeout = 10 * time.Second
+
+// ErrInvalidRemote indicates that the remote target settings are malformed.
+var ErrInvalidRemote = errors.New("invalid remote target")
+
+// RemoteConfig contains the settings of the remote target.
+type RemoteConfig struct {
+	URL     string            `toml:"url"`
+	Token   string            `toml:"token,omitempty"`
+	Headers map[string]string `toml:"headers,omitempty"`
+	// MaxBodySize is the size in bytes above which a request is split,
+	// unlimited if 0.
+	MaxBodySize int `toml:"max_body_size,omitempty"`
+	// MaxRecords is the number of records above which a SenML pack is
+	// split, unlimited if 0.
+	MaxRecords int `toml:"max_records,omitempty"`
+	// Timeout is the time allowed for a request, 10 seconds if 0.
+	Timeout Duration `toml:"timeout,omitempty"`
+}
+
+// Validate returns ErrInvalidRemote if the URL is not an absolute HTTP(S) URL.
+func (cfg RemoteConfig) Validate() error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return errors.Wrap(ErrInvalidRemote, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Wrap(ErrInvalidRemote, errors.New(cfg.URL))
+	}
+	if cfg.MaxBodySize < 0 {
+		return errors.Wrap(ErrInvalidRemote, errors.New("max_body_size must not be negative"))
+	}
+	if cfg.MaxRecords < 0 {
+		return errors.Wrap(ErrInvalidRemote, errors.New("max_records must not be negative"))
+	}
+	if cfg.Timeout < 0 {
+		return errors.Wrap(ErrInvalidRemote, errors.New("timeout must not be negative"))
+	}
+	return nil
+}
+
+// timeout returns the time allowed for a request.
+func (cfg RemoteConfig) timeout() time.Duration {
+	if cfg.Timeout == 0 {
+		return defRemoteTimeout
+	}
+	return time.Duration(cfg.Timeout)
+}
+
+// Remote holds the remote target settings, which can be swapped at runtime.
+// Batches being sent keep the settings they started with.
+type Remote struct {
+	mu  sync.RWMutex
+	cfg RemoteConfig
+}
+
+// NewRemote returns remote target holder initialized with the settings.
+func NewRemote(cfg RemoteConfig) (*Remote, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Remote{cfg: cfg}, nil
+}
+
+// Config returns the current settings.
+func (r *Remote) Config() RemoteConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cfg
+}
+
+// Set replaces the settings if they are valid.
+func (r *Remote) Set(cfg RemoteConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cfg = cfg
+	r.mu.Unlock()
+	return nil
+}
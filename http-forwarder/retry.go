@@ -0,0 +1,477 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+const (
+	defRetryMinBackoff = time.Second
+	defRetryMaxBackoff = time.Minute
+)
+
+var (
+	// ErrInvalidRetry indicates that the retry queue settings are malformed.
+	ErrInvalidRetry = errors.New("invalid retry queue")
+
+	errRetryQueueFull   = errors.New("retry queue is full")
+	errRetryQueueClosed = errors.New("retry queue closed")
+	errSpill            = errors.New("failed to write spill file")
+)
+
+// RetryConfig contains the settings of the retry queue.
+type RetryConfig struct {
+	// Size is the number of batches held in memory.
+	Size int
+
+	// SpillFile is the file the batches which don't fit in memory are
+	// appended to. Batches are not queued when the memory is full if it is
+	// empty.
+	SpillFile string
+
+	// MinBackoff is the time waited before sending again a batch which
+	// failed, one second if 0. It doubles after each failure, up to
+	// MaxBackoff, one minute if 0.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// retryBatch is a batch of records waiting to be sent again, along with the
+// settings carried by the context it was forwarded within.
+type retryBatch struct {
+	Records  []senml.Message   `json:"records"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Delivery string            `json:"delivery,omitempty"`
+	Sink     string            `json:"sink,omitempty"`
+	// Created is the creation time of the message the records come from,
+	// used to observe their latency once they are sent.
+	Created int64 `json:"created,omitempty"`
+}
+
+// context returns the context the batch is sent again within.
+func (b retryBatch) context() context.Context {
+	ctx := WithTags(context.Background(), b.Tags)
+	return withCreated(WithSink(WithDelivery(ctx, b.Delivery), b.Sink), b.Created)
+}
+
+var _ Repository = (*RetryQueue)(nil)
+
+// RetryQueue forwards the records to the repository, and queues the batches
+// which failed for a reason which may not last, such as an open circuit or
+// a request timeout. Queued batches are sent again in order, with an
+// exponential backoff. Batches which don't fit in memory are appended to
+// the spill file, whose batches are sent again after the ones in memory,
+// including at start.
+type RetryQueue struct {
+	repo    Repository
+	cfg     RetryConfig
+	metrics Metrics
+	logger  logger.Logger
+
+	mu      sync.Mutex
+	batches []retryBatch
+	// spilled is the number of batches of the spill file.
+	spilled int
+	closed  bool
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRetryQueue returns retry queue forwarding the records to the
+// repository. The batches left in the spill file by a previous run are sent
+// again.
+func NewRetryQueue(repo Repository, cfg RetryConfig, metrics Metrics, logger logger.Logger) (*RetryQueue, error) {
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = defRetryMinBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = defRetryMaxBackoff
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	q := &RetryQueue{
+		repo:    repo,
+		cfg:     cfg,
+		metrics: metrics,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if cfg.SpillFile != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.SpillFile), 0755); err != nil {
+			return nil, errors.Wrap(ErrInvalidRetry, err)
+		}
+		batches, err := readSpill(cfg.SpillFile)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidRetry, err)
+		}
+		if q.spilled = len(batches); q.spilled > 0 {
+			logger.Info(fmt.Sprintf("Sending again %d batches of the spill file", q.spilled))
+		}
+	}
+	q.updateDepth()
+
+	q.wg.Add(1)
+	go q.run()
+	return q, nil
+}
+
+func (cfg RetryConfig) validate() error {
+	if cfg.Size <= 0 {
+		return errors.Wrap(ErrInvalidRetry, errors.New("size must be positive"))
+	}
+	if cfg.MinBackoff < 0 || cfg.MaxBackoff < cfg.MinBackoff {
+		return errors.Wrap(ErrInvalidRetry, errors.New("backoff must be positive and below the max backoff"))
+	}
+	return nil
+}
+
+func (q *RetryQueue) Save(messages ...senml.Message) error {
+	return q.SaveContext(context.Background(), messages...)
+}
+
+// SaveContext forwards the records, and queues them if the repository
+// failed unless it rejected them. The error of the repository is returned
+// if they can't be queued.
+func (q *RetryQueue) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	err := q.repo.SaveContext(ctx, messages...)
+	if err == nil || errors.Contains(err, ErrRemoteRejected) {
+		return err
+	}
+
+	b := retryBatch{
+		Records:  messages,
+		Tags:     TagsFromContext(ctx),
+		Delivery: DeliveryFromContext(ctx),
+		Sink:     SinkFromContext(ctx),
+		Created:  createdFromContext(ctx),
+	}
+	if qerr := q.push(b); qerr != nil {
+		return errors.Wrap(qerr, err)
+	}
+	q.logger.Warn(fmt.Sprintf("Queued %d records to send them again: %s", len(messages), err))
+	return nil
+}
+
+// Close stops sending the queued batches, waiting for the batch being sent
+// until the context is done. The batches left in memory are written to the
+// spill file ahead of its batches, so that they are sent again at start.
+// Without spill file, they are dropped.
+func (q *RetryQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mu.Unlock()
+
+	close(q.done)
+	stopped := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// The batch being sent is kept: it may be sent twice.
+		q.logger.Warn("Closing retry queue while a batch is being sent")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.batches) == 0 {
+		return nil
+	}
+	if q.cfg.SpillFile == "" {
+		var n int
+		for _, b := range q.batches {
+			n += len(b.Records)
+		}
+		q.metrics.Dropped.With("reason", reasonShutdown).Add(float64(n))
+		q.logger.Warn(fmt.Sprintf("Dropped %d queued records without spill file", n))
+		q.batches = nil
+		q.updateDepth()
+		return nil
+	}
+
+	spilled, err := readSpill(q.cfg.SpillFile)
+	if err != nil {
+		return errors.Wrap(errSpill, err)
+	}
+	kept, n := encodable(q.batches)
+	if n > 0 {
+		q.metrics.Dropped.With("reason", reasonShutdown).Add(float64(n))
+		q.logger.Warn(fmt.Sprintf("Dropped %d queued records which can't be encoded", n))
+	}
+	batches := append(kept, spilled...)
+	if err := writeSpill(q.cfg.SpillFile, batches); err != nil {
+		return errors.Wrap(errSpill, err)
+	}
+	q.logger.Info(fmt.Sprintf("Wrote %d queued batches to the spill file", len(kept)))
+	q.batches = nil
+	q.spilled = len(batches)
+	q.updateDepth()
+	return nil
+}
+
+// Depth returns the number of queued batches, including the batches of the
+// spill file.
+func (q *RetryQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.batches) + q.spilled
+}
+
+// push appends the batch to the queue: in memory while it has room and the
+// spill file is empty, so that the batches keep their order, and to the
+// spill file otherwise.
+func (q *RetryQueue) push(b retryBatch) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch {
+	case q.closed:
+		return errRetryQueueClosed
+	case len(q.batches) < q.cfg.Size && q.spilled == 0:
+		q.batches = append(q.batches, b)
+	case q.cfg.SpillFile != "":
+		if err := appendSpill(q.cfg.SpillFile, []retryBatch{b}); err != nil {
+			return errors.Wrap(errSpill, err)
+		}
+		q.spilled++
+	default:
+		return errRetryQueueFull
+	}
+	q.updateDepth()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// head returns the first batch of the queue. The batches of the spill file
+// are moved to memory once the memory is empty. There is none once the queue
+// is closed.
+func (q *RetryQueue) head() (retryBatch, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return retryBatch{}, false, nil
+	}
+	if len(q.batches) == 0 && q.spilled > 0 {
+		if err := q.unspill(); err != nil {
+			return retryBatch{}, false, err
+		}
+	}
+	if len(q.batches) == 0 {
+		return retryBatch{}, false, nil
+	}
+	return q.batches[0], true, nil
+}
+
+// pop removes the first batch of the queue.
+func (q *RetryQueue) pop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.batches) > 0 {
+		q.batches[0] = retryBatch{}
+		q.batches = q.batches[1:]
+	}
+	q.updateDepth()
+}
+
+// updateDepth exports the number of queued batches. It must be called with
+// the lock held, or before the queue is used.
+func (q *RetryQueue) updateDepth() {
+	q.metrics.QueueDepth.Set(float64(len(q.batches) + q.spilled))
+}
+
+// unspill moves the first batches of the spill file to memory, and keeps
+// the other ones in the file. It must be called with the lock held.
+func (q *RetryQueue) unspill() error {
+	batches, err := readSpill(q.cfg.SpillFile)
+	if err != nil {
+		return err
+	}
+	n := len(batches)
+	if n > q.cfg.Size {
+		n = q.cfg.Size
+	}
+	if err := writeSpill(q.cfg.SpillFile, batches[n:]); err != nil {
+		return err
+	}
+	q.batches = append(q.batches, batches[:n]...)
+	q.spilled = len(batches) - n
+	q.updateDepth()
+	return nil
+}
+
+func (q *RetryQueue) run() {
+	defer q.wg.Done()
+
+	backoff := q.cfg.MinBackoff
+	for {
+		b, ok, err := q.head()
+		if err != nil {
+			q.logger.Warn(fmt.Sprintf("Failed to read spill file: %s", err))
+		}
+		if !ok && err == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		if ok {
+			err = q.repo.SaveContext(b.context(), b.Records...)
+			outcome := outcomeSuccess
+			if err != nil {
+				outcome = outcomeFailure
+			}
+			q.metrics.Retries.With("outcome", outcome).Add(1)
+			switch {
+			case err == nil:
+				q.pop()
+				backoff = q.cfg.MinBackoff
+				continue
+			case errors.Contains(err, ErrRemoteRejected):
+				q.pop()
+				q.metrics.Dropped.With("reason", reasonSend).Add(float64(len(b.Records)))
+				q.logger.Warn(fmt.Sprintf("Dropped %d queued records: %s", len(b.Records), err))
+				backoff = q.cfg.MinBackoff
+				continue
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-q.done:
+			return
+		}
+		if backoff *= 2; backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+	}
+}
+
+// readSpill returns the batches of the spill file, a JSON object per line.
+// Malformed lines, such as a line left incomplete by a crash, are skipped.
+func readSpill(name string) ([]retryBatch, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var batches []retryBatch
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var b retryBatch
+			if json.Unmarshal(line, &b) == nil {
+				batches = append(batches, b)
+			}
+		}
+		if err == io.EOF {
+			return batches, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// appendSpill appends the batches to the spill file.
+func appendSpill(name string, batches []retryBatch) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	data, err := encodeSpill(batches)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSpill replaces the spill file with the batches, and removes it if
+// there is none.
+func writeSpill(name string, batches []retryBatch) error {
+	if len(batches) == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := encodeSpill(batches)
+	if err != nil {
+		return err
+	}
+	return writeFile(name, data)
+}
+
+// encodable returns the batches which can be written to the spill file, and
+// the number of records of the other ones, e.g. holding a NaN value.
+func encodable(batches []retryBatch) ([]retryBatch, int) {
+	var kept []retryBatch
+	n := 0
+	for _, b := range batches {
+		if _, err := json.Marshal(b); err != nil {
+			n += len(b.Records)
+			continue
+		}
+		kept = append(kept, b)
+	}
+	return kept, n
+}
+
+func encodeSpill(batches []retryBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, b := range batches {
+		if err := enc.Encode(b); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,303 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyMock fails with its error until it is fixed, and records the
+// messages forwarded afterwards along with the sink and tags of each call.
+type flakyMock struct {
+	mu    sync.Mutex
+	err   error
+	msgs  []senml.Message
+	sinks []string
+	tags  []map[string]string
+}
+
+func (fm *flakyMock) Save(messages ...senml.Message) error {
+	return fm.SaveContext(context.Background(), messages...)
+}
+
+func (fm *flakyMock) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.err != nil {
+		return fm.err
+	}
+	fm.msgs = append(fm.msgs, messages...)
+	fm.sinks = append(fm.sinks, writer.SinkFromContext(ctx))
+	fm.tags = append(fm.tags, writer.TagsFromContext(ctx))
+	return nil
+}
+
+func (fm *flakyMock) fail(err error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.err = err
+}
+
+func (fm *flakyMock) names() []string {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	var names []string
+	for _, msg := range fm.msgs {
+		names = append(names, msg.Name)
+	}
+	return names
+}
+
+type gaugeMock struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (gm *gaugeMock) With(labelValues ...string) metrics.Gauge {
+	return gm
+}
+
+func (gm *gaugeMock) Set(value float64) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	gm.value = value
+}
+
+func (gm *gaugeMock) Add(delta float64) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	gm.value += delta
+}
+
+func (gm *gaugeMock) get() float64 {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	return gm.value
+}
+
+func record(name string) senml.Message {
+	return senml.Message{Channel: "45", Publisher: "2580", Name: name, Value: &v}
+}
+
+func TestNewRetryQueue(t *testing.T) {
+	cases := []struct {
+		desc string
+		cfg  writer.RetryConfig
+		err  error
+	}{
+		{
+			desc: "create retry queue",
+			cfg:  writer.RetryConfig{Size: 10},
+			err:  nil,
+		},
+		{
+			desc: "create retry queue without size",
+			cfg:  writer.RetryConfig{},
+			err:  writer.ErrInvalidRetry,
+		},
+		{
+			desc: "create retry queue with backoff above max backoff",
+			cfg:  writer.RetryConfig{Size: 10, MinBackoff: time.Minute, MaxBackoff: time.Second},
+			err:  writer.ErrInvalidRetry,
+		},
+	}
+
+	for _, tc := range cases {
+		q, err := writer.NewRetryQueue(&flakyMock{}, tc.cfg, nopMetrics, testLog)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		if q != nil {
+			q.Close(context.Background())
+		}
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	var retries float64
+	depth := &gaugeMock{}
+	m := nopMetrics
+	m.Retries = counterMock{value: &retries}
+	m.QueueDepth = depth
+
+	repo := &flakyMock{err: writer.ErrCircuitOpen}
+	q, err := writer.NewRetryQueue(repo, writer.RetryConfig{Size: 10, MinBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}, m, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating retry queue: %s", err))
+	defer q.Close(context.Background())
+
+	ctx := writer.WithSink(writer.WithTags(context.Background(), map[string]string{"site": "north"}), writer.SinkMQTT)
+	for _, name := range []string{"a", "b", "c"} {
+		err := q.SaveContext(ctx, record(name))
+		assert.Nil(t, err, fmt.Sprintf("queue records while the circuit is open: unexpected error %v", err))
+	}
+	assert.Empty(t, repo.names(), "records must not be forwarded while the circuit is open")
+	assert.Equal(t, float64(3), depth.get(), "queue depth expected to count the queued batches")
+
+	repo.fail(nil)
+	assert.Eventually(t, func() bool { return len(repo.names()) == 3 }, time.Second, 10*time.Millisecond, "queued records expected to be sent again")
+	assert.Eventually(t, func() bool { return depth.get() == 0 }, time.Second, 10*time.Millisecond, "queue depth expected to be 0 once the batches are sent")
+	q.Close(context.Background())
+	assert.True(t, retries >= 3, fmt.Sprintf("expected at least 3 retries, got %v", retries))
+	assert.Equal(t, []string{"a", "b", "c"}, repo.names(), "queued records expected to be sent again in order")
+	assert.Equal(t, writer.SinkMQTT, repo.sinks[0], "queued records expected to keep their sink")
+	assert.Equal(t, "north", repo.tags[0]["site"], "queued records expected to keep their tags")
+
+	repo.fail(errors.Wrap(writer.ErrRemoteRejected, errors.New("400 Bad Request")))
+	err = q.SaveContext(ctx, record("d"))
+	assert.True(t, errors.Contains(err, writer.ErrRemoteRejected), fmt.Sprintf("rejected records must not be queued, got %v", err))
+}
+
+func TestRetryQueueFull(t *testing.T) {
+	repo := &flakyMock{err: writer.ErrCircuitOpen}
+	q, err := writer.NewRetryQueue(repo, writer.RetryConfig{Size: 1, MinBackoff: time.Hour, MaxBackoff: time.Hour}, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating retry queue: %s", err))
+	defer q.Close(context.Background())
+
+	err = q.Save(record("a"))
+	assert.Nil(t, err, fmt.Sprintf("queue records: unexpected error %v", err))
+	err = q.Save(record("b"))
+	assert.True(t, errors.Contains(err, writer.ErrCircuitOpen), fmt.Sprintf("full queue without spill file expected to return %v, got %v", writer.ErrCircuitOpen, err))
+}
+
+func TestRetryQueueSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retry")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+	spill := filepath.Join(dir, "retry.jsonl")
+	cfg := writer.RetryConfig{Size: 2, SpillFile: spill, MinBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	repo := &flakyMock{err: writer.ErrCircuitOpen}
+	q, err := writer.NewRetryQueue(repo, cfg, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating retry queue: %s", err))
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		err := q.Save(record(name))
+		assert.Nil(t, err, fmt.Sprintf("queue records: unexpected error %v", err))
+	}
+	data, err := ioutil.ReadFile(spill)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading spill file: %s", err))
+	assert.Equal(t, 3, strings.Count(string(data), "\n"), "records which don't fit in memory expected to be spilled")
+
+	err = q.Close(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("close retry queue: unexpected error %v", err))
+	assert.Equal(t, 5, q.Depth(), "closed queue expected to count the spilled records")
+
+	data, err = ioutil.ReadFile(spill)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading spill file: %s", err))
+	assert.Equal(t, 5, strings.Count(string(data), "\n"), "records left in memory expected to be spilled ahead of the spilled ones on close")
+
+	// A line left incomplete by a crash is skipped.
+	f, err := os.OpenFile(spill, os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening spill file: %s", err))
+	_, err = f.WriteString(`{"records":[{"chan`)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing spill file: %s", err))
+	f.Close()
+
+	repo = &flakyMock{}
+	q, err = writer.NewRetryQueue(repo, cfg, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating retry queue: %s", err))
+	defer q.Close(context.Background())
+	assert.Eventually(t, func() bool { return len(repo.names()) == 5 }, time.Second, 10*time.Millisecond, "spilled records expected to be sent again at start")
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, repo.names(), "spilled records expected to be sent again in order")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(spill)
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond, "spill file expected to be removed once sent")
+}
+
+func TestRetryQueueClose(t *testing.T) {
+	var dropped float64
+	m := nopMetrics
+	m.Dropped = counterMock{value: &dropped}
+
+	repo := &flakyMock{err: writer.ErrCircuitOpen}
+	q, err := writer.NewRetryQueue(repo, writer.RetryConfig{Size: 10, MinBackoff: time.Hour, MaxBackoff: time.Hour}, m, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating retry queue: %s", err))
+	for _, name := range []string{"a", "b"} {
+		err := q.Save(record(name))
+		assert.Nil(t, err, fmt.Sprintf("queue records: unexpected error %v", err))
+	}
+
+	err = q.Close(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("close retry queue: unexpected error %v", err))
+	assert.Equal(t, float64(2), dropped, "queued records expected to be dropped on close without spill file")
+	assert.Equal(t, 0, q.Depth(), "closed queue expected to be empty without spill file")
+
+	err = q.Save(record("c"))
+	assert.True(t, errors.Contains(err, writer.ErrCircuitOpen), fmt.Sprintf("closed queue expected to return %v, got %v", writer.ErrCircuitOpen, err))
+}
+
+func TestRetryQueueCloseUnencodable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retry")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+	spill := filepath.Join(dir, "retry.jsonl")
+
+	repo := &flakyMock{err: writer.ErrCircuitOpen}
+	q, err := writer.NewRetryQueue(repo, writer.RetryConfig{Size: 10, SpillFile: spill, MinBackoff: time.Hour, MaxBackoff: time.Hour}, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating retry queue: %s", err))
+	nan := record("nan")
+	value := math.NaN()
+	nan.Value = &value
+	for _, msg := range []senml.Message{record("a"), nan, record("b")} {
+		err := q.Save(msg)
+		assert.Nil(t, err, fmt.Sprintf("queue records: unexpected error %v", err))
+	}
+
+	err = q.Close(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("close retry queue: unexpected error %v", err))
+	data, err := ioutil.ReadFile(spill)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading spill file: %s", err))
+	assert.Equal(t, 2, strings.Count(string(data), "\n"), "records which can be encoded expected to be spilled on close")
+}
+
+func TestQueueCheck(t *testing.T) {
+	repo := &flakyMock{err: writer.ErrCircuitOpen}
+	q, err := writer.NewRetryQueue(repo, writer.RetryConfig{Size: 10, MinBackoff: time.Hour, MaxBackoff: time.Hour}, nopMetrics, testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating retry queue: %s", err))
+	defer q.Close(context.Background())
+	check := writer.QueueCheck(q, 2)
+
+	cases := []struct {
+		desc string
+		name string
+		err  error
+	}{
+		{
+			desc: "check queue below threshold",
+			name: "a",
+			err:  nil,
+		},
+		{
+			desc: "check queue at threshold",
+			name: "b",
+			err:  nil,
+		},
+		{
+			desc: "check queue above threshold",
+			name: "c",
+			err:  writer.ErrQueueAboveThreshold,
+		},
+	}
+
+	for _, tc := range cases {
+		err := q.Save(record(tc.name))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error queueing records: %s", tc.desc, err))
+		err = check()
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+	}
+}
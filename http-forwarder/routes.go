@@ -0,0 +1,604 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/messaging"
+)
+
+var (
+	// ErrRouteExists indicates that the route is already configured.
+	ErrRouteExists = errors.New("route already exists")
+
+	// ErrRouteNotFound indicates that the route is not configured.
+	ErrRouteNotFound = errors.New("route not found")
+
+	// ErrInvalidSubject indicates that the route subject is malformed.
+	ErrInvalidSubject = errors.New("invalid subject")
+
+	// ErrInvalidConfig indicates that the configuration file is rejected.
+	ErrInvalidConfig = errors.New("invalid configuration")
+
+	// ErrRoutesClosed indicates that the routes no longer change because
+	// the service is shutting down.
+	ErrRoutesClosed = errors.New("routes are closed")
+
+	errSaveConfFile = errors.New("unable to save configuration file")
+)
+
+// Route represents the forwarding of the messages published on a NATS subject.
+type Route struct {
+	Subject string `json:"subject"`
+	Paused  bool   `json:"paused"`
+}
+
+// Routes manages the forwarded routes at runtime. Every change is
+// persisted to the subjects configuration file.
+type Routes interface {
+	// Reload applies the subjects configuration file. Subjects are
+	// subscribed or unsubscribed according to the difference with the
+	// current routes and the remote target settings are swapped. An
+	// invalid configuration is rejected and the current one is kept.
+	Reload() error
+
+	// List returns the configured routes.
+	List() []Route
+
+	// Add subscribes to the subject and adds its route.
+	Add(subject string) (Route, error)
+
+	// Remove unsubscribes from the subject and removes its route.
+	Remove(subject string) error
+
+	// Pause unsubscribes from the subject while keeping its route.
+	Pause(subject string) (Route, error)
+
+	// Resume subscribes again to the subject of a paused route.
+	Resume(subject string) (Route, error)
+
+	// Scripts returns the paths of the scripts of the routes, loaded
+	// again on reload.
+	Scripts() []string
+
+	// Flush forwards the aggregates of the open windows of the routes and
+	// saves the state of their deadbands.
+	Flush(ctx context.Context) error
+
+	// Close stops the changes of the routes: Reload, Add, Remove, Pause
+	// and Resume fail afterwards.
+	Close()
+}
+
+var _ Routes = (*routes)(nil)
+
+type routes struct {
+	mu      sync.Mutex
+	sub     messaging.Subscriber
+	handler func(p *pipeline, msg messaging.Message) error
+	emit    Emitter
+	sinks   map[string]bool
+	path    string
+	routes  []Route
+	remote  *Remote
+	// configs contains the routes table of the file, persisted on save.
+	configs map[string]RouteConfig
+	// pipelines are read by the handlers without holding the routes lock.
+	pmu       sync.RWMutex
+	pipelines map[string]*pipeline
+	scripts   []string
+	// defRemote contains the settings used when the file has no remote table.
+	defRemote RemoteConfig
+	// fileRemote contains the remote table of the file, persisted on save.
+	fileRemote *RemoteConfig
+	// fallback is set while the routes are the default ones, used when the
+	// file failed to load.
+	fallback bool
+	// closed is set once the routes no longer change.
+	closed bool
+	logger logger.Logger
+}
+
+func (rs *routes) List() []Route {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	list := make([]Route, len(rs.routes))
+	copy(list, rs.routes)
+	return list
+}
+
+func (rs *routes) Add(subject string) (Route, error) {
+	if !validSubject(subject) {
+		return Route{}, ErrInvalidSubject
+	}
+	// Added routes have no settings and use the default sink.
+	if err := rs.env().checkSink(""); err != nil {
+		return Route{}, err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.closed {
+		return Route{}, ErrRoutesClosed
+	}
+	if rs.find(subject) >= 0 {
+		return Route{}, ErrRouteExists
+	}
+	r := Route{Subject: subject}
+	next := append(rs.copyRoutes(), r)
+	if err := rs.save(next); err != nil {
+		return Route{}, err
+	}
+	if err := rs.sub.Subscribe(subject, rs.handle(subject)); err != nil {
+		rs.restore()
+		return Route{}, err
+	}
+
+	rs.routes = next
+	rs.logger.Info(fmt.Sprintf("Route %s added", subject))
+	return r, nil
+}
+
+func (rs *routes) Remove(subject string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.closed {
+		return ErrRoutesClosed
+	}
+	i := rs.find(subject)
+	if i < 0 {
+		return ErrRouteNotFound
+	}
+	next := rs.copyRoutes()
+	next = append(next[:i], next[i+1:]...)
+	if err := rs.save(next); err != nil {
+		return err
+	}
+	if !rs.routes[i].Paused {
+		if err := rs.sub.Unsubscribe(subject); err != nil {
+			rs.restore()
+			return err
+		}
+	}
+
+	rs.routes = next
+	delete(rs.configs, subject)
+	rs.pmu.Lock()
+	p := rs.pipelines[subject]
+	delete(rs.pipelines, subject)
+	rs.scripts = scripts(rs.pipelines)
+	rs.pmu.Unlock()
+	go p.release(rs.logger)
+	rs.logger.Info(fmt.Sprintf("Route %s removed", subject))
+	return nil
+}
+
+func (rs *routes) Pause(subject string) (Route, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.closed {
+		return Route{}, ErrRoutesClosed
+	}
+	i := rs.find(subject)
+	if i < 0 {
+		return Route{}, ErrRouteNotFound
+	}
+	if rs.routes[i].Paused {
+		return rs.routes[i], nil
+	}
+	next := rs.copyRoutes()
+	next[i].Paused = true
+	if err := rs.save(next); err != nil {
+		return Route{}, err
+	}
+	if err := rs.sub.Unsubscribe(subject); err != nil {
+		rs.restore()
+		return Route{}, err
+	}
+
+	rs.routes = next
+	rs.logger.Info(fmt.Sprintf("Route %s paused", subject))
+	return rs.routes[i], nil
+}
+
+func (rs *routes) Resume(subject string) (Route, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.closed {
+		return Route{}, ErrRoutesClosed
+	}
+	i := rs.find(subject)
+	if i < 0 {
+		return Route{}, ErrRouteNotFound
+	}
+	if !rs.routes[i].Paused {
+		return rs.routes[i], nil
+	}
+	next := rs.copyRoutes()
+	next[i].Paused = false
+	if err := rs.save(next); err != nil {
+		return Route{}, err
+	}
+	if err := rs.sub.Subscribe(subject, rs.handle(subject)); err != nil {
+		rs.restore()
+		return Route{}, err
+	}
+
+	rs.routes = next
+	rs.logger.Info(fmt.Sprintf("Route %s resumed", subject))
+	return rs.routes[i], nil
+}
+
+func (rs *routes) Reload() error {
+	cfg, err := loadSubjectsConfig(rs.path)
+	if err != nil {
+		return errors.Wrap(ErrInvalidConfig, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	pipelines, err := cfg.pipelines(rs.env())
+	if err != nil {
+		return errors.Wrap(ErrInvalidConfig, err)
+	}
+	next := cfg.routes()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	applied := false
+	defer func() {
+		if !applied {
+			closeAggregators(pipelines)
+		}
+	}()
+	if rs.closed {
+		return ErrRoutesClosed
+	}
+
+	current := active(rs.routes)
+	wanted := active(next)
+
+	var subscribed []string
+	for _, r := range next {
+		if !wanted[r.Subject] || current[r.Subject] {
+			continue
+		}
+		if err := rs.sub.Subscribe(r.Subject, rs.handle(r.Subject)); err != nil {
+			for _, subject := range subscribed {
+				rs.sub.Unsubscribe(subject)
+			}
+			return err
+		}
+		subscribed = append(subscribed, r.Subject)
+	}
+	for _, r := range rs.routes {
+		if !current[r.Subject] || wanted[r.Subject] {
+			continue
+		}
+		if err := rs.sub.Unsubscribe(r.Subject); err != nil {
+			rs.logger.Warn(fmt.Sprintf("Failed to unsubscribe from %s: %s", r.Subject, err))
+		}
+	}
+
+	remote := rs.defRemote
+	if cfg.Remote != nil {
+		remote = *cfg.Remote
+	}
+	if err := rs.remote.Set(remote); err != nil {
+		return err
+	}
+
+	rs.routes = next
+	rs.fileRemote = cfg.Remote
+	rs.configs = cfg.Routes
+	rs.pmu.RLock()
+	released := keepState(rs.pipelines, pipelines)
+	rs.pmu.RUnlock()
+	rs.setPipelines(pipelines)
+	rs.fallback = false
+	applied = true
+	for _, p := range released {
+		go p.release(rs.logger)
+	}
+	rs.logger.Info(fmt.Sprintf("Configuration reloaded: %d subjects subscribed, %d unsubscribed", len(subscribed), countMissing(current, wanted)))
+	return nil
+}
+
+// subscribe subscribes to the subjects of the routes which are not paused.
+func (rs *routes) subscribe() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, r := range rs.routes {
+		if r.Paused {
+			continue
+		}
+		if err := rs.sub.Subscribe(r.Subject, rs.handle(r.Subject)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle returns the handler of the messages received on the subject,
+// processed by the current pipeline of its route.
+func (rs *routes) handle(subject string) messaging.MessageHandler {
+	return func(msg messaging.Message) error {
+		rs.pmu.RLock()
+		p := rs.pipelines[subject]
+		rs.pmu.RUnlock()
+		return rs.handler(p, msg)
+	}
+}
+
+func (rs *routes) setPipelines(pipelines map[string]*pipeline) {
+	rs.pmu.Lock()
+	rs.pipelines = pipelines
+	rs.scripts = scripts(pipelines)
+	rs.pmu.Unlock()
+}
+
+func (rs *routes) Flush(ctx context.Context) error {
+	rs.pmu.RLock()
+	pipelines := make([]*pipeline, 0, len(rs.pipelines))
+	for _, p := range rs.pipelines {
+		pipelines = append(pipelines, p)
+	}
+	rs.pmu.RUnlock()
+
+	var err error
+	for _, p := range pipelines {
+		if e := p.flush(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (rs *routes) Close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.closed = true
+}
+
+// env returns the dependencies of the pipelines of the routes.
+func (rs *routes) env() pipelineEnv {
+	return pipelineEnv{dir: filepath.Dir(rs.path), emit: rs.emit, sinks: rs.sinks, logger: rs.logger}
+}
+
+func (rs *routes) Scripts() []string {
+	rs.pmu.RLock()
+	defer rs.pmu.RUnlock()
+
+	paths := make([]string, len(rs.scripts))
+	copy(paths, rs.scripts)
+	return paths
+}
+
+// find returns the index of the route of the subject or -1. It must be
+// called with the lock held.
+func (rs *routes) find(subject string) int {
+	for i, r := range rs.routes {
+		if r.Subject == subject {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyRoutes returns a copy of the routes, changed and saved before being
+// applied. It must be called with the lock held.
+func (rs *routes) copyRoutes() []Route {
+	list := make([]Route, len(rs.routes))
+	copy(list, rs.routes)
+	return list
+}
+
+// save persists the list of routes, along with the settings of the routes
+// of the list, before it is applied. Nothing is persisted while running
+// on the default subjects of a configuration file which failed to load, not
+// to overwrite the file. It must be called with the lock held.
+func (rs *routes) save(list []Route) error {
+	if rs.fallback {
+		rs.logger.Warn(fmt.Sprintf("Routes not persisted to %s, which failed to load", rs.path))
+		return nil
+	}
+
+	cfg := subjectsConfig{Remote: rs.fileRemote}
+	for _, r := range list {
+		cfg.Subjects.List = append(cfg.Subjects.List, r.Subject)
+		if r.Paused {
+			cfg.Subjects.Paused = append(cfg.Subjects.Paused, r.Subject)
+		}
+		if rc, ok := rs.configs[r.Subject]; ok {
+			if cfg.Routes == nil {
+				cfg.Routes = make(map[string]RouteConfig)
+			}
+			cfg.Routes[r.Subject] = rc
+		}
+	}
+
+	if err := saveSubjectsConfig(rs.path, cfg); err != nil {
+		return errors.Wrap(errSaveConfFile, err)
+	}
+	return nil
+}
+
+// restore persists the current routes again, once saved changes failed to
+// be applied. It must be called with the lock held.
+func (rs *routes) restore() {
+	if err := rs.save(rs.routes); err != nil {
+		rs.logger.Warn(fmt.Sprintf("Failed to restore routes: %s", err))
+	}
+}
+
+// validSubject reports whether the subject is a valid NATS subject.
+func validSubject(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for i, t := range tokens {
+		if t == "" || (t == ">" && i != len(tokens)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// active returns the set of subjects of the routes which are not paused.
+func active(list []Route) map[string]bool {
+	subjects := make(map[string]bool)
+	for _, r := range list {
+		if !r.Paused {
+			subjects[r.Subject] = true
+		}
+	}
+	return subjects
+}
+
+// countMissing returns the number of subjects of a which are not in b.
+func countMissing(a, b map[string]bool) int {
+	n := 0
+	for subject := range a {
+		if !b[subject] {
+			n++
+		}
+	}
+	return n
+}
+
+type filterConfig struct {
+	List   []string `toml:"filter"`
+	Paused []string `toml:"paused,omitempty"`
+}
+
+type subjectsConfig struct {
+	Subjects filterConfig           `toml:"subjects"`
+	Remote   *RemoteConfig          `toml:"remote,omitempty"`
+	Routes   map[string]RouteConfig `toml:"routes,omitempty"`
+}
+
+// validate rejects malformed or duplicated subjects, invalid remote settings
+// and route settings which are not related to a listed subject. The route
+// settings themselves are checked when their pipelines are created.
+func (cfg subjectsConfig) validate() error {
+	seen := make(map[string]bool)
+	for _, subject := range cfg.Subjects.List {
+		if !validSubject(subject) {
+			return errors.Wrap(ErrInvalidConfig, errors.Wrap(ErrInvalidSubject, errors.New(subject)))
+		}
+		if seen[subject] {
+			return errors.Wrap(ErrInvalidConfig, errors.Wrap(ErrRouteExists, errors.New(subject)))
+		}
+		seen[subject] = true
+	}
+	if cfg.Remote != nil {
+		if err := cfg.Remote.Validate(); err != nil {
+			return errors.Wrap(ErrInvalidConfig, err)
+		}
+	}
+	for subject := range cfg.Routes {
+		if !seen[subject] {
+			return errors.Wrap(ErrInvalidConfig, errors.Wrap(ErrRouteNotFound, errors.New(subject)))
+		}
+	}
+	return nil
+}
+
+// pipelines returns the pipelines of the routes having settings.
+func (cfg subjectsConfig) pipelines(env pipelineEnv) (map[string]*pipeline, error) {
+	pipelines := make(map[string]*pipeline)
+	for subject, rc := range cfg.Routes {
+		p, err := rc.pipeline(env)
+		if err != nil {
+			closeAggregators(pipelines)
+			return nil, err
+		}
+		pipelines[subject] = p
+	}
+	return pipelines, nil
+}
+
+func (cfg subjectsConfig) routes() []Route {
+	paused := make(map[string]bool)
+	for _, subject := range cfg.Subjects.Paused {
+		paused[subject] = true
+	}
+
+	var rs []Route
+	for _, subject := range cfg.Subjects.List {
+		rs = append(rs, Route{Subject: subject, Paused: paused[subject]})
+	}
+	return rs
+}
+
+func loadSubjectsConfig(subjectsConfigPath string) (subjectsConfig, error) {
+	var subjectsCfg subjectsConfig
+
+	data, err := ioutil.ReadFile(subjectsConfigPath)
+	if err != nil {
+		return subjectsCfg, errors.Wrap(errOpenConfFile, err)
+	}
+	if err := toml.Unmarshal(data, &subjectsCfg); err != nil {
+		return subjectsCfg, errors.Wrap(errParseConfFile, err)
+	}
+
+	return subjectsCfg, nil
+}
+
+// saveSubjectsConfig atomically replaces the configuration file by writing
+// a temporary file in the same directory and renaming it. The file is
+// encoded from the configuration, so its comments and layout are not kept.
+func saveSubjectsConfig(subjectsConfigPath string, cfg subjectsConfig) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(cfg); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(subjectsConfigPath), filepath.Base(subjectsConfigPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(subjectsConfigPath); err == nil {
+		mode = fi.Mode()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), subjectsConfigPath)
+}
@@ -0,0 +1,515 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/messaging"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const subjectsCfg = `[subjects]
+filter = ["channels.1", "channels.2.>"]
+paused = ["channels.2.>"]
+`
+
+func TestRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(subjectsCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repoMock{}, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	expected := []writer.Route{{Subject: "channels.1"}, {Subject: "channels.2.>", Paused: true}}
+	assert.Equal(t, expected, routes.List(), "unexpected routes loaded from config")
+	assert.Len(t, sub.handlers, 1, "paused routes must not be subscribed")
+
+	cases := []struct {
+		desc       string
+		op         func() error
+		err        error
+		subscribed []string
+	}{
+		{
+			desc:       "add route",
+			op:         func() error { _, err := routes.Add("channels.3"); return err },
+			subscribed: []string{"channels.1", "channels.3"},
+		},
+		{
+			desc:       "add existing route",
+			op:         func() error { _, err := routes.Add("channels.3"); return err },
+			err:        writer.ErrRouteExists,
+			subscribed: []string{"channels.1", "channels.3"},
+		},
+		{
+			desc:       "add route with invalid subject",
+			op:         func() error { _, err := routes.Add("channels..>"); return err },
+			err:        writer.ErrInvalidSubject,
+			subscribed: []string{"channels.1", "channels.3"},
+		},
+		{
+			desc:       "pause route",
+			op:         func() error { _, err := routes.Pause("channels.1"); return err },
+			subscribed: []string{"channels.3"},
+		},
+		{
+			desc:       "resume route",
+			op:         func() error { _, err := routes.Resume("channels.2.>"); return err },
+			subscribed: []string{"channels.2.>", "channels.3"},
+		},
+		{
+			desc:       "remove route",
+			op:         func() error { return routes.Remove("channels.3") },
+			subscribed: []string{"channels.2.>"},
+		},
+		{
+			desc:       "remove paused route",
+			op:         func() error { return routes.Remove("channels.1") },
+			subscribed: []string{"channels.2.>"},
+		},
+		{
+			desc:       "remove unknown route",
+			op:         func() error { return routes.Remove("channels.1") },
+			err:        writer.ErrRouteNotFound,
+			subscribed: []string{"channels.2.>"},
+		},
+		{
+			desc:       "close routes",
+			op:         func() error { routes.Close(); return nil },
+			subscribed: []string{"channels.2.>"},
+		},
+		{
+			desc:       "add route to closed routes",
+			op:         func() error { _, err := routes.Add("channels.3"); return err },
+			err:        writer.ErrRoutesClosed,
+			subscribed: []string{"channels.2.>"},
+		},
+		{
+			desc:       "pause closed route",
+			op:         func() error { _, err := routes.Pause("channels.2.>"); return err },
+			err:        writer.ErrRoutesClosed,
+			subscribed: []string{"channels.2.>"},
+		},
+		{
+			desc:       "reload closed routes",
+			op:         routes.Reload,
+			err:        writer.ErrRoutesClosed,
+			subscribed: []string{"channels.2.>"},
+		},
+	}
+
+	for _, tc := range cases {
+		err := tc.op()
+		assert.Equal(t, tc.err, err, fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		var subscribed []string
+		for _, r := range routes.List() {
+			if _, ok := sub.handlers[r.Subject]; ok {
+				subscribed = append(subscribed, r.Subject)
+			}
+		}
+		assert.ElementsMatch(t, tc.subscribed, subscribed, fmt.Sprintf("%s: unexpected subscriptions", tc.desc))
+		assert.Len(t, sub.handlers, len(tc.subscribed), fmt.Sprintf("%s: unexpected subscriptions", tc.desc))
+	}
+
+	// Routes are persisted and loaded again on start.
+	reloaded, err := writer.Start(&subscriberMock{handlers: make(map[string]messaging.MessageHandler)}, repoMock{}, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+	assert.Equal(t, routes.List(), reloaded.List(), "persisted routes must match runtime routes")
+}
+
+func TestRoutesSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	cfg := `# Routes of the forwarder.
+[subjects]
+# Temperatures first.
+filter = [
+  "channels.1",  # sensors
+  "channels.2",
+]
+
+# Only the temperatures.
+[[routes."channels.2".include]]
+unit = "Cel"
+
+[routes."channels.1".aggregate]
+window = "1m"
+`
+	err = ioutil.WriteFile(path, []byte(cfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repoMock{}, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	_, err = routes.Pause("channels.1")
+	require.Nil(t, err, fmt.Sprintf("unexpected error pausing route: %s", err))
+	err = routes.Remove("channels.2")
+	require.Nil(t, err, fmt.Sprintf("unexpected error removing route: %s", err))
+	_, err = routes.Add("channels.3")
+	require.Nil(t, err, fmt.Sprintf("unexpected error adding route: %s", err))
+
+	// The file is encoded again, without its comments.
+	expected := `[subjects]
+  filter = ["channels.1", "channels.3"]
+  paused = ["channels.1"]
+
+[routes]
+  [routes."channels.1"]
+    [routes."channels.1".aggregate]
+      window = "1m0s"
+      grace = "0s"
+`
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading config: %s", err))
+	assert.Equal(t, expected, string(data), "expected settings of removed route dropped")
+
+	// The routes are not changed if they can't be saved.
+	err = os.Remove(path)
+	require.Nil(t, err, fmt.Sprintf("unexpected error removing config: %s", err))
+	err = os.MkdirAll(filepath.Join(path, "blocker"), 0755)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+
+	list := routes.List()
+	_, err = routes.Add("channels.4")
+	assert.NotNil(t, err, "expected error saving routes")
+	_, err = routes.Resume("channels.1")
+	assert.NotNil(t, err, "expected error saving routes")
+	err = routes.Remove("channels.3")
+	assert.NotNil(t, err, "expected error saving routes")
+	assert.Equal(t, list, routes.List(), "routes which failed to be saved must not be applied")
+	assert.Len(t, sub.handlers, 1, "routes which failed to be saved must not be subscribed")
+	assert.NotNil(t, sub.handlers["channels.3"], "routes which failed to be saved must not be unsubscribed")
+}
+
+func TestRoutesFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	cfg := "# Being edited.\n[subjects\n"
+	err = ioutil.WriteFile(path, []byte(cfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repoMock{}, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	_, err = routes.Add("channels.1")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error adding route: %s", err))
+	assert.Equal(t, []writer.Route{{Subject: "channels.>"}, {Subject: "channels.1"}}, routes.List(), "expected route added at runtime")
+
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading config: %s", err))
+	assert.Equal(t, cfg, string(data), "configuration which failed to load must not be overwritten")
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(subjectsCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	remote := newRemote(t, host)
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repoMock{}, httpSink, remote, senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	cases := []struct {
+		desc       string
+		cfg        string
+		err        error
+		subscribed []string
+		remote     writer.RemoteConfig
+	}{
+		{
+			desc: "reload valid configuration",
+			cfg: `[subjects]
+filter = ["channels.2.>", "channels.3"]
+
+[remote]
+url = "http://localhost:9001"
+token = "secret"
+
+[remote.headers]
+X-Forwarder = "test"
+`,
+			subscribed: []string{"channels.2.>", "channels.3"},
+			remote:     writer.RemoteConfig{URL: "http://localhost:9001", Token: "secret", Headers: map[string]string{"X-Forwarder": "test"}},
+		},
+		{
+			desc:       "reload malformed configuration",
+			cfg:        `[subjects`,
+			err:        writer.ErrInvalidConfig,
+			subscribed: []string{"channels.2.>", "channels.3"},
+			remote:     writer.RemoteConfig{URL: "http://localhost:9001", Token: "secret", Headers: map[string]string{"X-Forwarder": "test"}},
+		},
+		{
+			desc: "reload configuration with invalid subject",
+			cfg: `[subjects]
+filter = ["channels..1"]
+`,
+			err:        writer.ErrInvalidConfig,
+			subscribed: []string{"channels.2.>", "channels.3"},
+			remote:     writer.RemoteConfig{URL: "http://localhost:9001", Token: "secret", Headers: map[string]string{"X-Forwarder": "test"}},
+		},
+		{
+			desc: "reload configuration with invalid remote",
+			cfg: `[subjects]
+filter = ["channels.1"]
+
+[remote]
+url = "localhost"
+`,
+			err:        writer.ErrInvalidConfig,
+			subscribed: []string{"channels.2.>", "channels.3"},
+			remote:     writer.RemoteConfig{URL: "http://localhost:9001", Token: "secret", Headers: map[string]string{"X-Forwarder": "test"}},
+		},
+		{
+			desc: "reload configuration with invalid filtering rule",
+			cfg: `[subjects]
+filter = ["channels.1"]
+
+[[routes."channels.1".include]]
+name_regex = "temp("
+`,
+			err:        writer.ErrInvalidRule,
+			subscribed: []string{"channels.2.>", "channels.3"},
+			remote:     writer.RemoteConfig{URL: "http://localhost:9001", Token: "secret", Headers: map[string]string{"X-Forwarder": "test"}},
+		},
+		{
+			desc: "reload configuration with unknown delivery",
+			cfg: `[subjects]
+filter = ["channels.1"]
+
+[routes."channels.1"]
+delivery = "message"
+`,
+			err:        writer.ErrInvalidDelivery,
+			subscribed: []string{"channels.2.>", "channels.3"},
+			remote:     writer.RemoteConfig{URL: "http://localhost:9001", Token: "secret", Headers: map[string]string{"X-Forwarder": "test"}},
+		},
+		{
+			desc: "reload configuration with unknown sink",
+			cfg: `[subjects]
+filter = ["channels.1"]
+
+[routes."channels.1"]
+sink = "amqp"
+`,
+			err:        writer.ErrInvalidSink,
+			subscribed: []string{"channels.2.>", "channels.3"},
+			remote:     writer.RemoteConfig{URL: "http://localhost:9001", Token: "secret", Headers: map[string]string{"X-Forwarder": "test"}},
+		},
+		{
+			desc: "reload configuration with settings of unknown route",
+			cfg: `[subjects]
+filter = ["channels.1"]
+
+[[routes."channels.2".exclude]]
+unit = "Cel"
+`,
+			err:        writer.ErrRouteNotFound,
+			subscribed: []string{"channels.2.>", "channels.3"},
+			remote:     writer.RemoteConfig{URL: "http://localhost:9001", Token: "secret", Headers: map[string]string{"X-Forwarder": "test"}},
+		},
+		{
+			desc: "reload configuration without remote",
+			cfg: `[subjects]
+filter = ["channels.1", "channels.3"]
+paused = ["channels.3"]
+`,
+			subscribed: []string{"channels.1"},
+			remote:     writer.RemoteConfig{URL: host, Token: token},
+		},
+	}
+
+	for _, tc := range cases {
+		err := ioutil.WriteFile(path, []byte(tc.cfg), 0644)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error writing config: %s", tc.desc, err))
+
+		err = routes.Reload()
+		if tc.err != nil {
+			assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		}
+
+		var subscribed []string
+		for subject := range sub.handlers {
+			subscribed = append(subscribed, subject)
+		}
+		assert.ElementsMatch(t, tc.subscribed, subscribed, fmt.Sprintf("%s: unexpected subscriptions", tc.desc))
+		assert.Equal(t, tc.remote, remote.Config(), fmt.Sprintf("%s: unexpected remote settings", tc.desc))
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(subjectsCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repoMock{}, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	done := make(chan struct{})
+	go writer.WatchConfig(routes, path, 10*time.Millisecond, testLog, done)
+	// Let the watcher record the initial state of the file.
+	time.Sleep(50 * time.Millisecond)
+
+	err = ioutil.WriteFile(path, []byte("[subjects]\nfilter = [\"channels.4\", \"channels.5\"]\n"), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	expected := []writer.Route{{Subject: "channels.4"}, {Subject: "channels.5"}}
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expected, routes.List())
+	}, time.Second, 10*time.Millisecond, "configuration change expected to be applied")
+	close(done)
+}
+
+func TestWatchScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	rename := func(name string) string {
+		return fmt.Sprintf("def process(address, records):\n    return [dict(r, name = %q) for r in records]\n", name)
+	}
+	writeScript(t, dir, "rename.star", rename("first"))
+	path := filepath.Join(dir, "subjects.toml")
+	cfg := "[subjects]\nfilter = [\"channels.1\"]\n\n[routes.\"channels.1\".script]\npath = \"rename.star\"\n"
+	err = ioutil.WriteFile(path, []byte(cfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	repo := &recorderMock{}
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+	assert.Equal(t, []string{filepath.Join(dir, "rename.star")}, routes.Scripts(), "unexpected scripts")
+
+	forwarded := func() string {
+		repo.msgs = nil
+		err := sub.handlers["channels.1"](messaging.Message{Channel: "1", Payload: []byte(`[{"n":"temperature","v":20}]`)})
+		if err != nil || len(repo.msgs) != 1 {
+			return ""
+		}
+		return repo.msgs[0].Name
+	}
+	assert.Equal(t, "first", forwarded(), "expected record processed by script")
+
+	done := make(chan struct{})
+	go writer.WatchConfig(routes, path, 10*time.Millisecond, testLog, done)
+	defer close(done)
+	// Let the watcher record the initial state of the files.
+	time.Sleep(50 * time.Millisecond)
+
+	writeScript(t, dir, "rename.star", rename("second"))
+	assert.Eventually(t, func() bool {
+		return forwarded() == "second"
+	}, time.Second, 10*time.Millisecond, "script change expected to be applied")
+
+	writeScript(t, dir, "rename.star", "def process(address, records)\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "second", forwarded(), "invalid script expected to be rejected")
+}
+
+func TestReloadAggregate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	aggregate := "\n[routes.\"channels.1\".aggregate]\nwindow = \"1h\"\nfunctions = [\"count\"]\n"
+	err = ioutil.WriteFile(path, []byte("[subjects]\nfilter = [\"channels.1\"]\n"+aggregate), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	repo := &recorderMock{}
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	send := func() {
+		err := sub.handlers["channels.1"](messaging.Message{Channel: "1", Payload: []byte(`[{"n":"temperature","v":20}]`)})
+		require.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	}
+	send()
+
+	err = ioutil.WriteFile(path, []byte("[subjects]\nfilter = [\"channels.1\", \"channels.2\"]\n"+aggregate), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+	err = routes.Reload()
+	require.Nil(t, err, fmt.Sprintf("unexpected error reloading config: %s", err))
+	send()
+
+	err = routes.Flush(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	require.Len(t, repo.msgs, 1, "expected aggregate of open window")
+	assert.Equal(t, 2.0, *repo.msgs[0].Value, "expected open window kept on reload")
+}
+
+func TestReloadAggregateDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	aggregate := "\n[routes.\"channels.1\".aggregate]\nwindow = \"1h\"\nfunctions = [\"count\"]\n"
+	err = ioutil.WriteFile(path, []byte("[subjects]\nfilter = [\"channels.1\"]\n"+aggregate), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	repo := &recorderMock{}
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repo, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+
+	send := func() {
+		err := sub.handlers["channels.1"](messaging.Message{Channel: "1", Payload: []byte(`[{"n":"temperature","v":20}]`)})
+		require.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	}
+	send()
+
+	routeCfg := "[subjects]\nfilter = [\"channels.1\"]\n\n[routes.\"channels.1\"]\ndelivery = \"record\"\n"
+	err = ioutil.WriteFile(path, []byte(routeCfg+aggregate), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+	err = routes.Reload()
+	require.Nil(t, err, fmt.Sprintf("unexpected error reloading config: %s", err))
+	// The window of the previous delivery is released in the background.
+	assert.Eventually(t, func() bool { return repo.count() == 1 }, time.Second, 10*time.Millisecond, "expected window released on delivery change")
+	send()
+
+	err = routes.Flush(context.Background())
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %v", err))
+	assert.Equal(t, []string{writer.DeliveryAddress, writer.DeliveryRecord}, repo.deliveries, "expected aggregates forwarded with the delivery of their route")
+	require.Len(t, repo.msgs, 2, "expected aggregates of the previous and the new window")
+	assert.Equal(t, 1.0, *repo.msgs[1].Value, "expected new window on delivery change")
+}
@@ -0,0 +1,183 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+)
+
+const (
+	defS3Region  = "us-east-1"
+	defS3Timeout = 30 * time.Second
+
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	s3Service   = "s3"
+	s3DateTime  = "20060102T150405Z"
+	s3Date      = "20060102"
+)
+
+var errUploadObject = errors.New("failed to upload object")
+
+// S3Config contains the settings of the S3 compatible object store the
+// archive files are uploaded to.
+type S3Config struct {
+	// URL is the endpoint of the object store, e.g.
+	// https://s3.eu-west-1.amazonaws.com or http://minio:9000. The objects
+	// are addressed with the bucket in the path.
+	URL string
+
+	// Region is the region the requests are signed for, us-east-1 if
+	// empty.
+	Region string
+
+	// Bucket is the bucket the objects are uploaded to.
+	Bucket string
+
+	// AccessKey and SecretKey are the credentials signing the requests.
+	AccessKey string
+	SecretKey string
+
+	// Prefix is prepended to the object keys, e.g. forwarder-1/.
+	Prefix string
+
+	// Timeout is the time allowed to upload an object, 30 seconds if 0.
+	Timeout time.Duration
+}
+
+// s3Client uploads objects with requests signed with AWS Signature
+// Version 4, which S3 compatible stores accept.
+type s3Client struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+func newS3Client(cfg S3Config) (*s3Client, error) {
+	if cfg.Region == "" {
+		cfg.Region = defS3Region
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defS3Timeout
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 URL %s", cfg.URL)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("missing S3 bucket")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("missing S3 credentials")
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+
+	return &s3Client{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// put uploads the data as the object of the key, under the prefix.
+func (c *s3Client) put(ctx context.Context, key string, data []byte) error {
+	uri := "/" + s3Escape(c.cfg.Bucket) + "/" + s3Escape(c.cfg.Prefix+key)
+	req, err := http.NewRequest(http.MethodPut, c.cfg.URL+uri, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(errUploadObject, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/gzip")
+	c.sign(req, uri, data, time.Now().UTC())
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(errUploadObject, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Wrap(errUploadObject, fmt.Errorf("status %d: %s", res.StatusCode, strings.TrimSpace(string(body))))
+	}
+	return nil
+}
+
+// sign sets the date, payload hash and authorization headers of the
+// request, signed at the time.
+func (c *s3Client) sign(req *http.Request, uri string, payload []byte, t time.Time) {
+	hash := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("X-Amz-Date", t.Format(s3DateTime))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{
+		"content-type":         req.Header.Get("Content-Type"),
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           t.Format(s3DateTime),
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, values[h])
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", t.Format(s3Date), c.cfg.Region, s3Service)
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		t.Format(s3DateTime),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretKey), t.Format(s3Date))
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, c.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape returns the URI encoded path, whose slashes are preserved.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
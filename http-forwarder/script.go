@@ -0,0 +1,396 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+const (
+	scriptFunc = "process"
+
+	defScriptTimeout    = 100 * time.Millisecond
+	defScriptMaxSteps   = 1000000
+	defScriptMaxRecords = 10000
+	defScriptMaxMemory  = 64 << 20
+)
+
+var (
+	// ErrInvalidScript indicates that the script can't be loaded.
+	ErrInvalidScript = errors.New("invalid script")
+
+	// ErrScriptFailed indicates that the script failed to process records.
+	ErrScriptFailed = errors.New("script failed")
+
+	// ErrScriptTimeout indicates that the script didn't complete in time.
+	ErrScriptTimeout = errors.New("script timed out")
+
+	// ErrScriptMemory indicates that the records returned by the script
+	// exceed the memory limit.
+	ErrScriptMemory = errors.New("script exceeded memory limit")
+)
+
+// Duration is a time.Duration set as a string (e.g. "100ms") in the
+// configuration file.
+type Duration time.Duration
+
+// UnmarshalText parses the duration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalText formats the duration.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// ScriptConfig contains the settings of the script of a route.
+type ScriptConfig struct {
+	// Path is the path of the Starlark script, relative to the directory
+	// of the configuration file.
+	Path string `toml:"path"`
+
+	// Timeout is the time allowed to process a batch, 100ms by default.
+	Timeout Duration `toml:"timeout,omitempty"`
+
+	// MaxSteps is the number of computation steps allowed to process a
+	// batch, 1000000 by default.
+	MaxSteps uint64 `toml:"max_steps,omitempty"`
+
+	// MaxRecords is the number of records the script can return for a
+	// batch, 10000 by default.
+	MaxRecords int `toml:"max_records,omitempty"`
+
+	// MaxMemory is the size in bytes of the records the script can return
+	// for a batch, 64 MiB by default. The memory allocated while the script
+	// runs is bounded by MaxSteps instead.
+	MaxMemory uint64 `toml:"max_memory,omitempty"`
+}
+
+// Script runs the process function of a Starlark script on the records
+// grouped by address. The function receives the address, as a struct with
+// topic, channel, subtopic, publisher and protocol fields, and the list of
+// records, as dicts keyed by the JSON names of the senml.Message fields.
+// It returns the list of records to forward, which can be filtered,
+// modified or new ones. Returned records without channel, subtopic,
+// publisher or protocol get the ones of the address.
+type Script struct {
+	path       string
+	process    starlark.Callable
+	timeout    time.Duration
+	maxSteps   uint64
+	maxRecords int
+	maxMemory  uint64
+	logger     logger.Logger
+}
+
+// NewScript loads the script. Its global values are frozen, so that it can
+// process batches concurrently.
+func NewScript(cfg ScriptConfig, logger logger.Logger) (*Script, error) {
+	src, err := ioutil.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidScript, err)
+	}
+
+	s := &Script{
+		path:       cfg.Path,
+		timeout:    time.Duration(cfg.Timeout),
+		maxSteps:   cfg.MaxSteps,
+		maxRecords: cfg.MaxRecords,
+		maxMemory:  cfg.MaxMemory,
+		logger:     logger,
+	}
+	if s.timeout <= 0 {
+		s.timeout = defScriptTimeout
+	}
+	if s.maxSteps == 0 {
+		s.maxSteps = defScriptMaxSteps
+	}
+	if s.maxRecords <= 0 {
+		s.maxRecords = defScriptMaxRecords
+	}
+	if s.maxMemory == 0 {
+		s.maxMemory = defScriptMaxMemory
+	}
+
+	thread := s.thread()
+	thread.SetMaxExecutionSteps(s.maxSteps)
+	globals, err := starlark.ExecFile(thread, cfg.Path, src, predeclared)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidScript, err)
+	}
+	fn, ok := globals[scriptFunc].(starlark.Callable)
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidScript, fmt.Errorf("%s doesn't define the %s function", cfg.Path, scriptFunc))
+	}
+	s.process = fn
+
+	return s, nil
+}
+
+var predeclared = starlark.StringDict{
+	"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+}
+
+func (s *Script) thread() *starlark.Thread {
+	return &starlark.Thread{
+		Name: s.path,
+		Print: func(_ *starlark.Thread, msg string) {
+			s.logger.Debug(fmt.Sprintf("Script %s: %s", s.path, msg))
+		},
+	}
+}
+
+// Run replaces the records of the batch by the ones returned by the script
+// for each address. Batches exceeding the timeout return ErrScriptTimeout,
+// the ones whose returned records exceed the memory limit ErrScriptMemory
+// and other failures return ErrScriptFailed.
+func (s *Script) Run(b *Batch) error {
+	var timedOut int32
+	thread := s.thread()
+	thread.SetMaxExecutionSteps(s.maxSteps)
+	timer := time.AfterFunc(s.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		thread.Cancel("timeout")
+	})
+	defer timer.Stop()
+
+	var records []senml.Message
+	var size uint64
+	for _, g := range groupByAddress(b.Records) {
+		res, err := starlark.Call(thread, s.process, starlark.Tuple{addressValue(g.address), recordsValue(g.records)}, nil)
+		if err != nil {
+			if atomic.LoadInt32(&timedOut) == 1 {
+				return errors.Wrap(ErrScriptTimeout, errors.New(s.timeout.String()))
+			}
+			return errors.Wrap(ErrScriptFailed, err)
+		}
+		out, err := fromRecordsValue(res, g.address)
+		if err != nil {
+			return errors.Wrap(ErrScriptFailed, err)
+		}
+		records = append(records, out...)
+		if len(records) > s.maxRecords {
+			return errors.Wrap(ErrScriptFailed, fmt.Errorf("more than %d records returned", s.maxRecords))
+		}
+		for _, msg := range out {
+			size += recordSize(msg)
+		}
+		if size > s.maxMemory {
+			return errors.Wrap(ErrScriptMemory, fmt.Errorf("more than %d bytes of records returned", s.maxMemory))
+		}
+	}
+	b.Records = records
+	return nil
+}
+
+// recordSize returns the approximate number of bytes held by the record.
+func recordSize(msg senml.Message) uint64 {
+	const fixed = 128
+	n := fixed + len(msg.Channel) + len(msg.Subtopic) + len(msg.Publisher) + len(msg.Protocol) + len(msg.Name) + len(msg.Unit)
+	if msg.StringValue != nil {
+		n += len(*msg.StringValue)
+	}
+	if msg.DataValue != nil {
+		n += len(*msg.DataValue)
+	}
+	return uint64(n)
+}
+
+type addressGroup struct {
+	address Address
+	records []senml.Message
+}
+
+// groupByAddress returns the records grouped by address, in the order of
+// appearance of the addresses.
+func groupByAddress(msgs []senml.Message) []addressGroup {
+	var groups []addressGroup
+	index := make(map[Address]int)
+	for _, msg := range msgs {
+		a := addressOf(msg)
+		i, ok := index[a]
+		if !ok {
+			i = len(groups)
+			index[a] = i
+			groups = append(groups, addressGroup{address: a})
+		}
+		groups[i].records = append(groups[i].records, msg)
+	}
+	return groups
+}
+
+func addressValue(a Address) starlark.Value {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"topic":     starlark.String(a.FullTopic),
+		"channel":   starlark.String(a.Channel),
+		"subtopic":  starlark.String(a.Subtopic),
+		"publisher": starlark.String(a.Published),
+		"protocol":  starlark.String(a.Protocol),
+	})
+}
+
+func recordsValue(msgs []senml.Message) starlark.Value {
+	list := make([]starlark.Value, len(msgs))
+	for i, msg := range msgs {
+		list[i] = recordValue(msg)
+	}
+	return starlark.NewList(list)
+}
+
+// recordValue returns the record as a dict holding the fields which are set.
+func recordValue(msg senml.Message) starlark.Value {
+	d := starlark.NewDict(13)
+	set := func(key string, v starlark.Value) {
+		d.SetKey(starlark.String(key), v)
+	}
+	setString := func(key, v string) {
+		if v != "" {
+			set(key, starlark.String(v))
+		}
+	}
+
+	setString("channel", msg.Channel)
+	setString("subtopic", msg.Subtopic)
+	setString("publisher", msg.Publisher)
+	setString("protocol", msg.Protocol)
+	setString("name", msg.Name)
+	setString("unit", msg.Unit)
+	if msg.Time != 0 {
+		set("time", starlark.Float(msg.Time))
+	}
+	if msg.UpdateTime != 0 {
+		set("update_time", starlark.Float(msg.UpdateTime))
+	}
+	if msg.Value != nil {
+		set("value", starlark.Float(*msg.Value))
+	}
+	if msg.StringValue != nil {
+		set("string_value", starlark.String(*msg.StringValue))
+	}
+	if msg.DataValue != nil {
+		set("data_value", starlark.String(*msg.DataValue))
+	}
+	if msg.BoolValue != nil {
+		set("bool_value", starlark.Bool(*msg.BoolValue))
+	}
+	if msg.Sum != nil {
+		set("sum", starlark.Float(*msg.Sum))
+	}
+	return d
+}
+
+func fromRecordsValue(v starlark.Value, a Address) ([]senml.Message, error) {
+	seq, ok := v.(starlark.Indexable)
+	if !ok || v.Type() == "string" {
+		return nil, fmt.Errorf("%s returned %s instead of a list", scriptFunc, v.Type())
+	}
+	msgs := make([]senml.Message, seq.Len())
+	for i := range msgs {
+		msg, err := fromRecordValue(seq.Index(i), a)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %s", i, err)
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+func fromRecordValue(v starlark.Value, a Address) (senml.Message, error) {
+	msg := senml.Message{Channel: a.Channel, Subtopic: a.Subtopic, Publisher: a.Published, Protocol: a.Protocol}
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return msg, fmt.Errorf("%s instead of a dict", v.Type())
+	}
+
+	for _, item := range d.Items() {
+		key, ok := starlark.AsString(item[0])
+		if !ok {
+			return msg, fmt.Errorf("%s key instead of a string", item[0].Type())
+		}
+		val := item[1]
+		if val == starlark.None {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "channel":
+			msg.Channel, err = asString(key, val)
+		case "subtopic":
+			msg.Subtopic, err = asString(key, val)
+		case "publisher":
+			msg.Publisher, err = asString(key, val)
+		case "protocol":
+			msg.Protocol, err = asString(key, val)
+		case "name":
+			msg.Name, err = asString(key, val)
+		case "unit":
+			msg.Unit, err = asString(key, val)
+		case "time":
+			msg.Time, err = asFloat(key, val)
+		case "update_time":
+			msg.UpdateTime, err = asFloat(key, val)
+		case "value":
+			var f float64
+			f, err = asFloat(key, val)
+			msg.Value = &f
+		case "string_value":
+			var s string
+			s, err = asString(key, val)
+			msg.StringValue = &s
+		case "data_value":
+			var s string
+			s, err = asString(key, val)
+			msg.DataValue = &s
+		case "bool_value":
+			b, ok := val.(starlark.Bool)
+			if !ok {
+				err = fmt.Errorf("%s is %s instead of a bool", key, val.Type())
+			}
+			bv := bool(b)
+			msg.BoolValue = &bv
+		case "sum":
+			var f float64
+			f, err = asFloat(key, val)
+			msg.Sum = &f
+		default:
+			err = fmt.Errorf("unknown field %s", key)
+		}
+		if err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+func asString(key string, v starlark.Value) (string, error) {
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return "", fmt.Errorf("%s is %s instead of a string", key, v.Type())
+	}
+	return s, nil
+}
+
+func asFloat(key string, v starlark.Value) (float64, error) {
+	f, ok := starlark.AsFloat(v)
+	if !ok {
+		return 0, fmt.Errorf("%s is %s instead of a number", key, v.Type())
+	}
+	return f, nil
+}
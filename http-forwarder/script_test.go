@@ -0,0 +1,225 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeScript(t *testing.T, dir, name, src string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(src), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing script: %s", err))
+	return path
+}
+
+func TestScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scripts")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	strV := "open"
+	records := []senml.Message{
+		{Channel: "1", Publisher: "2580", Name: "temperature", Unit: "Cel", Value: float(25), Time: 1000},
+		{Channel: "1", Publisher: "2580", Name: "door", StringValue: &strV, Time: 1000},
+		{Channel: "2", Publisher: "2581", Name: "temperature", Unit: "Cel", Value: float(-5), Time: 1001},
+	}
+
+	cases := []struct {
+		desc     string
+		src      string
+		cfg      writer.ScriptConfig
+		expected []senml.Message
+		err      error
+	}{
+		{
+			desc: "forward records unchanged",
+			src: `
+def process(address, records):
+    return records
+`,
+			expected: records,
+		},
+		{
+			desc: "filter records",
+			src: `
+def process(address, records):
+    return [r for r in records if r.get("value", 0) > 0]
+`,
+			expected: records[:1],
+		},
+		{
+			desc: "modify records",
+			src: `
+def process(address, records):
+    for r in records:
+        if r.get("unit") == "Cel":
+            r["value"] = r["value"] * 9 / 5 + 32
+            r["unit"] = "degF"
+    return records
+`,
+			expected: []senml.Message{
+				{Channel: "1", Publisher: "2580", Name: "temperature", Unit: "degF", Value: float(77), Time: 1000},
+				records[1],
+				{Channel: "2", Publisher: "2581", Name: "temperature", Unit: "degF", Value: float(23), Time: 1001},
+			},
+		},
+		{
+			desc: "split records to other subtopic",
+			src: `
+def process(address, records):
+    for r in records:
+        if "string_value" in r:
+            r["subtopic"] = "events"
+    return records
+`,
+			expected: []senml.Message{
+				records[0],
+				{Channel: "1", Subtopic: "events", Publisher: "2580", Name: "door", StringValue: &strV, Time: 1000},
+				records[2],
+			},
+		},
+		{
+			desc: "emit new records",
+			src: `
+def process(address, records):
+    count = {"name": address.channel + ":count", "value": len(records), "protocol": "script"}
+    return records[:1] + [count]
+`,
+			expected: []senml.Message{
+				records[0],
+				{Channel: "1", Publisher: "2580", Protocol: "script", Name: "1:count", Value: float(2)},
+				records[2],
+				{Channel: "2", Publisher: "2581", Protocol: "script", Name: "2:count", Value: float(1)},
+			},
+		},
+		{
+			desc: "return records of wrong type",
+			src: `
+def process(address, records):
+    return None
+`,
+			err: writer.ErrScriptFailed,
+		},
+		{
+			desc: "return record with unknown field",
+			src: `
+def process(address, records):
+    return [{"name": "temperature", "color": "red"}]
+`,
+			err: writer.ErrScriptFailed,
+		},
+		{
+			desc: "fail at runtime",
+			src: `
+def process(address, records):
+    return records[0]["missing"]
+`,
+			err: writer.ErrScriptFailed,
+		},
+		{
+			desc: "exceed steps",
+			src: `
+def process(address, records):
+    for i in range(1000000):
+        pass
+    return records
+`,
+			cfg: writer.ScriptConfig{MaxSteps: 1000},
+			err: writer.ErrScriptFailed,
+		},
+		{
+			desc: "exceed timeout",
+			src: `
+def process(address, records):
+    for i in range(100000000):
+        pass
+    return records
+`,
+			cfg: writer.ScriptConfig{Timeout: writer.Duration(10 * time.Millisecond), MaxSteps: 1 << 40},
+			err: writer.ErrScriptTimeout,
+		},
+		{
+			desc: "return records exceeding memory",
+			src: `
+def process(address, records):
+    return [{"name": "temperature", "string_value": "x" * 2048}]
+`,
+			cfg: writer.ScriptConfig{MaxMemory: 1024},
+			err: writer.ErrScriptMemory,
+		},
+		{
+			desc: "exceed records",
+			src: `
+def process(address, records):
+    return records * 10
+`,
+			cfg: writer.ScriptConfig{MaxRecords: 5},
+			err: writer.ErrScriptFailed,
+		},
+	}
+
+	for i, tc := range cases {
+		tc.cfg.Path = writeScript(t, dir, fmt.Sprintf("script%d.star", i), tc.src)
+		s, err := writer.NewScript(tc.cfg, testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error loading script: %s", tc.desc, err))
+
+		in := make([]senml.Message, len(records))
+		copy(in, records)
+		b := writer.Batch{Records: in}
+		err = s.Run(&b)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+		if tc.err == nil {
+			assert.Equal(t, tc.expected, b.Records, fmt.Sprintf("%s: unexpected records", tc.desc))
+		}
+	}
+}
+
+func TestNewScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scripts")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		desc string
+		path string
+		err  error
+	}{
+		{
+			desc: "load valid script",
+			path: writeScript(t, dir, "valid.star", "def process(address, records):\n    return records\n"),
+		},
+		{
+			desc: "load missing script",
+			path: filepath.Join(dir, "missing.star"),
+			err:  writer.ErrInvalidScript,
+		},
+		{
+			desc: "load malformed script",
+			path: writeScript(t, dir, "malformed.star", "def process(address, records)\n"),
+			err:  writer.ErrInvalidScript,
+		},
+		{
+			desc: "load script without process function",
+			path: writeScript(t, dir, "noprocess.star", "def transform(address, records):\n    return records\n"),
+			err:  writer.ErrInvalidScript,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := writer.NewScript(writer.ScriptConfig{Path: tc.path}, testLog)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.err, err))
+	}
+}
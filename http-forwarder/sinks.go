@@ -0,0 +1,129 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"context"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/transformers/senml"
+)
+
+// Sinks the records of a route are forwarded to.
+const (
+	// SinkHTTP forwards the records to the remote HTTP target. It is the
+	// default.
+	SinkHTTP = "http"
+
+	// SinkMQTT publishes the records to the MQTT broker.
+	SinkMQTT = "mqtt"
+
+	// SinkMainflux posts the records to the HTTP adapter of the remote
+	// Mainflux.
+	SinkMainflux = "mainflux"
+
+	// SinkKafka produces the records to the Kafka topics.
+	SinkKafka = "kafka"
+
+	// SinkGRPC streams the records to the gRPC receiver.
+	SinkGRPC = "grpc"
+
+	// SinkPush pushes the records to the WebSocket and Server-Sent Events
+	// clients of the HTTP API.
+	SinkPush = "push"
+)
+
+var (
+	// ErrInvalidSink indicates that the sink of a route is unknown.
+	ErrInvalidSink = errors.New("invalid sink")
+
+	// ErrSinkNotConfigured indicates that the sink selected by a route is
+	// not configured.
+	ErrSinkNotConfigured = errors.New("sink not configured")
+)
+
+func validSink(sink string) bool {
+	switch sink {
+	case "", SinkHTTP, SinkMQTT, SinkMainflux, SinkKafka, SinkGRPC, SinkPush:
+		return true
+	}
+	return false
+}
+
+type sinkKey struct{}
+
+// WithSink returns context carrying the sink of the records forwarded
+// within it.
+func WithSink(ctx context.Context, sink string) context.Context {
+	if sink == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, sinkKey{}, sink)
+}
+
+// SinkFromContext returns the sink carried by the context, SinkHTTP by
+// default.
+func SinkFromContext(ctx context.Context) string {
+	if sink, ok := ctx.Value(sinkKey{}).(string); ok {
+		return sink
+	}
+	return SinkHTTP
+}
+
+type createdKey struct{}
+
+// withCreated returns context carrying the creation time, in nanoseconds,
+// of the message the records forwarded within it come from.
+func withCreated(ctx context.Context, created int64) context.Context {
+	if created <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, createdKey{}, created)
+}
+
+// createdFromContext returns the creation time carried by the context, 0 if
+// there is none.
+func createdFromContext(ctx context.Context) int64 {
+	created, _ := ctx.Value(createdKey{}).(int64)
+	return created
+}
+
+var _ Repository = (*sinks)(nil)
+
+type sinks struct {
+	repos   map[string]Repository
+	metrics Metrics
+}
+
+// NewSinks returns repository forwarding the records to the repository of
+// the sink carried by the context. Records whose sink is not configured are
+// rejected with ErrSinkNotConfigured. The latency of the records accepted by
+// their sink is observed from the creation time carried by the context.
+func NewSinks(repos map[string]Repository, metrics Metrics) Repository {
+	s := &sinks{repos: make(map[string]Repository, len(repos)), metrics: metrics}
+	for name, repo := range repos {
+		s.repos[name] = repo
+	}
+	return s
+}
+
+func (s *sinks) Save(messages ...senml.Message) error {
+	return s.SaveContext(context.Background(), messages...)
+}
+
+func (s *sinks) SaveContext(ctx context.Context, messages ...senml.Message) error {
+	sink := SinkFromContext(ctx)
+	repo, ok := s.repos[sink]
+	if !ok {
+		return errors.Wrap(ErrRemoteRejected, errors.Wrap(ErrSinkNotConfigured, errors.New(sink)))
+	}
+	if err := repo.SaveContext(ctx, messages...); err != nil {
+		return err
+	}
+	if created := createdFromContext(ctx); created > 0 {
+		s.metrics.Latency.Observe(time.Since(time.Unix(0, created)).Seconds())
+	}
+	return nil
+}
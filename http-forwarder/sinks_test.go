@@ -0,0 +1,116 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	writer "github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder"
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/messaging"
+	"github.com/mainflux/mainflux/transformers/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sinksCfg = `[subjects]
+filter = ["channels.1", "channels.2", "channels.3"]
+
+[routes."channels.2"]
+sink = "mqtt"
+
+[routes."channels.3"]
+sink = "http"
+`
+
+func TestConsumerSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(sinksCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	cases := []struct {
+		desc    string
+		sinks   []string
+		subject string
+		sink    string
+	}{
+		{
+			desc:    "forward records to default sink",
+			sinks:   []string{writer.SinkHTTP, writer.SinkMQTT},
+			subject: "channels.1",
+			sink:    writer.SinkHTTP,
+		},
+		{
+			desc:    "forward records to sink of route",
+			sinks:   []string{writer.SinkHTTP, writer.SinkMQTT},
+			subject: "channels.2",
+			sink:    writer.SinkMQTT,
+		},
+		{
+			desc:    "forward records to explicit default sink",
+			sinks:   []string{writer.SinkHTTP, writer.SinkMQTT},
+			subject: "channels.3",
+			sink:    writer.SinkHTTP,
+		},
+	}
+
+	for _, tc := range cases {
+		repos := make(map[string]writer.Repository)
+		recorders := make(map[string]*recorderMock)
+		for _, name := range tc.sinks {
+			recorders[name] = &recorderMock{}
+			repos[name] = recorders[name]
+		}
+
+		sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+		_, err := writer.Start(sub, writer.NewSinks(repos, nopMetrics), tc.sinks, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error starting consumer: %s", tc.desc, err))
+
+		err = sub.handlers[tc.subject](messaging.Message{Channel: "1", Publisher: "2580", Payload: []byte(`[{"n":"temperature","v":20}]`)})
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+
+		for name, rec := range recorders {
+			expected := 0
+			if name == tc.sink {
+				expected = 1
+			}
+			assert.Len(t, rec.msgs, expected, fmt.Sprintf("%s: unexpected records forwarded to %s", tc.desc, name))
+		}
+	}
+}
+
+func TestConsumerSinkNotConfigured(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating directory: %s", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subjects.toml")
+	err = ioutil.WriteFile(path, []byte(sinksCfg), 0644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+
+	// The routes are rejected on start, and every subject is forwarded to
+	// the default sink.
+	sub := &subscriberMock{handlers: make(map[string]messaging.MessageHandler)}
+	routes, err := writer.Start(sub, repoMock{}, httpSink, newRemote(t, host), senml.New(senml.JSON), path, nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+	assert.Equal(t, []writer.Route{{Subject: "channels.>"}}, routes.List(), "expected routes rejected on start")
+
+	err = routes.Reload()
+	assert.True(t, errors.Contains(err, writer.ErrSinkNotConfigured), fmt.Sprintf("expected %v got %v", writer.ErrSinkNotConfigured, err))
+	assert.Equal(t, []writer.Route{{Subject: "channels.>"}}, routes.List(), "expected routes rejected on reload")
+
+	routes, err = writer.Start(sub, repoMock{}, []string{writer.SinkMQTT}, newRemote(t, host), senml.New(senml.JSON), "", nopMetrics, tracing.NewNop(), testLog)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting consumer: %s", err))
+	_, err = routes.Add("channels.1")
+	assert.True(t, errors.Contains(err, writer.ErrSinkNotConfigured), fmt.Sprintf("expected %v got %v", writer.ErrSinkNotConfigured, err))
+}
@@ -0,0 +1,282 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mainflux/mainflux/errors"
+	"github.com/mainflux/mainflux/logger"
+)
+
+const (
+	tracesPath = "/v1/traces"
+	queueSize  = 2048
+	batchSize  = 512
+
+	statusError = 2
+)
+
+var errExport = errors.New("failed to export spans")
+
+// Exporter sends ended spans to a tracing backend.
+type Exporter interface {
+	// Export enqueues ended span for export.
+	Export(s *Span)
+
+	// Close flushes enqueued spans and stops the exporter.
+	Close() error
+}
+
+var _ Exporter = (*otlpExporter)(nil)
+
+type otlpExporter struct {
+	// dropped is the number of spans dropped since the last flush, first
+	// for 64-bit alignment.
+	dropped  uint64
+	url      string
+	service  string
+	interval time.Duration
+	client   *http.Client
+	logger   logger.Logger
+	spans    chan *Span
+	done     chan struct{}
+	closed   chan error
+	once     sync.Once
+	err      error
+}
+
+// NewOTLPExporter returns exporter which sends batches of spans to the
+// OTLP/HTTP collector endpoint (e.g. http://localhost:4318) every interval.
+// Spans are dropped when the export queue is full, and the number of dropped
+// spans is logged every interval.
+func NewOTLPExporter(endpoint, service string, interval time.Duration, logger logger.Logger) Exporter {
+	e := &otlpExporter{
+		url:      strings.TrimRight(endpoint, "/") + tracesPath,
+		service:  service,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+		spans:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+		closed:   make(chan error, 1),
+	}
+	go e.run()
+
+	return e
+}
+
+func (e *otlpExporter) Export(s *Span) {
+	select {
+	case <-e.done:
+	case e.spans <- s:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+func (e *otlpExporter) Close() error {
+	e.once.Do(func() {
+		close(e.done)
+		e.err = <-e.closed
+	})
+	return e.err
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				e.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = nil
+			e.logDropped()
+		case <-e.done:
+			e.logDropped()
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					e.closed <- e.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *otlpExporter) flush(batch []*Span) {
+	if err := e.send(batch); err != nil {
+		e.logger.Warn(fmt.Sprintf("Failed to export %d spans: %s", len(batch), err))
+	}
+}
+
+// logDropped logs the number of spans dropped since it was last called.
+func (e *otlpExporter) logDropped() {
+	if n := atomic.SwapUint64(&e.dropped, 0); n > 0 {
+		e.logger.Warn(fmt.Sprintf("Tracing export queue is full, dropped %d spans", n))
+	}
+}
+
+func (e *otlpExporter) send(batch []*Span) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(e.request(batch))
+	if err != nil {
+		return errors.Wrap(errExport, err)
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(errExport, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Wrap(errExport, errors.New(resp.Status))
+	}
+	return nil
+}
+
+// The types below follow the JSON encoding of the OTLP trace service request.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func (e *otlpExporter) request(batch []*Span) exportRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = convert(s)
+	}
+
+	return exportRequest{
+		ResourceSpans: []resourceSpans{
+			{
+				Resource: resource{
+					Attributes: []keyValue{attribute(String("service.name", e.service))},
+				},
+				ScopeSpans: []scopeSpans{
+					{
+						Scope: scope{Name: e.service},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func convert(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              int(s.kind),
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, a := range s.attrs {
+		out.Attributes = append(out.Attributes, attribute(a))
+	}
+	if s.err != nil {
+		out.Status = status{Code: statusError, Message: s.err.Error()}
+	}
+
+	return out
+}
+
+func attribute(a Attribute) keyValue {
+	var v anyValue
+	switch val := a.Value.(type) {
+	case string:
+		v.StringValue = &val
+	case int64:
+		i := strconv.FormatInt(val, 10)
+		v.IntValue = &i
+	case float64:
+		v.DoubleValue = &val
+	case bool:
+		v.BoolValue = &val
+	default:
+		str := fmt.Sprint(val)
+		v.StringValue = &str
+	}
+
+	return keyValue{Key: a.Key, Value: v}
+}
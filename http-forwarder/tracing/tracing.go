@@ -0,0 +1,239 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tracing contains a minimal OpenTelemetry compatible tracer. Spans
+// are propagated using the W3C Trace Context format and exported to an
+// OpenTelemetry collector using OTLP/HTTP with JSON encoding.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the W3C Trace Context propagation header.
+const TraceParentHeader = "traceparent"
+
+// SpanKind describes the relationship between the span and its parent.
+type SpanKind int
+
+// Span kinds as defined by OTLP.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+	KindProducer SpanKind = 4
+	KindConsumer SpanKind = 5
+)
+
+// Attribute is a key-value pair describing a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns integer attribute.
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+// Tracer creates spans.
+type Tracer interface {
+	// Start creates span which is a child of the span carried by the context,
+	// if any, and returns the context carrying the new span.
+	Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span)
+}
+
+// Span represents a single operation within a trace. A nil span is valid
+// and records nothing.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     SpanKind
+	start    time.Time
+	end      time.Time
+	attrs    []Attribute
+	err      error
+	sampled  bool
+	exporter Exporter
+	mu       sync.Mutex
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End completes the span and hands it over to the exporter if it is
+// sampled.
+func (s *Span) End() {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.exporter.Export(s)
+}
+
+// TraceID returns the hex encoded trace ID.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// TraceParent returns the W3C traceparent value identifying the span, with
+// the sampled flag set if the span is sampled.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of the context carrying the span.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span carried by the context, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Inject sets the traceparent header from the span carried by the context.
+func Inject(ctx context.Context, header http.Header) {
+	if tp := SpanFromContext(ctx).TraceParent(); tp != "" {
+		header.Set(TraceParentHeader, tp)
+	}
+}
+
+// ParseTraceParent extracts the trace and parent span IDs from the
+// W3C traceparent value.
+func ParseTraceParent(value string) (traceID [16]byte, spanID [8]byte, ok bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+var _ Tracer = (*tracer)(nil)
+
+type tracer struct {
+	exporter Exporter
+	// bound is the value below which the trace IDs are sampled.
+	bound uint64
+	mu    sync.Mutex
+	rand  *rand.Rand
+}
+
+// New returns tracer handing ended spans over to the exporter. The ratio,
+// between 0 and 1, is the fraction of the traces which are sampled: the
+// spans of the other traces are propagated but not exported. The sampling
+// decision is taken from the trace ID when the root span starts, and is
+// inherited by its children.
+func New(exporter Exporter, ratio float64) Tracer {
+	var bound uint64
+	switch {
+	case ratio >= 1:
+		bound = math.MaxUint64
+	case ratio > 0:
+		bound = uint64(ratio * math.MaxUint64)
+	}
+	return &tracer{
+		exporter: exporter,
+		bound:    bound,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// sampled returns true if the trace is sampled.
+func (t *tracer) sampled(traceID [16]byte) bool {
+	if t.bound == math.MaxUint64 {
+		return true
+	}
+	return binary.BigEndian.Uint64(traceID[8:]) < t.bound
+}
+
+func (t *tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	s := &Span{
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    attrs,
+		exporter: t.exporter,
+	}
+
+	t.mu.Lock()
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		t.rand.Read(s.traceID[:])
+		s.sampled = t.sampled(s.traceID)
+	}
+	t.rand.Read(s.spanID[:])
+	t.mu.Unlock()
+
+	return ContextWithSpan(ctx, s), s
+}
+
+var _ Tracer = (*nopTracer)(nil)
+
+type nopTracer struct{}
+
+// NewNop returns tracer which doesn't record spans.
+func NewNop() Tracer {
+	return nopTracer{}
+}
+
+func (nopTracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	return ctx, nil
+}
@@ -0,0 +1,220 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonathandreyer/mainflux-httpforwarder/http-forwarder/tracing"
+	log "github.com/mainflux/mainflux/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testLog, _ = log.New(os.Stdout, log.Info.String())
+
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Status       struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type exportRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []exportedSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type collectorStub struct {
+	mu    sync.Mutex
+	spans []exportedSpan
+}
+
+func (cs *collectorStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			cs.spans = append(cs.spans, ss.Spans...)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestTracer(t *testing.T) {
+	collector := &collectorStub{}
+	ts := httptest.NewServer(collector)
+	defer ts.Close()
+
+	exporter := tracing.NewOTLPExporter(ts.URL, "test", time.Hour, testLog)
+	tracer := tracing.New(exporter, 1)
+
+	ctx, parent := tracer.Start(context.Background(), "consume", tracing.KindConsumer, tracing.String("channel", "45"))
+	childCtx, child := tracer.Start(ctx, "POST", tracing.KindClient, tracing.Int("records", 2))
+
+	header := http.Header{}
+	tracing.Inject(childCtx, header)
+	traceID, spanID, ok := tracing.ParseTraceParent(header.Get(tracing.TraceParentHeader))
+	assert.True(t, ok, fmt.Sprintf("invalid traceparent header %s", header.Get(tracing.TraceParentHeader)))
+	assert.Equal(t, parent.TraceID(), hex.EncodeToString(traceID[:]), "traceparent must carry the trace ID")
+
+	child.SetError(errors.New("remote failure"))
+	child.End()
+	parent.End()
+
+	err := exporter.Close()
+	require.Nil(t, err, fmt.Sprintf("unexpected error closing exporter: %s", err))
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	require.Len(t, collector.spans, 2, "expected both spans to be exported")
+
+	exportedChild, exportedParent := collector.spans[0], collector.spans[1]
+	assert.Equal(t, "POST", exportedChild.Name, "unexpected child span name")
+	assert.Equal(t, int(tracing.KindClient), exportedChild.Kind, "unexpected child span kind")
+	assert.Equal(t, hex.EncodeToString(spanID[:]), exportedChild.SpanID, "traceparent must carry the child span ID")
+	assert.Equal(t, exportedParent.SpanID, exportedChild.ParentSpanID, "child span must reference its parent")
+	assert.Equal(t, exportedParent.TraceID, exportedChild.TraceID, "spans must share the trace ID")
+	assert.Equal(t, 2, exportedChild.Status.Code, "failed span must have error status")
+	assert.Equal(t, "", exportedParent.ParentSpanID, "root span must not have a parent")
+}
+
+func TestNopTracer(t *testing.T) {
+	ctx, span := tracing.NewNop().Start(context.Background(), "consume", tracing.KindConsumer)
+	span.SetAttributes(tracing.String("channel", "45"))
+	span.End()
+
+	header := http.Header{}
+	tracing.Inject(ctx, header)
+	assert.Equal(t, "", header.Get(tracing.TraceParentHeader), "nop tracer must not propagate trace context")
+}
+
+// traceFlags returns the flags of the traceparent value.
+func traceFlags(traceParent string) string {
+	return traceParent[strings.LastIndex(traceParent, "-")+1:]
+}
+
+func TestTracerSampling(t *testing.T) {
+	cases := []struct {
+		desc  string
+		ratio float64
+		flags string
+		min   int
+		max   int
+	}{
+		{desc: "sample every trace", ratio: 1, flags: "01", min: 100, max: 100},
+		{desc: "sample no trace", ratio: 0, flags: "00", min: 0, max: 0},
+		{desc: "sample half of the traces", ratio: 0.5, min: 20, max: 80},
+	}
+
+	for _, tc := range cases {
+		collector := &collectorStub{}
+		ts := httptest.NewServer(collector)
+
+		exporter := tracing.NewOTLPExporter(ts.URL, "test", time.Hour, testLog)
+		tracer := tracing.New(exporter, tc.ratio)
+
+		for i := 0; i < 100; i++ {
+			ctx, parent := tracer.Start(context.Background(), "consume", tracing.KindConsumer)
+			childCtx, child := tracer.Start(ctx, "POST", tracing.KindClient)
+
+			header := http.Header{}
+			tracing.Inject(childCtx, header)
+			flags := traceFlags(header.Get(tracing.TraceParentHeader))
+			assert.Equal(t, traceFlags(parent.TraceParent()), flags, fmt.Sprintf("%s: child must inherit the sampling decision of its parent", tc.desc))
+			if tc.flags != "" {
+				assert.Equal(t, tc.flags, flags, fmt.Sprintf("%s: unexpected traceparent flags", tc.desc))
+			}
+
+			child.End()
+			parent.End()
+		}
+
+		err := exporter.Close()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error closing exporter: %s", tc.desc, err))
+		ts.Close()
+
+		collector.mu.Lock()
+		traces := map[string]int{}
+		for _, s := range collector.spans {
+			traces[s.TraceID]++
+		}
+		collector.mu.Unlock()
+		for id, n := range traces {
+			assert.Equal(t, 2, n, fmt.Sprintf("%s: expected both spans of trace %s to be exported", tc.desc, id))
+		}
+		assert.True(t, len(traces) >= tc.min && len(traces) <= tc.max, fmt.Sprintf("%s: expected between %d and %d sampled traces, got %d", tc.desc, tc.min, tc.max, len(traces)))
+	}
+}
+
+type loggerMock struct {
+	log.Logger
+	mu    sync.Mutex
+	warns []string
+}
+
+func (l *loggerMock) Warn(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warns = append(l.warns, msg)
+}
+
+func TestExporterDropped(t *testing.T) {
+	release := make(chan struct{})
+	collector := &collectorStub{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		collector.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	logger := &loggerMock{Logger: testLog}
+	exporter := tracing.NewOTLPExporter(ts.URL, "test", time.Hour, logger)
+	tracer := tracing.New(exporter, 1)
+
+	// The export queue is full while the collector doesn't respond.
+	for i := 0; i < 5000; i++ {
+		_, span := tracer.Start(context.Background(), "consume", tracing.KindConsumer)
+		span.End()
+	}
+	close(release)
+
+	err := exporter.Close()
+	assert.Nil(t, err, fmt.Sprintf("unexpected error closing exporter: %s", err))
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.warns, 1, "expected the dropped spans to be logged once")
+	assert.Contains(t, logger.warns[0], "dropped", "expected the number of dropped spans to be logged")
+}
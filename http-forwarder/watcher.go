@@ -0,0 +1,68 @@
+// Copyright (c) J.Dreyer
+// SPDX-License-Identifier: Apache-2.0
+
+package http_forwarder
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mainflux/mainflux/logger"
+)
+
+// WatchConfig polls the configuration file and the scripts of the routes
+// every interval and reloads the routes whenever the modification time or
+// size of one of them changes, until done is closed. Polling is used instead
+// of file system events because config files are usually mounted into
+// containers, where events are unreliable.
+func WatchConfig(routes Routes, path string, interval time.Duration, logger logger.Logger, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := stat(path, routes.Scripts())
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			current := stat(path, routes.Scripts())
+			if !anyChanged(last, current) {
+				continue
+			}
+
+			if err := routes.Reload(); err != nil {
+				logger.Warn(fmt.Sprintf("Rejected configuration %s, keeping the previous one: %s", path, err))
+			}
+			// The scripts may have changed with the configuration.
+			last = stat(path, routes.Scripts())
+		}
+	}
+}
+
+// stat returns the information of the files which exist.
+func stat(path string, scripts []string) map[string]os.FileInfo {
+	files := make(map[string]os.FileInfo)
+	for _, p := range append([]string{path}, scripts...) {
+		if fi, err := os.Stat(p); err == nil {
+			files[p] = fi
+		}
+	}
+	return files
+}
+
+func anyChanged(last, current map[string]os.FileInfo) bool {
+	for p, fi := range current {
+		if changed(last[p], fi) {
+			return true
+		}
+	}
+	return false
+}
+
+func changed(last, current os.FileInfo) bool {
+	if last == nil {
+		return true
+	}
+	return !last.ModTime().Equal(current.ModTime()) || last.Size() != current.Size()
+}